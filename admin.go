@@ -0,0 +1,449 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/mujz/ipp/validator"
+)
+
+// Roles users can have
+const (
+	userRole  = "user"
+	adminRole = "admin"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// Only lets logged in admins through
+func AdminDecorator(f http.HandlerFunc) http.HandlerFunc {
+	return AuthDecorator(func(w http.ResponseWriter, r *http.Request) {
+		// Get user ID from context
+		ctx := r.Context()
+		userID := ctx.Value(userIDKey).(int)
+
+		role, err := model.GetRole(userID)
+		if err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to retrieve user.")
+			log.Println(err)
+			return
+		}
+		if role != adminRole {
+			marshalError(w, http.StatusForbidden, "Only admins can do that.")
+			return
+		}
+
+		f(w, r)
+	})
+}
+
+// Searches users by email or ID with the q query parameter, a page at a time
+func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Get the admin's ID from context
+	ctx := r.Context()
+	adminID := ctx.Value(userIDKey).(int)
+
+	number, size, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	if !audit(w, adminID, "search_users", 0, "q="+query) {
+		return
+	}
+
+	users, total, err := model.SearchUsers(query, size, (number-1)*size)
+	if err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to search users.")
+		log.Println(err)
+		return
+	}
+
+	// Send users to client
+	setPageHeaders(w, r, number, size, total)
+	payload := make([]interface{}, len(users))
+	for i, user := range users {
+		payload[i] = user
+	}
+	jsonapi.MarshalManyPayload(w, payload)
+}
+
+// Shows a user, or acts on them:
+//
+//	GET  /admin/users/{id}
+//	PUT  /admin/users/{id}/number  sets their number
+//	PUT  /admin/users/{id}/role    sets their role
+//	POST /admin/users/{id}/disable disables them and logs them out
+//	POST /admin/users/{id}/enable  lets them log in again
+//	POST /admin/users/{id}/logout  logs them out everywhere
+func AdminUserHandler(w http.ResponseWriter, r *http.Request) {
+	// Get the admin's ID from context
+	ctx := r.Context()
+	adminID := ctx.Value(userIDKey).(int)
+
+	// Get the user ID and action from the path
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/admin/users/"), "/", 2)
+	userID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		NotFoundHandler(w, r)
+		return
+	}
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+
+	methods := map[string]string{
+		"":        "GET",
+		"number":  "PUT",
+		"role":    "PUT",
+		"disable": "POST",
+		"enable":  "POST",
+		"logout":  "POST",
+	}
+	if method, ok := methods[action]; !ok || r.Method != method {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Get the user
+	user, err := model.GetUser(userID)
+	if err == sql.ErrNoRows {
+		NotFoundHandler(w, r)
+		return
+	} else if err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to retrieve user.")
+		log.Println(err)
+		return
+	}
+
+	switch action {
+	case "":
+		if !audit(w, adminID, "view_user", userID, "") {
+			return
+		}
+
+	case "number":
+		// Parse the body's JSON
+		newNumber := new(Number)
+		if err := jsonapi.UnmarshalPayload(r.Body, newNumber); err != nil {
+			marshalError(w, http.StatusBadRequest, "Invalid request body.")
+			log.Println(err)
+			return
+		}
+
+		// Validate the number
+		if !validator.ValidateNumber(newNumber.Value) {
+			marshalError(w, http.StatusBadRequest, fmt.Sprintf(
+				"Number out of range. Please make sure that it's between %d and %d",
+				validator.MinNum, validator.MaxNum,
+			))
+			return
+		}
+
+		if !audit(w, adminID, "set_number", userID, fmt.Sprintf("%d -> %d", user.Number.Value, newNumber.Value)) {
+			return
+		}
+		if user.Number, err = model.UpdateNumber(userID, newNumber.Value); err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to update number.")
+			log.Println(err)
+			return
+		}
+
+	case "role":
+		// Parse the body's JSON
+		changes := new(User)
+		if err := jsonapi.UnmarshalPayload(r.Body, changes); err != nil {
+			marshalError(w, http.StatusBadRequest, "Invalid request body.")
+			log.Println(err)
+			return
+		}
+		if changes.Role != userRole && changes.Role != adminRole {
+			marshalError(w, http.StatusBadRequest, fmt.Sprintf("Role must be %s or %s.", userRole, adminRole))
+			return
+		}
+
+		if !audit(w, adminID, "set_role", userID, user.Role+" -> "+changes.Role) {
+			return
+		}
+		if err := model.SetRole(userID, changes.Role); err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to update role.")
+			log.Println(err)
+			return
+		}
+		user.Role = changes.Role
+
+	case "disable":
+		if userID == adminID {
+			marshalError(w, http.StatusBadRequest, "You can't disable your own account.")
+			return
+		}
+
+		if !audit(w, adminID, "disable", userID, "") {
+			return
+		}
+		if err := model.DisableUser(userID, time.Now()); err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to disable user.")
+			log.Println(err)
+			return
+		}
+
+	case "enable":
+		if !audit(w, adminID, "enable", userID, "") {
+			return
+		}
+		if err := model.EnableUser(userID); err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to enable user.")
+			log.Println(err)
+			return
+		}
+
+	case "logout":
+		if !audit(w, adminID, "logout", userID, "") {
+			return
+		}
+		if err := model.RevokeTokens(userID, time.Now()); err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to log user out.")
+			log.Println(err)
+			return
+		}
+	}
+
+	// Send the user as they are now to client
+	if action == "disable" || action == "enable" {
+		if user, err = model.GetUser(userID); err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to retrieve user.")
+			log.Println(err)
+			return
+		}
+	}
+	jsonapi.MarshalOnePayload(w, user)
+}
+
+// Lists what admins did, newest first, only to the user in the user_id query
+// parameter if there is one
+func AuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Get the admin's ID from context
+	ctx := r.Context()
+	adminID := ctx.Value(userIDKey).(int)
+
+	number, size, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+
+	targetID := 0
+	if q := r.URL.Query().Get("user_id"); q != "" {
+		var err error
+		if targetID, err = strconv.Atoi(q); err != nil {
+			marshalError(w, http.StatusBadRequest, "user_id must be a number.")
+			return
+		}
+	}
+
+	if !audit(w, adminID, "view_audit_log", targetID, "") {
+		return
+	}
+
+	entries, total, err := model.GetAuditLog(targetID, size, (number-1)*size)
+	if err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to retrieve audit log.")
+		log.Println(err)
+		return
+	}
+
+	// Send entries to client
+	setPageHeaders(w, r, number, size, total)
+	payload := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		payload[i] = entry
+	}
+	jsonapi.MarshalManyPayload(w, payload)
+}
+
+// Lists the invite codes a page at a time, or creates one. The code is only
+// in the response to its creation.
+func InvitesHandler(w http.ResponseWriter, r *http.Request) {
+	// Get the admin's ID from context
+	ctx := r.Context()
+	adminID := ctx.Value(userIDKey).(int)
+
+	switch r.Method {
+	case "GET":
+		number, size, ok := parsePage(w, r)
+		if !ok {
+			return
+		}
+
+		if !audit(w, adminID, "view_invites", 0, "") {
+			return
+		}
+
+		invites, total, err := model.GetInvites(size, (number-1)*size)
+		if err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to retrieve invites.")
+			log.Println(err)
+			return
+		}
+
+		// Send invites to client
+		setPageHeaders(w, r, number, size, total)
+		payload := make([]interface{}, len(invites))
+		for i, invite := range invites {
+			payload[i] = invite
+		}
+		jsonapi.MarshalManyPayload(w, payload)
+
+	case "POST":
+		// Parse the body's JSON
+		invite := new(Invite)
+		if err := jsonapi.UnmarshalPayload(r.Body, invite); err != nil {
+			marshalError(w, http.StatusBadRequest, "Invalid request body.")
+			log.Println(err)
+			return
+		}
+		if invite.MaxUses < 0 {
+			marshalError(w, http.StatusBadRequest, "max_uses can't be negative.")
+			return
+		}
+		if invite.ExpiresAt != nil && invite.ExpiresAt.Before(time.Now()) {
+			marshalError(w, http.StatusBadRequest, "expires_at must be in the future.")
+			return
+		}
+
+		code, err := newInviteCode()
+		if err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to create invite.")
+			log.Println(err)
+			return
+		}
+		invite.CreatedBy, invite.Uses = adminID, 0
+
+		if !audit(w, adminID, "create_invite", 0, fmt.Sprintf("max_uses=%d", invite.MaxUses)) {
+			return
+		}
+		if err := model.CreateInvite(hashInviteCode(code), invite); err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to create invite.")
+			log.Println(err)
+			return
+		}
+
+		// Send invite to client with the code
+		invite.Code = code
+		w.WriteHeader(http.StatusCreated)
+		jsonapi.MarshalOnePayload(w, invite)
+
+	default:
+		NotFoundHandler(w, r)
+	}
+}
+
+// Revokes the invite code with the ID in the path
+func InviteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Get the admin's ID from context
+	ctx := r.Context()
+	adminID := ctx.Value(userIDKey).(int)
+
+	// Get the invite ID from the path
+	inviteID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/admin/invites/"))
+	if err != nil {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	if !audit(w, adminID, "delete_invite", 0, fmt.Sprintf("id=%d", inviteID)) {
+		return
+	}
+	if err := model.DeleteInvite(inviteID); err == sql.ErrNoRows {
+		NotFoundHandler(w, r)
+		return
+	} else if err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to delete invite.")
+		log.Println(err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Writes what an admin is about to do to the audit log. Responds with 500 and
+// returns false if it can't, so nothing happens without a record.
+func audit(w http.ResponseWriter, adminID int, action string, targetUserID int, details string) bool {
+	if err := model.LogAdminAction(adminID, action, targetUserID, details); err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to write the audit log.")
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+// Returns the page[number] (from 1) and page[size] query parameters.
+// Responds with 400 and returns false if they're invalid.
+func parsePage(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	query := r.URL.Query()
+	number, size := 1, defaultPageSize
+
+	var err error
+	if q := query.Get("page[number]"); q != "" {
+		if number, err = strconv.Atoi(q); err != nil || number < 1 {
+			marshalError(w, http.StatusBadRequest, "page[number] must be a positive number.")
+			return 0, 0, false
+		}
+	}
+	if q := query.Get("page[size]"); q != "" {
+		if size, err = strconv.Atoi(q); err != nil || size < 1 || size > maxPageSize {
+			marshalError(w, http.StatusBadRequest, fmt.Sprintf("page[size] must be between 1 and %d.", maxPageSize))
+			return 0, 0, false
+		}
+	}
+	return number, size, true
+}
+
+// Sets the total count and links to the neighbouring pages
+func setPageHeaders(w http.ResponseWriter, r *http.Request, number, size, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	pageURL := func(n int) string {
+		query := r.URL.Query()
+		query.Set("page[number]", strconv.Itoa(n))
+		query.Set("page[size]", strconv.Itoa(size))
+		return (&url.URL{Path: r.URL.Path, RawQuery: query.Encode()}).String()
+	}
+
+	var links []string
+	if number > 1 {
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pageURL(number-1)))
+	}
+	if number*size < total {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(number+1)))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
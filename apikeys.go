@@ -0,0 +1,222 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/jsonapi"
+	"github.com/mujz/ipp/authentication"
+	"github.com/mujz/ipp/validator"
+)
+
+const maxAPIKeyNameLength = 64
+
+// Why a call broke a key's restrictions, with a code clients can check
+var apiKeyRestrictionErrors = map[error]*jsonapi.ErrorObject{
+	authentication.APIKeyExpiredErr: {
+		Code:   "api_key_expired",
+		Detail: "This API key expired. Please create a new one.",
+	},
+	authentication.APIKeyIPNotAllowedErr: {
+		Code:   "ip_not_allowed",
+		Detail: "This API key can't be used from your IP address.",
+	},
+	authentication.APIKeyOriginNotAllowedErr: {
+		Code:   "origin_not_allowed",
+		Detail: "This API key can't be used from this website.",
+	},
+	authentication.APIKeyCallLimitErr: {
+		Code:   "call_limit_reached",
+		Detail: "This API key made all the calls it's allowed.",
+	},
+}
+
+// Lists the logged in user's API keys or creates one. Test-mode keys count in
+// a sandbox and can't be used for anything else.
+func APIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	ctx := r.Context()
+	userID := ctx.Value(userIDKey).(int)
+
+	switch r.Method {
+	case "GET":
+		keys, err := model.GetAPIKeys(userID)
+		if err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to retrieve API keys.")
+			log.Println(err)
+			return
+		}
+
+		// Send keys to client
+		payload := make([]interface{}, len(keys))
+		for i, key := range keys {
+			payload[i] = key
+		}
+		jsonapi.MarshalManyPayload(w, payload)
+
+	case "POST":
+		// Parse the body's JSON
+		newKey := new(APIKey)
+		if err := jsonapi.UnmarshalPayload(r.Body, newKey); err != nil {
+			marshalError(w, http.StatusBadRequest, "Invalid request body.")
+			log.Println(err)
+			return
+		}
+
+		// Validate the key
+		newKey.Name = strings.TrimSpace(newKey.Name)
+		if newKey.Name == "" || utf8.RuneCountInString(newKey.Name) > maxAPIKeyNameLength {
+			marshalError(w, http.StatusBadRequest, fmt.Sprintf("API keys need a name of up to %d characters.", maxAPIKeyNameLength))
+			return
+		}
+		if newKey.Mode == "" {
+			newKey.Mode = liveMode
+		}
+		if newKey.Mode != liveMode && newKey.Mode != testMode {
+			marshalError(w, http.StatusBadRequest, "Mode must be live or test.")
+			return
+		}
+		apiKey := &authentication.APIKey{UserID: userID, Test: newKey.Mode == testMode}
+		if !parseAPIKeyRestrictions(w, newKey, apiKey) {
+			return
+		}
+
+		// Create the key
+		key, err := auth.CreateAPIKey(model, apiKey, newKey.Name)
+		if err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to create API key.")
+			log.Println(err)
+			return
+		}
+
+		// Send the key and its signing secret to the client. It's the only
+		// time they're shown.
+		newKey.ID, newKey.Key, newKey.CreatedAt = apiKey.ID, key, time.Now()
+		newKey.SigningSecret = auth.SigningSecret(key)
+		w.WriteHeader(http.StatusCreated)
+		jsonapi.MarshalOnePayload(w, newKey)
+
+	default:
+		NotFoundHandler(w, r)
+	}
+}
+
+// Validates the restrictions in newKey, normalizes them and sets them on
+// apiKey. Responds with 400 and returns false if one is invalid.
+func parseAPIKeyRestrictions(w http.ResponseWriter, newKey *APIKey, apiKey *authentication.APIKey) bool {
+	networks, ok := parseRestrictions(w, newKey.AllowedNetworks, newKey.AllowedOrigins, newKey.ExpiresAt)
+	if !ok {
+		return false
+	}
+	apiKey.AllowedNetworks, apiKey.AllowedOrigins = networks, newKey.AllowedOrigins
+	if newKey.ExpiresAt != nil {
+		apiKey.ExpiresAt = *newKey.ExpiresAt
+	}
+
+	if newKey.MaxCalls < 0 {
+		marshalError(w, http.StatusBadRequest, "Maximum calls can't be negative.")
+		return false
+	}
+	apiKey.MaxCalls = newKey.MaxCalls
+
+	return true
+}
+
+// Validates the allowed networks, origins and expiry date that API keys and
+// service accounts can be restricted with, normalizes the networks and
+// origins in place and returns the parsed networks. Responds with 400 and
+// returns false if one is invalid.
+func parseRestrictions(w http.ResponseWriter, networks, origins []string, expiresAt *time.Time) ([]*net.IPNet, bool) {
+	var parsed []*net.IPNet
+	for i, s := range networks {
+		network, err := validator.ParseCIDR(s)
+		if err != nil {
+			marshalError(w, http.StatusBadRequest, fmt.Sprintf("%q isn't an IP address or CIDR range like 192.0.2.0/24.", s))
+			return nil, false
+		}
+		parsed = append(parsed, network)
+		networks[i] = network.String()
+	}
+
+	for i, s := range origins {
+		origin, ok := validator.NormalizeOrigin(s)
+		if !ok {
+			marshalError(w, http.StatusBadRequest, fmt.Sprintf("%q isn't an origin like https://example.com.", s))
+			return nil, false
+		}
+		origins[i] = origin
+	}
+
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		marshalError(w, http.StatusBadRequest, "Expiry date must be in the future.")
+		return nil, false
+	}
+
+	return parsed, true
+}
+
+// Responds with 403 and the restriction the call broke, or 401 if the key
+// or the request's signature isn't valid at all
+func marshalAPIKeyError(w http.ResponseWriter, err error) {
+	if detail, ok := signatureErrors[err]; ok {
+		marshalError(w, http.StatusUnauthorized, detail)
+		return
+	}
+
+	restriction, ok := apiKeyRestrictionErrors[err]
+	if !ok {
+		marshalError(w, http.StatusUnauthorized, "API key is invalid or revoked")
+		log.Println(err)
+		return
+	}
+	marshalRestrictionError(w, restriction)
+}
+
+// Responds with 403 and the restriction a key or service account broke
+func marshalRestrictionError(w http.ResponseWriter, restriction *jsonapi.ErrorObject) {
+	w.WriteHeader(http.StatusForbidden)
+	jsonapi.MarshalErrors(w, []*jsonapi.ErrorObject{{
+		Title:  errorTitles[http.StatusForbidden],
+		Detail: restriction.Detail,
+		Status: strconv.Itoa(http.StatusForbidden),
+		Code:   restriction.Code,
+	}})
+}
+
+// Revokes one of the logged in user's API keys
+func APIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Get user ID from context
+	ctx := r.Context()
+	userID := ctx.Value(userIDKey).(int)
+
+	// Get the key ID from the path
+	keyID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/me/keys/"))
+	if err != nil {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	if err := model.DeleteAPIKey(userID, keyID); err != nil {
+		if err == sql.ErrNoRows {
+			NotFoundHandler(w, r)
+		} else {
+			marshalError(w, http.StatusInternalServerError, "Failed to revoke API key.")
+			log.Println(err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,164 @@
+package authentication
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeyPrefix  = "ipp_"
+	liveKeyPrefix = apiKeyPrefix + "live_"
+	testKeyPrefix = apiKeyPrefix + "test_" // Test-mode keys count in a sandbox
+)
+
+var (
+	InvalidAPIKeyErr = errors.New("authentication: API key is invalid or revoked.")
+
+	// Restrictions a request with a key can fail
+	APIKeyExpiredErr          = errors.New("authentication: API key expired.")
+	APIKeyIPNotAllowedErr     = errors.New("authentication: API key can't be used from this IP address.")
+	APIKeyOriginNotAllowedErr = errors.New("authentication: API key can't be used from this origin.")
+	APIKeyCallLimitErr        = errors.New("authentication: API key made all the calls it's allowed.")
+)
+
+type APIKey struct {
+	ID     int
+	UserID int
+	Test   bool // Whether it's a test-mode key
+
+	// Restrictions, which are off when empty
+	AllowedNetworks []*net.IPNet
+	AllowedOrigins  []string // Like https://example.com
+	ExpiresAt       time.Time
+	MaxCalls        int
+	Calls           int // Only counted for keys with a maximum
+}
+
+type APIKeyStore interface {
+	// Takes the hash of an API key, the key's name and its user, mode and
+	// restrictions, saves the key and returns its ID
+	CreateAPIKey(string, string, *APIKey) (int, error)
+	// Takes the hash of an API key and returns it. Returns sql.ErrNoRows if
+	// no usable key has the hash.
+	GetAPIKey(string) (APIKey, error)
+	// Takes a key ID and counts a call with it. Returns sql.ErrNoRows if the
+	// key already made its maximum calls.
+	CountAPIKeyCall(int) error
+	// Takes a key ID and returns the key and its hash. Returns sql.ErrNoRows
+	// if no usable key has the ID.
+	GetAPIKeyByID(int) (APIKey, string, error)
+}
+
+// Whether the credential is an API key rather than a token
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, apiKeyPrefix)
+}
+
+// Returns a new long-lived key for the user, mode and restrictions in
+// apiKey, and sets its ID. Only the key's hash is stored, so it can't be
+// shown again.
+func (a *Authenticator) CreateAPIKey(store APIKeyStore, apiKey *APIKey, name string) (string, error) {
+	secret, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	key := liveKeyPrefix + secret
+	if apiKey.Test {
+		key = testKeyPrefix + secret
+	}
+
+	if apiKey.ID, err = store.CreateAPIKey(hashCode(key), name, apiKey); err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// Returns the key, with the user it belongs to, if its restrictions allow a
+// call from the IP address and origin, which is "" if the request didn't come
+// from a browser. Calls are only counted for keys with a maximum.
+func (a *Authenticator) VerifyAPIKey(store APIKeyStore, key string, ip net.IP, origin string) (*APIKey, error) {
+	if !IsAPIKey(key) {
+		return nil, InvalidAPIKeyErr
+	}
+
+	apiKey, err := store.GetAPIKey(hashCode(key))
+	if err == sql.ErrNoRows {
+		return nil, InvalidAPIKeyErr
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := apiKey.call(store, ip, origin); err != nil {
+		return nil, err
+	}
+
+	return &apiKey, nil
+}
+
+// Checks the key's restrictions and counts the call if it has a maximum
+func (k *APIKey) call(store APIKeyStore, ip net.IP, origin string) error {
+	if err := k.allow(ip, origin); err != nil {
+		return err
+	}
+
+	if k.MaxCalls > 0 {
+		if err := store.CountAPIKeyCall(k.ID); err == sql.ErrNoRows {
+			return APIKeyCallLimitErr
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the restriction a call from the IP address and origin fails
+func (k *APIKey) allow(ip net.IP, origin string) error {
+	if expired(k.ExpiresAt) {
+		return APIKeyExpiredErr
+	}
+	if !allowedIP(k.AllowedNetworks, ip) {
+		return APIKeyIPNotAllowedErr
+	}
+	if !allowedOrigin(k.AllowedOrigins, origin) {
+		return APIKeyOriginNotAllowedErr
+	}
+	return nil
+}
+
+// Whether an expiry time, which is zero if there's none, has passed
+func expired(expiresAt time.Time) bool {
+	return !expiresAt.IsZero() && time.Now().After(expiresAt)
+}
+
+// Whether the IP address is in one of the networks, or there are none
+func allowedIP(networks []*net.IPNet, ip net.IP) bool {
+	if len(networks) == 0 {
+		return true
+	}
+	for _, network := range networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the origin is one of the allowed ones, or there are none. Leaving
+// the Origin header out mustn't be a way around the restriction.
+func allowedOrigin(origins []string, origin string) bool {
+	if len(origins) == 0 {
+		return true
+	}
+	for _, allowed := range origins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package authentication
+
+import (
+	"database/sql"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An in-memory store of keys by hash and the calls made with them by ID
+type apiKeyStore struct {
+	keys  map[string]APIKey
+	calls map[int]int
+}
+
+func newAPIKeyStore() *apiKeyStore {
+	return &apiKeyStore{keys: map[string]APIKey{}, calls: map[int]int{}}
+}
+
+func (s *apiKeyStore) CreateAPIKey(hash, name string, key *APIKey) (int, error) {
+	id := len(s.keys) + 1
+	stored := *key
+	stored.ID = id
+	s.keys[hash] = stored
+	return id, nil
+}
+
+func (s *apiKeyStore) GetAPIKey(hash string) (APIKey, error) {
+	key, ok := s.keys[hash]
+	if !ok {
+		return APIKey{}, sql.ErrNoRows
+	}
+	return key, nil
+}
+
+func (s *apiKeyStore) GetAPIKeyByID(id int) (APIKey, string, error) {
+	for hash, key := range s.keys {
+		if key.ID == id {
+			return key, hash, nil
+		}
+	}
+	return APIKey{}, "", sql.ErrNoRows
+}
+
+func (s *apiKeyStore) CountAPIKeyCall(id int) error {
+	for _, key := range s.keys {
+		if key.ID == id && s.calls[id] < key.MaxCalls {
+			s.calls[id]++
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func TestAPIKey(t *testing.T) {
+	store := newAPIKeyStore()
+
+	apiKey := &APIKey{UserID: 42}
+	key, err := auth.CreateAPIKey(store, apiKey, "Test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, "ipp_live_") || !IsAPIKey(key) {
+		t.Fatalf("Expected a live API key; Got %s", key)
+	}
+	if _, ok := store.keys[key]; ok {
+		t.Fatal("Expected the API key to be stored hashed")
+	}
+
+	if verified, err := auth.VerifyAPIKey(store, key, nil, ""); err != nil || verified.ID != apiKey.ID || verified.UserID != 42 || verified.Test {
+		t.Fatalf("Expected live key %d for user 42; Got %+v, %v", apiKey.ID, verified, err)
+	}
+
+	for _, invalid := range []string{key + "x", "ipp_live_", "not,a,key"} {
+		if _, err := auth.VerifyAPIKey(store, invalid, nil, ""); err != InvalidAPIKeyErr {
+			t.Fatalf("Expected %v for %q; Got %v", InvalidAPIKeyErr, invalid, err)
+		}
+	}
+}
+
+func TestTestModeAPIKey(t *testing.T) {
+	store := newAPIKeyStore()
+
+	key, err := auth.CreateAPIKey(store, &APIKey{UserID: 42, Test: true}, "Test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, "ipp_test_") {
+		t.Fatalf("Expected a test-mode API key; Got %s", key)
+	}
+
+	if apiKey, err := auth.VerifyAPIKey(store, key, nil, ""); err != nil || !apiKey.Test {
+		t.Fatalf("Expected a test-mode key; Got %+v, %v", apiKey, err)
+	}
+
+	// Switching the prefix doesn't make a test key live
+	live := "ipp_live_" + strings.TrimPrefix(key, "ipp_test_")
+	if _, err := auth.VerifyAPIKey(store, live, nil, ""); err != InvalidAPIKeyErr {
+		t.Fatalf("Expected %v; Got %v", InvalidAPIKeyErr, err)
+	}
+}
+
+func TestAPIKeyRestrictions(t *testing.T) {
+	store := newAPIKeyStore()
+	key, err := auth.CreateAPIKey(store, &APIKey{UserID: 42}, "Test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := hashCode(key)
+
+	_, office, _ := net.ParseCIDR("192.0.2.0/24")
+	restricted := store.keys[hash]
+	restricted.AllowedNetworks = []*net.IPNet{office}
+	restricted.AllowedOrigins = []string{"https://example.com"}
+	store.keys[hash] = restricted
+
+	ip, origin := net.ParseIP("192.0.2.1"), "https://example.com"
+	for _, c := range []struct {
+		ip     net.IP
+		origin string
+		err    error
+	}{
+		{ip, origin, nil},
+		{net.ParseIP("198.51.100.1"), origin, APIKeyIPNotAllowedErr},
+		{nil, origin, APIKeyIPNotAllowedErr},
+		{ip, "https://evil.example.com", APIKeyOriginNotAllowedErr},
+		{ip, "", APIKeyOriginNotAllowedErr},
+	} {
+		if _, err := auth.VerifyAPIKey(store, key, c.ip, c.origin); err != c.err {
+			t.Fatalf("Expected %v from %s with origin %q; Got %v", c.err, c.ip, c.origin, err)
+		}
+	}
+
+	restricted.MaxCalls = 1
+	store.keys[hash] = restricted
+	if _, err := auth.VerifyAPIKey(store, key, ip, origin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.VerifyAPIKey(store, key, ip, origin); err != APIKeyCallLimitErr {
+		t.Fatalf("Expected %v; Got %v", APIKeyCallLimitErr, err)
+	}
+
+	restricted.ExpiresAt = time.Now().Add(-time.Second)
+	store.keys[hash] = restricted
+	if _, err := auth.VerifyAPIKey(store, key, ip, origin); err != APIKeyExpiredErr {
+		t.Fatalf("Expected %v; Got %v", APIKeyExpiredErr, err)
+	}
+}
@@ -1,26 +1,53 @@
 package authentication
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
-	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	InvalidSealErr  = errors.New("authentication: signed value is malformed or its signature is invalid.")
+	RevokedTokenErr = errors.New("authentication: token was revoked.")
+	ClientTokenErr  = errors.New("authentication: token was issued to a service account.")
 )
 
 type Token struct {
 	Subject       string `json:"sub" jsonapi:"primary,token"`
 	ExpiresAt     string `jsonapi:"attr,exipres_at"`
 	expiresAt     time.Time
-	UnixExpiresAt int64  `json:"exp"`
-	Type          string `json:"typ,omitempty" jsonapi:"attr,type,omitempty"`
+	UnixExpiresAt int64   `json:"exp"`
+	IssuedAt      float64 `json:"iat"` // Fractional so revocation isn't off by up to a second
+	Type          string  `json:"typ,omitempty" jsonapi:"attr,type,omitempty"`
+	Scope         string  `json:"scope,omitempty" jsonapi:"attr,scope,omitempty"` // Space-separated; anything the user can do if empty
+	ClientID      string  `json:"client_id,omitempty"`                            // The service account the token was issued to
+}
+
+// What a verified token lets its holder do
+type Grant struct {
+	UserID    int
+	ClientID  string   // The service account the token was issued to, if any
+	Scopes    []string // nil if the token can do anything the user can
+	IssuedAt  time.Time
+	ExpiresAt time.Time
 }
 
 type User struct {
-	ID       int    `json:"id" jsonapi:"primary,User"`
-	Username string `json:"username" jsonapi:"attr,email"`
-	Password string `json:"password" jsonapi:"attr,password"`
+	ID        int    `json:"id" jsonapi:"primary,User"`
+	Username  string `json:"username" jsonapi:"attr,email"`
+	Password  string `json:"password" jsonapi:"attr,password"`
+	TwoFactor bool   `json:"-"` // Whether the user has to provide a second factor to log in
 }
 
 type UserGetter interface {
@@ -28,21 +55,91 @@ type UserGetter interface {
 	Get(string) (User, error)
 }
 
+type LoginStore interface {
+	UserGetter
+	// Takes a user ID, their current password hash and a new one, and
+	// replaces the hash unless it changed in the meantime
+	UpdatePasswordHash(int, string, string) error
+}
+
 type UserCreator interface {
 	// Takes username (or email) and password and returns user
 	Create(string, string) (User, error)
 }
 
+type TrialConverter interface {
+	// Takes a trial user's ID, a username (or email) and password and makes
+	// them a normal user. Returns sql.ErrNoRows if the user isn't on a trial.
+	ConvertTrial(int, string, string) error
+}
+
+type TokenStore interface {
+	// Takes a user ID and returns the time before which the user's tokens
+	// were revoked, or the zero time if they never were. Returns
+	// sql.ErrNoRows if none of the user's tokens are valid, e.g. because
+	// they were deleted.
+	GetTokensValidSince(int) (time.Time, error)
+}
+
 type Authenticator struct {
 	secret             []byte        // Secret key
 	expirationInterval time.Duration // Duration of time before token exires
+	Hasher             *PasswordHasher
+
+	// A hash to compare passwords against for unknown users so they take as
+	// long to reject as a wrong password
+	dummyHash     string
+	dummyHashOnce sync.Once
 }
 
 func NewAuthenticator(secret []byte, expirationInterval time.Duration) *Authenticator {
-	return &Authenticator{secret, expirationInterval}
+	return &Authenticator{secret: secret, expirationInterval: expirationInterval, Hasher: DefaultPasswordHasher()}
 }
 
 func (a *Authenticator) Authenticate(tokenString string) (int, error) {
+	grant, _, err := a.parse(tokenString)
+	if err != nil {
+		return -1, err
+	}
+	return grant.UserID, nil
+}
+
+// Authenticates the token like Authenticate and also rejects tokens issued
+// before the user's tokens were revoked, e.g. by a password reset. Tokens
+// issued to service accounts are rejected; use VerifyGrant to accept them.
+func (a *Authenticator) Verify(store TokenStore, tokenString string) (int, error) {
+	grant, err := a.verify(store, tokenString)
+	if err != nil {
+		return -1, err
+	}
+	if grant.ClientID != "" {
+		return -1, ClientTokenErr
+	}
+	return grant.UserID, nil
+}
+
+func (a *Authenticator) verify(store TokenStore, tokenString string) (*Grant, error) {
+	grant, issuedAt, err := a.parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	validSince, err := store.GetTokensValidSince(grant.UserID)
+	if err == sql.ErrNoRows {
+		return nil, RevokedTokenErr
+	} else if err != nil {
+		return nil, err
+	}
+
+	if issuedAt < float64(validSince.UnixNano())/float64(time.Second) {
+		return nil, RevokedTokenErr
+	}
+
+	return grant, nil
+}
+
+// Returns what the token grants and when it was issued
+func (a *Authenticator) parse(tokenString string) (*Grant, float64, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
@@ -52,41 +149,76 @@ func (a *Authenticator) Authenticate(tokenString string) (int, error) {
 	})
 
 	if err != nil {
-		return -1, err
+		return nil, 0, err
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return strconv.Atoi(claims["sub"].(string))
+		issuedAt, _ := claims["iat"].(float64)
+		id, err := strconv.Atoi(claims["sub"].(string))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		grant := &Grant{UserID: id, IssuedAt: time.Unix(0, int64(issuedAt*float64(time.Second)))}
+		if exp, ok := claims["exp"].(float64); ok {
+			grant.ExpiresAt = time.Unix(int64(exp), 0)
+		}
+		grant.ClientID, _ = claims["client_id"].(string)
+		if scope, _ := claims["scope"].(string); scope != "" {
+			grant.Scopes = strings.Fields(scope)
+		}
+		return grant, issuedAt, nil
 	} else {
-		return -1, fmt.Errorf("Token invalid")
+		return nil, 0, fmt.Errorf("Token invalid")
 	}
 }
 
-func (a *Authenticator) Login(model UserGetter, username, password string) (*Token, error) {
+// Returns a token, or a challenge if the user has to provide their second
+// factor. Returns sql.ErrNoRows for unknown users and IncorrectPasswordErr for
+// wrong passwords. Hashes weaker than the hasher's are replaced.
+func (a *Authenticator) Login(model LoginStore, username, password string) (*Token, error) {
 	// Get the user from the model
 	user, err := model.Get(username)
-	if err != nil {
+	if err == sql.ErrNoRows {
+		a.verifyDummyHash(password)
+		return nil, err
+	} else if err != nil {
 		return nil, err
 	}
 
 	// Validate password
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+	if err := a.Hasher.Verify(user.Password, password); err != nil {
 		return nil, err
 	}
 
+	// Upgrade the hash while we know the password. If it fails, it's tried
+	// again next time.
+	if a.Hasher.NeedsRehash(user.Password) {
+		if hash, err := a.Hasher.Hash(password); err != nil {
+			log.Println(err)
+		} else if err := model.UpdatePasswordHash(user.ID, user.Password, hash); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// Ask for the second factor first if the user enabled it
+	if user.TwoFactor {
+		return a.twoFactorChallenge(user.ID)
+	}
+
 	// Generate token
 	return a.generateToken(user.ID)
 }
 
 func (a *Authenticator) Signup(model UserCreator, username, password string) (*Token, error) {
 	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := a.Hasher.Hash(password)
 	if err != nil {
 		return nil, err
 	}
 
 	// Create user
-	user, err := model.Create(username, string(hashedPassword))
+	user, err := model.Create(username, hashedPassword)
 	if err != nil {
 		return nil, err
 	}
@@ -95,12 +227,47 @@ func (a *Authenticator) Signup(model UserCreator, username, password string) (*T
 	return a.generateToken(user.ID)
 }
 
+// Gives a trial user a username (or email) and password so they can log in
+// like anyone who signed up
+func (a *Authenticator) ConvertTrial(model TrialConverter, userID int, username, password string) (*Token, error) {
+	// Hash password
+	hashedPassword, err := a.Hasher.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := model.ConvertTrial(userID, username, hashedPassword); err != nil {
+		return nil, err
+	}
+
+	// Generate token
+	return a.generateToken(userID)
+}
+
+func (a *Authenticator) verifyDummyHash(password string) {
+	a.dummyHashOnce.Do(func() {
+		a.dummyHash, _ = a.Hasher.Hash("ipp,dummy,password")
+	})
+	a.Hasher.Verify(a.dummyHash, password)
+}
+
 func (a *Authenticator) generateToken(id int) (*Token, error) {
-	expiresAt := time.Now().Add(a.expirationInterval)
+	return a.generateClientToken(id, "", nil)
+}
+
+// Returns a token for the user that the service account with the client ID
+// can use for the scopes. Without a client ID, it's the user's own token.
+func (a *Authenticator) generateClientToken(id int, clientID string, scopes []string) (*Token, error) {
+	now := time.Now()
+	expiresAt := now.Add(a.expirationInterval)
+	scope := strings.Join(scopes, " ")
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &Token{
 		Subject:       strconv.Itoa(id),
 		UnixExpiresAt: expiresAt.Unix(),
+		IssuedAt:      float64(now.UnixNano()) / float64(time.Second),
+		Scope:         scope,
+		ClientID:      clientID,
 	})
 
 	signedToken, err := token.SignedString(a.secret)
@@ -112,9 +279,53 @@ func (a *Authenticator) generateToken(id int) (*Token, error) {
 		Subject:   signedToken,
 		ExpiresAt: expiresAt.Format(time.RFC3339),
 		expiresAt: expiresAt,
+		Scope:     scope,
 	}, nil
 }
 
+// Signs data with the secret key. The purpose is mixed into the signature so
+// a value signed for one use can't be replayed for another.
+func (a *Authenticator) sign(purpose string, data []byte) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Serializes v and signs it for the given purpose. The result is URL safe.
+func (a *Authenticator) seal(purpose string, v interface{}) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(a.sign(purpose, payload)), nil
+}
+
+// Verifies a value produced by seal for the same purpose and decodes it into v
+func (a *Authenticator) unseal(purpose, sealed string, v interface{}) error {
+	parts := strings.Split(sealed, ".")
+	if len(parts) != 2 {
+		return InvalidSealErr
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return InvalidSealErr
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return InvalidSealErr
+	}
+	if !hmac.Equal(signature, a.sign(purpose, payload)) {
+		return InvalidSealErr
+	}
+
+	return json.Unmarshal(payload, v)
+}
+
 func (t Token) Valid() error {
 	err := new(jwt.ValidationError)
 
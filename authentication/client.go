@@ -0,0 +1,162 @@
+package authentication
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net"
+	"time"
+)
+
+const clientIDPrefix = "sa_"
+
+var (
+	InvalidClientErr = errors.New("authentication: client ID or secret is invalid.")
+	InvalidScopeErr  = errors.New("authentication: scope wasn't granted to the client.")
+
+	// Restrictions a request from a client can fail
+	ClientExpiredErr          = errors.New("authentication: service account expired.")
+	ClientIPNotAllowedErr     = errors.New("authentication: service account can't be used from this IP address.")
+	ClientOriginNotAllowedErr = errors.New("authentication: service account can't be used from this origin.")
+)
+
+// A non-human client that gets tokens with its own credentials to act for
+// the user who owns it, but only within its scopes
+type ServiceAccount struct {
+	ID       int
+	OwnerID  int
+	ClientID string
+	Scopes   []string
+
+	// Restrictions, which are off when empty, like an API key's
+	AllowedNetworks []*net.IPNet
+	AllowedOrigins  []string // Like https://example.com
+	ExpiresAt       time.Time
+}
+
+type ClientStore interface {
+	TokenStore
+	// Takes a client ID and returns its service account and the hash of its
+	// secret. Returns sql.ErrNoRows if no usable account has the client ID.
+	GetServiceAccount(string) (ServiceAccount, string, error)
+	// Takes the hash of the client's secret, the account's name and its
+	// client ID, owner, scopes and restrictions, saves the account and
+	// returns its ID
+	CreateServiceAccount(string, string, *ServiceAccount) (int, error)
+}
+
+// Creates a service account for the owner, scopes and restrictions in
+// account, sets its ID and client ID and returns its secret. Only the
+// secret's hash is stored, so it can't be shown again.
+func (a *Authenticator) CreateServiceAccount(store ClientStore, account *ServiceAccount, name string) (string, error) {
+	clientID, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	account.ClientID = clientIDPrefix + clientID
+	if account.ID, err = store.CreateServiceAccount(hashCode(secret), name, account); err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// Returns a token for the client with the requested scopes, or all of its
+// scopes if none were requested (the client-credentials grant of RFC 6749),
+// if its restrictions allow a request from the IP address and origin
+func (a *Authenticator) ClientCredentialsToken(store ClientStore, clientID, secret string, scopes []string, ip net.IP, origin string) (*Token, error) {
+	account, hash, err := store.GetServiceAccount(clientID)
+	if err == sql.ErrNoRows {
+		return nil, InvalidClientErr
+	} else if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashCode(secret)), []byte(hash)) != 1 {
+		return nil, InvalidClientErr
+	}
+	if err := account.allow(ip, origin); err != nil {
+		return nil, err
+	}
+
+	if len(scopes) == 0 {
+		scopes = account.Scopes
+	}
+	for _, scope := range scopes {
+		if !hasScope(account.Scopes, scope) {
+			return nil, InvalidScopeErr
+		}
+	}
+
+	return a.generateClientToken(account.OwnerID, account.ClientID, scopes)
+}
+
+// Verifies the token like Verify but also accepts tokens issued to service
+// accounts, which are revoked once their account is deleted, if the
+// account's restrictions allow a request from the IP address and origin
+func (a *Authenticator) VerifyGrant(store ClientStore, tokenString string, ip net.IP, origin string) (*Grant, error) {
+	grant, account, err := a.verifyGrant(store, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if account != nil {
+		if err := account.allow(ip, origin); err != nil {
+			return nil, err
+		}
+	}
+	return grant, nil
+}
+
+// Verifies the token and returns its grant and, if it was issued to a
+// service account, the account, without checking the account's restrictions
+func (a *Authenticator) verifyGrant(store ClientStore, tokenString string) (*Grant, *ServiceAccount, error) {
+	grant, err := a.verify(store, tokenString)
+	if err != nil {
+		return nil, nil, err
+	}
+	if grant.ClientID == "" {
+		return grant, nil, nil
+	}
+
+	account, _, err := store.GetServiceAccount(grant.ClientID)
+	if err == sql.ErrNoRows || err == nil && account.OwnerID != grant.UserID {
+		return nil, nil, RevokedTokenErr
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	return grant, &account, nil
+}
+
+// Returns the restriction a request from the IP address and origin fails
+func (s *ServiceAccount) allow(ip net.IP, origin string) error {
+	if expired(s.ExpiresAt) {
+		return ClientExpiredErr
+	}
+	if !allowedIP(s.AllowedNetworks, ip) {
+		return ClientIPNotAllowedErr
+	}
+	if !allowedOrigin(s.AllowedOrigins, origin) {
+		return ClientOriginNotAllowedErr
+	}
+	return nil
+}
+
+// Whether the grant allows the scope
+func (g *Grant) Allows(scope string) bool {
+	return g.Scopes == nil || hasScope(g.Scopes, scope)
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package authentication
+
+import (
+	"database/sql"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An in-memory store of service accounts and their secrets' hashes by client
+// ID
+type clientStore struct {
+	accounts map[string]ServiceAccount
+	hashes   map[string]string
+}
+
+func newClientStore() *clientStore {
+	return &clientStore{accounts: map[string]ServiceAccount{}, hashes: map[string]string{}}
+}
+
+func (s *clientStore) GetTokensValidSince(userID int) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+func (s *clientStore) GetServiceAccount(clientID string) (ServiceAccount, string, error) {
+	account, ok := s.accounts[clientID]
+	if !ok {
+		return account, "", sql.ErrNoRows
+	}
+	return account, s.hashes[clientID], nil
+}
+
+func (s *clientStore) CreateServiceAccount(hash, name string, account *ServiceAccount) (int, error) {
+	id := len(s.accounts) + 1
+	saved := *account
+	saved.ID = id
+	s.accounts[account.ClientID] = saved
+	s.hashes[account.ClientID] = hash
+	return id, nil
+}
+
+func TestClientCredentials(t *testing.T) {
+	store := newClientStore()
+
+	account := &ServiceAccount{OwnerID: 42, Scopes: []string{"read", "next"}}
+	secret, err := auth.CreateServiceAccount(store, account, "Backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(account.ClientID, "sa_") {
+		t.Fatalf("Expected a client ID; Got %s", account.ClientID)
+	}
+	if store.hashes[account.ClientID] == secret {
+		t.Fatal("Expected the secret to be stored hashed")
+	}
+
+	// Without scopes, the token gets all of the account's
+	token, err := auth.ClientCredentialsToken(store, account.ClientID, secret, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Scope != "read next" {
+		t.Fatalf("Expected scope %q; Got %q", "read next", token.Scope)
+	}
+
+	// It's a token for the owner, but only VerifyGrant accepts it
+	if id, err := auth.Authenticate(token.Subject); err != nil || id != 42 {
+		t.Fatalf("Expected user 42; Got %d, %v", id, err)
+	}
+	if _, err := auth.Verify(store, token.Subject); err != ClientTokenErr {
+		t.Fatalf("Expected %v; Got %v", ClientTokenErr, err)
+	}
+	grant, err := auth.VerifyGrant(store, token.Subject, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grant.UserID != 42 || grant.ClientID != account.ClientID || !grant.Allows("next") || grant.Allows("write") {
+		t.Fatalf("Expected a grant to read and count for user 42; Got %+v", grant)
+	}
+
+	// Clients can ask for fewer scopes but not more
+	token, err = auth.ClientCredentialsToken(store, account.ClientID, secret, []string{"next"}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grant, err := auth.VerifyGrant(store, token.Subject, nil, ""); err != nil || grant.Allows("read") {
+		t.Fatalf("Expected a grant to count only; Got %+v, %v", grant, err)
+	}
+	if _, err := auth.ClientCredentialsToken(store, account.ClientID, secret, []string{"write"}, nil, ""); err != InvalidScopeErr {
+		t.Fatalf("Expected %v; Got %v", InvalidScopeErr, err)
+	}
+
+	for _, c := range [][2]string{{account.ClientID, secret + "x"}, {"sa_unknown", secret}} {
+		if _, err := auth.ClientCredentialsToken(store, c[0], c[1], nil, nil, ""); err != InvalidClientErr {
+			t.Fatalf("Expected %v for %s; Got %v", InvalidClientErr, c[0], err)
+		}
+	}
+
+	// Deleting the account revokes its tokens
+	delete(store.accounts, account.ClientID)
+	if _, err := auth.VerifyGrant(store, token.Subject, nil, ""); err != RevokedTokenErr {
+		t.Fatalf("Expected %v; Got %v", RevokedTokenErr, err)
+	}
+
+	// Users' own tokens can do anything
+	userToken, err := auth.generateToken(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grant, err := auth.VerifyGrant(store, userToken.Subject, nil, ""); err != nil || grant.ClientID != "" || !grant.Allows("write") {
+		t.Fatalf("Expected an unscoped grant; Got %+v, %v", grant, err)
+	}
+}
+
+func TestClientRestrictions(t *testing.T) {
+	store := newClientStore()
+
+	_, office, _ := net.ParseCIDR("192.0.2.0/24")
+	account := &ServiceAccount{
+		OwnerID:         42,
+		Scopes:          []string{"next"},
+		AllowedNetworks: []*net.IPNet{office},
+		AllowedOrigins:  []string{"https://example.com"},
+	}
+	secret, err := auth.CreateServiceAccount(store, account, "Backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip, origin := net.ParseIP("192.0.2.1"), "https://example.com"
+	token, err := auth.ClientCredentialsToken(store, account.ClientID, secret, nil, ip, origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restrictions apply to getting tokens and using them
+	for _, c := range []struct {
+		ip     net.IP
+		origin string
+		err    error
+	}{
+		{ip, origin, nil},
+		{net.ParseIP("198.51.100.1"), origin, ClientIPNotAllowedErr},
+		{nil, origin, ClientIPNotAllowedErr},
+		{ip, "https://evil.example.com", ClientOriginNotAllowedErr},
+		{ip, "", ClientOriginNotAllowedErr},
+	} {
+		if _, err := auth.ClientCredentialsToken(store, account.ClientID, secret, nil, c.ip, c.origin); err != c.err {
+			t.Fatalf("Expected %v getting a token from %s with origin %q; Got %v", c.err, c.ip, c.origin, err)
+		}
+		if _, err := auth.VerifyGrant(store, token.Subject, c.ip, c.origin); err != c.err {
+			t.Fatalf("Expected %v using a token from %s with origin %q; Got %v", c.err, c.ip, c.origin, err)
+		}
+	}
+
+	expired := store.accounts[account.ClientID]
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	store.accounts[account.ClientID] = expired
+	if _, err := auth.ClientCredentialsToken(store, account.ClientID, secret, nil, ip, origin); err != ClientExpiredErr {
+		t.Fatalf("Expected %v; Got %v", ClientExpiredErr, err)
+	}
+	if _, err := auth.VerifyGrant(store, token.Subject, ip, origin); err != ClientExpiredErr {
+		t.Fatalf("Expected %v; Got %v", ClientExpiredErr, err)
+	}
+}
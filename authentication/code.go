@@ -0,0 +1,84 @@
+package authentication
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"time"
+)
+
+const loginCodeTTL = 30 * time.Second
+
+var codeChallengeRegexp = regexp.MustCompile("^[A-Za-z0-9_-]{43}$")
+
+var (
+	InvalidLoginCodeErr       = errors.New("authentication: login code is invalid, expired or already used.")
+	InvalidCodeChallengeErr   = errors.New("authentication: code_challenge must be an S256 PKCE challenge.")
+	CodeVerifierMismatchedErr = errors.New("authentication: code_verifier doesn't match the login's code_challenge.")
+)
+
+type LoginCodeStore interface {
+	TwoFactorChecker
+	// Takes the hash of a login code, the user ID, the client's code
+	// challenge and the expiry time and saves the code
+	CreateLoginCode(string, int, string, time.Time) error
+	// Takes the hash of a login code, deletes it and returns the user ID,
+	// client's code challenge and expiry time it was saved with
+	TakeLoginCode(string) (int, string, time.Time, error)
+}
+
+// Validates the code challenge a client sends when it starts a login
+func ValidateCodeChallenge(challenge string) error {
+	if !codeChallengeRegexp.MatchString(challenge) {
+		return InvalidCodeChallengeErr
+	}
+	return nil
+}
+
+// Returns a single-use code that the client that started the login can
+// exchange for a token. Only the code's hash is stored.
+func (a *Authenticator) issueLoginCode(store LoginCodeStore, userID int, challenge string) (string, error) {
+	code, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	if err := store.CreateLoginCode(hashCode(code), userID, challenge, time.Now().Add(loginCodeTTL)); err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// Exchanges a login code for a token, or a challenge if the user enabled
+// two-factor authentication. The verifier must match the challenge the
+// client sent when it started the login.
+func (a *Authenticator) ExchangeLoginCode(store LoginCodeStore, code, verifier string) (*Token, error) {
+	userID, challenge, expiresAt, err := store.TakeLoginCode(hashCode(code))
+	if err == sql.ErrNoRows {
+		return nil, InvalidLoginCodeErr
+	} else if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(expiresAt) {
+		return nil, InvalidLoginCodeErr
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) != 1 {
+		return nil, CodeVerifierMismatchedErr
+	}
+
+	return a.tokenOrChallenge(store, userID)
+}
+
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,41 +1,65 @@
 package authentication
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/facebook"
 )
 
 type FacebookAuthenticator struct {
-	model              FacebookUserCreator
+	model              FacebookStore
 	auth               *Authenticator
-	authURL            string
 	successRedirectURL *url.URL
 	failureRedirectURL string
+	ProfileURL         string // Where the user's profile is fetched from
+	// Takes the verified email of someone logging in with Facebook for the
+	// first time, or "", and returns an error worded for them if they can't
+	// sign up. Anyone can if it's nil.
+	CheckSignup func(email string) error
 	*oauth2.Config
 }
 
 type fbUser struct {
-	ID   string
-	Name string
+	ID            string
+	Name          string
+	Email         string
+	EmailVerified *bool `json:"email_verified"` // Facebook leaves it out; its emails are always verified
 }
 
-type FacebookUserCreator interface {
-	CreateFacebookUser(string) (int, error)
+// FacebookSignedRequest is the payload of the signed_request Facebook sends
+// to the deauthorize and data deletion callbacks
+type FacebookSignedRequest struct {
+	Algorithm string `json:"algorithm"`
+	UserID    string `json:"user_id"`
+	IssuedAt  int64  `json:"issued_at"`
+}
+
+type FacebookStore interface {
+	IdentityStore
+	LoginCodeStore
 }
 
 type Key int
 
 const (
-	oauthStateString = "randoms123sawr32vyj"
-	TokenKey         = Key(1)
-	ErrorKey         = Key(2)
+	TokenKey = Key(1)
+	ErrorKey = Key(2)
+
+	facebookProvider = "facebook"
+	linkIntent       = "link"
+
+	signedRequestWindow = 5 * time.Minute // How old or far in the future a signed_request's issued_at can be
 )
 
 var (
@@ -44,9 +68,12 @@ var (
 	InvalidFacebookTokenErr = errors.New("authentication: failed to parse Facebook token.")
 	InvalidUserInfoErr      = errors.New("authentication: failed to parse Facebook user info.")
 	UserInfoFetchFailedErr  = errors.New("authentication: failed to fetch user info from Facebook's Graph API")
+	InvalidIntentErr        = errors.New("authentication: unknown login intent.")
+	InvalidSignedRequestErr = errors.New("authentication: Facebook signed_request is malformed or its signature is invalid.")
+	StaleSignedRequestErr   = errors.New("authentication: Facebook signed_request was issued too long ago.")
 )
 
-func NewFacebookAuthenticator(appID, appSecret, redirectURL, successRedirectURL, failureRedirectURL string, scopes []string, userCreator FacebookUserCreator, auth *Authenticator) *FacebookAuthenticator {
+func NewFacebookAuthenticator(appID, appSecret, redirectURL, successRedirectURL, failureRedirectURL string, scopes []string, store FacebookStore, auth *Authenticator) *FacebookAuthenticator {
 
 	successURL, err := url.Parse(successRedirectURL)
 	if err != nil {
@@ -54,10 +81,11 @@ func NewFacebookAuthenticator(appID, appSecret, redirectURL, successRedirectURL,
 	}
 
 	f := &FacebookAuthenticator{
-		model:              userCreator,
+		model:              store,
 		auth:               auth,
 		successRedirectURL: successURL,
 		failureRedirectURL: failureRedirectURL,
+		ProfileURL:         facebookProfileAPI,
 		Config: &oauth2.Config{
 			ClientID:     appID,
 			ClientSecret: appSecret,
@@ -67,36 +95,84 @@ func NewFacebookAuthenticator(appID, appSecret, redirectURL, successRedirectURL,
 		},
 	}
 
-	f.setAuthURL()
-
 	return f
 }
 
-func (f *FacebookAuthenticator) setAuthURL() {
+// Returns the Facebook login URL for the given state and PKCE code challenge
+func (f *FacebookAuthenticator) authCodeURL(state, codeChallenge string) string {
 	Url, _ := url.Parse(f.Endpoint.AuthURL)
 	params := url.Values{}
 
 	params.Add("client_id", f.ClientID)
-	params.Add("state", oauthStateString)
+	params.Add("state", state)
 	if scopes := f.Scopes; scopes != nil && len(scopes) > 0 {
 		params.Add("scope", strings.Join(scopes, ","))
 	}
 	params.Add("redirect_uri", f.RedirectURL)
 	params.Add("response_type", "code")
+	params.Add("code_challenge", codeChallenge)
+	params.Add("code_challenge_method", "S256")
 
 	Url.RawQuery = params.Encode()
-	f.authURL = Url.String()
+	return Url.String()
 }
 
-// Redirects the user to the Facebook login page
+// Redirects the user to the Facebook login page. A fresh state and PKCE
+// verifier are generated for every login and bound to the browser with a
+// signed cookie. An optional return_to path is remembered so the user lands
+// back where they started. The client must send a PKCE code_challenge; the
+// login ends with a one-time code that only the holder of its verifier can
+// exchange for a token. With intent=link, the user isn't logged in at the
+// end; the web app gets an identity token to link Facebook to their account.
 func (f *FacebookAuthenticator) LoginHandler(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, f.authURL, http.StatusTemporaryRedirect)
+	returnTo, err := validateReturnTo(r.FormValue("return_to"))
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, f.failureRedirectURL, http.StatusTemporaryRedirect)
+		return
+	}
+
+	intent := r.FormValue("intent")
+	if intent != "" && intent != linkIntent {
+		log.Println(InvalidIntentErr)
+		http.Redirect(w, r, f.failureRedirectURL, http.StatusTemporaryRedirect)
+		return
+	}
+
+	challenge := r.FormValue("code_challenge")
+	if intent != linkIntent {
+		if err := ValidateCodeChallenge(challenge); err != nil {
+			log.Println(err)
+			http.Redirect(w, r, f.failureRedirectURL, http.StatusTemporaryRedirect)
+			return
+		}
+	}
+
+	state, err := newOAuthState(returnTo, intent, challenge)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, f.failureRedirectURL, http.StatusTemporaryRedirect)
+		return
+	}
+
+	if err := state.setCookie(w, f.auth, f.RedirectURL); err != nil {
+		log.Println(err)
+		http.Redirect(w, r, f.failureRedirectURL, http.StatusTemporaryRedirect)
+		return
+	}
+
+	http.Redirect(w, r, f.authCodeURL(state.State, state.codeChallenge()), http.StatusTemporaryRedirect)
 }
 
 func (f *FacebookAuthenticator) LoginCallbackHandler(w http.ResponseWriter, r *http.Request) {
-	// Verify state is the same as the one we sent
-	state := r.FormValue("state")
-	if state != oauthStateString {
+	// Verify the state is the one we sent to this browser
+	state, err := readOAuthState(w, r, f.auth, f.RedirectURL)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, f.failureRedirectURL, http.StatusTemporaryRedirect)
+		return
+	}
+	if !state.matches(r.FormValue("state")) {
 		log.Println(InvalidFacebookStateErr)
 		http.Redirect(w, r, f.failureRedirectURL, http.StatusTemporaryRedirect)
 		return
@@ -104,15 +180,16 @@ func (f *FacebookAuthenticator) LoginCallbackHandler(w http.ResponseWriter, r *h
 
 	// Get the token from the code
 	code := r.FormValue("code")
-	fbToken, err := f.Exchange(oauth2.NoContext, code)
+	fbToken, err := f.Exchange(oauth2.NoContext, code,
+		oauth2.SetAuthURLParam("code_verifier", state.Verifier))
 	if err != nil {
 		log.Println(err)
 		http.Redirect(w, r, f.failureRedirectURL, http.StatusTemporaryRedirect)
 		return
 	}
 
-	// Get the user info (Name and Facebook ID)
-	resp, err := http.Get(facebookProfileAPI + "?access_token=" +
+	// Get the user info (Name, Email and Facebook ID)
+	resp, err := http.Get(f.ProfileURL + "?fields=id,name,email&access_token=" +
 		url.QueryEscape(fbToken.AccessToken))
 	if err != nil {
 		log.Println(err)
@@ -129,16 +206,77 @@ func (f *FacebookAuthenticator) LoginCallbackHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	// Create a new Facebook user
-	userID, err := f.model.CreateFacebookUser(user.ID)
+	// Facebook only returns emails that the user has confirmed
+	identity := &ExternalIdentity{
+		Provider:      facebookProvider,
+		Subject:       user.ID,
+		Email:         user.Email,
+		EmailVerified: user.Email != "",
+	}
+	if user.EmailVerified != nil {
+		identity.EmailVerified = identity.EmailVerified && *user.EmailVerified
+	}
+
+	if state.Intent == linkIntent {
+		f.redirectWithIdentity(w, r, state.ReturnTo, identity, "")
+		return
+	}
+
+	// Look up the user the identity is linked to
+	userID, err := f.model.GetIdentityUser(facebookProvider, user.ID)
+	if err == sql.ErrNoRows {
+		// Offer to merge instead of creating a second account for the
+		// same person
+		if identity.EmailVerified {
+			if _, err := f.model.GetUserID(identity.Email); err == nil {
+				f.redirectWithIdentity(w, r, state.ReturnTo, identity,
+					"An account with your Facebook email already exists. Log in to link Facebook to it.")
+				return
+			} else if err != sql.ErrNoRows {
+				log.Println(err)
+				http.Redirect(w, r, f.failureRedirectURL, http.StatusTemporaryRedirect)
+				return
+			}
+		}
+
+		// Create a new Facebook user
+		if f.CheckSignup != nil {
+			verifiedEmail := ""
+			if identity.EmailVerified {
+				verifiedEmail = identity.Email
+			}
+			if err := f.CheckSignup(verifiedEmail); err != nil {
+				http.Redirect(w, r, f.successURL(state.ReturnTo, url.Values{"error": {err.Error()}}), http.StatusTemporaryRedirect)
+				return
+			}
+		}
+		userID, err = f.model.CreateIdentityUser(facebookProvider, user.ID, user.Email)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, f.failureRedirectURL, http.StatusTemporaryRedirect)
+		return
+	}
+
+	// Generate a one-time code the client can exchange for a token. The
+	// token itself never shows up in a URL.
+	loginCode, err := f.auth.issueLoginCode(f.model, userID, state.CodeChallenge)
 	if err != nil {
 		log.Println(err)
 		http.Redirect(w, r, f.failureRedirectURL, http.StatusTemporaryRedirect)
 		return
 	}
 
-	// Generate a token for the user
-	token, err := f.auth.generateToken(userID)
+	// Redirect to success redirect url with the code
+	params := url.Values{}
+	params.Set("code", loginCode)
+	http.Redirect(w, r, f.successURL(state.ReturnTo, params), http.StatusTemporaryRedirect)
+}
+
+// Redirects to the web app with an identity token that a logged in user can
+// use to link the identity to their account
+func (f *FacebookAuthenticator) redirectWithIdentity(w http.ResponseWriter, r *http.Request, returnTo string, identity *ExternalIdentity, message string) {
+	identityToken, err := f.auth.IdentityToken(identity)
 	if err != nil {
 		log.Println(err)
 		http.Redirect(w, r, f.failureRedirectURL, http.StatusTemporaryRedirect)
@@ -146,8 +284,68 @@ func (f *FacebookAuthenticator) LoginCallbackHandler(w http.ResponseWriter, r *h
 	}
 
 	params := url.Values{}
-	params.Add("token", token.Subject)
-	f.successRedirectURL.RawQuery = params.Encode()
-	// Redirect to success redirect url with the token
-	http.Redirect(w, r, f.successRedirectURL.String(), http.StatusTemporaryRedirect)
+	params.Set("identity", identityToken)
+	if message != "" {
+		params.Set("error", message)
+	}
+	http.Redirect(w, r, f.successURL(returnTo, params), http.StatusTemporaryRedirect)
+}
+
+// Returns the success redirect URL with the return_to path and the params
+func (f *FacebookAuthenticator) successURL(returnTo string, params url.Values) string {
+	Url := *f.successRedirectURL
+	query := url.Values{}
+
+	if returnTo != "" {
+		if rt, err := url.Parse(returnTo); err == nil {
+			Url.Path = strings.TrimSuffix(Url.Path, "/") + rt.Path
+			Url.Fragment = rt.Fragment
+			query = rt.Query()
+		}
+	}
+
+	for k, v := range params {
+		query[k] = v
+	}
+	Url.RawQuery = query.Encode()
+	return Url.String()
+}
+
+// Verifies a signed_request sent by Facebook with the app secret and returns
+// its payload. Requests issued more than a few minutes ago are rejected so
+// they can't be replayed.
+func (f *FacebookAuthenticator) ParseSignedRequest(signedRequest string) (*FacebookSignedRequest, error) {
+	parts := strings.Split(signedRequest, ".")
+	if len(parts) != 2 {
+		return nil, InvalidSignedRequestErr
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[0], "="))
+	if err != nil {
+		return nil, InvalidSignedRequestErr
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, InvalidSignedRequestErr
+	}
+
+	// The signature is over the encoded payload
+	mac := hmac.New(sha256.New, []byte(f.ClientSecret))
+	mac.Write([]byte(parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, InvalidSignedRequestErr
+	}
+
+	request := new(FacebookSignedRequest)
+	if err := json.Unmarshal(payload, request); err != nil {
+		return nil, InvalidSignedRequestErr
+	}
+	if strings.ToUpper(request.Algorithm) != "HMAC-SHA256" || request.UserID == "" {
+		return nil, InvalidSignedRequestErr
+	}
+	if age := time.Since(time.Unix(request.IssuedAt, 0)); age > signedRequestWindow || age < -signedRequestWindow {
+		return nil, StaleSignedRequestErr
+	}
+
+	return request, nil
 }
@@ -2,11 +2,18 @@ package authentication
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -16,6 +23,10 @@ import (
 const (
 	appID     = "12345"
 	appSecret = "1as2sd34sd5"
+
+	// PKCE example from RFC 7636
+	codeVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	codeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
 )
 
 var (
@@ -23,13 +34,59 @@ var (
 	extractPathAndQueryRegexp = regexp.MustCompile(`^((http[s]?):\/)?\/?([^:\/\s]+)((\/\w+)*(:\d+)?\/?)`)
 )
 
-type model struct{}
+type model struct {
+	existingEmail string
+}
+
+func (m model) GetIdentityUser(provider, subject string) (int, error) {
+	return 0, sql.ErrNoRows
+}
+
+func (m model) GetUserID(email string) (int, error) {
+	if email != "" && email == m.existingEmail {
+		return 654321, nil
+	}
+	return 0, sql.ErrNoRows
+}
 
-func (m model) CreateFacebookUser(fbID string) (int, error) {
+func (m model) CreateIdentityUser(provider, subject, email string) (int, error) {
 	return 123456, nil
 }
 
-func (f FacebookAuthenticator) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
+type loginCode struct {
+	userID    int
+	challenge string
+	expiresAt time.Time
+}
+
+var (
+	loginCodes     = map[string]loginCode{}
+	loginCodesLock sync.Mutex
+)
+
+func (m model) CreateLoginCode(hash string, userID int, challenge string, expiresAt time.Time) error {
+	loginCodesLock.Lock()
+	defer loginCodesLock.Unlock()
+	loginCodes[hash] = loginCode{userID, challenge, expiresAt}
+	return nil
+}
+
+func (m model) HasTwoFactor(userID int) (bool, error) {
+	return false, nil
+}
+
+func (m model) TakeLoginCode(hash string) (int, string, time.Time, error) {
+	loginCodesLock.Lock()
+	defer loginCodesLock.Unlock()
+	code, ok := loginCodes[hash]
+	if !ok {
+		return 0, "", time.Time{}, sql.ErrNoRows
+	}
+	delete(loginCodes, hash)
+	return code.userID, code.challenge, code.expiresAt, nil
+}
+
+func (f FacebookAuthenticator) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
 	return &oauth2.Token{
 		AccessToken: "123456",
 		TokenType:   "Bearer",
@@ -58,6 +115,11 @@ func fbHandler(t *testing.T) http.HandlerFunc {
 			t.Log("Facebook API: No state")
 		}
 
+		if challenge := q.Get("code_challenge"); challenge == "" || q.Get("code_challenge_method") != "S256" {
+			t.Logf("Facebook API: Expected an S256 code challenge; Got %q", q)
+			t.Fail()
+		}
+
 		Url, err := url.Parse(redirectURL[0])
 		if err != nil {
 			t.Logf("Facebook API was passed an invalid redirect URL %s", redirectURL[0])
@@ -82,8 +144,8 @@ func successHandler(t *testing.T) http.HandlerFunc {
 			t.Fail()
 		}
 
-		if len(q["token"]) < 1 {
-			t.Logf("No token in callback URL %s", r.URL)
+		if len(q["code"]) < 1 {
+			t.Logf("No code in callback URL %s", r.URL)
 			t.Fail()
 		}
 
@@ -146,15 +208,19 @@ func TestFacebookLogin(t *testing.T) {
 	sMux.HandleFunc("/login", fb.LoginHandler)
 	sMux.HandleFunc("/callback", fb.LoginCallbackHandler)
 
-	facebookProfileAPI = s.URL + "/me"
+	fb.ProfileURL = s.URL + "/me"
 	fb.Endpoint.AuthURL = s.URL
-	fb.setAuthURL()
 
-	r, _ := http.NewRequest("GET", "/login", nil)
+	r, _ := http.NewRequest("GET", "/login?code_challenge="+codeChallenge, nil)
 	w := httptest.NewRecorder()
 
 	sMux.ServeHTTP(w, r)
 
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != stateCookieName || !cookies[0].HttpOnly {
+		t.Fatalf("Expected an HttpOnly %s cookie; Got %v", stateCookieName, cookies)
+	}
+
 	redirectURL, ok := w.Header()["Location"]
 	if !ok {
 		t.Fatalf("Expected redirect, but no Location header was found.\nHeaders: %v", w.Header())
@@ -171,9 +237,274 @@ func TestFacebookLogin(t *testing.T) {
 
 	url = extractPathAndQueryRegexp.ReplaceAllString(w.Header()["Location"][0], "")
 	r, _ = http.NewRequest("GET", "/"+url, nil)
+	r.AddCookie(cookies[0])
 	sMux.ServeHTTP(w, r)
 
+	if location := w.Header().Get("Location"); !strings.HasPrefix(location, s.URL+"/success") {
+		t.Fatalf("Expected redirect to %s/success; Got: %s", s.URL, location)
+	}
+
 	url = extractPathAndQueryRegexp.ReplaceAllString(w.Header()["Location"][0], "")
 	r, _ = http.NewRequest("GET", "/"+url, nil)
 	sMux.ServeHTTP(w, r)
 }
+
+func TestFacebookLoginCallbackRejectsForgedState(t *testing.T) {
+	fb := NewFacebookAuthenticator(appID, appSecret, "https://api.test/callback",
+		"https://web.test/", "https://web.test/error", nil, model{}, auth)
+
+	r, _ := http.NewRequest("GET", "/login?return_to=/dash&code_challenge="+codeChallenge, nil)
+	w := httptest.NewRecorder()
+	fb.LoginHandler(w, r)
+	cookie := w.Result().Cookies()[0]
+
+	if !cookie.Secure || cookie.Path != "/callback" {
+		t.Fatalf("Expected a secure cookie scoped to /callback; Got %v", cookie)
+	}
+
+	// No cookie at all
+	r, _ = http.NewRequest("GET", "/callback?code=123&state=abc", nil)
+	w = httptest.NewRecorder()
+	fb.LoginCallbackHandler(w, r)
+	if location := w.Header().Get("Location"); location != "https://web.test/error" {
+		t.Fatalf("Expected redirect to the failure URL; Got %s", location)
+	}
+
+	// Cookie from another login attempt
+	r, _ = http.NewRequest("GET", "/callback?code=123&state=abc", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	fb.LoginCallbackHandler(w, r)
+	if location := w.Header().Get("Location"); location != "https://web.test/error" {
+		t.Fatalf("Expected redirect to the failure URL; Got %s", location)
+	}
+
+	// Tampered cookie
+	cookie.Value = "x" + cookie.Value
+	r, _ = http.NewRequest("GET", "/callback?code=123&state=abc", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	fb.LoginCallbackHandler(w, r)
+	if location := w.Header().Get("Location"); location != "https://web.test/error" {
+		t.Fatalf("Expected redirect to the failure URL; Got %s", location)
+	}
+}
+
+func TestFacebookLoginRejectsOpenRedirect(t *testing.T) {
+	fb := NewFacebookAuthenticator(appID, appSecret, "https://api.test/callback",
+		"https://web.test/", "https://web.test/error", nil, model{}, auth)
+
+	for _, returnTo := range []string{"https://evil.test", "//evil.test", "/\\evil.test", "dash"} {
+		r, _ := http.NewRequest("GET", "/login?return_to="+url.QueryEscape(returnTo), nil)
+		w := httptest.NewRecorder()
+		fb.LoginHandler(w, r)
+		if location := w.Header().Get("Location"); location != "https://web.test/error" {
+			t.Fatalf("Expected return_to=%s to be rejected; Got redirect to %s", returnTo, location)
+		}
+	}
+}
+
+func TestFacebookSuccessURL(t *testing.T) {
+	fb := NewFacebookAuthenticator(appID, appSecret, "https://api.test/callback",
+		"https://web.test/", "https://web.test/error", nil, model{}, auth)
+
+	params := url.Values{"token": {"tok"}}
+	if got, expected := fb.successURL("", params), "https://web.test/?token=tok"; got != expected {
+		t.Fatalf("Expected %s; Got %s", expected, got)
+	}
+	if got, expected := fb.successURL("/dash?tab=1#top", params), "https://web.test/dash?tab=1&token=tok#top"; got != expected {
+		t.Fatalf("Expected %s; Got %s", expected, got)
+	}
+}
+
+// Runs the Facebook login flow against a fake Graph API that returns the
+// given profile and returns the query of the final redirect to the web app
+func facebookLoginRedirect(t *testing.T, store FacebookStore, profile, loginQuery string, options ...func(*FacebookAuthenticator)) url.Values {
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(profile))
+	}))
+	defer graph.Close()
+
+	fb := NewFacebookAuthenticator(appID, appSecret, "https://api.test/callback",
+		"https://web.test/", "https://web.test/error", nil, store, auth)
+	fb.ProfileURL = graph.URL
+	for _, option := range options {
+		option(fb)
+	}
+
+	r, _ := http.NewRequest("GET", "/login?code_challenge="+codeChallenge+"&"+loginQuery, nil)
+	w := httptest.NewRecorder()
+	fb.LoginHandler(w, r)
+
+	authURL, _ := url.Parse(w.Header().Get("Location"))
+	r, _ = http.NewRequest("GET", "/callback?code=123&state="+url.QueryEscape(authURL.Query().Get("state")), nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	w = httptest.NewRecorder()
+	fb.LoginCallbackHandler(w, r)
+
+	location, _ := url.Parse(w.Header().Get("Location"))
+	if location.Host != "web.test" || location.Path == "/error" {
+		t.Fatalf("Expected a successful redirect to the web app; Got %s", location)
+	}
+	return location.Query()
+}
+
+func TestFacebookLoginOffersMergeForExistingEmail(t *testing.T) {
+	q := facebookLoginRedirect(t, model{existingEmail: "jd@m.ca"},
+		`{"id": "1326314725", "email": "jd@m.ca"}`, "")
+
+	if q.Get("token") != "" {
+		t.Fatalf("Expected no token when the email belongs to another account; Got %s", q.Get("token"))
+	}
+
+	identity, err := auth.ParseIdentityToken(q.Get("identity"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Provider != "facebook" || identity.Subject != "1326314725" || identity.Email != "jd@m.ca" {
+		t.Fatalf("Unexpected identity %+v", identity)
+	}
+}
+
+func TestFacebookLoginWithLinkIntent(t *testing.T) {
+	q := facebookLoginRedirect(t, model{}, `{"id": "1326314725"}`, "intent=link")
+
+	if q.Get("token") != "" || q.Get("error") != "" {
+		t.Fatalf("Expected only an identity token; Got %v", q)
+	}
+	if _, err := auth.ParseIdentityToken(q.Get("identity")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFacebookLoginCreatesUser(t *testing.T) {
+	q := facebookLoginRedirect(t, model{existingEmail: "other@m.ca"},
+		`{"id": "1326314725", "email": "jd@m.ca"}`, "")
+
+	if q.Get("token") != "" {
+		t.Fatalf("Expected the token to be kept out of the URL; Got %s", q.Get("token"))
+	}
+
+	token, err := auth.ExchangeLoginCode(model{}, q.Get("code"), codeVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, err := auth.Authenticate(token.Subject); err != nil || id != 123456 {
+		t.Fatalf("Expected a token for user 123456; Got %d, %v", id, err)
+	}
+
+	// Codes are single-use
+	if _, err := auth.ExchangeLoginCode(model{}, q.Get("code"), codeVerifier); err != InvalidLoginCodeErr {
+		t.Fatalf("Expected %v; Got %v", InvalidLoginCodeErr, err)
+	}
+}
+
+func TestFacebookLoginChecksSignup(t *testing.T) {
+	var checked string
+	q := facebookLoginRedirect(t, model{}, `{"id": "1326314725", "email": "jd@m.ca"}`, "",
+		func(fb *FacebookAuthenticator) {
+			fb.CheckSignup = func(email string) error {
+				checked = email
+				return errors.New("Signing up is closed.")
+			}
+		})
+
+	if checked != "jd@m.ca" {
+		t.Fatalf("Expected the signup check to get the verified email; Got %q", checked)
+	}
+	if q.Get("code") != "" || q.Get("error") != "Signing up is closed." {
+		t.Fatalf("Expected the signup to be refused; Got %v", q)
+	}
+
+	// Linking an account isn't signing up
+	checked = ""
+	facebookLoginRedirect(t, model{}, `{"id": "1326314725"}`, "intent=link",
+		func(fb *FacebookAuthenticator) {
+			fb.CheckSignup = func(email string) error {
+				checked = "called"
+				return nil
+			}
+		})
+	if checked != "" {
+		t.Fatal("Expected linking not to check signup")
+	}
+}
+
+func TestFacebookLoginRequiresCodeChallenge(t *testing.T) {
+	fb := NewFacebookAuthenticator(appID, appSecret, "https://api.test/callback",
+		"https://web.test/", "https://web.test/error", nil, model{}, auth)
+
+	r, _ := http.NewRequest("GET", "/login", nil)
+	w := httptest.NewRecorder()
+	fb.LoginHandler(w, r)
+	if location := w.Header().Get("Location"); location != "https://web.test/error" {
+		t.Fatalf("Expected redirect to the failure URL; Got %s", location)
+	}
+}
+
+func TestExchangeLoginCode(t *testing.T) {
+	code, err := auth.issueLoginCode(model{}, 42, codeChallenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A different client can't use the code
+	if _, err := auth.ExchangeLoginCode(model{}, code, "another-clients-verifier"); err != CodeVerifierMismatchedErr {
+		t.Fatalf("Expected %v; Got %v", CodeVerifierMismatchedErr, err)
+	}
+
+	// Codes are gone once they've been tried
+	if _, err := auth.ExchangeLoginCode(model{}, code, codeVerifier); err != InvalidLoginCodeErr {
+		t.Fatalf("Expected %v; Got %v", InvalidLoginCodeErr, err)
+	}
+
+	// Expired codes are rejected
+	model{}.CreateLoginCode(hashCode("expired"), 42, codeChallenge, time.Now().Add(-time.Second))
+	if _, err := auth.ExchangeLoginCode(model{}, "expired", codeVerifier); err != InvalidLoginCodeErr {
+		t.Fatalf("Expected %v; Got %v", InvalidLoginCodeErr, err)
+	}
+}
+
+func signRequest(secret, payload string) string {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) + "." + encoded
+}
+
+func TestParseSignedRequest(t *testing.T) {
+	fb := NewFacebookAuthenticator(appID, appSecret, "https://api.test/callback",
+		"https://web.test/", "https://web.test/error", nil, model{}, auth)
+
+	request, err := fb.ParseSignedRequest(signRequest(appSecret, fmt.Sprintf(
+		`{"algorithm": "HMAC-SHA256", "issued_at": %d, "user_id": "1326314725"}`, time.Now().Unix())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.UserID != "1326314725" {
+		t.Fatalf("Expected user_id = 1326314725; Got %s", request.UserID)
+	}
+
+	for _, signedRequest := range []string{
+		"",
+		"garbage",
+		signRequest("another app's secret", `{"algorithm": "HMAC-SHA256", "user_id": "1326314725"}`),
+		signRequest(appSecret, `{"algorithm": "none", "user_id": "1326314725"}`),
+		signRequest(appSecret, `{"algorithm": "HMAC-SHA256"}`),
+	} {
+		if _, err := fb.ParseSignedRequest(signedRequest); err != InvalidSignedRequestErr {
+			t.Fatalf("Expected %q to be rejected; Got %v", signedRequest, err)
+		}
+	}
+
+	// Old requests can't be replayed
+	for _, issuedAt := range []time.Time{time.Unix(1497473227, 0), time.Now().Add(-10 * time.Minute), time.Now().Add(10 * time.Minute), {}} {
+		signedRequest := signRequest(appSecret, fmt.Sprintf(
+			`{"algorithm": "HMAC-SHA256", "issued_at": %d, "user_id": "1326314725"}`, issuedAt.Unix()))
+		if _, err := fb.ParseSignedRequest(signedRequest); err != StaleSignedRequestErr {
+			t.Fatalf("Expected a request issued at %v to be rejected; Got %v", issuedAt, err)
+		}
+	}
+}
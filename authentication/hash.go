@@ -0,0 +1,215 @@
+package authentication
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var (
+	IncorrectPasswordErr = errors.New("authentication: password is incorrect.")
+	UnknownHashErr       = errors.New("authentication: password hash is malformed or uses an unknown algorithm.")
+	UnknownPepperErr     = errors.New("authentication: password hash was peppered with an unknown pepper.")
+)
+
+// PasswordHasher hashes passwords with argon2id or bcrypt. Argon2id hashes
+// are encoded in the PHC string format, e.g.
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>, so they record their
+// parameters, and bcrypt hashes record their cost.
+type PasswordHasher struct {
+	Algorithm     string // Argon2id or Bcrypt
+	BcryptCost    int
+	Argon2Time    uint32 // Passes over the memory
+	Argon2Memory  uint32 // In KiB
+	Argon2Threads uint8
+
+	// A secret mixed into argon2id hashes so they can't be cracked without
+	// it. It isn't stored with the hashes, only an ID for it.
+	Pepper []byte
+	// Peppers that were replaced, so their hashes can still be verified
+	// until they're rehashed
+	OldPeppers [][]byte
+}
+
+// Returns a hasher with OWASP's recommended argon2id parameters
+func DefaultPasswordHasher() *PasswordHasher {
+	return &PasswordHasher{
+		Algorithm:     Argon2id,
+		BcryptCost:    bcrypt.DefaultCost,
+		Argon2Time:    2,
+		Argon2Memory:  19 * 1024,
+		Argon2Threads: 1,
+	}
+}
+
+// The parameters of an argon2id hash
+type argon2Hash struct {
+	time, memory uint32
+	threads      uint8
+	keyID        string
+	salt, key    []byte
+}
+
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	if h.Algorithm == Bcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	params := fmt.Sprintf("m=%d,t=%d,p=%d", h.Argon2Memory, h.Argon2Time, h.Argon2Threads)
+	if len(h.Pepper) > 0 {
+		params += ",keyid=" + pepperID(h.Pepper)
+	}
+
+	key := argon2.IDKey(pepper(h.Pepper, password), salt, h.Argon2Time, h.Argon2Memory, h.Argon2Threads, argon2KeyLength)
+
+	return fmt.Sprintf(
+		"$%s$v=%d$%s$%s$%s", Argon2id, argon2.Version, params,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Returns IncorrectPasswordErr if the password doesn't match the hash
+func (h *PasswordHasher) Verify(hash, password string) error {
+	if strings.HasPrefix(hash, "$2") {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return IncorrectPasswordErr
+		}
+		return err
+	}
+
+	parsed, err := parseArgon2Hash(hash)
+	if err != nil {
+		return err
+	}
+
+	var secret []byte
+	if parsed.keyID != "" {
+		if secret = h.findPepper(parsed.keyID); secret == nil {
+			return UnknownPepperErr
+		}
+	}
+
+	key := argon2.IDKey(pepper(secret, password), parsed.salt, parsed.time, parsed.memory, parsed.threads, uint32(len(parsed.key)))
+	if subtle.ConstantTimeCompare(key, parsed.key) != 1 {
+		return IncorrectPasswordErr
+	}
+	return nil
+}
+
+// Returns whether the hash uses another algorithm, weaker parameters or
+// another pepper than the hasher, and should be replaced next time the
+// password is known
+func (h *PasswordHasher) NeedsRehash(hash string) bool {
+	if strings.HasPrefix(hash, "$2") {
+		if h.Algorithm != Bcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost < h.BcryptCost
+	}
+
+	parsed, err := parseArgon2Hash(hash)
+	if err != nil || h.Algorithm != Argon2id {
+		return true
+	}
+
+	keyID := ""
+	if len(h.Pepper) > 0 {
+		keyID = pepperID(h.Pepper)
+	}
+
+	return parsed.time < h.Argon2Time ||
+		parsed.memory < h.Argon2Memory ||
+		parsed.threads < h.Argon2Threads ||
+		parsed.keyID != keyID
+}
+
+func (h *PasswordHasher) findPepper(keyID string) []byte {
+	for _, p := range append([][]byte{h.Pepper}, h.OldPeppers...) {
+		if len(p) > 0 && pepperID(p) == keyID {
+			return p
+		}
+	}
+	return nil
+}
+
+func parseArgon2Hash(hash string) (*argon2Hash, error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != Argon2id || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, UnknownHashErr
+	}
+
+	parsed := new(argon2Hash)
+	for _, param := range strings.Split(parts[3], ",") {
+		var err error
+		switch {
+		case strings.HasPrefix(param, "m="):
+			_, err = fmt.Sscanf(param, "m=%d", &parsed.memory)
+		case strings.HasPrefix(param, "t="):
+			_, err = fmt.Sscanf(param, "t=%d", &parsed.time)
+		case strings.HasPrefix(param, "p="):
+			_, err = fmt.Sscanf(param, "p=%d", &parsed.threads)
+		case strings.HasPrefix(param, "keyid="):
+			parsed.keyID = strings.TrimPrefix(param, "keyid=")
+		default:
+			err = UnknownHashErr
+		}
+		if err != nil {
+			return nil, UnknownHashErr
+		}
+	}
+	if parsed.time == 0 || parsed.memory == 0 || parsed.threads == 0 {
+		return nil, UnknownHashErr
+	}
+
+	var err error
+	if parsed.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, UnknownHashErr
+	}
+	if parsed.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(parsed.key) == 0 {
+		return nil, UnknownHashErr
+	}
+
+	return parsed, nil
+}
+
+// Mixes the pepper into the password, if there is one
+func pepper(secret []byte, password string) []byte {
+	if len(secret) == 0 {
+		return []byte(password)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// Identifies a pepper in hashes without giving it away
+func pepperID(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return base64.RawStdEncoding.EncodeToString(sum[:6])
+}
@@ -0,0 +1,146 @@
+package authentication
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap parameters so the tests are fast
+func testHasher() *PasswordHasher {
+	return &PasswordHasher{
+		Algorithm:     Argon2id,
+		BcryptCost:    bcrypt.MinCost,
+		Argon2Time:    1,
+		Argon2Memory:  1024,
+		Argon2Threads: 1,
+	}
+}
+
+// An in-memory store with a single user
+type loginStore struct {
+	user User
+}
+
+func (s *loginStore) Get(email string) (User, error) {
+	if email != s.user.Username {
+		return User{}, sql.ErrNoRows
+	}
+	return s.user, nil
+}
+
+func (s *loginStore) UpdatePasswordHash(userID int, oldHash, newHash string) error {
+	if s.user.Password == oldHash {
+		s.user.Password = newHash
+	}
+	return nil
+}
+
+func TestHashPassword(t *testing.T) {
+	for _, algorithm := range []string{Argon2id, Bcrypt} {
+		h := testHasher()
+		h.Algorithm = algorithm
+
+		hash, err := h.Hash("mpa$$!23")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if algorithm == Argon2id && !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+			t.Errorf("Expected the hash to record its parameters; Got %s", hash)
+		}
+
+		if err := h.Verify(hash, "mpa$$!23"); err != nil {
+			t.Errorf("Expected the %s hash to verify; Got %v", algorithm, err)
+		}
+		if err := h.Verify(hash, "wrong"); err != IncorrectPasswordErr {
+			t.Errorf("Expected %v; Got %v", IncorrectPasswordErr, err)
+		}
+		if h.NeedsRehash(hash) {
+			t.Errorf("Expected a fresh %s hash not to need rehashing", algorithm)
+		}
+	}
+
+	if err := testHasher().Verify("$argon2id$v=19$m=1024$salt$key", "mpa$$!23"); err != UnknownHashErr {
+		t.Errorf("Expected %v; Got %v", UnknownHashErr, err)
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	h := testHasher()
+	hash, _ := h.Hash("mpa$$!23")
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("mpa$$!23"), bcrypt.MinCost)
+
+	stronger := testHasher()
+	stronger.Argon2Memory *= 2
+	if !stronger.NeedsRehash(hash) {
+		t.Error("Expected a hash with less memory to need rehashing")
+	}
+
+	if !h.NeedsRehash(string(bcryptHash)) {
+		t.Error("Expected a bcrypt hash to need rehashing to argon2id")
+	}
+
+	h.Algorithm, h.BcryptCost = Bcrypt, bcrypt.MinCost+1
+	if !h.NeedsRehash(string(bcryptHash)) {
+		t.Error("Expected a bcrypt hash with a lower cost to need rehashing")
+	}
+}
+
+func TestPepper(t *testing.T) {
+	h := testHasher()
+	h.Pepper = []byte("pepper")
+
+	hash, _ := h.Hash("mpa$$!23")
+	if !strings.Contains(hash, ",keyid=") {
+		t.Fatalf("Expected the hash to identify its pepper; Got %s", hash)
+	}
+
+	// The hash is useless without the pepper
+	if err := testHasher().Verify(hash, "mpa$$!23"); err != UnknownPepperErr {
+		t.Fatalf("Expected %v; Got %v", UnknownPepperErr, err)
+	}
+
+	// Old peppers still verify until the password is rehashed
+	rotated := testHasher()
+	rotated.Pepper, rotated.OldPeppers = []byte("new pepper"), [][]byte{h.Pepper}
+	if err := rotated.Verify(hash, "mpa$$!23"); err != nil {
+		t.Fatal(err)
+	}
+	if !rotated.NeedsRehash(hash) {
+		t.Fatal("Expected a hash with an old pepper to need rehashing")
+	}
+}
+
+func TestLoginRehashesPassword(t *testing.T) {
+	a := NewAuthenticator([]byte("my,secret,key"), 5*time.Second)
+	a.Hasher = testHasher()
+
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("mpa$$!23"), bcrypt.MinCost)
+	store := &loginStore{User{ID: 42, Username: "jd@m.ca", Password: string(bcryptHash)}}
+
+	if _, err := a.Login(store, "jd@m.ca", "wrong"); err != IncorrectPasswordErr {
+		t.Fatalf("Expected %v; Got %v", IncorrectPasswordErr, err)
+	}
+	if store.user.Password != string(bcryptHash) {
+		t.Fatal("Expected a wrong password not to rehash")
+	}
+
+	if _, err := a.Login(store, "jd@m.ca", "mpa$$!23"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(store.user.Password, "$argon2id$") {
+		t.Fatalf("Expected the password to be rehashed with argon2id; Got %s", store.user.Password)
+	}
+
+	// The new hash works
+	if _, err := a.Login(store, "jd@m.ca", "mpa$$!23"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Login(store, "unknown@m.ca", "mpa$$!23"); err != sql.ErrNoRows {
+		t.Fatalf("Expected %v; Got %v", sql.ErrNoRows, err)
+	}
+}
@@ -0,0 +1,51 @@
+package authentication
+
+import (
+	"errors"
+	"time"
+)
+
+const identityTokenTTL = 10 * time.Minute
+
+var InvalidIdentityTokenErr = errors.New("authentication: identity token is invalid or expired.")
+
+// ExternalIdentity is a user's account at a third party login provider
+type ExternalIdentity struct {
+	Provider      string `json:"provider"`
+	Subject       string `json:"sub"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+	ExpiresAt     int64  `json:"exp"`
+}
+
+type IdentityStore interface {
+	// Takes a provider and the user's ID at that provider and returns the
+	// ID of the user the identity is linked to
+	GetIdentityUser(string, string) (int, error)
+	// Takes an email and returns the ID of the user that signed up with it
+	GetUserID(string) (int, error)
+	// Takes a provider, the user's ID and email at that provider and
+	// creates a new user with the identity linked to it
+	CreateIdentityUser(string, string, string) (int, error)
+}
+
+// Returns a short-lived signed token proving that the holder just logged in
+// with the given identity. The web app exchanges it for a link between the
+// identity and the logged in user.
+func (a *Authenticator) IdentityToken(identity *ExternalIdentity) (string, error) {
+	i := *identity
+	i.ExpiresAt = time.Now().Add(identityTokenTTL).Unix()
+	return a.seal("identity", &i)
+}
+
+// Verifies a token returned by IdentityToken and returns the identity
+func (a *Authenticator) ParseIdentityToken(token string) (*ExternalIdentity, error) {
+	identity := new(ExternalIdentity)
+	if err := a.unseal("identity", token, identity); err != nil {
+		return nil, InvalidIdentityTokenErr
+	}
+	if time.Now().Unix() > identity.ExpiresAt {
+		return nil, InvalidIdentityTokenErr
+	}
+	return identity, nil
+}
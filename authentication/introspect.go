@@ -0,0 +1,78 @@
+package authentication
+
+import (
+	"database/sql"
+	"time"
+)
+
+// What a credential is good for. Inactive credentials report nothing else,
+// whether they're unknown, expired or revoked.
+type Introspection struct {
+	Active    bool
+	UserID    int
+	ClientID  string   // The service account the token was issued to, if any
+	Scopes    []string // nil if the credential can do anything the user can
+	APIKey    bool     // Whether it's an API key rather than a token
+	Test      bool     // Whether it's a test-mode API key
+	IssuedAt  time.Time
+	ExpiresAt time.Time // The zero time if it doesn't expire on its own
+}
+
+type IntrospectionStore interface {
+	ClientStore
+	APIKeyStore
+}
+
+// Returns whether the token or API key is active and what it grants, as in
+// RFC 7662. Unlike VerifyAPIKey, it doesn't count a call, and it can't check
+// IP address and origin restrictions since the caller isn't the key's client.
+func (a *Authenticator) Introspect(store IntrospectionStore, credential string) (*Introspection, error) {
+	if IsAPIKey(credential) {
+		return introspectAPIKey(store, credential)
+	}
+
+	// Tokens that don't parse are forged, malformed or expired
+	if _, _, err := a.parse(credential); err != nil {
+		return &Introspection{}, nil
+	}
+
+	grant, account, err := a.verifyGrant(store, credential)
+	if err == RevokedTokenErr {
+		return &Introspection{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if account != nil && expired(account.ExpiresAt) {
+		return &Introspection{}, nil
+	}
+
+	return &Introspection{
+		Active:    true,
+		UserID:    grant.UserID,
+		ClientID:  grant.ClientID,
+		Scopes:    grant.Scopes,
+		IssuedAt:  grant.IssuedAt,
+		ExpiresAt: grant.ExpiresAt,
+	}, nil
+}
+
+func introspectAPIKey(store APIKeyStore, key string) (*Introspection, error) {
+	apiKey, err := store.GetAPIKey(hashCode(key))
+	if err == sql.ErrNoRows {
+		return &Introspection{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if expired(apiKey.ExpiresAt) || apiKey.MaxCalls > 0 && apiKey.Calls >= apiKey.MaxCalls {
+		return &Introspection{}, nil
+	}
+
+	return &Introspection{
+		Active:    true,
+		UserID:    apiKey.UserID,
+		APIKey:    true,
+		Test:      apiKey.Test,
+		ExpiresAt: apiKey.ExpiresAt,
+	}, nil
+}
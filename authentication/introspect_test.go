@@ -0,0 +1,90 @@
+package authentication
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+type introspectionStore struct {
+	*clientStore
+	*apiKeyStore
+}
+
+func TestIntrospectToken(t *testing.T) {
+	store := introspectionStore{newClientStore(), newAPIKeyStore()}
+
+	account := &ServiceAccount{OwnerID: 42, Scopes: []string{"next"}}
+	secret, err := auth.CreateServiceAccount(store, account, "Backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.ClientCredentialsToken(store, account.ClientID, secret, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	introspection, err := auth.Introspect(store, token.Subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !introspection.Active || introspection.UserID != 42 || introspection.ClientID != account.ClientID ||
+		len(introspection.Scopes) != 1 || introspection.ExpiresAt.Before(time.Now()) || introspection.APIKey {
+		t.Fatalf("Expected an active token for the service account; Got %+v", introspection)
+	}
+
+	// Tokens of expired accounts are inactive
+	expiredAccount := store.accounts[account.ClientID]
+	expiredAccount.ExpiresAt = time.Now().Add(-time.Second)
+	store.accounts[account.ClientID] = expiredAccount
+	if introspection, err := auth.Introspect(store, token.Subject); err != nil || introspection.Active {
+		t.Fatalf("Expected the token of an expired account to be inactive; Got %+v, %v", introspection, err)
+	}
+
+	// Expired, forged and revoked tokens are inactive
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &Token{
+		Subject:       strconv.Itoa(42),
+		UnixExpiresAt: time.Now().Add(-time.Minute).Unix(),
+	}).SignedString(auth.secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(store.accounts, account.ClientID)
+	for _, inactive := range []string{expired, token.Subject + "x", token.Subject, "not,a,token"} {
+		if introspection, err := auth.Introspect(store, inactive); err != nil || introspection.Active {
+			t.Fatalf("Expected %q to be inactive; Got %+v, %v", inactive, introspection, err)
+		}
+	}
+}
+
+func TestIntrospectAPIKey(t *testing.T) {
+	store := introspectionStore{newClientStore(), newAPIKeyStore()}
+
+	key, err := auth.CreateAPIKey(store, &APIKey{UserID: 42, Test: true, MaxCalls: 1}, "Test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Introspecting doesn't count a call
+	for i := 0; i < 2; i++ {
+		introspection, err := auth.Introspect(store, key)
+		if err != nil || !introspection.Active || !introspection.APIKey || !introspection.Test || introspection.UserID != 42 {
+			t.Fatalf("Expected an active test-mode key; Got %+v, %v", introspection, err)
+		}
+	}
+
+	// Keys that made all their calls are inactive
+	hash := hashCode(key)
+	used := store.keys[hash]
+	used.Calls = 1
+	store.keys[hash] = used
+	if introspection, err := auth.Introspect(store, key); err != nil || introspection.Active {
+		t.Fatalf("Expected the key to be inactive; Got %+v, %v", introspection, err)
+	}
+
+	if introspection, err := auth.Introspect(store, key+"x"); err != nil || introspection.Active {
+		t.Fatalf("Expected an unknown key to be inactive; Got %+v, %v", introspection, err)
+	}
+}
@@ -0,0 +1,61 @@
+package authentication
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const magicLinkTTL = 15 * time.Minute
+
+var InvalidMagicLinkErr = errors.New("authentication: magic link is invalid, expired or already used.")
+
+type MagicLinkStore interface {
+	TwoFactorChecker
+	// Takes an email and returns the ID of the user that signed up with it
+	GetUserID(string) (int, error)
+	// Takes the hash of a magic link token, the user ID and the expiry time
+	// and saves the token
+	CreateMagicLink(string, int, time.Time) error
+	// Takes the hash of a magic link token, deletes it and returns the user
+	// ID and expiry time it was saved with
+	TakeMagicLink(string) (int, time.Time, error)
+}
+
+// Returns a single-use token that logs the holder in as the user with the
+// email. Only the token's hash is stored. Returns sql.ErrNoRows if no user
+// has the email.
+func (a *Authenticator) MagicLinkToken(store MagicLinkStore, email string) (string, error) {
+	userID, err := store.GetUserID(email)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	if err := store.CreateMagicLink(hashCode(token), userID, time.Now().Add(magicLinkTTL)); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Exchanges a magic link token for the same token Login returns, which is a
+// challenge if the user enabled two-factor authentication
+func (a *Authenticator) MagicLogin(store MagicLinkStore, token string) (*Token, error) {
+	userID, expiresAt, err := store.TakeMagicLink(hashCode(token))
+	if err == sql.ErrNoRows {
+		return nil, InvalidMagicLinkErr
+	} else if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(expiresAt) {
+		return nil, InvalidMagicLinkErr
+	}
+
+	return a.tokenOrChallenge(store, userID)
+}
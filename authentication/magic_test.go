@@ -0,0 +1,81 @@
+package authentication
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+type magicLink struct {
+	userID    int
+	expiresAt time.Time
+}
+
+// An in-memory store with a single user
+type magicLinkStore struct {
+	email string
+	links map[string]magicLink
+}
+
+func (s *magicLinkStore) GetUserID(email string) (int, error) {
+	if email != s.email {
+		return 0, sql.ErrNoRows
+	}
+	return 42, nil
+}
+
+func (s *magicLinkStore) HasTwoFactor(userID int) (bool, error) {
+	return false, nil
+}
+
+func (s *magicLinkStore) CreateMagicLink(hash string, userID int, expiresAt time.Time) error {
+	s.links[hash] = magicLink{userID, expiresAt}
+	return nil
+}
+
+func (s *magicLinkStore) TakeMagicLink(hash string) (int, time.Time, error) {
+	link, ok := s.links[hash]
+	if !ok {
+		return 0, time.Time{}, sql.ErrNoRows
+	}
+	delete(s.links, hash)
+	return link.userID, link.expiresAt, nil
+}
+
+func TestMagicLogin(t *testing.T) {
+	store := &magicLinkStore{email: "jd@m.ca", links: map[string]magicLink{}}
+
+	if _, err := auth.MagicLinkToken(store, "unknown@m.ca"); err != sql.ErrNoRows {
+		t.Fatalf("Expected %v; Got %v", sql.ErrNoRows, err)
+	}
+
+	token, err := auth.MagicLinkToken(store, "jd@m.ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.links[token]; ok {
+		t.Fatal("Expected the magic link token to be stored hashed")
+	}
+
+	authToken, err := auth.MagicLogin(store, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := auth.Authenticate(authToken.Subject); err != nil || id != 42 {
+		t.Fatalf("Expected a token for user 42; Got %d, %v", id, err)
+	}
+
+	// Magic links are single-use
+	if _, err := auth.MagicLogin(store, token); err != InvalidMagicLinkErr {
+		t.Fatalf("Expected %v; Got %v", InvalidMagicLinkErr, err)
+	}
+}
+
+func TestMagicLoginExpiredToken(t *testing.T) {
+	store := &magicLinkStore{email: "jd@m.ca", links: map[string]magicLink{}}
+	store.links[hashCode("expired")] = magicLink{42, time.Now().Add(-time.Second)}
+
+	if _, err := auth.MagicLogin(store, "expired"); err != InvalidMagicLinkErr {
+		t.Fatalf("Expected %v; Got %v", InvalidMagicLinkErr, err)
+	}
+}
@@ -0,0 +1,112 @@
+package authentication
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const passwordResetTTL = time.Hour
+
+var (
+	InvalidResetTokenErr = errors.New("authentication: password reset token is invalid, expired or already used.")
+	NoPasswordErr        = errors.New("authentication: user doesn't have a password.")
+)
+
+type PasswordResetStore interface {
+	// Takes an email and returns the ID of the user that signed up with it
+	GetUserID(string) (int, error)
+	// Takes the hash of a reset token, the user ID and the expiry time and
+	// saves the token
+	CreatePasswordReset(string, int, time.Time) error
+	// Takes the hash of a reset token, deletes it and returns the user ID
+	// and expiry time it was saved with
+	TakePasswordReset(string) (int, time.Time, error)
+	// Takes a user ID, a password hash and a time, sets the user's password
+	// and revokes the user's tokens issued before the time and other reset
+	// tokens
+	ResetPassword(int, string, time.Time) error
+}
+
+type PasswordChangeStore interface {
+	// Takes a user ID and returns their password hash, or "" if they don't
+	// have a password
+	GetPasswordHash(int) (string, error)
+	// Takes a user ID, their current password hash, a new one and a time,
+	// replaces the hash and revokes the user's tokens issued before the
+	// time. Returns sql.ErrNoRows if the hash changed in the meantime.
+	ChangePassword(int, string, string, time.Time) error
+}
+
+// Returns a single-use token that lets the holder set a new password for the
+// user with the email. Only the token's hash is stored. Returns
+// sql.ErrNoRows if no user has the email.
+func (a *Authenticator) ForgotPassword(store PasswordResetStore, email string) (string, error) {
+	userID, err := store.GetUserID(email)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	if err := store.CreatePasswordReset(hashCode(token), userID, time.Now().Add(passwordResetTTL)); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Sets a new password for the user the reset token was issued for. The
+// user's existing tokens stop working.
+func (a *Authenticator) ResetPassword(store PasswordResetStore, token, password string) error {
+	userID, expiresAt, err := store.TakePasswordReset(hashCode(token))
+	if err == sql.ErrNoRows {
+		return InvalidResetTokenErr
+	} else if err != nil {
+		return err
+	}
+
+	if time.Now().After(expiresAt) {
+		return InvalidResetTokenErr
+	}
+
+	hashedPassword, err := a.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	return store.ResetPassword(userID, hashedPassword, time.Now())
+}
+
+// Sets a new password for the user if the current one is right. The user's
+// existing tokens stop working, so a new one is returned.
+func (a *Authenticator) ChangePassword(store PasswordChangeStore, userID int, current, password string) (*Token, error) {
+	hash, err := store.GetPasswordHash(userID)
+	if err != nil {
+		return nil, err
+	}
+	if hash == "" {
+		return nil, NoPasswordErr
+	}
+
+	if err := a.Hasher.Verify(hash, current); err != nil {
+		return nil, err
+	}
+
+	newHash, err := a.Hasher.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+
+	// Another change won the race
+	if err := store.ChangePassword(userID, hash, newHash, time.Now()); err == sql.ErrNoRows {
+		return nil, IncorrectPasswordErr
+	} else if err != nil {
+		return nil, err
+	}
+
+	return a.generateToken(userID)
+}
@@ -0,0 +1,161 @@
+package authentication
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+type passwordReset struct {
+	userID    int
+	expiresAt time.Time
+}
+
+// An in-memory store with a single user
+type passwordStore struct {
+	email      string
+	password   string
+	validSince time.Time
+	resets     map[string]passwordReset
+}
+
+func (s *passwordStore) GetUserID(email string) (int, error) {
+	if email != s.email {
+		return 0, sql.ErrNoRows
+	}
+	return 42, nil
+}
+
+func (s *passwordStore) CreatePasswordReset(hash string, userID int, expiresAt time.Time) error {
+	s.resets[hash] = passwordReset{userID, expiresAt}
+	return nil
+}
+
+func (s *passwordStore) TakePasswordReset(hash string) (int, time.Time, error) {
+	reset, ok := s.resets[hash]
+	if !ok {
+		return 0, time.Time{}, sql.ErrNoRows
+	}
+	delete(s.resets, hash)
+	return reset.userID, reset.expiresAt, nil
+}
+
+func (s *passwordStore) ResetPassword(userID int, password string, validSince time.Time) error {
+	s.password = password
+	s.validSince = validSince
+	s.resets = map[string]passwordReset{}
+	return nil
+}
+
+func (s *passwordStore) GetPasswordHash(userID int) (string, error) {
+	return s.password, nil
+}
+
+func (s *passwordStore) ChangePassword(userID int, oldHash, newHash string, validSince time.Time) error {
+	if s.password != oldHash {
+		return sql.ErrNoRows
+	}
+	s.password = newHash
+	s.validSince = validSince
+	return nil
+}
+
+func (s *passwordStore) GetTokensValidSince(userID int) (time.Time, error) {
+	return s.validSince, nil
+}
+
+func TestResetPassword(t *testing.T) {
+	store := &passwordStore{email: "jd@m.ca", resets: map[string]passwordReset{}}
+
+	before, err := auth.generateToken(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Verify(store, before.Subject); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := auth.ForgotPassword(store, "jd@m.ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.resets[token]; ok {
+		t.Fatal("Expected the reset token to be stored hashed")
+	}
+
+	if err := auth.ResetPassword(store, token, "new password"); err != nil {
+		t.Fatal(err)
+	}
+	if store.password == "" || store.password == "new password" {
+		t.Fatalf("Expected the new password to be hashed; Got %q", store.password)
+	}
+
+	// Tokens issued before the reset are revoked
+	if _, err := auth.Verify(store, before.Subject); err != RevokedTokenErr {
+		t.Fatalf("Expected %v; Got %v", RevokedTokenErr, err)
+	}
+
+	after, err := auth.generateToken(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := auth.Verify(store, after.Subject); err != nil || id != 42 {
+		t.Fatalf("Expected a token for user 42; Got %d, %v", id, err)
+	}
+
+	// Reset tokens are single-use
+	if err := auth.ResetPassword(store, token, "another password"); err != InvalidResetTokenErr {
+		t.Fatalf("Expected %v; Got %v", InvalidResetTokenErr, err)
+	}
+}
+
+func TestForgotPasswordUnknownEmail(t *testing.T) {
+	store := &passwordStore{email: "jd@m.ca", resets: map[string]passwordReset{}}
+
+	if _, err := auth.ForgotPassword(store, "unknown@m.ca"); err != sql.ErrNoRows {
+		t.Fatalf("Expected %v; Got %v", sql.ErrNoRows, err)
+	}
+}
+
+func TestResetPasswordExpiredToken(t *testing.T) {
+	store := &passwordStore{email: "jd@m.ca", resets: map[string]passwordReset{}}
+	store.resets[hashCode("expired")] = passwordReset{42, time.Now().Add(-time.Second)}
+
+	if err := auth.ResetPassword(store, "expired", "new password"); err != InvalidResetTokenErr {
+		t.Fatalf("Expected %v; Got %v", InvalidResetTokenErr, err)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	store := &passwordStore{email: "jd@m.ca"}
+
+	if _, err := auth.ChangePassword(store, 42, "", "new password"); err != NoPasswordErr {
+		t.Fatalf("Expected %v; Got %v", NoPasswordErr, err)
+	}
+
+	store.password, _ = auth.Hasher.Hash("old password")
+	before, err := auth.generateToken(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := auth.ChangePassword(store, 42, "wrong password", "new password"); err != IncorrectPasswordErr {
+		t.Fatalf("Expected %v; Got %v", IncorrectPasswordErr, err)
+	}
+
+	token, err := auth.ChangePassword(store, 42, "old password", "new password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.Hasher.Verify(store.password, "new password"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the token issued with the change still works
+	if _, err := auth.Verify(store, before.Subject); err != RevokedTokenErr {
+		t.Fatalf("Expected %v; Got %v", RevokedTokenErr, err)
+	}
+	if id, err := auth.Verify(store, token.Subject); err != nil || id != 42 {
+		t.Fatalf("Expected a token for user 42; Got %d, %v", id, err)
+	}
+}
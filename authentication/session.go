@@ -0,0 +1,99 @@
+package authentication
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	SessionCookieName = "ipp_session"
+	CSRFCookieName    = "ipp_csrf"
+	CSRFHeaderName    = "X-CSRF-Token"
+)
+
+var (
+	NoSessionErr         = errors.New("authentication: no session cookie in request.")
+	InvalidCSRFTokenErr  = errors.New("authentication: CSRF token is missing or doesn't match the session.")
+	InvalidExpiryTimeErr = errors.New("authentication: token has an invalid expiry time.")
+)
+
+// Sets the session cookie holding the token and the CSRF cookie the web app
+// echoes back in the X-CSRF-Token header. The session cookie can't be read
+// by JavaScript; the CSRF one has to be.
+func (a *Authenticator) SetSessionCookies(w http.ResponseWriter, token *Token, secure bool) error {
+	expiresAt, err := time.Parse(time.RFC3339, token.ExpiresAt)
+	if err != nil {
+		return InvalidExpiryTimeErr
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    token.Subject,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    a.csrfToken(token.Subject),
+		Path:     "/",
+		Expires:  expiresAt,
+		Secure:   secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return nil
+}
+
+// Expires the session and CSRF cookies
+func ClearSessionCookies(w http.ResponseWriter, secure bool) {
+	for _, name := range []string{SessionCookieName, CSRFCookieName} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: name == SessionCookieName,
+			Secure:   secure,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+}
+
+// Returns the token in the request's session cookie. Requests that change
+// state must also carry a CSRF token in both the CSRF cookie and header
+// (double-submit) that was issued for this session.
+func (a *Authenticator) SessionToken(r *http.Request) (string, error) {
+	session, err := r.Cookie(SessionCookieName)
+	if err != nil || session.Value == "" {
+		return "", NoSessionErr
+	}
+
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return session.Value, nil
+	}
+
+	cookie, err := r.Cookie(CSRFCookieName)
+	if err != nil {
+		return "", InvalidCSRFTokenErr
+	}
+	header := r.Header.Get(CSRFHeaderName)
+
+	expected := a.csrfToken(session.Value)
+	if !hmac.Equal([]byte(header), []byte(cookie.Value)) || !hmac.Equal([]byte(header), []byte(expected)) {
+		return "", InvalidCSRFTokenErr
+	}
+
+	return session.Value, nil
+}
+
+// The CSRF token is derived from the session so a token planted by an
+// attacker (e.g. from a sibling subdomain) won't match
+func (a *Authenticator) csrfToken(session string) string {
+	return base64.RawURLEncoding.EncodeToString(a.sign("csrf", []byte(session)))
+}
@@ -0,0 +1,80 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func sessionCookies(t *testing.T) []*http.Cookie {
+	token, err := auth.generateToken(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := auth.SetSessionCookies(w, token, true); err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 2 {
+		t.Fatalf("Expected session and CSRF cookies; Got %v", cookies)
+	}
+	if c := cookies[0]; c.Name != SessionCookieName || !c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("Expected an HttpOnly, Secure, SameSite session cookie; Got %v", c)
+	}
+	if c := cookies[1]; c.Name != CSRFCookieName || c.HttpOnly {
+		t.Fatalf("Expected a CSRF cookie readable by JavaScript; Got %v", c)
+	}
+	return cookies
+}
+
+func TestSessionToken(t *testing.T) {
+	cookies := sessionCookies(t)
+
+	r, _ := http.NewRequest("GET", "/current", nil)
+	if _, err := auth.SessionToken(r); err != NoSessionErr {
+		t.Fatalf("Expected %v; Got %v", NoSessionErr, err)
+	}
+
+	// Safe methods don't need a CSRF token
+	r.AddCookie(cookies[0])
+	token, err := auth.SessionToken(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := auth.Authenticate(token); err != nil || id != 42 {
+		t.Fatalf("Expected the session of user 42; Got %d, %v", id, err)
+	}
+}
+
+func TestSessionTokenRequiresCSRFToken(t *testing.T) {
+	cookies := sessionCookies(t)
+
+	// Missing header
+	r, _ := http.NewRequest("PUT", "/current", nil)
+	r.AddCookie(cookies[0])
+	r.AddCookie(cookies[1])
+	if _, err := auth.SessionToken(r); err != InvalidCSRFTokenErr {
+		t.Fatalf("Expected %v; Got %v", InvalidCSRFTokenErr, err)
+	}
+
+	// Matching cookie and header that weren't issued for the session
+	r, _ = http.NewRequest("PUT", "/current", nil)
+	r.AddCookie(cookies[0])
+	r.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: "planted"})
+	r.Header.Set(CSRFHeaderName, "planted")
+	if _, err := auth.SessionToken(r); err != InvalidCSRFTokenErr {
+		t.Fatalf("Expected %v; Got %v", InvalidCSRFTokenErr, err)
+	}
+
+	// Double-submitted token
+	r, _ = http.NewRequest("PUT", "/current", nil)
+	r.AddCookie(cookies[0])
+	r.AddCookie(cookies[1])
+	r.Header.Set(CSRFHeaderName, cookies[1].Value)
+	if _, err := auth.SessionToken(r); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,84 @@
+package authentication
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mujz/ipp/signing"
+)
+
+var (
+	InvalidSignatureErr  = errors.New("authentication: request signature is invalid.")
+	StaleSignatureErr    = errors.New("authentication: request was signed too long ago or in the future.")
+	ReplayedSignatureErr = errors.New("authentication: signed request was already made.")
+)
+
+type NonceStore interface {
+	// Takes a nonce and how long to remember it, and returns false if it was
+	// already used within that time
+	UseNonce(string, time.Duration) (bool, error)
+}
+
+// Returns the secret that signs requests with the API key instead of sending
+// it. It's derived from the key's hash, so it doesn't have to be stored, but
+// a copy of the database isn't enough to sign requests.
+func (a *Authenticator) SigningSecret(key string) string {
+	return a.signingSecret(hashCode(key))
+}
+
+func (a *Authenticator) signingSecret(hash string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte("signing:" + hash))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the API key that signed the request, like VerifyAPIKey, if the
+// signature is valid, was made within the window and its nonce wasn't used
+// before
+func (a *Authenticator) VerifySignedRequest(store APIKeyStore, nonces NonceStore, r *http.Request, window time.Duration, ip net.IP, origin string) (*APIKey, error) {
+	signature, err := signing.Parse(r.Header.Get("Authorization"))
+	if err != nil {
+		return nil, InvalidSignatureErr
+	}
+
+	keyID, err := strconv.Atoi(signature.KeyID)
+	if err != nil {
+		return nil, InvalidSignatureErr
+	}
+	apiKey, hash, err := store.GetAPIKeyByID(keyID)
+	if err == sql.ErrNoRows {
+		return nil, InvalidSignatureErr
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := signature.Verify(r, a.signingSecret(hash)); err == signing.MismatchErr || err == signing.BodyTooLargeErr {
+		return nil, InvalidSignatureErr
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Only requests signed recently are accepted, and their nonces are
+	// remembered for as long, so each can only be made once
+	if age := time.Since(signature.Timestamp); age > window || age < -window {
+		return nil, StaleSignatureErr
+	}
+	if fresh, err := nonces.UseNonce(signature.KeyID+":"+signature.Nonce, 2*window); err != nil {
+		return nil, err
+	} else if !fresh {
+		return nil, ReplayedSignatureErr
+	}
+
+	if err := apiKey.call(store, ip, origin); err != nil {
+		return nil, err
+	}
+
+	return &apiKey, nil
+}
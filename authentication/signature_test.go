@@ -0,0 +1,74 @@
+package authentication
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mujz/ipp/signing"
+)
+
+// An in-memory store of used nonces
+type nonceStore map[string]bool
+
+func (s nonceStore) UseNonce(nonce string, window time.Duration) (bool, error) {
+	if s[nonce] {
+		return false, nil
+	}
+	s[nonce] = true
+	return true, nil
+}
+
+func signedRequest(t *testing.T, keyID, secret string, at time.Time) *http.Request {
+	r, _ := http.NewRequest("PUT", "/current", strings.NewReader(`{"value":5}`))
+	if err := signing.SignAt(r, keyID, secret, at); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestVerifySignedRequest(t *testing.T) {
+	store, nonces := newAPIKeyStore(), nonceStore{}
+	apiKey := &APIKey{UserID: 42, MaxCalls: 2}
+	key, err := auth.CreateAPIKey(store, apiKey, "Test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, secret, now := strconv.Itoa(apiKey.ID), auth.SigningSecret(key), time.Now()
+
+	r := signedRequest(t, keyID, secret, now)
+	if verified, err := auth.VerifySignedRequest(store, nonces, r, time.Minute, nil, ""); err != nil || verified.UserID != 42 {
+		t.Fatalf("Expected the key of user 42; Got %+v, %v", verified, err)
+	}
+
+	// Each signed request can only be made once
+	replay, _ := http.NewRequest("PUT", "/current", strings.NewReader(`{"value":5}`))
+	replay.Header.Set("Authorization", r.Header.Get("Authorization"))
+	if _, err := auth.VerifySignedRequest(store, nonces, replay, time.Minute, nil, ""); err != ReplayedSignatureErr {
+		t.Fatalf("Expected %v; Got %v", ReplayedSignatureErr, err)
+	}
+
+	// Only recently signed requests are accepted
+	for _, at := range []time.Time{now.Add(-2 * time.Minute), now.Add(2 * time.Minute)} {
+		if _, err := auth.VerifySignedRequest(store, nonces, signedRequest(t, keyID, secret, at), time.Minute, nil, ""); err != StaleSignatureErr {
+			t.Fatalf("Expected %v for a request signed at %s; Got %v", StaleSignatureErr, at, err)
+		}
+	}
+
+	// The key itself, other keys' secrets and unknown keys can't sign
+	for _, c := range [][2]string{{keyID, key}, {keyID, auth.SigningSecret(key + "x")}, {"999", secret}, {"key", secret}} {
+		if _, err := auth.VerifySignedRequest(store, nonces, signedRequest(t, c[0], c[1], now), time.Minute, nil, ""); err != InvalidSignatureErr {
+			t.Fatalf("Expected %v for key %s; Got %v", InvalidSignatureErr, c[0], err)
+		}
+	}
+
+	// Signed requests count toward the key's restrictions like bearer ones
+	if _, err := auth.VerifySignedRequest(store, nonces, signedRequest(t, keyID, secret, now), time.Minute, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.VerifySignedRequest(store, nonces, signedRequest(t, keyID, secret, now), time.Minute, nil, ""); err != APIKeyCallLimitErr {
+		t.Fatalf("Expected %v; Got %v", APIKeyCallLimitErr, err)
+	}
+}
@@ -0,0 +1,149 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	stateCookieName = "ipp_oauth_state"
+	stateTTL        = 10 * time.Minute
+)
+
+var (
+	InvalidStateCookieErr = errors.New("authentication: oauth state cookie is missing, tampered with or expired.")
+	InvalidReturnToErr    = errors.New("authentication: return_to must be a path on the web app.")
+)
+
+// oauthState is what we remember about a login attempt between redirecting
+// the user to the provider and the provider redirecting them back to us. It
+// lives in a signed cookie so the callback can only be completed by the same
+// browser that started the login.
+type oauthState struct {
+	State         string `json:"state"`
+	Verifier      string `json:"verifier"`
+	ReturnTo      string `json:"return_to,omitempty"`
+	Intent        string `json:"intent,omitempty"`
+	CodeChallenge string `json:"code_challenge,omitempty"` // Challenge of the client the login code is bound to
+	ExpiresAt     int64  `json:"exp"`
+}
+
+func newOAuthState(returnTo, intent, codeChallenge string) (*oauthState, error) {
+	state, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauthState{
+		State:         state,
+		Verifier:      verifier,
+		ReturnTo:      returnTo,
+		Intent:        intent,
+		CodeChallenge: codeChallenge,
+		ExpiresAt:     time.Now().Add(stateTTL).Unix(),
+	}, nil
+}
+
+// Returns the PKCE S256 code challenge for the state's verifier
+func (s *oauthState) codeChallenge() string {
+	sum := sha256.Sum256([]byte(s.Verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Sets the signed state cookie. The cookie is scoped to the callback path so
+// it isn't sent along with any other request.
+func (s *oauthState) setCookie(w http.ResponseWriter, a *Authenticator, callbackURL string) error {
+	value, err := a.seal("oauth-state", s)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, stateCookie(callbackURL, value, int(stateTTL.Seconds())))
+	return nil
+}
+
+// Reads and verifies the state cookie, then clears it so it can't be reused.
+func readOAuthState(w http.ResponseWriter, r *http.Request, a *Authenticator, callbackURL string) (*oauthState, error) {
+	cookie, err := r.Cookie(stateCookieName)
+	if err != nil {
+		return nil, InvalidStateCookieErr
+	}
+	http.SetCookie(w, stateCookie(callbackURL, "", -1))
+
+	s := new(oauthState)
+	if err := a.unseal("oauth-state", cookie.Value, s); err != nil {
+		return nil, InvalidStateCookieErr
+	}
+	if time.Now().Unix() > s.ExpiresAt {
+		return nil, InvalidStateCookieErr
+	}
+
+	return s, nil
+}
+
+// Checks that the state sent back by the provider is the one we sent
+func (s *oauthState) matches(state string) bool {
+	return subtle.ConstantTimeCompare([]byte(s.State), []byte(state)) == 1
+}
+
+func stateCookie(callbackURL, value string, maxAge int) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     stateCookieName,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	if u, err := url.Parse(callbackURL); err == nil {
+		if u.Path != "" {
+			cookie.Path = u.Path
+		}
+		cookie.Secure = u.Scheme == "https"
+	}
+
+	return cookie
+}
+
+// Validates a return_to parameter. Only paths on the web app are allowed so
+// the login flow can't be used as an open redirect.
+func validateReturnTo(returnTo string) (string, error) {
+	if returnTo == "" {
+		return "", nil
+	}
+
+	if !strings.HasPrefix(returnTo, "/") ||
+		strings.HasPrefix(returnTo, "//") ||
+		strings.ContainsAny(returnTo, "\\\r\n") {
+		return "", InvalidReturnToErr
+	}
+
+	u, err := url.Parse(returnTo)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return "", InvalidReturnToErr
+	}
+
+	return u.String(), nil
+}
+
+// Returns a URL safe random string made of n random bytes
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,326 @@
+package authentication
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	TwoFactorChallengeType = "2fa_challenge"
+
+	totpIssuer   = "i++"
+	totpPeriod   = 30 // seconds
+	totpDigits   = 6
+	totpSkew     = 1 // Accept codes this many periods early or late
+	challengeTTL = 5 * time.Minute
+
+	recoveryCodeCount = 10
+)
+
+var (
+	totpCodeRegexp = regexp.MustCompile("^[0-9]{6}$")
+	base32NoPad    = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+var (
+	TwoFactorEnabledErr          = errors.New("authentication: two-factor authentication is already enabled.")
+	TwoFactorNotEnrolledErr      = errors.New("authentication: two-factor authentication wasn't set up.")
+	InvalidTwoFactorCodeErr      = errors.New("authentication: two-factor code is invalid or was already used.")
+	InvalidTwoFactorChallengeErr = errors.New("authentication: two-factor challenge is invalid or expired.")
+	InvalidCiphertextErr         = errors.New("authentication: encrypted value is malformed or was tampered with.")
+)
+
+type TwoFactorChecker interface {
+	// Takes a user ID and returns whether the user enabled two-factor
+	// authentication
+	HasTwoFactor(int) (bool, error)
+}
+
+type TwoFactorStore interface {
+	TwoFactorChecker
+	// Takes a user ID and an encrypted TOTP secret and saves it unconfirmed,
+	// replacing any other unconfirmed secret
+	CreateTwoFactor(int, string) error
+	// Takes a user ID and returns the encrypted secret, whether it was
+	// confirmed and the last time step a code was used for
+	GetTwoFactor(int) (string, bool, int64, error)
+	// Takes a user ID and a time step and records that a code was used for
+	// it. Returns sql.ErrNoRows if a code was used for it or a later one.
+	UseTwoFactorStep(int, int64) error
+	// Takes a user ID and the hashes of recovery codes, confirms the secret
+	// and replaces the user's recovery codes
+	ConfirmTwoFactor(int, []string) error
+	// Takes a user ID and the hash of a recovery code and marks the code
+	// used. Returns sql.ErrNoRows if the user has no such unused code.
+	UseRecoveryCode(int, string) error
+	// Takes a user ID and deletes their secret and recovery codes
+	DeleteTwoFactor(int) error
+}
+
+type twoFactorChallenge struct {
+	UserID    int   `json:"sub"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+// Starts enrolling the user in two-factor authentication. Returns the new
+// secret and the otpauth:// URI authenticator apps read from a QR code.
+func (a *Authenticator) EnrollTwoFactor(store TwoFactorStore, userID int, email string) (string, string, error) {
+	if _, confirmed, _, err := store.GetTwoFactor(userID); err == nil && confirmed {
+		return "", "", TwoFactorEnabledErr
+	} else if err != nil && err != sql.ErrNoRows {
+		return "", "", err
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", "", err
+	}
+	secret := base32NoPad.EncodeToString(key)
+
+	encrypted, err := a.encrypt("totp", []byte(secret))
+	if err != nil {
+		return "", "", err
+	}
+	if err := store.CreateTwoFactor(userID, encrypted); err != nil {
+		return "", "", err
+	}
+
+	uri := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + totpIssuer + ":" + email,
+		RawQuery: url.Values{
+			"secret":    {secret},
+			"issuer":    {totpIssuer},
+			"algorithm": {"SHA1"},
+			"digits":    {fmt.Sprint(totpDigits)},
+			"period":    {fmt.Sprint(totpPeriod)},
+		}.Encode(),
+	}
+	return secret, uri.String(), nil
+}
+
+// Turns on two-factor authentication once the user proves their
+// authenticator works. Returns one-time recovery codes; only their hashes
+// are stored.
+func (a *Authenticator) ConfirmTwoFactor(store TwoFactorStore, userID int, code string) ([]string, error) {
+	encrypted, confirmed, lastStep, err := store.GetTwoFactor(userID)
+	if err == sql.ErrNoRows {
+		return nil, TwoFactorNotEnrolledErr
+	} else if err != nil {
+		return nil, err
+	} else if confirmed {
+		return nil, TwoFactorEnabledErr
+	}
+
+	if err := a.verifyTOTP(store, userID, encrypted, lastStep, code); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32NoPad.EncodeToString(b))
+		codes[i] = code[:8] + "-" + code[8:]
+		hashes[i] = hashCode(normalizeRecoveryCode(codes[i]))
+	}
+
+	if err := store.ConfirmTwoFactor(userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Turns off two-factor authentication. The user has to provide a code from
+// their authenticator or a recovery code.
+func (a *Authenticator) DisableTwoFactor(store TwoFactorStore, userID int, code string) error {
+	if err := a.verifySecondFactor(store, userID, code); err != nil {
+		return err
+	}
+	return store.DeleteTwoFactor(userID)
+}
+
+// Exchanges a challenge returned at login and a code from the user's
+// authenticator, or a recovery code, for a token
+func (a *Authenticator) LoginTwoFactor(store TwoFactorStore, challenge, code string) (*Token, error) {
+	userID, err := a.TwoFactorChallengeUser(challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.verifySecondFactor(store, userID, code); err != nil {
+		return nil, err
+	}
+
+	return a.generateToken(userID)
+}
+
+// Returns the ID of the user a challenge returned at login belongs to
+func (a *Authenticator) TwoFactorChallengeUser(challenge string) (int, error) {
+	c := new(twoFactorChallenge)
+	if err := a.unseal("2fa-challenge", challenge, c); err != nil || time.Now().Unix() > c.ExpiresAt {
+		return 0, InvalidTwoFactorChallengeErr
+	}
+	return c.UserID, nil
+}
+
+// Returns a token for the user, or a challenge if the user has to provide
+// their second factor first
+func (a *Authenticator) tokenOrChallenge(store TwoFactorChecker, userID int) (*Token, error) {
+	enabled, err := store.HasTwoFactor(userID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return a.twoFactorChallenge(userID)
+	}
+	return a.generateToken(userID)
+}
+
+// Returns a short-lived token that proves the user logged in with their
+// first factor. Its type is TwoFactorChallengeType.
+func (a *Authenticator) twoFactorChallenge(userID int) (*Token, error) {
+	expiresAt := time.Now().Add(challengeTTL)
+
+	challenge, err := a.seal("2fa-challenge", &twoFactorChallenge{userID, expiresAt.Unix()})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		Subject:   challenge,
+		ExpiresAt: expiresAt.Format(time.RFC3339),
+		expiresAt: expiresAt,
+		Type:      TwoFactorChallengeType,
+	}, nil
+}
+
+// Verifies a code from the user's authenticator or one of their recovery
+// codes
+func (a *Authenticator) verifySecondFactor(store TwoFactorStore, userID int, code string) error {
+	encrypted, confirmed, lastStep, err := store.GetTwoFactor(userID)
+	if err == sql.ErrNoRows {
+		return TwoFactorNotEnrolledErr
+	} else if err != nil {
+		return err
+	} else if !confirmed {
+		return TwoFactorNotEnrolledErr
+	}
+
+	code = strings.TrimSpace(code)
+	if totpCodeRegexp.MatchString(code) {
+		return a.verifyTOTP(store, userID, encrypted, lastStep, code)
+	}
+
+	if err := store.UseRecoveryCode(userID, hashCode(normalizeRecoveryCode(code))); err == sql.ErrNoRows {
+		return InvalidTwoFactorCodeErr
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Verifies a TOTP code and records its time step so it can't be replayed
+func (a *Authenticator) verifyTOTP(store TwoFactorStore, userID int, encrypted string, lastStep int64, code string) error {
+	secret, err := a.decrypt("totp", encrypted)
+	if err != nil {
+		return err
+	}
+	key, err := base32NoPad.DecodeString(string(secret))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastStep || !hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			continue
+		}
+
+		if err := store.UseTwoFactorStep(userID, step); err == sql.ErrNoRows {
+			return InvalidTwoFactorCodeErr
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	return InvalidTwoFactorCodeErr
+}
+
+// Returns the RFC 6238 code for the time step
+func totpCode(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.Replace(strings.ToLower(strings.TrimSpace(code)), "-", "", -1)
+}
+
+// Encrypts plaintext with a key derived from the secret key for the purpose
+func (a *Authenticator) encrypt(purpose string, plaintext []byte) (string, error) {
+	gcm, err := a.cipher(purpose)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+// Decrypts a value produced by encrypt for the same purpose
+func (a *Authenticator) decrypt(purpose, ciphertext string) ([]byte, error) {
+	gcm, err := a.cipher(purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(ciphertext)
+	if err != nil || len(b) < gcm.NonceSize() {
+		return nil, InvalidCiphertextErr
+	}
+
+	plaintext, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, InvalidCiphertextErr
+	}
+	return plaintext, nil
+}
+
+func (a *Authenticator) cipher(purpose string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(a.sign("encryption-key", []byte(purpose)))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
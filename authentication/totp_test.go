@@ -0,0 +1,177 @@
+package authentication
+
+import (
+	"database/sql"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// An in-memory store with a single user
+type twoFactorStore struct {
+	secret    string
+	confirmed bool
+	lastStep  int64
+	recovery  map[string]bool
+}
+
+func (s *twoFactorStore) HasTwoFactor(userID int) (bool, error) {
+	return s.confirmed, nil
+}
+
+func (s *twoFactorStore) CreateTwoFactor(userID int, secret string) error {
+	s.secret, s.lastStep = secret, 0
+	return nil
+}
+
+func (s *twoFactorStore) GetTwoFactor(userID int) (string, bool, int64, error) {
+	if s.secret == "" {
+		return "", false, 0, sql.ErrNoRows
+	}
+	return s.secret, s.confirmed, s.lastStep, nil
+}
+
+func (s *twoFactorStore) UseTwoFactorStep(userID int, step int64) error {
+	if step <= s.lastStep {
+		return sql.ErrNoRows
+	}
+	s.lastStep = step
+	return nil
+}
+
+func (s *twoFactorStore) ConfirmTwoFactor(userID int, hashes []string) error {
+	s.confirmed = true
+	s.recovery = map[string]bool{}
+	for _, hash := range hashes {
+		s.recovery[hash] = true
+	}
+	return nil
+}
+
+func (s *twoFactorStore) UseRecoveryCode(userID int, hash string) error {
+	if !s.recovery[hash] {
+		return sql.ErrNoRows
+	}
+	delete(s.recovery, hash)
+	return nil
+}
+
+func (s *twoFactorStore) DeleteTwoFactor(userID int) error {
+	*s = twoFactorStore{}
+	return nil
+}
+
+func TestTOTPCode(t *testing.T) {
+	// SHA1 test vectors from RFC 6238, truncated to 6 digits
+	key := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		2000000000: "279037",
+	}
+
+	for unix, expected := range vectors {
+		if code := totpCode(key, unix/totpPeriod); code != expected {
+			t.Errorf("Expected code %s at %d; Got %s", expected, unix, code)
+		}
+	}
+}
+
+// Returns the code the user's authenticator shows now
+func currentCode(t *testing.T, secret string) string {
+	key, err := base32NoPad.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, time.Now().Unix()/totpPeriod)
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	store := &twoFactorStore{}
+
+	/* Enrolling */
+	secret, uri, err := auth.EnrollTwoFactor(store, 42, "jd@m.ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.secret == secret {
+		t.Fatal("Expected the secret to be stored encrypted")
+	}
+	if u, err := url.Parse(uri); err != nil || u.Scheme != "otpauth" || u.Query().Get("secret") != secret {
+		t.Fatalf("Expected an otpauth URI with the secret; Got %s", uri)
+	}
+
+	// Nothing changes until the user confirms
+	if token, err := auth.tokenOrChallenge(store, 42); err != nil || token.Type == TwoFactorChallengeType {
+		t.Fatalf("Expected a token; Got %+v, %v", token, err)
+	}
+
+	if _, err := auth.ConfirmTwoFactor(store, 42, "000000"); err != InvalidTwoFactorCodeErr && currentCode(t, secret) != "000000" {
+		t.Fatalf("Expected %v; Got %v", InvalidTwoFactorCodeErr, err)
+	}
+
+	codes, err := auth.ConfirmTwoFactor(store, 42, currentCode(t, secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes; Got %v", recoveryCodeCount, codes)
+	}
+
+	if _, _, err := auth.EnrollTwoFactor(store, 42, "jd@m.ca"); err != TwoFactorEnabledErr {
+		t.Fatalf("Expected %v; Got %v", TwoFactorEnabledErr, err)
+	}
+
+	/* Logging in */
+	challenge, err := auth.tokenOrChallenge(store, 42)
+	if err != nil || challenge.Type != TwoFactorChallengeType {
+		t.Fatalf("Expected a challenge; Got %+v, %v", challenge, err)
+	}
+	if _, err := auth.Authenticate(challenge.Subject); err == nil {
+		t.Fatal("Expected the challenge not to authenticate")
+	}
+
+	// The code used to confirm can't be replayed
+	if _, err := auth.LoginTwoFactor(store, challenge.Subject, currentCode(t, secret)); err != InvalidTwoFactorCodeErr {
+		t.Fatalf("Expected %v; Got %v", InvalidTwoFactorCodeErr, err)
+	}
+
+	// Recovery codes work once
+	token, err := auth.LoginTwoFactor(store, challenge.Subject, codes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := auth.Authenticate(token.Subject); err != nil || id != 42 {
+		t.Fatalf("Expected a token for user 42; Got %d, %v", id, err)
+	}
+	if _, err := auth.LoginTwoFactor(store, challenge.Subject, codes[0]); err != InvalidTwoFactorCodeErr {
+		t.Fatalf("Expected %v; Got %v", InvalidTwoFactorCodeErr, err)
+	}
+
+	if _, err := auth.LoginTwoFactor(store, "forged.challenge", codes[1]); err != InvalidTwoFactorChallengeErr {
+		t.Fatalf("Expected %v; Got %v", InvalidTwoFactorChallengeErr, err)
+	}
+
+	/* Disabling */
+	if err := auth.DisableTwoFactor(store, 42, codes[1]); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, _ := store.HasTwoFactor(42); enabled {
+		t.Fatal("Expected two-factor authentication to be disabled")
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	ciphertext, err := auth.encrypt("test", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plaintext, err := auth.decrypt("test", ciphertext); err != nil || string(plaintext) != "secret" {
+		t.Fatalf("Expected secret; Got %q, %v", plaintext, err)
+	}
+
+	if _, err := auth.decrypt("other", ciphertext); err != InvalidCiphertextErr {
+		t.Fatalf("Expected %v; Got %v", InvalidCiphertextErr, err)
+	}
+}
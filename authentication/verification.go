@@ -0,0 +1,80 @@
+package authentication
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	emailVerificationTTL = 24 * time.Hour
+	// How long users have to wait before asking for another email
+	emailVerificationInterval = time.Minute
+)
+
+var (
+	InvalidVerificationTokenErr = errors.New("authentication: email verification token is invalid, expired or already used.")
+	VerificationThrottledErr    = errors.New("authentication: a verification email was sent too recently.")
+)
+
+type EmailVerificationStore interface {
+	// Takes the hash of a verification token, the user ID, the email being
+	// verified and the expiry time and saves the token
+	CreateEmailVerification(string, int, string, time.Time) error
+	// Takes a user ID and email and returns when the last verification
+	// token was created for them, or the zero time if none was
+	GetEmailVerificationSentAt(int, string) (time.Time, error)
+	// Takes the hash of a verification token, deletes it and returns the
+	// user ID, email and expiry time it was saved with
+	TakeEmailVerification(string) (int, string, time.Time, error)
+	// Takes a user ID and email and marks the email verified if it's still
+	// the user's email. Returns sql.ErrNoRows if it isn't.
+	VerifyEmail(int, string) error
+}
+
+// Returns a single-use token that proves the holder owns the email when it's
+// sent back. Only the token's hash is stored. Returns VerificationThrottledErr
+// if the user was sent one for the email less than a minute ago.
+func (a *Authenticator) EmailVerificationToken(store EmailVerificationStore, userID int, email string) (string, error) {
+	sentAt, err := store.GetEmailVerificationSentAt(userID, email)
+	if err != nil {
+		return "", err
+	}
+	if time.Since(sentAt) < emailVerificationInterval {
+		return "", VerificationThrottledErr
+	}
+
+	token, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	if err := store.CreateEmailVerification(hashCode(token), userID, email, time.Now().Add(emailVerificationTTL)); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Marks the email the token was issued for verified and returns its user's ID
+func (a *Authenticator) VerifyEmail(store EmailVerificationStore, token string) (int, error) {
+	userID, email, expiresAt, err := store.TakeEmailVerification(hashCode(token))
+	if err == sql.ErrNoRows {
+		return 0, InvalidVerificationTokenErr
+	} else if err != nil {
+		return 0, err
+	}
+
+	if time.Now().After(expiresAt) {
+		return 0, InvalidVerificationTokenErr
+	}
+
+	// The user changed their email since the token was sent
+	if err := store.VerifyEmail(userID, email); err == sql.ErrNoRows {
+		return 0, InvalidVerificationTokenErr
+	} else if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
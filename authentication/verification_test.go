@@ -0,0 +1,97 @@
+package authentication
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+type emailVerification struct {
+	userID    int
+	email     string
+	expiresAt time.Time
+}
+
+// An in-memory store with a single user
+type verificationStore struct {
+	email         string
+	verified      bool
+	sentAt        map[string]time.Time
+	verifications map[string]emailVerification
+}
+
+func (s *verificationStore) CreateEmailVerification(hash string, userID int, email string, expiresAt time.Time) error {
+	s.sentAt[email] = time.Now()
+	s.verifications[hash] = emailVerification{userID, email, expiresAt}
+	return nil
+}
+
+func (s *verificationStore) GetEmailVerificationSentAt(userID int, email string) (time.Time, error) {
+	return s.sentAt[email], nil
+}
+
+func (s *verificationStore) TakeEmailVerification(hash string) (int, string, time.Time, error) {
+	v, ok := s.verifications[hash]
+	if !ok {
+		return 0, "", time.Time{}, sql.ErrNoRows
+	}
+	delete(s.verifications, hash)
+	return v.userID, v.email, v.expiresAt, nil
+}
+
+func (s *verificationStore) VerifyEmail(userID int, email string) error {
+	if email != s.email {
+		return sql.ErrNoRows
+	}
+	s.verified = true
+	return nil
+}
+
+func TestVerifyEmail(t *testing.T) {
+	store := &verificationStore{email: "jd@m.ca", sentAt: map[string]time.Time{}, verifications: map[string]emailVerification{}}
+
+	token, err := auth.EmailVerificationToken(store, 42, "jd@m.ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.verifications[token]; ok {
+		t.Fatal("Expected the verification token to be stored hashed")
+	}
+
+	// Resending right away is throttled
+	if _, err := auth.EmailVerificationToken(store, 42, "jd@m.ca"); err != VerificationThrottledErr {
+		t.Fatalf("Expected %v; Got %v", VerificationThrottledErr, err)
+	}
+
+	// But not for another email
+	if _, err := auth.EmailVerificationToken(store, 42, "new@m.ca"); err != nil {
+		t.Fatal(err)
+	}
+
+	if id, err := auth.VerifyEmail(store, token); err != nil || id != 42 || !store.verified {
+		t.Fatalf("Expected user 42's email to be verified; Got %d, %v", id, err)
+	}
+
+	// Verification tokens are single-use
+	if _, err := auth.VerifyEmail(store, token); err != InvalidVerificationTokenErr {
+		t.Fatalf("Expected %v; Got %v", InvalidVerificationTokenErr, err)
+	}
+}
+
+func TestVerifyChangedEmail(t *testing.T) {
+	store := &verificationStore{email: "new@m.ca", verifications: map[string]emailVerification{}}
+	store.verifications[hashCode("old")] = emailVerification{42, "jd@m.ca", time.Now().Add(time.Hour)}
+
+	if _, err := auth.VerifyEmail(store, "old"); err != InvalidVerificationTokenErr || store.verified {
+		t.Fatalf("Expected %v; Got %v", InvalidVerificationTokenErr, err)
+	}
+}
+
+func TestVerifyEmailExpiredToken(t *testing.T) {
+	store := &verificationStore{email: "jd@m.ca", verifications: map[string]emailVerification{}}
+	store.verifications[hashCode("expired")] = emailVerification{42, "jd@m.ca", time.Now().Add(-time.Second)}
+
+	if _, err := auth.VerifyEmail(store, "expired"); err != InvalidVerificationTokenErr {
+		t.Fatalf("Expected %v; Got %v", InvalidVerificationTokenErr, err)
+	}
+}
@@ -3,14 +3,16 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 var (
 	// Server vars
-	Port    = os.Getenv("PORT")
-	BaseURL = os.Getenv("BASE_URL")
-	WebURL  = os.Getenv("WEB_URL")
+	Port          = os.Getenv("PORT")
+	BaseURL       = os.Getenv("BASE_URL")
+	WebURL        = os.Getenv("WEB_URL")
+	SecureCookies bool
 
 	// Database vars
 	DBName     = os.Getenv("DB_NAME")
@@ -24,9 +26,66 @@ var (
 	FBAppID     = os.Getenv("FB_APP_ID")
 	FBAppSecret = os.Getenv("FB_APP_SECRET")
 
+	// Mail vars
+	Mailer       = os.Getenv("MAILER") // smtp, file or stdout
+	MailFrom     = os.Getenv("MAIL_FROM")
+	MailFile     = os.Getenv("MAIL_FILE")
+	SMTPAddr     = os.Getenv("SMTP_ADDR")
+	SMTPUsername = os.Getenv("SMTP_USERNAME")
+	SMTPPassword = os.Getenv("SMTP_PASSWORD")
+
+	// Email verification vars
+	UnverifiedAccess      = os.Getenv("UNVERIFIED_ACCESS") // full, read-only or limited
+	UnverifiedNumberLimit int                              // How far unverified users can count with limited access
+
+	// Password policy vars
+	PasswordMinLength    int
+	PasswordMaxLength    int
+	PasswordMinStrength  int                                   // 0 (anything goes) to 4
+	BreachedPasswordsDir = os.Getenv("BREACHED_PASSWORDS_DIR") // Files of breached SHA-1s by prefix, e.g. 5BAA6.txt
+
+	// Password hashing vars
+	PasswordHash       = os.Getenv("PASSWORD_HASH") // argon2id or bcrypt
+	BcryptCost         int
+	Argon2Time         int
+	Argon2Memory       int // In KiB
+	Argon2Threads      int
+	PasswordPepper     = []byte(os.Getenv("PASSWORD_PEPPER")) // Optional; mixed into argon2id hashes
+	PasswordOldPeppers [][]byte                               // Comma-separated PASSWORD_OLD_PEPPERS still accepted until passwords are rehashed
+
+	// Rate limiting vars
+	RateLimitStore = os.Getenv("RATE_LIMIT_STORE")      // memory, or postgres to share limits between replicas
+	TrustProxy     = os.Getenv("TRUST_PROXY") == "true" // Take the client's IP from X-Forwarded-For
+	TrustedProxies []string                             // Comma-separated TRUSTED_PROXIES CIDRs whose X-Forwarded-For entries are believed too
+
+	// Signup vars
+	SignupMode            = os.Getenv("SIGNUP_MODE")             // open, invite (only with an invite code) or closed
+	SignupAllowedDomains  []string                               // Comma-separated SIGNUP_ALLOWED_DOMAINS; any domain if empty
+	DisposableDomainsFile = os.Getenv("DISPOSABLE_DOMAINS_FILE") // Domains to reject, one per line, e.g. disposable_domains.txt
+
+	// Trial vars
+	TrialLifetime time.Duration // How long trial accounts last unless they're converted
+	TrialsPerIP   int           // How many trials a client can start a day; 0 turns trials off
+
+	// Respond the same whether or not an email is registered, so nobody can
+	// find out who has an account
+	EnumerationProtection = os.Getenv("ENUMERATION_PROTECTION") == "true"
+
+	// How long deleted accounts can be restored before they're deleted for good
+	AccountDeletionGracePeriod time.Duration
+
+	// Development vars
+	MockIdP = os.Getenv("MOCK_IDP") == "true" // Log in with a mock provider instead of Facebook
+
 	// Authentication vars
 	AuthSecretKey               = []byte(os.Getenv("SECRET_KEY"))
 	AuthTokenExpirationInterval time.Duration
+	SignatureWindow             time.Duration                           // How old or far in the future a signed request's timestamp can be
+	QueryAPIKeys                = os.Getenv("QUERY_API_KEYS") == "true" // Accept API keys in the api_key query parameter, only to get and count
+
+	// Introspection vars
+	IntrospectionSecret   = os.Getenv("INTROSPECTION_SECRET") // The API gateway's credential for /oauth/introspect, which is off if it's empty
+	IntrospectionCacheTTL time.Duration                       // How long the gateway may cache that a credential is active
 )
 
 func init() {
@@ -40,6 +99,9 @@ func init() {
 		BaseURL = "http://localhost:8080"
 	}
 
+	// Only send cookies over HTTPS unless we're being served over HTTP
+	SecureCookies = !strings.HasPrefix(BaseURL, "http://")
+
 	if DBName == "" {
 		DBName = "ipp"
 	}
@@ -59,6 +121,106 @@ func init() {
 		DBSSLMode = "disable"
 	}
 
+	if Mailer == "" {
+		Mailer = "stdout"
+	}
+	if MailFrom == "" {
+		MailFrom = "i++ <no-reply@localhost>"
+	}
+	if MailFile == "" {
+		MailFile = "mail.log"
+	}
+
+	if UnverifiedAccess == "" {
+		UnverifiedAccess = "full"
+	}
+	if limit, err := strconv.Atoi(os.Getenv("UNVERIFIED_NUMBER_LIMIT")); err != nil {
+		UnverifiedNumberLimit = 10
+	} else {
+		UnverifiedNumberLimit = limit
+	}
+
+	if length, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err != nil {
+		PasswordMinLength = 8
+	} else {
+		PasswordMinLength = length
+	}
+	if length, err := strconv.Atoi(os.Getenv("PASSWORD_MAX_LENGTH")); err != nil {
+		PasswordMaxLength = 64
+	} else {
+		PasswordMaxLength = length
+	}
+	if strength, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_STRENGTH")); err != nil {
+		PasswordMinStrength = 2
+	} else {
+		PasswordMinStrength = strength
+	}
+
+	if PasswordHash == "" {
+		PasswordHash = "argon2id"
+	}
+	if cost, err := strconv.Atoi(os.Getenv("BCRYPT_COST")); err != nil {
+		BcryptCost = 12
+	} else {
+		BcryptCost = cost
+	}
+	if passes, err := strconv.Atoi(os.Getenv("ARGON2_TIME")); err != nil {
+		Argon2Time = 2
+	} else {
+		Argon2Time = passes
+	}
+	if memory, err := strconv.Atoi(os.Getenv("ARGON2_MEMORY")); err != nil {
+		Argon2Memory = 19 * 1024
+	} else {
+		Argon2Memory = memory
+	}
+	if threads, err := strconv.Atoi(os.Getenv("ARGON2_THREADS")); err != nil {
+		Argon2Threads = 1
+	} else {
+		Argon2Threads = threads
+	}
+	for _, pepper := range strings.Split(os.Getenv("PASSWORD_OLD_PEPPERS"), ",") {
+		if pepper != "" {
+			PasswordOldPeppers = append(PasswordOldPeppers, []byte(pepper))
+		}
+	}
+
+	if SignupMode == "" {
+		SignupMode = "open"
+	}
+	for _, domain := range strings.Split(os.Getenv("SIGNUP_ALLOWED_DOMAINS"), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			SignupAllowedDomains = append(SignupAllowedDomains, domain)
+		}
+	}
+
+	if days, err := strconv.Atoi(os.Getenv("TRIAL_LIFETIME_IN_DAYS")); err != nil {
+		TrialLifetime = 7 * 24 * time.Hour
+	} else {
+		TrialLifetime = time.Duration(days) * 24 * time.Hour
+	}
+	if trials, err := strconv.Atoi(os.Getenv("TRIALS_PER_IP")); err != nil {
+		TrialsPerIP = 5
+	} else {
+		TrialsPerIP = trials
+	}
+
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			TrustedProxies = append(TrustedProxies, proxy)
+		}
+	}
+
+	if RateLimitStore == "" {
+		RateLimitStore = "memory"
+	}
+
+	if days, err := strconv.Atoi(os.Getenv("ACCOUNT_DELETION_GRACE_PERIOD_IN_DAYS")); err != nil {
+		AccountDeletionGracePeriod = 30 * 24 * time.Hour
+	} else {
+		AccountDeletionGracePeriod = time.Duration(days) * 24 * time.Hour
+	}
+
 	if numOfSeconds, err := strconv.Atoi(
 		os.Getenv("AUTH_TOKEN_EXPIRATION_INTERVAL_IN_SECONDS"),
 	); err != nil {
@@ -70,4 +232,16 @@ func init() {
 	if AuthSecretKey == nil {
 		AuthSecretKey = []byte("ipp,secret")
 	}
+
+	if seconds, err := strconv.Atoi(os.Getenv("SIGNATURE_WINDOW_IN_SECONDS")); err != nil {
+		SignatureWindow = 5 * time.Minute
+	} else {
+		SignatureWindow = time.Duration(seconds) * time.Second
+	}
+
+	if seconds, err := strconv.Atoi(os.Getenv("INTROSPECTION_CACHE_TTL_IN_SECONDS")); err != nil {
+		IntrospectionCacheTTL = time.Minute
+	} else {
+		IntrospectionCacheTTL = time.Duration(seconds) * time.Second
+	}
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/handlers"
+	"github.com/mujz/ipp/authentication"
+	"github.com/mujz/ipp/config"
+)
+
+// The query parameter that carries an API key for clients that can't set
+// headers, like webhooks
+const apiKeyParam = "api_key"
+
+// API keys in the query string end up in browser histories and proxy logs,
+// so they can only get and count
+var queryScopes = []string{readScope, nextScope}
+
+// Returns the token or API key the request carries, or "" if it has none so
+// the session cookie can be used, and whether it came in the query string.
+// Clients that can't send a bearer token can send an API key as the Basic
+// auth username or password, in X-API-Key, or in the query string if that's
+// turned on. Responds with 401 and returns false if the credential is
+// malformed.
+func requestCredential(w http.ResponseWriter, r *http.Request) (string, bool, bool) {
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		if username, password, ok := r.BasicAuth(); ok {
+			for _, key := range []string{username, password} {
+				if authentication.IsAPIKey(key) {
+					return key, false, true
+				}
+			}
+			marshalError(w, http.StatusUnauthorized, "Basic auth only takes an API key as the username or password.")
+			return "", false, false
+		}
+
+		// Split the header into "Bearer" and token
+		authHeaderParts := strings.Split(authHeader, " ")
+		if len(authHeaderParts) != 2 || strings.ToLower(authHeaderParts[0]) != "bearer" {
+			marshalError(w, http.StatusUnauthorized, "Invalid authorization header format; it must be Bearer {token}")
+			return "", false, false
+		}
+		return authHeaderParts[1], false, true
+	}
+
+	key, inQuery := r.Header.Get("X-API-Key"), false
+	if key == "" && config.QueryAPIKeys {
+		key, inQuery = r.URL.Query().Get(apiKeyParam), true
+	}
+	if key == "" {
+		return "", false, true
+	}
+	if !authentication.IsAPIKey(key) {
+		marshalError(w, http.StatusUnauthorized, "Only API keys can be sent outside the Authorization header.")
+		return "", false, false
+	}
+	return key, inQuery, true
+}
+
+// Writes an access log line in the Apache Combined Log Format, like
+// handlers.CombinedLoggingHandler, but with API keys in the query string
+// redacted
+func writeAccessLog(w io.Writer, params handlers.LogFormatterParams) {
+	r := params.Request
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	username := "-"
+	if params.URL.User != nil && params.URL.User.Username() != "" {
+		username = params.URL.User.Username()
+	}
+	uri := r.RequestURI
+	if uri == "" {
+		uri = params.URL.RequestURI()
+	}
+
+	fmt.Fprintf(w, "%s - %s [%s] %q %d %d %q %q\n",
+		host, username, params.TimeStamp.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+redactAPIKey(uri)+" "+r.Proto, params.StatusCode, params.Size,
+		r.Referer(), r.UserAgent(),
+	)
+}
+
+// Replaces the API key in the URI's query string, keeping the rest as it was
+func redactAPIKey(uri string) string {
+	parts := strings.SplitN(uri, "?", 2)
+	if len(parts) != 2 {
+		return uri
+	}
+
+	params := strings.Split(parts[1], "&")
+	for i, param := range params {
+		name := strings.SplitN(param, "=", 2)[0]
+		if name, err := url.QueryUnescape(name); err == nil && name == apiKeyParam {
+			params[i] = apiKeyParam + "=REDACTED"
+		}
+	}
+	return parts[0] + "?" + strings.Join(params, "&")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/url"
+	"text/template"
+
+	"github.com/mujz/ipp/config"
+	"github.com/mujz/ipp/mailer"
+)
+
+var unverifiedEmailErr = errors.New("ipp: email address isn't verified.")
+
+var alreadyRegisteredTemplate = template.Must(template.New("registered").Parse(`Hi,
+
+Someone tried to sign up for i++ with this email address, but you already have
+an account. If it was you, you can log in here:
+
+{{ .URL }}
+
+If you forgot your password, you can reset it from the same page. If it wasn't
+you, you can ignore this email.
+`))
+
+// Responds with 401. With enumeration protection, the detail is the same for
+// every reason a login can fail.
+func loginError(w http.ResponseWriter, detail string) {
+	if config.EnumerationProtection {
+		detail = "Email or password is incorrect. If you just signed up, verify your email address first."
+	}
+	marshalError(w, http.StatusUnauthorized, detail)
+}
+
+// With enumeration protection, only users who verified their email can log
+// in with a password. Otherwise signing up and then logging in would tell
+// whether the email was already taken. Unverified users are sent another
+// verification email.
+func checkVerifiedLogin(email string) error {
+	if !config.EnumerationProtection {
+		return nil
+	}
+
+	userID, err := model.GetUserID(email)
+	if err != nil {
+		return err
+	}
+
+	_, verified, err := model.GetEmailVerified(userID)
+	if err != nil {
+		return err
+	}
+	if verified {
+		return nil
+	}
+
+	// Sent in the background so the response takes as long as for a wrong
+	// password
+	inBackground(func() error { return sendVerificationEmail(userID, email) })
+	return unverifiedEmailErr
+}
+
+// Tells the owner of an email that someone tried to sign up with it, instead
+// of telling whoever tried
+func sendAlreadyRegisteredEmail(email string) error {
+	Url, err := url.Parse(config.WebURL)
+	if err != nil {
+		return err
+	}
+	Url.Fragment = "login"
+
+	var body bytes.Buffer
+	if err := alreadyRegisteredTemplate.Execute(&body, struct{ URL string }{Url.String()}); err != nil {
+		return err
+	}
+
+	return mail.Send(&mailer.Message{
+		To:      email,
+		Subject: "You already have an i++ account",
+		Body:    body.String(),
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/mujz/ipp/config"
+)
+
+const facebookProvider = "facebook"
+
+var deletionStatuses = map[string]string{
+	DeletionPending:   "We received your request and are deleting your data.",
+	DeletionCompleted: "Your data has been deleted.",
+	DeletionFailed:    "We couldn't delete your data yet. We'll try again when Facebook resends the request.",
+}
+
+var deletionStatusTemplate = template.Must(template.New("deletion").Parse(`<!doctype html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8">
+    <title>i++ data deletion</title>
+  </head>
+  <body>
+    <h1>Data deletion request {{ .ConfirmationCode }}</h1>
+    <p>{{ .Description }}</p>
+    <p>Requested at {{ .RequestedAt.Format "2006-01-02 15:04 MST" }}. Last updated at {{ .UpdatedAt.Format "2006-01-02 15:04 MST" }}.</p>
+  </body>
+</html>
+`))
+
+type dataDeletionResponse struct {
+	URL              string `json:"url"`
+	ConfirmationCode string `json:"confirmation_code"`
+}
+
+// Facebook calls this when a user removes the app from their account
+func FacebookDeauthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Verify the request came from Facebook
+	request, err := fbAuth.ParseSignedRequest(r.FormValue("signed_request"))
+	if err != nil {
+		marshalError(w, http.StatusBadRequest, "Invalid signed_request.")
+		log.Println(err)
+		return
+	}
+
+	// Unlink Facebook unless it's the only way the user can log in
+	if err := model.DeauthorizeIdentity(facebookProvider, request.UserID); err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to deauthorize user.")
+		log.Println(err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Facebook calls this with POST when a user asks for their data to be
+// deleted. The user is sent to the status URL we return with GET.
+func FacebookDataDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		// Verify the request came from Facebook
+		request, err := fbAuth.ParseSignedRequest(r.FormValue("signed_request"))
+		if err != nil {
+			marshalError(w, http.StatusBadRequest, "Invalid signed_request.")
+			log.Println(err)
+			return
+		}
+
+		// Record the request so the user can follow its progress
+		code, err := confirmationCode()
+		if err == nil {
+			err = model.CreateDeletionRequest(code)
+		}
+		if err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to delete user data.")
+			log.Println(err)
+			return
+		}
+
+		// Delete the user's Facebook data, and the user too if they
+		// can't log in any other way
+		if err := model.DeleteIdentityData(facebookProvider, request.UserID); err != nil {
+			log.Println(err)
+			if err := model.UpdateDeletionRequest(code, DeletionFailed); err != nil {
+				log.Println(err)
+			}
+			marshalError(w, http.StatusInternalServerError, "Failed to delete user data.")
+			return
+		}
+
+		if err := model.UpdateDeletionRequest(code, DeletionCompleted); err != nil {
+			log.Println(err)
+		}
+
+		// Send Facebook the confirmation code and status URL
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&dataDeletionResponse{
+			URL:              config.BaseURL + "/facebook/deletion?code=" + code,
+			ConfirmationCode: code,
+		})
+
+	case "GET":
+		// Get the deletion request
+		deletion, err := model.GetDeletionRequest(r.FormValue("code"))
+		if err == sql.ErrNoRows {
+			NotFoundHandler(w, r)
+			return
+		} else if err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to retrieve deletion request.")
+			log.Println(err)
+			return
+		}
+
+		// Show the status page
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := deletionStatusTemplate.Execute(w, struct {
+			*DeletionRequest
+			Description string
+		}{deletion, deletionStatuses[deletion.Status]}); err != nil {
+			log.Println(err)
+		}
+
+	default:
+		NotFoundHandler(w, r)
+	}
+}
+
+func confirmationCode() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -5,17 +5,22 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
-
-	"golang.org/x/crypto/bcrypt"
+	"sync"
 
 	"github.com/google/jsonapi"
 	"github.com/lib/pq"
 	"github.com/mujz/ipp/authentication"
 	"github.com/mujz/ipp/config"
+	"github.com/mujz/ipp/mailer"
+	"github.com/mujz/ipp/mockidp"
+	"github.com/mujz/ipp/ratelimit"
+	"github.com/mujz/ipp/signing"
 	"github.com/mujz/ipp/validator"
 )
 
@@ -25,9 +30,16 @@ const userIDKey = key(1)
 const userKey = key(2)
 
 var (
-	auth   *authentication.Authenticator
-	fbAuth *authentication.FacebookAuthenticator
-	model  Model
+	auth    *authentication.Authenticator
+	fbAuth  *authentication.FacebookAuthenticator
+	mail    mailer.Mailer
+	mockIdP *mockidp.Provider
+	model   Model
+
+	passwordPolicy *validator.PasswordPolicy
+
+	// Work handlers left running after responding, which tests wait for
+	background sync.WaitGroup
 )
 
 func init() {
@@ -36,6 +48,15 @@ func init() {
 		config.AuthSecretKey,
 		config.AuthTokenExpirationInterval,
 	)
+	auth.Hasher = &authentication.PasswordHasher{
+		Algorithm:     config.PasswordHash,
+		BcryptCost:    config.BcryptCost,
+		Argon2Time:    uint32(config.Argon2Time),
+		Argon2Memory:  uint32(config.Argon2Memory),
+		Argon2Threads: uint8(config.Argon2Threads),
+		Pepper:        config.PasswordPepper,
+		OldPeppers:    config.PasswordOldPeppers,
+	}
 
 	// Initialize the model
 	model = Model{
@@ -51,6 +72,63 @@ func init() {
 		panic(err)
 	}
 
+	// Initialize the mailer
+	switch config.Mailer {
+	case "smtp":
+		mail = mailer.NewSMTPMailer(config.SMTPAddr, config.SMTPUsername, config.SMTPPassword, config.MailFrom)
+	case "file":
+		f, err := os.OpenFile(config.MailFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			panic(err)
+		}
+		mail = mailer.NewWriterMailer(f, config.MailFrom)
+	default:
+		mail = mailer.NewWriterMailer(os.Stdout, config.MailFrom)
+	}
+
+	// Initialize the password policy
+	passwordPolicy = &validator.PasswordPolicy{
+		MinLength:   config.PasswordMinLength,
+		MaxLength:   config.PasswordMaxLength,
+		MinStrength: config.PasswordMinStrength,
+	}
+	if config.PasswordHash == authentication.Bcrypt {
+		// bcrypt ignores anything past 72 bytes
+		passwordPolicy.MaxBytes = 72
+	}
+	if config.BreachedPasswordsDir != "" {
+		passwordPolicy.Breached = validator.BreachedPasswordDir(config.BreachedPasswordsDir)
+	}
+
+	// Initialize the signup controls
+	allowedDomains = validator.NewDomainList(config.SignupAllowedDomains)
+	if config.DisposableDomainsFile != "" {
+		list, err := validator.LoadDomainList(config.DisposableDomainsFile)
+		if err != nil {
+			panic(err)
+		}
+		disposableDomains = list
+	}
+
+	// Initialize the proxies whose X-Forwarded-For entries are believed
+	for _, proxy := range config.TrustedProxies {
+		network, err := validator.ParseCIDR(proxy)
+		if err != nil {
+			panic(err)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+
+	// Initialize the login limiters
+	var failures ratelimit.Store = ratelimit.NewMemoryStore()
+	if config.RateLimitStore == "postgres" {
+		failures = model.LoginFailures()
+	}
+	accountLimiter = ratelimit.New(failures, accountPolicy)
+	ipLimiter = ratelimit.New(failures, ipPolicy)
+	trialLimiter = ratelimit.New(failures, trialPolicy)
+	nonces = nonceStore{failures}
+
 	var Url *url.URL
 	Url, err := url.Parse(config.WebURL)
 	if err != nil {
@@ -67,10 +145,37 @@ func init() {
 		config.BaseURL+"/login/facebook/callback",
 		config.WebURL,
 		Url.String(),
-		nil,
+		[]string{"email"},
 		model,
 		auth,
 	)
+	fbAuth.CheckSignup = checkProviderSignup
+
+	// Swap Facebook for the mock provider in development
+	if config.MockIdP {
+		log.Println("WARNING: MOCK_IDP is enabled. Anyone can log in as anyone with \"Login with Facebook\".")
+		mockIdP = mockidp.New(
+			config.BaseURL+"/mock-idp",
+			fbAuth.ClientID,
+			fbAuth.ClientSecret,
+			fbAuth.RedirectURL,
+			nil,
+		)
+		fbAuth.Endpoint = mockIdP.Endpoint()
+		fbAuth.ProfileURL = mockIdP.UserInfoURL()
+	}
+}
+
+// Runs f after the handler responds and logs its error, so the response
+// doesn't wait for an email to be sent or take longer when one is
+func inBackground(f func() error) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		if err := f(); err != nil {
+			log.Println(err)
+		}
+	}()
 }
 
 func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
@@ -80,12 +185,16 @@ func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
 func CurrentHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
+		if !allowScope(w, r, readScope) {
+			return
+		}
+
 		// Get user ID from context
 		ctx := r.Context()
 		userID := ctx.Value(userIDKey).(int)
 
 		// Get the number
-		number, err := model.GetNumber(userID)
+		number, err := numbers(r).GetNumber(userID)
 		if err != nil {
 			marshalError(w, http.StatusInternalServerError, "Failed to retrieve user's number")
 			log.Println(err)
@@ -96,6 +205,10 @@ func CurrentHandler(w http.ResponseWriter, r *http.Request) {
 		jsonapi.MarshalOnePayload(w, number)
 
 	case "PUT":
+		if !allowScope(w, r, writeScope) {
+			return
+		}
+
 		// Get user ID from context
 		ctx := r.Context()
 		userID := ctx.Value(userIDKey).(int)
@@ -120,8 +233,13 @@ func CurrentHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Unverified users may not be allowed to change it
+		if !allowUnverified(w, userID, newNumber.Value) {
+			return
+		}
+
 		// Update the number
-		number, err := model.UpdateNumber(userID, newNumber.Value)
+		number, err := numbers(r).UpdateNumber(userID, newNumber.Value)
 		if err != nil {
 			marshalError(w, http.StatusInternalServerError, "Failed to update number.")
 			log.Println(err)
@@ -142,12 +260,39 @@ func NextHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !allowScope(w, r, nextScope) {
+		return
+	}
+
 	// Get user ID from context
 	ctx := r.Context()
 	userID := ctx.Value(userIDKey).(int)
 
-	// Increment the number
-	number, err := model.IncrementNumber(userID)
+	// Increment the number. Unverified users may be limited in how far they
+	// can count, which is checked as it's incremented, so parallel requests
+	// can't count past the limit.
+	var (
+		number *Number
+		err    error
+	)
+	switch config.UnverifiedAccess {
+	case limitedAccess:
+		number, err = numbers(r).IncrementNumberUpTo(userID, config.UnverifiedNumberLimit)
+		if err == sql.ErrNoRows {
+			// Only verified users count past the limit
+			if !allowUnverified(w, userID, config.UnverifiedNumberLimit+1) {
+				return
+			}
+			number, err = numbers(r).IncrementNumber(userID)
+		}
+	case readOnlyAccess:
+		if !allowUnverified(w, userID, 0) {
+			return
+		}
+		fallthrough
+	default:
+		number, err = numbers(r).IncrementNumber(userID)
+	}
 	if err != nil {
 		marshalError(w, http.StatusInternalServerError, "Failed to increment number")
 		log.Println(err)
@@ -163,10 +308,34 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user := ctx.Value(userKey).(*User)
 
+	// Use up the invite code if signup is by invitation
+	inviteID, err := useInvite(user.InviteCode)
+	if err == invalidInviteErr {
+		marshalSignupError(w, invalidInviteErr)
+		return
+	} else if err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to create user")
+		log.Println(err)
+		return
+	}
+
 	// Create user
 	token, err := auth.Signup(model, user.Email, user.Password)
 	if err != nil {
+		if err := returnInvite(inviteID); err != nil {
+			log.Println(err)
+		}
+
 		if err, ok := err.(*pq.Error); ok && err.Code.Name() == "unique_violation" {
+			if config.EnumerationProtection {
+				// Respond as if the user was created and tell the email's
+				// owner instead
+				if err := sendAlreadyRegisteredEmail(user.Email); err != nil {
+					log.Println(err)
+				}
+				w.WriteHeader(http.StatusAccepted)
+				return
+			}
 			marshalError(w, http.StatusBadRequest, "Email address taken. Did you mean to log in instead?")
 		} else {
 			marshalError(w, http.StatusInternalServerError, "Failed to create user")
@@ -175,8 +344,23 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Ask the user to verify their email. They can ask for another one if
+	// this fails.
+	if userID, err := model.GetUserID(user.Email); err != nil {
+		log.Println(err)
+	} else if err := sendVerificationEmail(userID, user.Email); err != nil {
+		log.Println(err)
+	}
+
+	// With enumeration protection, the user logs in once they've verified
+	// their email
+	if config.EnumerationProtection {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
 	// Send token to client
-	jsonapi.MarshalOnePayload(w, token)
+	sendToken(w, r, token)
 }
 
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
@@ -184,13 +368,62 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user := ctx.Value(userKey).(*User)
 
+	// Make brute-forcing passwords slow
+	limits := []limit{ipLimit(r), emailLimit(user.Email)}
+	if !allowAttempt(w, limits...) {
+		return
+	}
+
 	// Log user in
 	token, err := auth.Login(model, user.Email, user.Password)
+	if err == nil {
+		err = checkVerifiedLogin(user.Email)
+	}
 	if err != nil {
-		if err == bcrypt.ErrMismatchedHashAndPassword {
-			marshalError(w, http.StatusUnauthorized, "Password is incorrect.")
+		// Wrong credentials stay counted as failures
+		if err == authentication.IncorrectPasswordErr {
+			loginError(w, "Password is incorrect.")
 		} else if err == sql.ErrNoRows {
-			marshalError(w, http.StatusUnauthorized, "Unknown email address. You'll need to sign up first.")
+			loginError(w, "Unknown email address. You'll need to sign up first.")
+		} else if err == unverifiedEmailErr {
+			releaseAttempts(limits...)
+			loginError(w, "Please verify your email address first. We sent you another link.")
+		} else {
+			releaseAttempts(limits...)
+			marshalError(w, http.StatusInternalServerError, "Error logging the user in.")
+			log.Println(err)
+		}
+		return
+	}
+
+	// Forgive the account's failures but not the IP's, or guessing could
+	// go on between logins to an account the client owns
+	releaseAttempts(limits[0])
+	resetAttempts(limits[1])
+
+	// Send token to client
+	sendToken(w, r, token)
+}
+
+func ExchangeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Parse the body's JSON
+	loginCode := new(LoginCode)
+	if err := jsonapi.UnmarshalPayload(r.Body, loginCode); err != nil {
+		marshalError(w, http.StatusBadRequest, "Invalid request body.")
+		log.Println(err)
+		return
+	}
+
+	// Exchange the code for a token
+	token, err := auth.ExchangeLoginCode(model, loginCode.Code, loginCode.Verifier)
+	if err != nil {
+		if err == authentication.InvalidLoginCodeErr || err == authentication.CodeVerifierMismatchedErr {
+			marshalError(w, http.StatusUnauthorized, "Login code is invalid or expired. Please log in again.")
 		} else {
 			marshalError(w, http.StatusInternalServerError, "Error logging the user in.")
 			log.Println(err)
@@ -199,7 +432,170 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Send token to client
-	jsonapi.MarshalOnePayload(w, token)
+	sendToken(w, r, token)
+}
+
+func IdentitiesHandler(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	ctx := r.Context()
+	userID := ctx.Value(userIDKey).(int)
+
+	switch r.Method {
+	case "GET":
+		// Get the user's identities
+		identities, err := model.GetIdentities(userID)
+		if err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to retrieve linked accounts.")
+			log.Println(err)
+			return
+		}
+
+		// Send identities to client
+		payload := make([]interface{}, len(identities))
+		for i, identity := range identities {
+			payload[i] = identity
+		}
+		jsonapi.MarshalManyPayload(w, payload)
+
+	case "POST":
+		// Parse the body's JSON
+		newIdentity := new(Identity)
+		if err := jsonapi.UnmarshalPayload(r.Body, newIdentity); err != nil {
+			marshalError(w, http.StatusBadRequest, "Invalid request body.")
+			log.Println(err)
+			return
+		}
+
+		// Verify the identity token we handed out at the end of the
+		// provider's login flow
+		external, err := auth.ParseIdentityToken(newIdentity.Token)
+		if err != nil {
+			marshalError(w, http.StatusBadRequest, "Identity token is invalid or expired. Please log in with the provider again.")
+			return
+		}
+
+		// Linking an identity to a trial converts it, which is signing up
+		trial, err := model.IsTrial(userID)
+		if err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to link account.")
+			log.Println(err)
+			return
+		}
+		if trial {
+			if err := checkProviderSignup(external.Email); err != nil {
+				marshalSignupError(w, err.(*signupError))
+				return
+			}
+		}
+
+		// Link the identity
+		identity, err := model.LinkIdentity(userID, external.Provider, external.Subject, external.Email)
+		if err != nil {
+			if err, ok := err.(*pq.Error); ok && err.Code.Name() == "unique_violation" {
+				marshalError(w, http.StatusBadRequest, "This account is already linked to an i++ user.")
+			} else {
+				marshalError(w, http.StatusInternalServerError, "Failed to link account.")
+				log.Println(err)
+			}
+			return
+		}
+
+		// The user can log in with the identity now, so the trial is over
+		if trial {
+			if err := model.EndTrial(userID); err != nil {
+				marshalError(w, http.StatusInternalServerError, "Failed to convert trial.")
+				log.Println(err)
+				return
+			}
+		}
+
+		// Send identity to client
+		jsonapi.MarshalOnePayload(w, identity)
+
+	default:
+		NotFoundHandler(w, r)
+	}
+}
+
+func IdentityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Get user ID from context
+	ctx := r.Context()
+	userID := ctx.Value(userIDKey).(int)
+
+	// Get the identity ID from the path
+	identityID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/me/identities/"))
+	if err != nil {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Unlink the identity
+	if err := model.UnlinkIdentity(userID, identityID); err != nil {
+		if err == sql.ErrNoRows {
+			NotFoundHandler(w, r)
+		} else if err == LastLoginMethodErr {
+			marshalError(w, http.StatusBadRequest, "You can't unlink the only way you can log in. Link another account or set a password first.")
+		} else {
+			marshalError(w, http.StatusInternalServerError, "Failed to unlink account.")
+			log.Println(err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Sends the token in the response body, or with session=cookie, in an
+// HttpOnly session cookie the web app's JavaScript can't read. Two-factor
+// challenges are always sent in the body.
+func sendToken(w http.ResponseWriter, r *http.Request, token *authentication.Token) {
+	// Disabled users' tokens don't work, so don't hand them out
+	if token.Type != authentication.TwoFactorChallengeType {
+		userID, err := auth.Authenticate(token.Subject)
+		if err == nil {
+			var disabled bool
+			if disabled, err = model.IsDisabled(userID); err == nil && disabled {
+				marshalError(w, http.StatusForbidden, "This account was disabled. Please contact support.")
+				return
+			}
+		}
+		if err != nil {
+			marshalError(w, http.StatusInternalServerError, "Error logging the user in.")
+			log.Println(err)
+			return
+		}
+	}
+
+	if r.URL.Query().Get("session") != "cookie" || token.Type == authentication.TwoFactorChallengeType {
+		jsonapi.MarshalOnePayload(w, token)
+		return
+	}
+
+	if err := auth.SetSessionCookies(w, token, config.SecureCookies); err != nil {
+		marshalError(w, http.StatusInternalServerError, "Error logging the user in.")
+		log.Println(err)
+		return
+	}
+
+	jsonapi.MarshalOnePayload(w, &authentication.Token{
+		ExpiresAt: token.ExpiresAt,
+		Type:      "session",
+	})
+}
+
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	authentication.ClearSessionCookies(w, config.SecureCookies)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 type globalHeadersHandler struct {
@@ -215,42 +611,180 @@ func (h globalHeadersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 
 	// Allow cross domain
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Content-Length")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Content-Length, X-CSRF-Token, X-API-Key")
 
 	// Intercept OPTIONS method
 	if r.Method == "OPTIONS" {
-		w.Header().Set("Access-Control-Allow-Methods", "GET,PUT,POST,DELETE,OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET,PUT,PATCH,POST,DELETE,OPTIONS")
 		w.WriteHeader(200)
 	}
 	h.handler.ServeHTTP(w, r)
 }
 
+// Which API keys an authDecorator accepts
+type apiKeyUse int
+
+const (
+	noAPIKeys    apiKeyUse = iota
+	trialAPIKeys           // Only while the key's user is on a trial
+	allAPIKeys
+)
+
+// Authenticates the user with a token or the session cookie. API keys are
+// rejected, so a leaked key can't take over the account.
 func AuthDecorator(f http.HandlerFunc) http.HandlerFunc {
+	return authDecorator(f, false, noAPIKeys)
+}
+
+// Authenticates like AuthDecorator but also accepts API keys, including
+// test-mode ones, whose requests count in the sandbox, and service account
+// tokens, whose scopes the handler checks with allowScope
+func CounterAuthDecorator(f http.HandlerFunc) http.HandlerFunc {
+	return authDecorator(f, true, allAPIKeys)
+}
+
+// Authenticates like AuthDecorator but also accepts the live API keys of
+// trial users, who have nothing else to authenticate with until they convert
+func TrialAuthDecorator(f http.HandlerFunc) http.HandlerFunc {
+	return authDecorator(f, false, trialAPIKeys)
+}
+
+func authDecorator(f http.HandlerFunc, counter bool, apiKeys apiKeyUse) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
-		// Get auth header
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			marshalError(w, http.StatusUnauthorized, "No authentication token was present in request headers.")
+		// Responds with 403 and returns false if API keys aren't accepted.
+		// It's checked before the key is, so the key's calls aren't used up.
+		allowAPIKeys := func() bool {
+			if apiKeys == noAPIKeys {
+				marshalError(w, http.StatusForbidden, "API keys can only count. Log in as a user for this.")
+				return false
+			}
+			return true
+		}
+
+		// Authenticate with an API key, for the handler to act as its user
+		withAPIKey := func(apiKey *authentication.APIKey, inQuery bool) {
+			// Test-mode keys mustn't change anything real
+			if apiKey.Test && !counter {
+				marshalError(w, http.StatusForbidden, "Test-mode API keys can only count. Use a live key for this.")
+				return
+			}
+
+			// Keys in the query string can only get and count
+			if inQuery {
+				if !counter {
+					marshalError(w, http.StatusForbidden, "API keys in the query string can only count. Send the key in a header for this.")
+					return
+				}
+				ctx = context.WithValue(ctx, grantKey, &authentication.Grant{UserID: apiKey.UserID, Scopes: queryScopes})
+			}
+
+			if apiKeys == trialAPIKeys {
+				trial, err := model.IsTrial(apiKey.UserID)
+				if err != nil {
+					marshalError(w, http.StatusInternalServerError, "Failed to authenticate.")
+					log.Println(err)
+					return
+				} else if !trial {
+					marshalError(w, http.StatusForbidden, "API keys can only count. Log in as a user for this.")
+					return
+				}
+			}
+
+			ctx = context.WithValue(ctx, userIDKey, apiKey.UserID)
+			ctx = context.WithValue(ctx, testModeKey, apiKey.Test)
+			f(w, r.WithContext(ctx))
+		}
+
+		// Requests signed with an API key's signing secret
+		if signing.IsSigned(r) {
+			if !allowAPIKeys() {
+				return
+			}
+			apiKey, err := auth.VerifySignedRequest(
+				model, nonces, r, config.SignatureWindow, net.ParseIP(clientIP(r)), r.Header.Get("Origin"),
+			)
+			if err != nil {
+				marshalAPIKeyError(w, err)
+				return
+			}
+			withAPIKey(apiKey, false)
 			return
 		}
 
-		// Split the header into "Bearer" and token
-		authHeaderParts := strings.Split(authHeader, " ")
-		if len(authHeaderParts) != 2 || strings.ToLower(authHeaderParts[0]) != "bearer" {
-			marshalError(w, http.StatusUnauthorized, "Invalid authorization header format; it must be Bearer {token}")
+		// Get the token or API key
+		credential, inQuery, ok := requestCredential(w, r)
+		if !ok {
+			return
+		}
+		if credential == "" {
+			// Fall back to the web app's session cookie
+			sessionAuthDecorator(f)(w, r)
 			return
 		}
 
-		// Parse userID from authtoken
-		id, err := auth.Authenticate(authHeaderParts[1])
-		if err != nil {
+		// Parse userID from the API key or authtoken
+		if authentication.IsAPIKey(credential) {
+			if !allowAPIKeys() {
+				return
+			}
+			apiKey, err := auth.VerifyAPIKey(model, credential, net.ParseIP(clientIP(r)), r.Header.Get("Origin"))
+			if err != nil {
+				marshalAPIKeyError(w, err)
+				return
+			}
+			withAPIKey(apiKey, inQuery)
+			return
+		}
+
+		grant, err := auth.VerifyGrant(model, credential, net.ParseIP(clientIP(r)), r.Header.Get("Origin"))
+		if restriction, ok := clientRestrictionErrors[err]; ok {
+			marshalRestrictionError(w, restriction)
+			return
+		} else if err != nil {
 			marshalError(w, http.StatusUnauthorized, "Authentication token is invalid")
 			log.Println(err)
 			return
 		}
 
+		// Service accounts only get to count, within their scopes
+		if grant.ClientID != "" && !counter {
+			marshalError(w, http.StatusForbidden, "Service accounts can only count. Log in as a user for this.")
+			return
+		}
+
+		// Add the userID and what the token may do to the context
+		ctx = context.WithValue(ctx, userIDKey, grant.UserID)
+		ctx = context.WithValue(ctx, grantKey, grant)
+
+		// Call handler function
+		f(w, r.WithContext(ctx))
+	}
+}
+
+func sessionAuthDecorator(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		// Get the token from the session cookie
+		token, err := auth.SessionToken(r)
+		if err == authentication.NoSessionErr {
+			marshalError(w, http.StatusUnauthorized, "No authentication token was present in request headers.")
+			return
+		} else if err != nil {
+			marshalError(w, http.StatusForbidden, "CSRF token is missing or invalid.")
+			return
+		}
+
+		// Parse userID from the token
+		id, err := auth.Verify(model, token)
+		if err != nil {
+			marshalError(w, http.StatusUnauthorized, "Session is invalid or expired. Please log in again.")
+			log.Println(err)
+			return
+		}
+
 		// Add the userID to the context
 		ctx = context.WithValue(ctx, userIDKey, id)
 
@@ -260,6 +794,29 @@ func AuthDecorator(f http.HandlerFunc) http.HandlerFunc {
 }
 
 func LoginValidationDecorator(f http.HandlerFunc) http.HandlerFunc {
+	return userValidationDecorator(f, anyPassword)
+}
+
+// Validates the email, that the password meets the password policy and that
+// the user is allowed to sign up
+func SignupValidationDecorator(f http.HandlerFunc) http.HandlerFunc {
+	return userValidationDecorator(signupDecorator(f), newPassword)
+}
+
+// Validates just the email for handlers that don't take a password
+func EmailValidationDecorator(f http.HandlerFunc) http.HandlerFunc {
+	return userValidationDecorator(f, noPassword)
+}
+
+type passwordCheck int
+
+const (
+	noPassword  passwordCheck = iota
+	anyPassword               // Logging in works with passwords from before the policy changed
+	newPassword               // Has to meet the password policy
+)
+
+func userValidationDecorator(f http.HandlerFunc, check passwordCheck) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			NotFoundHandler(w, r)
@@ -285,11 +842,19 @@ func LoginValidationDecorator(f http.HandlerFunc) http.HandlerFunc {
 		}
 
 		// Validate password
-		if !validator.ValidatePassword(user.Password) {
-			marshalError(w, http.StatusBadRequest,
-				"Invalid password. Please make sure it's at least 8 characters long and doesn't contain an unsupported character. Supported characters are \"a-z, A-Z, 0-9, !#$%^&*_+=-}{|/.'`~\"")
-			return
+		switch check {
+		case anyPassword:
+			if user.Password == "" {
+				marshalError(w, http.StatusBadRequest, "Password is required.")
+				return
+			}
+		case newPassword:
+			if err := passwordPolicy.Check(user.Password); err != nil {
+				marshalPasswordError(w, err)
+				return
+			}
 		}
+		user.Password = validator.NormalizePassword(user.Password)
 
 		// Add the user to the context
 		ctx = context.WithValue(ctx, userKey, user)
@@ -299,14 +864,47 @@ func LoginValidationDecorator(f http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+var passwordErrorDetails = map[string]string{
+	validator.PasswordTooShort:         fmt.Sprintf("Password must be at least %d characters long.", config.PasswordMinLength),
+	validator.PasswordTooLong:          "Password is too long.",
+	validator.PasswordInvalidCharacter: "Password can't contain control characters like tabs or line breaks.",
+	validator.PasswordTooWeak:          "Password is too easy to guess. Try a longer one, or a few unrelated words.",
+	validator.PasswordBreached:         "Password appeared in a data breach, so attackers will try it. Please choose another one.",
+}
+
 var errorTitles = map[int]string{
 	http.StatusBadRequest:          "Bad Request",
 	http.StatusUnauthorized:        "Unauthorized",
 	http.StatusForbidden:           "Forbidden",
 	http.StatusNotFound:            "Not Found",
+	http.StatusTooManyRequests:     "Too Many Requests",
 	http.StatusInternalServerError: "Internal Server Error",
 }
 
+// Responds with 400 and an error for each reason the password doesn't meet
+// the policy, with the reason as its code
+func marshalPasswordError(w http.ResponseWriter, err error) {
+	passwordErr, ok := err.(*validator.PasswordError)
+	if !ok {
+		marshalError(w, http.StatusInternalServerError, "Failed to validate password.")
+		log.Println(err)
+		return
+	}
+
+	errors := []*jsonapi.ErrorObject{}
+	for _, reason := range passwordErr.Reasons {
+		errors = append(errors, &jsonapi.ErrorObject{
+			Title:  errorTitles[http.StatusBadRequest],
+			Detail: passwordErrorDetails[reason],
+			Status: strconv.Itoa(http.StatusBadRequest),
+			Code:   reason,
+		})
+	}
+
+	w.WriteHeader(http.StatusBadRequest)
+	jsonapi.MarshalErrors(w, errors)
+}
+
 func marshalError(w http.ResponseWriter, status int, detail string) {
 	w.WriteHeader(status)
 	jsonapi.MarshalErrors(w, []*jsonapi.ErrorObject{{
@@ -1,18 +1,70 @@
 riot.tag2('app', '<button if="{Token}" id="logout" class="material-button" type="button" onclick="{logout}">Logout</button> <login if="{!Token}"></login> <dash if="{Token}"></dash>', 'app,[data-is="app"]{ width: 40%; max-width: 500px; } @media (max-width: 800px) { app,[data-is="app"]{ width: 60%; } } @media (max-width: 550px) { app,[data-is="app"]{ width: 90%; } } app #logout,[data-is="app"] #logout{ position: absolute; top: 0; right: 16px; }', '', function(opts) {
-token = GetParameterByName("token")
-if(token) {
-  StoreToken(token);
-  this.update();
-  window.location.href = window.location.origin;
+var self = this;
+
+identity = GetParameterByName("identity")
+if(identity) {
+  window.sessionStorage.setItem(IDENTITY_KEY, identity);
+  LinkPendingIdentity();
+}
+
+verifyToken = GetParameterByName("verify_token")
+if(verifyToken) {
+  var payload = JSON.stringify({
+    data: {
+      type: "email-verification",
+      attributes: {
+        token: verifyToken
+      }
+    }
+  });
+
+  xhr("/email/verify", "POST", payload, function(res) {
+    window.location.href = window.location.origin + window.location.pathname + window.location.hash;
+  }, function(res) {
+    window.location.href = window.location.origin + "/?error=" + encodeURIComponent(res.errors[0].detail);
+  });
+}
+
+magicToken = GetParameterByName("magic_token")
+if(magicToken) {
+  xhr("/login/magic/callback?session=cookie&token=" + encodeURIComponent(magicToken), "GET", null, function(res) {
+    window.location.href = window.location.origin + window.location.pathname + (StoreToken(res) ? window.location.hash : "#2fa");
+  }, function(res) {
+    window.location.href = window.location.origin + "/?error=" + encodeURIComponent(res.errors[0].detail);
+  });
+}
+
+code = GetParameterByName("code")
+if(code) {
+  var payload = JSON.stringify({
+    data: {
+      type: "code",
+      attributes: {
+        code: code,
+        code_verifier: window.sessionStorage.getItem(VERIFIER_KEY)
+      }
+    }
+  });
+  window.sessionStorage.removeItem(VERIFIER_KEY);
+
+  xhr("/login/exchange?session=cookie", "POST", payload, function(res) {
+    window.location.href = window.location.origin + window.location.pathname + (StoreToken(res) ? window.location.hash : "#2fa");
+  }, function(res) {
+    window.location.href = window.location.origin + "/?error=" + encodeURIComponent(res.errors[0].detail);
+  });
 }
 
 this.logout = function(e) {
-  ClearToken();
-  this.update();
+  xhr("/logout", "POST", null, loggedOut, loggedOut);
 }.bind(this)
+
+function loggedOut() {
+  ClearToken();
+  self.update();
+}
 });
 
-riot.tag2('dash', '<h1>User Dashboard</h1> <div id="number-container"> <p>Current number = {number}</p> <form onsubmit="{incrementNumber}"> <button class="material-button primary" type="submit">☝️</button> </form> </div> <form id="update-form" onsubmit="{submit}"> <material-input name="number" label="Number" type="number"></material-input> <button class="material-button" type="submit">Update</button> </form> <span class="error" show="{error}">{error}</span>', 'dash h1,[data-is="dash"] h1{ text-align: center; } dash material-input,[data-is="dash"] material-input{ width: 100%; } dash #update-form,[data-is="dash"] #update-form{ margin-top: 30px; display: flex; justify-content: space-between; align-items: baseline; } dash #number-container,[data-is="dash"] #number-container{ display: flex; justify-content: space-between; align-items: center; }', '', function(opts) {
+riot.tag2('dash', '<h1>User Dashboard</h1> <div id="number-container"> <p>Current number = {number}</p> <form onsubmit="{incrementNumber}"> <button class="material-button primary" type="submit">☝️</button> </form> </div> <form id="update-form" onsubmit="{submit}"> <material-input name="number" label="Number" type="number"></material-input> <button class="material-button" type="submit">Update</button> </form> <span class="error" show="{error}">{error}</span> <a show="{unverified}" href="#" onclick="{resendVerification}">Resend verification email</a> <div id="link-container"> <a class="material-button facebook" href="{API_URL + ⁗/login/facebook?intent=link⁗}">Link Facebook</a> </div> <div id="two-factor"> <button class="material-button" show="{!enrollmentSecret && !recoveryCodes}" onclick="{enrollTwoFactor}">Set up two-factor authentication</button> <form show="{enrollmentSecret}" onsubmit="{confirmTwoFactor}"> <p>Add this key to your <a href="{enrollmentURI}">authenticator app</a>: <code>{enrollmentSecret}</code></p> <material-input name="code" label="Code from the app" type="text"></material-input> <button class="material-button primary" type="submit">Turn on</button> </form> <div show="{recoveryCodes}"> <p>Two-factor authentication is on. Keep these recovery codes somewhere safe; each one logs you in once if you lose your authenticator.</p> <p each="{code in recoveryCodes}"><code>{code}</code></p> </div> </div>', 'dash h1,[data-is="dash"] h1{ text-align: center; } dash material-input,[data-is="dash"] material-input{ width: 100%; } dash #update-form,[data-is="dash"] #update-form{ margin-top: 30px; display: flex; justify-content: space-between; align-items: baseline; } dash #link-container,[data-is="dash"] #link-container{ margin-top: 30px; display: flex; justify-content: center; } dash #two-factor,[data-is="dash"] #two-factor{ margin-top: 30px; text-align: center; } dash #number-container,[data-is="dash"] #number-container{ display: flex; justify-content: space-between; align-items: center; }', '', function(opts) {
 var self = this;
 
 xhr("/current", "GET", null, bindNumber, bindError);
@@ -40,6 +92,44 @@ function bindNumber(res) {
   self.update();
 }
 
+this.resendVerification = function(e) {
+  e.preventDefault();
+  xhr("/email/resend", "POST", null, function(res) {
+    self.error = "We sent you another verification email.";
+    self.unverified = false;
+    self.update();
+  }, bindError);
+}.bind(this)
+
+this.enrollTwoFactor = function(e) {
+  e.preventDefault();
+  xhr("/me/2fa", "POST", null, function(res) {
+    self.enrollmentSecret = res.data.attributes.secret;
+    self.enrollmentURI = res.data.attributes.provisioning_uri;
+    self.error = "";
+    self.update();
+  }, bindError);
+}.bind(this)
+
+this.confirmTwoFactor = function(e) {
+  e.preventDefault();
+  var payload = JSON.stringify({
+    data: {
+      type: "two-factor",
+      attributes: {
+        code: e.target.code.value
+      }
+    }
+  });
+
+  xhr("/me/2fa/confirm", "POST", payload, function(res) {
+    self.enrollmentSecret = null;
+    self.recoveryCodes = res.data.attributes.recovery_codes;
+    self.error = "";
+    self.update();
+  }, bindError);
+}.bind(this)
+
 this.submit = function(e) {
   e.preventDefault();
   updateNumber(e.target.number.value);
@@ -47,13 +137,15 @@ this.submit = function(e) {
 
 function bindError(res) {
   self.error = res.errors[0].detail;
+  self.unverified = res.errors[0].status == "403";
   self.update();
   self.parent.update();
 }
 });
 
-riot.tag2('login', '<h1>i++</h1> <div class="container"> <form class="center-vertical" onsubmit="{submit}"> <material-input name="email" label="Email" required type="email"></material-input> <material-input name="password" label="Password" type="password" required></material-input> <span class="error" show="{loginError}"> {loginError} </span> <span show="{!login}" class="prompt"> Already have an account? Try <a onclick="{isLogin}" href="#login">logging in</a> instead. </span> <button class="material-button primary" show="{!login}" type="submit">Sign up</button> <span show="{login}" class="prompt"> Need an account? <a onclick="{isLogin}" href="#signup">Sign up</a> now. </span> <button class="material-button primary" show="{login}" type="submit">Login</button> </form> <div class="center-vertical"> <p>or</p> <a class="material-button facebook" href="{API_URL + ⁗/login/facebook⁗}">Login with Facebook</a> </div> </div>', 'login { display: flex; flex-direction: column; align-items: center; font-family: "Roboto"; } login .container,[data-is="login"] .container{ width: 100% } login .center-vertical,[data-is="login"] .center-vertical{ display: flex; flex-direction: column; align-items: center; } login material-input,[data-is="login"] material-input{ width: 100%; } login .error,[data-is="login"] .error{ margin-bottom: 10px; align-self: flex-start; } login .prompt,[data-is="login"] .prompt{ align-self: flex-start; margin-bottom: 10px; }', '', function(opts) {
+riot.tag2('login', '<h1>i++</h1> <div class="container"> <form class="center-vertical" show="{!forgot && !resetToken && !twoFactor}" onsubmit="{submit}"> <material-input name="email" label="Email" required type="email"></material-input> <material-input name="password" label="Password" type="password" required></material-input> <span class="error" show="{loginError}"> {loginError} </span> <span show="{!login}" class="prompt"> Already have an account? Try <a onclick="{isLogin}" href="#login">logging in</a> instead. </span> <button class="material-button primary" show="{!login}" type="submit">Sign up</button> <span show="{login}" class="prompt"> Need an account? <a onclick="{isLogin}" href="#signup">Sign up</a> now. </span> <span show="{login}" class="prompt"> <a href="#forgot">Forgot your password?</a> Or <a href="#login" onclick="{emailLoginLink}">email me a login link</a>. </span> <span class="prompt" show="{message}"> {message} </span> <button class="material-button primary" show="{login}" type="submit">Login</button> </form> <form class="center-vertical" show="{forgot && !resetToken}" onsubmit="{forgotPassword}"> <material-input name="email" label="Email" type="email" required></material-input> <span class="error" show="{loginError}"> {loginError} </span> <span class="prompt" show="{message}"> {message} </span> <span class="prompt"> Remembered it? <a href="#login">Log in</a> instead. </span> <button class="material-button primary" type="submit">Email me a reset link</button> </form> <form class="center-vertical" show="{twoFactor}" onsubmit="{loginTwoFactor}"> <material-input name="code" label="Authenticator or recovery code" type="text" required></material-input> <span class="error" show="{loginError}"> {loginError} </span> <button class="material-button primary" type="submit">Verify</button> </form> <form class="center-vertical" show="{resetToken}" onsubmit="{resetPassword}"> <material-input name="password" label="New password" type="password" required></material-input> <span class="error" show="{loginError}"> {loginError} </span> <button class="material-button primary" type="submit">Reset password</button> </form> <div class="center-vertical"> <p>or</p> <a class="material-button facebook" onclick="{loginWithFacebook}" href="#">Login with Facebook</a> </div> </div>', 'login { display: flex; flex-direction: column; align-items: center; font-family: "Roboto"; } login .container,[data-is="login"] .container{ width: 100% } login .center-vertical,[data-is="login"] .center-vertical{ display: flex; flex-direction: column; align-items: center; } login material-input,[data-is="login"] material-input{ width: 100%; } login .error,[data-is="login"] .error{ margin-bottom: 10px; align-self: flex-start; } login .prompt,[data-is="login"] .prompt{ align-self: flex-start; margin-bottom: 10px; }', '', function(opts) {
 self = this;
+self.resetToken = GetParameterByName("reset_token");
 loginOrSignup();
 
 var err = GetParameterByName("error")
@@ -69,12 +161,93 @@ this.submit = function(e) {
   auth(self.login ? "/login" : "/signup", e.target.email.value, e.target.password.value);
 }.bind(this)
 
+this.emailLoginLink = function(e) {
+  e.preventDefault();
+  var payload = JSON.stringify({
+    data: {
+      type: "user",
+      attributes: {
+        email: self.root.querySelector("form input[name=email]").value
+      }
+    }
+  });
+
+  xhr("/login/magic", "POST", payload, function(res) {
+    self.loginError = null;
+    self.message = "If that address belongs to an account, we've emailed it a link to log in.";
+    self.update();
+  }, bindLoginError);
+}.bind(this)
+
+this.loginTwoFactor = function(e) {
+  e.preventDefault();
+  var payload = JSON.stringify({
+    data: {
+      type: "two-factor",
+      attributes: {
+        challenge: window.sessionStorage.getItem(CHALLENGE_KEY),
+        code: e.target.code.value
+      }
+    }
+  });
+
+  xhr("/login/2fa?session=cookie", "POST", payload, function(res) {
+    window.sessionStorage.removeItem(CHALLENGE_KEY);
+    StoreToken(res);
+    location.hash = "";
+    self.parent.update();
+  }, bindLoginError);
+}.bind(this)
+
+this.forgotPassword = function(e) {
+  e.preventDefault();
+  var payload = JSON.stringify({
+    data: {
+      type: "password-reset",
+      attributes: {
+        email: e.target.email.value
+      }
+    }
+  });
+
+  xhr("/password/forgot", "POST", payload, function(res) {
+    self.loginError = null;
+    self.message = "If that address belongs to an account, we've emailed it a link to reset your password.";
+    self.update();
+  }, bindLoginError);
+}.bind(this)
+
+this.resetPassword = function(e) {
+  e.preventDefault();
+  var payload = JSON.stringify({
+    data: {
+      type: "password-reset",
+      attributes: {
+        token: self.resetToken,
+        password: e.target.password.value
+      }
+    }
+  });
+
+  xhr("/password/reset", "POST", payload, function(res) {
+    window.location.href = window.location.origin + window.location.pathname + "#login";
+  }, bindLoginError);
+}.bind(this)
+
+this.loginWithFacebook = function(e) {
+  e.preventDefault();
+  LoginWith("facebook");
+}.bind(this)
+
 function loginOrSignup() {
   if (location.hash === "#login") {
     self.login = true;
   } else {
     self.login = false;
   }
+  self.forgot = location.hash === "#forgot";
+  self.twoFactor = location.hash === "#2fa" && !!window.sessionStorage.getItem(CHALLENGE_KEY);
+  self.message = null;
   self.update();
 }
 
@@ -89,17 +262,28 @@ function auth(path, email, password) {
     }
   });
 
-  xhr(path, "POST", payload, storeToken, bindLoginError);
+  xhr(path + "?session=cookie", "POST", payload, storeToken, bindLoginError);
 }
 
 function storeToken(res) {
-  Token = res.data.id;
-  StoreToken(Token);
+  // Signups with enumeration protection finish once the email is verified
+  if(!res.data) {
+    self.loginError = null;
+    self.message = "Check your email to finish signing up.";
+    self.update();
+    return;
+  }
+
+  if(!StoreToken(res)) {
+    location.hash = "#2fa";
+  }
   self.parent.update();
 }
 
 function bindLoginError(res) {
-  this.loginError = res.errors[0].detail;
+  self.loginError = res.errors.map(function(error) {
+    return error.detail;
+  }).join(" ");
   self.update();
 }
 });
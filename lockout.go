@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mujz/ipp/config"
+	"github.com/mujz/ipp/ratelimit"
+)
+
+var (
+	// Slows down guessing one account's password or second factor
+	accountPolicy = ratelimit.Policy{
+		FreeAttempts: 5,
+		Backoff:      time.Second,
+		MaxBackoff:   time.Minute,
+		LockoutAfter: 10,
+		Lockout:      15 * time.Minute,
+		Window:       time.Hour,
+	}
+
+	// Slows down one client guessing many accounts' passwords. It's more
+	// lenient since several users can share an IP address.
+	ipPolicy = ratelimit.Policy{
+		FreeAttempts: 20,
+		Backoff:      time.Second,
+		MaxBackoff:   time.Minute,
+		LockoutAfter: 100,
+		Lockout:      15 * time.Minute,
+		Window:       time.Hour,
+	}
+
+	accountLimiter *ratelimit.Limiter
+	ipLimiter      *ratelimit.Limiter
+
+	trustedProxies []*net.IPNet
+)
+
+// A limiter and the key a request is counted against
+type limit struct {
+	*ratelimit.Limiter
+	key string
+}
+
+func emailLimit(email string) limit {
+	return limit{accountLimiter, "email:" + strings.ToLower(email)}
+}
+
+func twoFactorLimit(userID int) limit {
+	return limit{accountLimiter, fmt.Sprintf("2fa:%d", userID)}
+}
+
+func passwordLimit(userID int) limit {
+	return limit{accountLimiter, fmt.Sprintf("password:%d", userID)}
+}
+
+func ipLimit(r *http.Request) limit {
+	return limit{ipLimiter, "ip:" + clientIP(r)}
+}
+
+// Returns the client's IP address. Each proxy appends the address it saw to
+// X-Forwarded-For, so the client is the last address that isn't one of our
+// proxies; anything before it could have been made up by the client. With
+// TRUST_PROXY, the proxy that connected to us is trusted wherever it is.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !config.TrustProxy && !trustedProxy(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			break
+		}
+		ip = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, network := range trustedProxies {
+		if parsed != nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reserves an attempt against each limit, counting it as failed until it's
+// released or the limit is reset, so parallel guesses can't all get in before
+// any of them fails. Responds with 429 and returns false if the client has to
+// wait before trying again.
+func allowAttempt(w http.ResponseWriter, limits ...limit) bool {
+	for i, l := range limits {
+		wait, err := l.Attempt(l.key)
+		if err != nil {
+			releaseAttempts(limits[:i]...)
+			marshalError(w, http.StatusInternalServerError, "Error logging the user in.")
+			log.Println(err)
+			return false
+		}
+		if wait > 0 {
+			releaseAttempts(limits[:i]...)
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			marshalError(w, http.StatusTooManyRequests, fmt.Sprintf(
+				"Too many failed attempts. Please try again in %d seconds.", seconds,
+			))
+			return false
+		}
+	}
+	return true
+}
+
+// Takes back reserved attempts that shouldn't count as failures
+func releaseAttempts(limits ...limit) {
+	for _, l := range limits {
+		if err := l.Release(l.key); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func resetAttempts(limits ...limit) {
+	for _, l := range limits {
+		if err := l.Reset(l.key); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Lifts the lockout on an email (and its user's second factor) or an IP
+// address given in the query
+func UnlockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Get the admin's ID from context
+	ctx := r.Context()
+	adminID := ctx.Value(userIDKey).(int)
+
+	query := r.URL.Query()
+	email, ip := query.Get("email"), query.Get("ip")
+	if email == "" && ip == "" {
+		marshalError(w, http.StatusBadRequest, "An email or ip is required.")
+		return
+	}
+
+	targetID := 0
+
+	var limits []limit
+	if email != "" {
+		limits = append(limits, emailLimit(email))
+		if userID, err := model.GetUserID(email); err == nil {
+			limits = append(limits, twoFactorLimit(userID))
+			targetID = userID
+		}
+	}
+	if ip != "" {
+		limits = append(limits, limit{ipLimiter, "ip:" + ip})
+	}
+
+	if !audit(w, adminID, "unlock", targetID, query.Encode()) {
+		return
+	}
+
+	for _, l := range limits {
+		if err := l.Reset(l.key); err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to lift the lockout.")
+			log.Println(err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
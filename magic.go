@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"text/template"
+
+	"github.com/mujz/ipp/authentication"
+	"github.com/mujz/ipp/config"
+	"github.com/mujz/ipp/mailer"
+)
+
+var magicLinkTemplate = template.Must(template.New("magic").Parse(`Hi,
+
+Open this link within 15 minutes to log in to i++:
+
+{{ .URL }}
+
+The link only works once. If you didn't ask for it, you can ignore this email.
+`))
+
+// Emails a login link to the user with the email in the body. The response
+// is the same whether or not there's such a user.
+func MagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	// Get user from context
+	ctx := r.Context()
+	user := ctx.Value(userKey).(*User)
+
+	inBackground(func() error { return sendMagicLink(user.Email) })
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Issues a magic link token for the user with the email, if there's one, and
+// emails them a link to the web app, which exchanges the token
+func sendMagicLink(email string) error {
+	token, err := auth.MagicLinkToken(model, email)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	Url, err := url.Parse(config.WebURL)
+	if err != nil {
+		return err
+	}
+	Url.RawQuery = url.Values{"magic_token": {token}}.Encode()
+
+	var body bytes.Buffer
+	if err := magicLinkTemplate.Execute(&body, struct{ URL string }{Url.String()}); err != nil {
+		return err
+	}
+
+	return mail.Send(&mailer.Message{
+		To:      email,
+		Subject: "Your i++ login link",
+		Body:    body.String(),
+	})
+}
+
+// Exchanges the token from a magic link for an authentication token
+func MagicLinkCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Log user in
+	token, err := auth.MagicLogin(model, r.URL.Query().Get("token"))
+	if err != nil {
+		if err == authentication.InvalidMagicLinkErr {
+			marshalError(w, http.StatusUnauthorized, "Login link is invalid or expired. Please ask for a new one.")
+		} else {
+			marshalError(w, http.StatusInternalServerError, "Error logging the user in.")
+			log.Println(err)
+		}
+		return
+	}
+
+	// Send token to client
+	sendToken(w, r, token)
+}
@@ -0,0 +1,140 @@
+// Package mailer sends the emails ipp sends to its users, like password
+// reset links, through SMTP or, in development and tests, to a file, stdout
+// or memory.
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var InvalidHeaderErr = errors.New("mailer: address or subject contains a line break.")
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	// Sends the message
+	Send(*Message) error
+}
+
+// Returns the message as an RFC 5322 email from the given address
+func (m *Message) Bytes(from string) ([]byte, error) {
+	for _, header := range []string{from, m.To, m.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, InvalidHeaderErr
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.Replace(m.Body, "\n", "\r\n", -1))
+	return b.Bytes(), nil
+}
+
+// SMTPMailer sends messages through an SMTP server
+type SMTPMailer struct {
+	Addr string // host:port of the server
+	From string
+	Auth smtp.Auth
+}
+
+// Returns a mailer that sends through the server at addr, logging in with
+// PLAIN auth if username isn't empty
+func NewSMTPMailer(addr, username, password, from string) *SMTPMailer {
+	m := &SMTPMailer{Addr: addr, From: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+func (m *SMTPMailer) Send(msg *Message) error {
+	b, err := msg.Bytes(m.From)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{msg.To}, b)
+}
+
+// WriterMailer writes messages to a file or stdout instead of sending them
+type WriterMailer struct {
+	From string
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func NewWriterMailer(w io.Writer, from string) *WriterMailer {
+	return &WriterMailer{From: from, w: w}
+}
+
+func (m *WriterMailer) Send(msg *Message) error {
+	b, err := msg.Bytes(m.From)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, err = fmt.Fprintf(m.w, "%s\r\n\r\n", b)
+	return err
+}
+
+// MemoryMailer keeps messages in memory so tests can read them
+type MemoryMailer struct {
+	lock     sync.Mutex
+	messages []Message
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(msg *Message) error {
+	if _, err := msg.Bytes(""); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.messages = append(m.messages, *msg)
+	return nil
+}
+
+// Returns the messages sent so far
+func (m *MemoryMailer) Messages() []Message {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// Returns the last message sent to the address and whether there was one
+func (m *MemoryMailer) Last(to string) (Message, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].To == to {
+			return m.messages[i], true
+		}
+	}
+	return Message{}, false
+}
@@ -0,0 +1,68 @@
+package mailer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBytes(t *testing.T) {
+	msg := &Message{To: "jd@m.ca", Subject: "Reset your password", Body: "Hi,\nclick the link."}
+
+	b, err := msg.Bytes("i++ <no-reply@m.ca>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"From: i++ <no-reply@m.ca>\r\n",
+		"To: jd@m.ca\r\n",
+		"Subject: Reset your password\r\n",
+		"\r\n\r\nHi,\r\nclick the link.",
+	}
+	for _, s := range expected {
+		if !bytes.Contains(b, []byte(s)) {
+			t.Errorf("Expected message to contain %q; Got %q", s, b)
+		}
+	}
+}
+
+func TestBytesHeaderInjection(t *testing.T) {
+	msg := &Message{To: "jd@m.ca\r\nBcc: everyone@m.ca", Subject: "Hi"}
+
+	if _, err := msg.Bytes("no-reply@m.ca"); err != InvalidHeaderErr {
+		t.Fatalf("Expected error %v; Got %v", InvalidHeaderErr, err)
+	}
+}
+
+func TestWriterMailer(t *testing.T) {
+	var b bytes.Buffer
+	m := NewWriterMailer(&b, "no-reply@m.ca")
+
+	if err := m.Send(&Message{To: "jd@m.ca", Subject: "Hi", Body: "Hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(b.String(), "To: jd@m.ca") || !strings.Contains(b.String(), "Hello") {
+		t.Fatalf("Expected the message to be written; Got %q", b.String())
+	}
+}
+
+func TestMemoryMailer(t *testing.T) {
+	m := NewMemoryMailer()
+	m.Send(&Message{To: "jd@m.ca", Body: "first"})
+	m.Send(&Message{To: "other@m.ca", Body: "other"})
+	m.Send(&Message{To: "jd@m.ca", Body: "second"})
+
+	if n := len(m.Messages()); n != 3 {
+		t.Fatalf("Expected 3 messages; Got %d", n)
+	}
+
+	if msg, ok := m.Last("jd@m.ca"); !ok || msg.Body != "second" {
+		t.Fatalf("Expected the last message to jd@m.ca; Got %+v", msg)
+	}
+
+	if _, ok := m.Last("nobody@m.ca"); ok {
+		t.Fatal("Expected no message to nobody@m.ca")
+	}
+}
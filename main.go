@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/mujz/ipp/config"
@@ -12,20 +13,62 @@ import (
 func NewServer() http.Handler {
 	server := http.NewServeMux()
 	server.HandleFunc("/", NotFoundHandler)
-	server.HandleFunc("/current", AuthDecorator(CurrentHandler))
-	server.HandleFunc("/next", AuthDecorator(NextHandler))
+	server.HandleFunc("/current", CounterAuthDecorator(CurrentHandler))
+	server.HandleFunc("/next", CounterAuthDecorator(NextHandler))
+	server.HandleFunc("/sandbox", CounterAuthDecorator(SandboxHandler))
 
+	server.HandleFunc("/trial", TrialHandler)
+	server.HandleFunc("/trial/convert", TrialAuthDecorator(SignupValidationDecorator(ConvertTrialHandler)))
+
+	server.HandleFunc("/oauth/token", TokenHandler)
+	server.HandleFunc("/oauth/introspect", IntrospectHandler)
 	server.HandleFunc("/login", LoginValidationDecorator(LoginHandler))
-	server.HandleFunc("/signup", LoginValidationDecorator(SignupHandler))
+	server.HandleFunc("/signup", SignupValidationDecorator(SignupHandler))
+	server.HandleFunc("/login/exchange", ExchangeHandler)
+	server.HandleFunc("/login/magic", EmailValidationDecorator(MagicLinkHandler))
+	server.HandleFunc("/login/magic/callback", MagicLinkCallbackHandler)
+	server.HandleFunc("/login/2fa", LoginTwoFactorHandler)
+	server.HandleFunc("/logout", LogoutHandler)
+	server.HandleFunc("/password/forgot", ForgotPasswordHandler)
+	server.HandleFunc("/password/reset", ResetPasswordHandler)
+	server.HandleFunc("/email/verify", VerifyEmailHandler)
+	server.HandleFunc("/email/resend", AuthDecorator(ResendVerificationHandler))
+
+	server.HandleFunc("/me", TrialAuthDecorator(MeHandler))
+	server.HandleFunc("/me/password", AuthDecorator(ChangePasswordHandler))
+	server.HandleFunc("/me/restore", AuthDecorator(RestoreAccountHandler))
+	server.HandleFunc("/me/export", AuthDecorator(ExportHandler))
+	server.HandleFunc("/me/keys", AuthDecorator(APIKeysHandler))
+	server.HandleFunc("/me/keys/", AuthDecorator(APIKeyHandler))
+	server.HandleFunc("/me/service-accounts", AuthDecorator(ServiceAccountsHandler))
+	server.HandleFunc("/me/service-accounts/", AuthDecorator(ServiceAccountHandler))
+	server.HandleFunc("/me/identities", TrialAuthDecorator(IdentitiesHandler))
+	server.HandleFunc("/me/identities/", AuthDecorator(IdentityHandler))
+	server.HandleFunc("/me/2fa", AuthDecorator(TwoFactorHandler))
+	server.HandleFunc("/me/2fa/confirm", AuthDecorator(ConfirmTwoFactorHandler))
 
 	server.HandleFunc("/login/facebook", fbAuth.LoginHandler)
 	server.HandleFunc("/login/facebook/callback", fbAuth.LoginCallbackHandler)
+	server.HandleFunc("/facebook/deauthorize", FacebookDeauthorizeHandler)
+	server.HandleFunc("/facebook/deletion", FacebookDataDeletionHandler)
+
+	server.HandleFunc("/admin/users", AdminDecorator(AdminUsersHandler))
+	server.HandleFunc("/admin/users/", AdminDecorator(AdminUserHandler))
+	server.HandleFunc("/admin/audit", AdminDecorator(AuditLogHandler))
+	server.HandleFunc("/admin/invites", AdminDecorator(InvitesHandler))
+	server.HandleFunc("/admin/invites/", AdminDecorator(InviteHandler))
+	server.HandleFunc("/admin/lockouts", AdminDecorator(UnlockHandler))
+
+	if mockIdP != nil {
+		server.Handle("/mock-idp/", http.StripPrefix("/mock-idp", mockIdP))
+	}
 	return GlobalHeadersHandler(server)
 }
 
 func main() {
 	port := config.Port
 	server := NewServer()
-	err := http.ListenAndServe(":"+port, handlers.CombinedLoggingHandler(os.Stdout, server))
+	go purgeDeletedUsers(time.Hour)
+	err := http.ListenAndServe(":"+port, handlers.CustomLoggingHandler(os.Stdout, server, writeAccessLog))
 	log.Fatal(err)
 }
@@ -2,18 +2,35 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/google/jsonapi"
+	"github.com/gorilla/handlers"
 	"github.com/mujz/ipp/authentication"
 	"github.com/mujz/ipp/config"
+	"github.com/mujz/ipp/mailer"
+	"github.com/mujz/ipp/signing"
 	"github.com/mujz/ipp/util/testutil"
+	"github.com/mujz/ipp/validator"
 )
 
 var secret = config.AuthSecretKey
@@ -33,6 +50,18 @@ func TestAnotherSuccessfulSignup(t *testing.T) {
 	testAuth(t, "/signup", fmt.Sprintf("j!#$&'*+-/=?^_`{|}~.01UP%v@m.ca", time.Now().UnixNano()), p, http.StatusOK)
 }
 
+func TestSuccessfulSignupPassphrase(t *testing.T) {
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	testAuth(t, "/signup", email, "ｃｏｒｒｅｃｔ horse battery staple", http.StatusOK)
+
+	// Passwords are normalized, so typing it on another keyboard works
+	testAuth(t, "/login", email, "correct horse battery staple", http.StatusOK)
+}
+
+func TestFailedSignupWeakPassword(t *testing.T) {
+	testAuth(t, "/signup", fmt.Sprintf(e, time.Now().UnixNano()), "12345678", http.StatusBadRequest)
+}
+
 func TestFailedSignupNoPassword(t *testing.T) {
 	testAuth(t, "/signup", fmt.Sprintf(e, time.Now().UnixNano()), "", http.StatusBadRequest)
 }
@@ -129,193 +158,1815 @@ func TestUnauthorizedIncrement(t *testing.T) {
 	testNext(t, "", 0, http.StatusUnauthorized)
 }
 
-/* --- Test 404 --- */
+/* --- Test Cookie Sessions --- */
 
-func Test404(t *testing.T) {
-	s := NewServer()
-	r, _ := http.NewRequest("GET", "/not-found", nil)
-	w := httptest.NewRecorder()
-	s.ServeHTTP(w, r)
+func TestSuccessfulSessionUpdate(t *testing.T) {
+	cookies := testSessionSignup(t)
+	testSessionUpdate(t, cookies, cookies[1].Value, http.StatusOK)
+}
 
-	// Assert Headers
-	checkHeaders(w, http.StatusNotFound, t)
+func TestFailedSessionUpdateWithoutCSRFToken(t *testing.T) {
+	cookies := testSessionSignup(t)
+	testSessionUpdate(t, cookies, "", http.StatusForbidden)
 }
 
-/* --- Helper Methods --- */
+/* --- Test Login Code Exchange --- */
 
-func testAuth(t *testing.T, path, email, password string, status int) string {
-	/* Seting up test */
-	s := NewServer()
+func TestFailedExchangeUnknownCode(t *testing.T) {
+	testExchange(t, "unknown", "verifier", http.StatusUnauthorized)
+}
 
-	user := &User{
-		Email:    email,
-		Password: password,
+func TestFailedExchangeWrongVerifier(t *testing.T) {
+	user, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), p)
+	if err != nil {
+		t.Fatal(err)
 	}
-	body := testutil.Body{}
-	if err := jsonapi.MarshalOnePayload(body, user); err != nil {
-		t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+
+	code := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := model.CreateLoginCode(hashString(code), user.ID, "challenge", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
 	}
 
-	/* Running test */
-	r, _ := http.NewRequest("POST", path, body)
-	w := httptest.NewRecorder()
+	testExchange(t, code, "verifier", http.StatusUnauthorized)
+}
 
-	s.ServeHTTP(w, r)
+/* --- Test Identities --- */
 
-	// Assert Headers
-	checkHeaders(w, status, t)
+func TestSuccessfulLinkIdentity(t *testing.T) {
+	token := testAuth(t, "/signup", fmt.Sprintf(e, time.Now().UnixNano()), p, http.StatusOK)
+	identityToken, err := auth.IdentityToken(&authentication.ExternalIdentity{
+		Provider: "facebook",
+		Subject:  strconv.FormatInt(time.Now().UnixNano(), 10),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	if status == http.StatusOK {
-		/* Reading result */
-		token := new(authentication.Token)
-		if err := jsonapi.UnmarshalPayload(w.Body, token); err != nil {
-			t.Fatalf("Failed to unmarshal response payload: %s\nReceived Body:%s\n", err, w.Body.String())
-		}
-		// assert token expiration date
-		now := time.Now()
-		exp, err := time.Parse(time.RFC3339, token.ExpiresAt)
-		if err != nil {
-			t.Logf(
-				"Token date format unrecognized \nExpected Format: %s\nGot:%s\n",
-				time.RFC3339,
-				token.ExpiresAt,
-			)
-			t.Fail()
-		} else if exp.Before(now) {
-			t.Logf(
-				"Token already expired\nNow: %s\nExpires:%s\n",
-				now.Format(time.RFC3339),
-				token.ExpiresAt,
-			)
-			t.Fail()
-		}
+	testLinkIdentity(t, token, identityToken, http.StatusOK)
+	testLinkIdentity(t, token, identityToken, http.StatusBadRequest)
+}
 
-		// assert token
-		parsedToken, err := jwt.Parse(token.Subject, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-			}
+func TestFailedLinkIdentityInvalidToken(t *testing.T) {
+	token := testAuth(t, "/signup", fmt.Sprintf(e, time.Now().UnixNano()), p, http.StatusOK)
+	testLinkIdentity(t, token, "forged.token", http.StatusBadRequest)
+}
 
-			return []byte(secret), nil
-		})
-		if err != nil {
-			t.Fatalf("Failed to decode token: %s\n", err)
-		}
+func TestUnauthorizedLinkIdentity(t *testing.T) {
+	testLinkIdentity(t, "", "", http.StatusUnauthorized)
+}
 
-		claims := parsedToken.Claims.(jwt.MapClaims)
-		if err != nil {
-			t.Fatalf("Failed getting claims from parsed token: %s\n", err)
-		}
+/* --- Test Password Reset --- */
 
-		if expClaim := claims["exp"].(float64); expClaim != float64(exp.Unix()) {
-			t.Logf(
-				"Expiration time mismatch between token and response attributes:\ntoken[\"exp\"]: %s\nattributes[\"ExpiresAt\"]:%s\n",
-				expClaim, float64(exp.Unix()),
-			)
-			t.Fail()
-		}
+func TestSuccessfulPasswordReset(t *testing.T) {
+	outbox := mailer.NewMemoryMailer()
+	mail = outbox
 
-		if _, err := strconv.Atoi(claims["sub"].(string)); err != nil {
-			t.Fatalf("User ID must be an integer; got %s\n", claims["sub"])
-		}
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	token := testAuth(t, "/signup", email, p, http.StatusOK)
 
-		return token.Subject
+	testPasswordReset(t, "/password/forgot", &PasswordReset{Email: email}, http.StatusAccepted)
+
+	resetToken := tokenFromEmail(t, outbox, email, "reset_token")
+
+	newPassword := "n3w-pa$$word"
+	testPasswordReset(t, "/password/reset", &PasswordReset{Token: resetToken, Password: newPassword}, http.StatusNoContent)
+
+	// The old token and password no longer work
+	testCurrentGet(t, token, 0, http.StatusUnauthorized)
+	testAuth(t, "/login", email, p, http.StatusUnauthorized)
+
+	token = testAuth(t, "/login", email, newPassword, http.StatusOK)
+	testCurrentGet(t, token, 1, http.StatusOK)
+
+	// Reset tokens are single-use
+	testPasswordReset(t, "/password/reset", &PasswordReset{Token: resetToken, Password: p}, http.StatusBadRequest)
+}
+
+func TestForgotPasswordUnknownEmail(t *testing.T) {
+	outbox := mailer.NewMemoryMailer()
+	mail = outbox
+
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	testPasswordReset(t, "/password/forgot", &PasswordReset{Email: email}, http.StatusAccepted)
+
+	background.Wait()
+	if _, ok := outbox.Last(email); ok {
+		t.Fatal("Expected no email to an unknown address")
 	}
-	return ""
 }
 
-func testCurrentGet(t *testing.T, token string, expected, status int) {
-	/* Seting up test */
-	s := NewServer()
+func TestFailedPasswordResetInvalidToken(t *testing.T) {
+	testPasswordReset(t, "/password/reset", &PasswordReset{Token: "forged", Password: p}, http.StatusBadRequest)
+}
 
-	/* Running test */
-	r, _ := http.NewRequest("GET", "/current", nil)
-	r.Header.Add("Authorization", "Bearer "+token)
-	w := httptest.NewRecorder()
+/* --- Test Email Verification --- */
 
-	s.ServeHTTP(w, r)
+func TestSuccessfulEmailVerification(t *testing.T) {
+	outbox := mailer.NewMemoryMailer()
+	mail = outbox
 
-	// Assert headers
-	checkHeaders(w, status, t)
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	token := testAuth(t, "/signup", email, p, http.StatusOK)
+	verifyToken := tokenFromEmail(t, outbox, email, "verify_token")
 
-	if status == http.StatusOK {
-		/* Reading result */
-		number := new(Number)
-		if err := jsonapi.UnmarshalPayload(w.Body, number); err != nil {
-			t.Fatalf("Failed to unmarshal response payload: %s\nReceived Body:%s\n", err, w.Body.String())
-		}
+	// The signup email was just sent
+	testResendVerification(t, token, http.StatusTooManyRequests)
 
-		if got := number.Value; got != expected {
-			t.Fatalf("Expected number = %d, but got = %d\n", expected, got)
-		}
+	testVerifyEmail(t, verifyToken, http.StatusNoContent)
+	testVerifyEmail(t, verifyToken, http.StatusBadRequest)
+
+	testResendVerification(t, token, http.StatusBadRequest)
+}
+
+func TestUnverifiedReadOnlyAccess(t *testing.T) {
+	outbox := mailer.NewMemoryMailer()
+	mail = outbox
+
+	config.UnverifiedAccess = readOnlyAccess
+	defer func() { config.UnverifiedAccess = fullAccess }()
+
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	token := testAuth(t, "/signup", email, p, http.StatusOK)
+
+	testCurrentGet(t, token, 1, http.StatusOK)
+	testCurrentUpdate(t, token, 5, http.StatusForbidden)
+	testNext(t, token, 2, http.StatusForbidden)
+
+	testVerifyEmail(t, tokenFromEmail(t, outbox, email, "verify_token"), http.StatusNoContent)
+
+	testCurrentUpdate(t, token, 5, http.StatusOK)
+	testNext(t, token, 6, http.StatusOK)
+}
+
+func TestUnverifiedLimitedAccess(t *testing.T) {
+	config.UnverifiedAccess = limitedAccess
+	defer func() { config.UnverifiedAccess = fullAccess }()
+
+	token := testAuth(t, "/signup", fmt.Sprintf(e, time.Now().UnixNano()), p, http.StatusOK)
+
+	testCurrentUpdate(t, token, config.UnverifiedNumberLimit-1, http.StatusOK)
+	testNext(t, token, config.UnverifiedNumberLimit, http.StatusOK)
+	testNext(t, token, 0, http.StatusForbidden)
+	testCurrentUpdate(t, token, config.UnverifiedNumberLimit+1, http.StatusForbidden)
+}
+
+/* --- Test Me --- */
+
+func TestSuccessfulMe(t *testing.T) {
+	outbox := mailer.NewMemoryMailer()
+	mail = outbox
+
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	token := testAuth(t, "/signup", email, p, http.StatusOK)
+	testNext(t, token, 2, http.StatusOK)
+
+	// The number is included in the compound document
+	w := testMe(t, "GET", token, nil, http.StatusOK)
+	var doc struct {
+		Data struct {
+			Attributes map[string]interface{} `json:"attributes"`
+		} `json:"data"`
+		Included []struct {
+			Type       string                 `json:"type"`
+			Attributes map[string]interface{} `json:"attributes"`
+		} `json:"included"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Data.Attributes["email"] != email || doc.Data.Attributes["password"] != nil {
+		t.Fatalf("Expected the email and no password; Got %v", doc.Data.Attributes)
+	}
+	if len(doc.Included) != 1 || doc.Included[0].Type != "number" || doc.Included[0].Attributes["value"] != 2.0 {
+		t.Fatalf("Expected the number 2 to be included; Got %+v", doc.Included)
 	}
+
+	// Changing the email takes the current password
+	newEmail := "new" + email
+	testMe(t, "PATCH", token, &User{Email: newEmail}, http.StatusUnauthorized)
+	testMe(t, "PATCH", token, &User{Email: newEmail, CurrentPassword: "wrongPassword"}, http.StatusUnauthorized)
+
+	// And asks to verify the new one and tells the old one
+	testMe(t, "PATCH", token, &User{Email: newEmail, CurrentPassword: p}, http.StatusOK)
+	if msg, ok := outbox.Last(email); !ok || msg.Subject != "Your i++ email address was changed" {
+		t.Fatalf("Expected an email to the old address; Got %+v", msg)
+	}
+	testVerifyEmail(t, tokenFromEmail(t, outbox, newEmail, "verify_token"), http.StatusNoContent)
+
+	testAuth(t, "/login", email, p, http.StatusUnauthorized)
+	testAuth(t, "/login", newEmail, p, http.StatusOK)
 }
 
-func testCurrentUpdate(t *testing.T, token string, newValue interface{}, status int) {
-	/* Seting up test */
-	s := NewServer()
+func TestFailedMeEmailTaken(t *testing.T) {
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	testAuth(t, "/signup", email, p, http.StatusOK)
+	token := testAuth(t, "/signup", "other"+email, p, http.StatusOK)
 
-	type TestNumber struct {
-		Value interface{} `jsonapi:"attr,value"`
+	testMe(t, "PATCH", token, &User{Email: email, CurrentPassword: p}, http.StatusBadRequest)
+	testMe(t, "PATCH", token, &User{Email: "invalid"}, http.StatusBadRequest)
+}
+
+func TestSuccessfulChangePassword(t *testing.T) {
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	token := testAuth(t, "/signup", email, p, http.StatusOK)
+	newPassword := "n3w-pa$$word"
+
+	testChangePassword(t, token, &PasswordChange{CurrentPassword: "wrongPassword", Password: newPassword}, http.StatusUnauthorized)
+	testChangePassword(t, token, &PasswordChange{CurrentPassword: p, Password: "short"}, http.StatusBadRequest)
+
+	w := testChangePassword(t, token, &PasswordChange{CurrentPassword: p, Password: newPassword}, http.StatusOK)
+	newToken := new(authentication.Token)
+	if err := jsonapi.UnmarshalPayload(w.Body, newToken); err != nil {
+		t.Fatal(err)
 	}
 
-	number := &TestNumber{
-		Value: newValue,
+	// Other sessions are logged out
+	testCurrentGet(t, token, 0, http.StatusUnauthorized)
+	testCurrentGet(t, newToken.Subject, 1, http.StatusOK)
+
+	testAuth(t, "/login", email, p, http.StatusUnauthorized)
+	testAuth(t, "/login", email, newPassword, http.StatusOK)
+}
+
+func TestDeleteAndRestoreAccount(t *testing.T) {
+	outbox := mailer.NewMemoryMailer()
+	mail = outbox
+
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	token := testAuth(t, "/signup", email, p, http.StatusOK)
+
+	testDeleteMe(t, token, &AccountDeletion{Password: "wrongPassword"}, http.StatusUnauthorized)
+	testDeleteMe(t, token, &AccountDeletion{Password: p}, http.StatusAccepted)
+	if msg, ok := outbox.Last(email); !ok || msg.Subject != "Your i++ account will be deleted" {
+		t.Fatalf("Expected an email about the deletion; Got %+v", msg)
 	}
 
-	body := testutil.Body{}
-	if err := jsonapi.MarshalOnePayload(body, number); err != nil {
-		t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+	// The user is logged out everywhere but can log in to restore the
+	// account during the grace period
+	testCurrentGet(t, token, 0, http.StatusUnauthorized)
+	token = testAuth(t, "/login", email, p, http.StatusOK)
+
+	user := new(User)
+	if err := jsonapi.UnmarshalPayload(testMe(t, "GET", token, nil, http.StatusOK).Body, user); err != nil {
+		t.Fatal(err)
+	}
+	if user.DeleteAt == nil || user.DeleteAt.Before(time.Now().Add(config.AccountDeletionGracePeriod-time.Minute)) {
+		t.Fatalf("Expected the account to be deleted after the grace period; Got %v", user.DeleteAt)
 	}
 
-	/* Running test */
-	r, _ := http.NewRequest("PUT", "/current", body)
+	testRestoreAccount(t, token, http.StatusNoContent)
+	user = new(User)
+	if err := jsonapi.UnmarshalPayload(testMe(t, "GET", token, nil, http.StatusOK).Body, user); err != nil {
+		t.Fatal(err)
+	}
+	if user.DeleteAt != nil {
+		t.Fatalf("Expected the deletion to be cancelled; Got %v", user.DeleteAt)
+	}
+}
+
+func TestSuccessfulExport(t *testing.T) {
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	token := testAuth(t, "/signup", email, p, http.StatusOK)
+	testNext(t, token, 2, http.StatusOK)
+
+	s := NewServer()
+	r, _ := http.NewRequest("GET", "/me/export", nil)
 	r.Header.Add("Authorization", "Bearer "+token)
 	w := httptest.NewRecorder()
-
 	s.ServeHTTP(w, r)
 
-	// Assert headers
-	checkHeaders(w, status, t)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected a JSON file; Got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
 
-	if status == http.StatusOK {
-		/* Reading result */
-		number := new(Number)
-		if err := jsonapi.UnmarshalPayload(w.Body, number); err != nil {
-			t.Fatalf("Failed to unmarshal response payload: %s\nReceived Body:%s\n", err, w.Body.String())
-		}
+	export := new(UserExport)
+	if err := json.Unmarshal(w.Body.Bytes(), export); err != nil {
+		t.Fatal(err)
+	}
+	if export.Account.Email == nil || *export.Account.Email != email || export.Number != 2 {
+		t.Fatalf("Expected the account and number; Got %+v", export)
+	}
+	if len(export.PendingLinks) != 1 || export.PendingLinks[0].Kind != "email_verification" {
+		t.Fatalf("Expected the signup verification link; Got %+v", export.PendingLinks)
+	}
+	if strings.Contains(w.Body.String(), "argon2") {
+		t.Fatal("Expected the password hash to be left out")
+	}
+}
 
-		if got := number.Value; got != newValue {
-			t.Fatalf("Expected number = %d, but got = %d\n", newValue, got)
-		}
+/* --- Test Magic Links --- */
+
+func TestSuccessfulMagicLogin(t *testing.T) {
+	outbox := mailer.NewMemoryMailer()
+	mail = outbox
+
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	testAuth(t, "/signup", email, p, http.StatusOK)
+
+	testMagicLink(t, email, http.StatusAccepted)
+	magicToken := tokenFromEmail(t, outbox, email, "magic_token")
+
+	token := testMagicLinkCallback(t, magicToken, http.StatusOK)
+	testCurrentGet(t, token, 1, http.StatusOK)
+
+	// Magic links are single-use
+	testMagicLinkCallback(t, magicToken, http.StatusUnauthorized)
+}
+
+func TestMagicLinkUnknownEmail(t *testing.T) {
+	outbox := mailer.NewMemoryMailer()
+	mail = outbox
+
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	testMagicLink(t, email, http.StatusAccepted)
+
+	background.Wait()
+	if _, ok := outbox.Last(email); ok {
+		t.Fatal("Expected no email to an unknown address")
 	}
 }
 
-func testNext(t *testing.T, token string, expected, status int) {
-	/* Seting up test */
-	s := NewServer()
+func TestFailedMagicLinkInvalidEmail(t *testing.T) {
+	testMagicLink(t, fmt.Sprintf("jd%v", time.Now().UnixNano()), http.StatusBadRequest)
+}
 
-	/* Running test */
-	r, _ := http.NewRequest("GET", "/next", nil)
-	r.Header.Add("Authorization", "Bearer "+token)
-	w := httptest.NewRecorder()
+/* --- Test Two-Factor Authentication --- */
 
-	s.ServeHTTP(w, r)
+func TestSuccessfulTwoFactorLogin(t *testing.T) {
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	token := testAuth(t, "/signup", email, p, http.StatusOK)
 
-	// Assert headers
-	checkHeaders(w, status, t)
+	/* Enrolling */
+	w := testTwoFactor(t, "POST", "/me/2fa", token, nil, http.StatusOK)
+	enrollment := new(TwoFactor)
+	if err := jsonapi.UnmarshalPayload(w.Body, enrollment); err != nil {
+		t.Fatal(err)
+	}
 
-	if status == http.StatusOK {
-		/* Reading result */
-		number := new(Number)
-		if err := jsonapi.UnmarshalPayload(w.Body, number); err != nil {
-			t.Fatalf("Failed to unmarshal response payload: %s\nReceived Body:%s\n", err, w.Body.String())
-		}
+	testTwoFactor(t, "POST", "/me/2fa/confirm", token, &TwoFactor{Code: "not a code"}, http.StatusUnauthorized)
+	w = testTwoFactor(t, "POST", "/me/2fa/confirm", token, &TwoFactor{Code: totp(t, enrollment.Secret)}, http.StatusOK)
+	var confirmation struct {
+		Data struct {
+			Attributes struct {
+				RecoveryCodes []string `json:"recovery_codes"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&confirmation); err != nil {
+		t.Fatal(err)
+	}
+	recoveryCodes := confirmation.Data.Attributes.RecoveryCodes
+	if len(recoveryCodes) < 2 {
+		t.Fatalf("Expected recovery codes; Got %v", recoveryCodes)
+	}
 
-		if got := number.Value; got != expected {
-			t.Fatalf("Expected number = %d, but got = %d\n", expected, got)
-		}
+	/* Logging in */
+	challenge := testLoginChallenge(t, email, p)
+
+	testTwoFactor(t, "POST", "/login/2fa", "", &TwoFactor{Challenge: "forged", Code: recoveryCodes[0]}, http.StatusUnauthorized)
+	w = testTwoFactor(t, "POST", "/login/2fa", "", &TwoFactor{Challenge: challenge, Code: recoveryCodes[0]}, http.StatusOK)
+
+	loggedIn := new(authentication.Token)
+	if err := jsonapi.UnmarshalPayload(w.Body, loggedIn); err != nil {
+		t.Fatal(err)
+	}
+	testCurrentGet(t, loggedIn.Subject, 1, http.StatusOK)
+
+	// Recovery codes are single-use
+	testTwoFactor(t, "POST", "/login/2fa", "", &TwoFactor{Challenge: challenge, Code: recoveryCodes[0]}, http.StatusUnauthorized)
+
+	/* Disabling */
+	testTwoFactor(t, "DELETE", "/me/2fa", token, &TwoFactor{Code: recoveryCodes[1]}, http.StatusNoContent)
+	testAuth(t, "/login", email, p, http.StatusOK)
+}
+
+/* --- Test Brute-Force Protection --- */
+
+func TestLoginLockout(t *testing.T) {
+	adminToken := testAdmin(t)
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	testAuth(t, "/signup", email, p, http.StatusOK)
+
+	for i := 0; i < accountPolicy.FreeAttempts; i++ {
+		testAuth(t, "/login", email, "wrongPassword", http.StatusUnauthorized)
 	}
+
+	// Even the right password has to wait now
+	w := testLogin(t, email, p, http.StatusTooManyRequests)
+	if retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retryAfter < 1 {
+		t.Fatalf("Expected a Retry-After header; Got %q", w.Header().Get("Retry-After"))
+	}
+
+	// Admins can lift the lockout
+	testUnlock(t, "not,a,token", "email="+url.QueryEscape(email), http.StatusUnauthorized)
+	testUnlock(t, adminToken, "", http.StatusBadRequest)
+	testUnlock(t, adminToken, "email="+url.QueryEscape(email), http.StatusNoContent)
+	testAuth(t, "/login", email, p, http.StatusOK)
+}
+
+/* --- Test Admin API --- */
+
+func TestAdmin(t *testing.T) {
+	adminToken := testAdmin(t)
+
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	token := testAuth(t, "/signup", email, p, http.StatusOK)
+	userID, err := model.GetUserID(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userPath := fmt.Sprintf("/admin/users/%d", userID)
+
+	// Only admins can use it
+	testRequest(t, "GET", "/admin/users", token, nil, http.StatusForbidden)
+
+	// Search
+	w := testRequest(t, "GET", "/admin/users?q="+url.QueryEscape(email)+"&page[size]=1", adminToken, nil, http.StatusOK)
+	if total := w.Header().Get("X-Total-Count"); total != "1" {
+		t.Fatalf("Expected 1 user; Got %s", total)
+	}
+	testRequest(t, "GET", "/admin/users?page[size]=1000", adminToken, nil, http.StatusBadRequest)
+
+	// Adjust the number
+	testRequest(t, "PUT", userPath+"/number", adminToken, &Number{Value: 42}, http.StatusOK)
+	testCurrentGet(t, token, 42, http.StatusOK)
+
+	// Disabling logs the user out and keeps them out
+	testRequest(t, "POST", userPath+"/disable", adminToken, nil, http.StatusOK)
+	testCurrentGet(t, token, 0, http.StatusUnauthorized)
+	testAuth(t, "/login", email, p, http.StatusForbidden)
+
+	testRequest(t, "POST", userPath+"/enable", adminToken, nil, http.StatusOK)
+	token = testAuth(t, "/login", email, p, http.StatusOK)
+	testCurrentGet(t, token, 42, http.StatusOK)
+
+	// Force logout
+	testRequest(t, "POST", userPath+"/logout", adminToken, nil, http.StatusOK)
+	testCurrentGet(t, token, 0, http.StatusUnauthorized)
+
+	testRequest(t, "GET", "/admin/users/0", adminToken, nil, http.StatusNotFound)
+
+	// Everything was audited, including looking at the audit log
+	w = testRequest(t, "GET", fmt.Sprintf("/admin/audit?user_id=%d", userID), adminToken, nil, http.StatusOK)
+	if total := w.Header().Get("X-Total-Count"); total != "5" {
+		t.Fatalf("Expected 5 audit log entries; Got %s", total)
+	}
+}
+
+/* --- Test Signup Controls --- */
+
+func TestInviteOnlySignup(t *testing.T) {
+	adminToken := testAdmin(t)
+
+	config.SignupMode = inviteSignup
+	defer func() { config.SignupMode = openSignup }()
+
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	testSignupWithInvite(t, email, "", http.StatusForbidden)
+	testSignupWithInvite(t, email, "made,up", http.StatusBadRequest)
+
+	w := testRequest(t, "POST", "/admin/invites", adminToken, &Invite{MaxUses: 1}, http.StatusCreated)
+	invite := new(Invite)
+	if err := jsonapi.UnmarshalPayload(w.Body, invite); err != nil {
+		t.Fatal(err)
+	}
+
+	// A signup that fails doesn't use up the invite
+	testSignupWithInvite(t, "invalid", invite.Code, http.StatusBadRequest)
+	testSignupWithInvite(t, email, invite.Code, http.StatusOK)
+	testSignupWithInvite(t, "other"+email, invite.Code, http.StatusBadRequest)
+
+	testRequest(t, "DELETE", fmt.Sprintf("/admin/invites/%d", invite.ID), adminToken, nil, http.StatusNoContent)
+}
+
+func TestClosedSignup(t *testing.T) {
+	config.SignupMode = closedSignup
+	defer func() { config.SignupMode = openSignup }()
+
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	testAuth(t, "/signup", email, p, http.StatusForbidden)
+}
+
+func TestSignupDomains(t *testing.T) {
+	allowedDomains = validator.NewDomainList([]string{"m.ca"})
+	disposableDomains = validator.NewDomainList([]string{"mailinator.com"})
+	defer func() { allowedDomains, disposableDomains = nil, nil }()
+
+	testAuth(t, "/signup", fmt.Sprintf("jd%d@other.ca", time.Now().UnixNano()), p, http.StatusBadRequest)
+	testAuth(t, "/signup", fmt.Sprintf(e, time.Now().UnixNano()), p, http.StatusOK)
+
+	allowedDomains = nil
+	testAuth(t, "/signup", fmt.Sprintf("jd%d@eu.mailinator.com", time.Now().UnixNano()), p, http.StatusBadRequest)
+}
+
+/* --- Test Trials --- */
+
+func TestTrialConversion(t *testing.T) {
+	trial := testTrial(t, http.StatusCreated)
+	if !strings.HasPrefix(trial.Key, "ipp_live_") || trial.Number.Value != 1 {
+		t.Fatalf("Expected a live key and number 1; Got %s, %d", trial.Key, trial.Number.Value)
+	}
+
+	// Count with the key
+	testNext(t, trial.Key, 2, http.StatusOK)
+	testCurrentUpdate(t, trial.Key, 10, http.StatusOK)
+	testNext(t, trial.Key, 11, http.StatusOK)
+
+	// Convert with an email and password and keep counting
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	w := testConvertTrial(t, trial.Key, &User{Email: email, Password: "weak"}, http.StatusBadRequest)
+	w = testConvertTrial(t, trial.Key, &User{Email: email, Password: p}, http.StatusOK)
+	token := new(authentication.Token)
+	if err := jsonapi.UnmarshalPayload(w.Body, token); err != nil {
+		t.Fatal(err)
+	}
+	testNext(t, token.Subject, 12, http.StatusOK)
+	testNext(t, trial.Key, 13, http.StatusOK)
+	testAuth(t, "/login", email, p, http.StatusOK)
+
+	// The key can't manage the account once it's a real one
+	testMe(t, "GET", trial.Key, nil, http.StatusForbidden)
+
+	user := new(User)
+	if err := jsonapi.UnmarshalPayload(testMe(t, "GET", token.Subject, nil, http.StatusOK).Body, user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != email || user.TrialExpiresAt != nil {
+		t.Fatalf("Expected a converted user with email %s; Got %s, %v", email, user.Email, user.TrialExpiresAt)
+	}
+
+	testConvertTrial(t, trial.Key, &User{Email: "other" + email, Password: p}, http.StatusBadRequest)
+}
+
+func TestTrialConversionWithIdentity(t *testing.T) {
+	trial := testTrial(t, http.StatusCreated)
+	identityToken, err := auth.IdentityToken(&authentication.ExternalIdentity{
+		Provider: "facebook",
+		Subject:  strconv.FormatInt(time.Now().UnixNano(), 10),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testLinkIdentity(t, trial.Key, identityToken, http.StatusOK)
+	if trial, err := model.IsTrial(trial.ID); err != nil || trial {
+		t.Fatalf("Expected the trial to be over; Got %v, %v", trial, err)
+	}
+}
+
+func TestTrialDeletion(t *testing.T) {
+	trial := testTrial(t, http.StatusCreated)
+	testDeleteMe(t, trial.Key, &AccountDeletion{}, http.StatusNoContent)
+	testNext(t, trial.Key, 0, http.StatusUnauthorized)
+}
+
+func TestTrialClosed(t *testing.T) {
+	config.SignupMode = inviteSignup
+	defer func() { config.SignupMode = openSignup }()
+
+	testTrial(t, http.StatusForbidden)
+}
+
+/* --- Test API Keys --- */
+
+func TestTestModeKeys(t *testing.T) {
+	token := testAuth(t, "/signup", fmt.Sprintf(e, time.Now().UnixNano()), p, http.StatusOK)
+	testNext(t, token, 2, http.StatusOK)
+
+	testCreateAPIKey(t, token, &APIKey{Name: "CI", Mode: "sandbox"}, http.StatusBadRequest)
+	testKey := testCreateAPIKey(t, token, &APIKey{Name: "CI", Mode: testMode}, http.StatusCreated)
+	liveKey := testCreateAPIKey(t, token, &APIKey{Name: "Server"}, http.StatusCreated)
+	if !strings.HasPrefix(testKey.Key, "ipp_test_") || liveKey.Mode != liveMode {
+		t.Fatalf("Expected a test key and a live one; Got %s, %s", testKey.Key, liveKey.Mode)
+	}
+
+	// The sandbox starts as a copy of the number and never touches it
+	testNext(t, testKey.Key, 3, http.StatusOK)
+	testCurrentUpdate(t, testKey.Key, 100, http.StatusOK)
+	testCurrentGet(t, testKey.Key, 100, http.StatusOK)
+	testCurrentGet(t, token, 2, http.StatusOK)
+	testNext(t, liveKey.Key, 3, http.StatusOK)
+	testCurrentGet(t, testKey.Key, 100, http.StatusOK)
+
+	// Test-mode keys can only count
+	testMe(t, "GET", testKey.Key, nil, http.StatusForbidden)
+	testRequest(t, "GET", "/me/keys", testKey.Key, nil, http.StatusForbidden)
+
+	// Wiping the sandbox starts it over from the number
+	testRequest(t, "DELETE", "/sandbox", testKey.Key, nil, http.StatusNoContent)
+	testCurrentGet(t, testKey.Key, 3, http.StatusOK)
+
+	// Revoked keys stop working
+	w := testRequest(t, "GET", "/me/keys", token, nil, http.StatusOK)
+	var keys struct {
+		Data []struct {
+			Attributes map[string]interface{} `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys.Data) != 2 || keys.Data[0].Attributes["key"] != nil {
+		t.Fatalf("Expected 2 keys without the keys themselves; Got %+v", keys.Data)
+	}
+	testRequest(t, "DELETE", fmt.Sprintf("/me/keys/%d", testKey.ID), token, nil, http.StatusNoContent)
+	testRequest(t, "DELETE", fmt.Sprintf("/me/keys/%d", testKey.ID), token, nil, http.StatusNotFound)
+	testNext(t, testKey.Key, 0, http.StatusUnauthorized)
+}
+
+func TestAPIKeyRestrictions(t *testing.T) {
+	token := testAuth(t, "/signup", fmt.Sprintf(e, time.Now().UnixNano()), p, http.StatusOK)
+
+	testCreateAPIKey(t, token, &APIKey{Name: "Web", AllowedNetworks: []string{"192.0.2"}}, http.StatusBadRequest)
+	testCreateAPIKey(t, token, &APIKey{Name: "Web", AllowedOrigins: []string{"example.com"}}, http.StatusBadRequest)
+	expired := time.Now().Add(-time.Hour)
+	testCreateAPIKey(t, token, &APIKey{Name: "Web", ExpiresAt: &expired}, http.StatusBadRequest)
+
+	key := testCreateAPIKey(t, token, &APIKey{
+		Name:            "Web",
+		AllowedNetworks: []string{"192.0.2.1/24"},
+		AllowedOrigins:  []string{"https://Example.com/"},
+		MaxCalls:        3,
+	}, http.StatusCreated)
+	if key.AllowedNetworks[0] != "192.0.2.0/24" || key.AllowedOrigins[0] != "https://example.com" {
+		t.Fatalf("Expected the restrictions to be normalized; Got %v, %v", key.AllowedNetworks, key.AllowedOrigins)
+	}
+
+	trustProxy := config.TrustProxy
+	config.TrustProxy = false
+	defer func() { config.TrustProxy = trustProxy }()
+
+	origin := "https://example.com"
+	testNextFrom(t, key.Key, "192.0.2.7:1234", "", origin, "", http.StatusOK)
+	w := testNextFrom(t, key.Key, "198.51.100.1:1234", "192.0.2.7", origin, "ip_not_allowed", http.StatusForbidden)
+	if !strings.Contains(w.Body.String(), "IP address") {
+		t.Fatalf("Expected the error to name the restriction; Got %s", w.Body.String())
+	}
+	testNextFrom(t, key.Key, "192.0.2.7:1234", "", "https://evil.com", "origin_not_allowed", http.StatusForbidden)
+	testNextFrom(t, key.Key, "192.0.2.7:1234", "", "", "origin_not_allowed", http.StatusForbidden)
+
+	// Only the trusted proxy's X-Forwarded-For entries are believed
+	trustedProxies = []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}
+	defer func() { trustedProxies = nil }()
+	testNextFrom(t, key.Key, "10.0.0.1:1234", "192.0.2.7, 10.0.0.2", origin, "", http.StatusOK)
+	testNextFrom(t, key.Key, "10.0.0.1:1234", "192.0.2.7, 198.51.100.1", origin, "ip_not_allowed", http.StatusForbidden)
+
+	// Calls that break other restrictions don't count toward the maximum
+	testNextFrom(t, key.Key, "192.0.2.7:1234", "", origin, "", http.StatusOK)
+	testNextFrom(t, key.Key, "192.0.2.7:1234", "", origin, "call_limit_reached", http.StatusForbidden)
+	testCurrentGet(t, token, 4, http.StatusOK)
+}
+
+/* --- Test Service Accounts --- */
+
+func TestServiceAccounts(t *testing.T) {
+	token := testAuth(t, "/signup", fmt.Sprintf(e, time.Now().UnixNano()), p, http.StatusOK)
+
+	testCreateServiceAccount(t, token, &ServiceAccount{Name: "Backend"}, http.StatusBadRequest)
+	testCreateServiceAccount(t, token, &ServiceAccount{Name: "Backend", Scopes: []string{"admin"}}, http.StatusBadRequest)
+	account := testCreateServiceAccount(t, token, &ServiceAccount{
+		Name:   "Backend",
+		Scopes: []string{readScope, nextScope},
+	}, http.StatusCreated)
+	if account.ClientID == "" || account.Secret == "" {
+		t.Fatalf("Expected a client ID and secret; Got %+v", account)
+	}
+
+	// Clients get tokens with their credentials in Basic auth or the form
+	form := url.Values{"grant_type": {"client_credentials"}}
+	read := testClientCredentials(t, account.ClientID, account.Secret, true, form, "", http.StatusOK)
+	if read.Scope != "read next" || read.TokenType != "Bearer" || read.ExpiresIn <= 0 {
+		t.Fatalf("Expected a bearer token for all the account's scopes; Got %+v", read)
+	}
+	form.Set("scope", nextScope)
+	next := testClientCredentials(t, account.ClientID, account.Secret, false, form, "", http.StatusOK)
+
+	form.Set("scope", writeScope)
+	testClientCredentials(t, account.ClientID, account.Secret, true, form, "invalid_scope", http.StatusBadRequest)
+	form.Del("scope")
+	testClientCredentials(t, account.ClientID, "wrong", true, form, "invalid_client", http.StatusUnauthorized)
+	testClientCredentials(t, account.ClientID, account.Secret, true, url.Values{"grant_type": {"password"}}, "unsupported_grant_type", http.StatusBadRequest)
+
+	// Tokens can only do what their scopes allow, for the account's owner
+	testNext(t, next.AccessToken, 3, http.StatusOK)
+	testCurrentGet(t, next.AccessToken, 0, http.StatusForbidden)
+	testCurrentGet(t, read.AccessToken, 3, http.StatusOK)
+	testCurrentUpdate(t, read.AccessToken, 100, http.StatusForbidden)
+	testRequest(t, "DELETE", "/sandbox", read.AccessToken, nil, http.StatusForbidden)
+
+	// Service accounts can only count
+	testMe(t, "GET", read.AccessToken, nil, http.StatusForbidden)
+	testRequest(t, "GET", "/me/service-accounts", read.AccessToken, nil, http.StatusForbidden)
+
+	// Deleting the account revokes its tokens
+	w := testRequest(t, "GET", "/me/service-accounts", token, nil, http.StatusOK)
+	if !strings.Contains(w.Body.String(), account.ClientID) || strings.Contains(w.Body.String(), account.Secret) {
+		t.Fatalf("Expected the account without its secret; Got %s", w.Body.String())
+	}
+	testRequest(t, "DELETE", fmt.Sprintf("/me/service-accounts/%d", account.ID), token, nil, http.StatusNoContent)
+	testNext(t, next.AccessToken, 0, http.StatusUnauthorized)
+	testClientCredentials(t, account.ClientID, account.Secret, true, form, "invalid_client", http.StatusUnauthorized)
+}
+
+func TestServiceAccountRestrictions(t *testing.T) {
+	token := testAuth(t, "/signup", fmt.Sprintf(e, time.Now().UnixNano()), p, http.StatusOK)
+
+	past := time.Now().Add(-time.Hour)
+	testCreateServiceAccount(t, token, &ServiceAccount{Name: "Backend", Scopes: []string{nextScope}, AllowedNetworks: []string{"not-an-ip"}}, http.StatusBadRequest)
+	testCreateServiceAccount(t, token, &ServiceAccount{Name: "Backend", Scopes: []string{nextScope}, ExpiresAt: &past}, http.StatusBadRequest)
+
+	// Clients outside the account's restrictions can't get tokens
+	account := testCreateServiceAccount(t, token, &ServiceAccount{
+		Name:           "Backend",
+		Scopes:         []string{nextScope},
+		AllowedOrigins: []string{"HTTPS://Example.com/"},
+	}, http.StatusCreated)
+	if len(account.AllowedOrigins) != 1 || account.AllowedOrigins[0] != "https://example.com" {
+		t.Fatalf("Expected the normalized origin; Got %v", account.AllowedOrigins)
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	testClientCredentials(t, account.ClientID, account.Secret, true, form, "invalid_client", http.StatusUnauthorized)
+}
+
+func TestIntrospection(t *testing.T) {
+	secret := config.IntrospectionSecret
+	config.IntrospectionSecret = "gateway,secret"
+	defer func() { config.IntrospectionSecret = secret }()
+
+	token := testAuth(t, "/signup", fmt.Sprintf(e, time.Now().UnixNano()), p, http.StatusOK)
+	key := testCreateAPIKey(t, token, &APIKey{Name: "CI", Mode: testMode}, http.StatusCreated)
+	account := testCreateServiceAccount(t, token, &ServiceAccount{Name: "Backend", Scopes: []string{nextScope}}, http.StatusCreated)
+	form := url.Values{"grant_type": {"client_credentials"}}
+	clientToken := testClientCredentials(t, account.ClientID, account.Secret, true, form, "", http.StatusOK)
+
+	// Only the gateway can introspect
+	testIntrospect(t, "wrong", token, http.StatusUnauthorized)
+
+	user := testIntrospect(t, config.IntrospectionSecret, token, http.StatusOK)
+	if !user.Active || user.Subject == "" || user.Scope != "" || user.ExpiresAt == 0 {
+		t.Fatalf("Expected an active unscoped token; Got %+v", user)
+	}
+	client := testIntrospect(t, config.IntrospectionSecret, clientToken.AccessToken, http.StatusOK)
+	if !client.Active || client.Subject != user.Subject || client.Scope != nextScope || client.ClientID != account.ClientID {
+		t.Fatalf("Expected an active token for the service account; Got %+v", client)
+	}
+	apiKey := testIntrospect(t, config.IntrospectionSecret, key.Key, http.StatusOK)
+	if !apiKey.Active || apiKey.Subject != user.Subject || apiKey.KeyMode != testMode {
+		t.Fatalf("Expected an active test-mode key; Got %+v", apiKey)
+	}
+
+	// Revoked credentials are inactive
+	testRequest(t, "DELETE", fmt.Sprintf("/me/keys/%d", key.ID), token, nil, http.StatusNoContent)
+	testRequest(t, "DELETE", fmt.Sprintf("/me/service-accounts/%d", account.ID), token, nil, http.StatusNoContent)
+	for _, revoked := range []string{key.Key, clientToken.AccessToken, "not,a,token"} {
+		if introspection := testIntrospect(t, config.IntrospectionSecret, revoked, http.StatusOK); introspection.Active || introspection.Subject != "" {
+			t.Fatalf("Expected an inactive token and nothing else; Got %+v", introspection)
+		}
+	}
+}
+
+func TestSignedRequests(t *testing.T) {
+	token := testAuth(t, "/signup", fmt.Sprintf(e, time.Now().UnixNano()), p, http.StatusOK)
+	key := testCreateAPIKey(t, token, &APIKey{Name: "Server"}, http.StatusCreated)
+	if key.SigningSecret == "" {
+		t.Fatal("Expected the key's signing secret")
+	}
+	keyID := strconv.Itoa(key.ID)
+
+	// Signed requests work like ones with the key
+	r := testSignedRequest(t, "GET", "/next", keyID, key.SigningSecret, nil)
+	testSigned(t, r, http.StatusOK)
+	testSigned(t, testSignedRequest(t, "PUT", "/current", keyID, key.SigningSecret, &Number{Value: 10}), http.StatusOK)
+	testCurrentGet(t, token, 10, http.StatusOK)
+
+	// But can't be replayed, changed or signed with the key itself
+	testSigned(t, r, http.StatusUnauthorized)
+	r = testSignedRequest(t, "GET", "/next", keyID, key.SigningSecret, nil)
+	r.URL.Path = "/me"
+	testSigned(t, r, http.StatusUnauthorized)
+	testSigned(t, testSignedRequest(t, "GET", "/next", keyID, key.Key, nil), http.StatusUnauthorized)
+
+	// Or manage the account
+	testSigned(t, testSignedRequest(t, "GET", "/me/keys", keyID, key.SigningSecret, nil), http.StatusForbidden)
+
+	// Revoked keys can't sign
+	testRequest(t, "DELETE", fmt.Sprintf("/me/keys/%d", key.ID), token, nil, http.StatusNoContent)
+	testSigned(t, testSignedRequest(t, "GET", "/next", keyID, key.SigningSecret, nil), http.StatusUnauthorized)
+	testCurrentGet(t, token, 10, http.StatusOK)
+}
+
+func TestAlternativeCredentials(t *testing.T) {
+	token := testAuth(t, "/signup", fmt.Sprintf(e, time.Now().UnixNano()), p, http.StatusOK)
+	key := testCreateAPIKey(t, token, &APIKey{Name: "Webhook"}, http.StatusCreated)
+
+	// API keys work as the Basic auth username or password and in X-API-Key
+	testCredential(t, "GET", "/next", func(r *http.Request) { r.SetBasicAuth(key.Key, "") }, http.StatusOK)
+	testCredential(t, "GET", "/next", func(r *http.Request) { r.SetBasicAuth("", key.Key) }, http.StatusOK)
+
+	// They can't manage the account however they're sent
+	testCredential(t, "GET", "/me", func(r *http.Request) { r.Header.Set("X-API-Key", key.Key) }, http.StatusForbidden)
+	testCredential(t, "GET", "/me/keys", func(r *http.Request) { r.SetBasicAuth(key.Key, "") }, http.StatusForbidden)
+	testRequest(t, "POST", "/me/keys", key.Key, nil, http.StatusForbidden)
+
+	// But passwords and tokens don't
+	testCredential(t, "GET", "/next", func(r *http.Request) { r.SetBasicAuth("jd@m.ca", p) }, http.StatusUnauthorized)
+	testCredential(t, "GET", "/next", func(r *http.Request) { r.Header.Set("X-API-Key", token) }, http.StatusUnauthorized)
+
+	// The query string is only used when it's turned on
+	queryAPIKeys := config.QueryAPIKeys
+	defer func() { config.QueryAPIKeys = queryAPIKeys }()
+	config.QueryAPIKeys = false
+	testCredential(t, "GET", "/next?api_key="+key.Key, nil, http.StatusUnauthorized)
+	config.QueryAPIKeys = true
+	testCredential(t, "GET", "/next?api_key="+key.Key, nil, http.StatusOK)
+	testCredential(t, "GET", "/current?api_key="+key.Key, nil, http.StatusOK)
+
+	// And keys in it can only get and count
+	testCredential(t, "PUT", "/current?api_key="+key.Key, nil, http.StatusForbidden)
+	testCredential(t, "DELETE", "/sandbox?api_key="+key.Key, nil, http.StatusForbidden)
+	testCredential(t, "GET", "/me?api_key="+key.Key, nil, http.StatusForbidden)
+	testCurrentGet(t, token, 4, http.StatusOK)
+}
+
+func TestAccessLogRedaction(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/next?a=1&api_key=ipp_live_secret&b=2", nil)
+	r.RequestURI = "/next?a=1&api_key=ipp_live_secret&b=2"
+	r.RemoteAddr = "192.0.2.1:1234"
+
+	var line strings.Builder
+	writeAccessLog(&line, handlers.LogFormatterParams{Request: r, URL: *r.URL, TimeStamp: time.Now(), StatusCode: 200})
+	if strings.Contains(line.String(), "ipp_live_secret") || !strings.Contains(line.String(), `"GET /next?a=1&api_key=REDACTED&b=2 HTTP/1.1" 200`) {
+		t.Fatalf("Expected the API key to be redacted; Got %s", line.String())
+	}
+}
+
+/* --- Test Enumeration Protection --- */
+
+func TestEnumerationProtection(t *testing.T) {
+	outbox := mailer.NewMemoryMailer()
+	mail = outbox
+
+	config.EnumerationProtection = true
+	defer func() { config.EnumerationProtection = false }()
+
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	testAuth(t, "/signup", email, p, http.StatusAccepted)
+	verifyToken := tokenFromEmail(t, outbox, email, "verify_token")
+
+	// Signing up again looks the same but emails the owner instead
+	testAuth(t, "/signup", email, p, http.StatusAccepted)
+	if msg, ok := outbox.Last(email); !ok || msg.Subject != "You already have an i++ account" {
+		t.Fatalf("Expected an email saying the account exists; Got %+v", msg)
+	}
+
+	// Logins fail the same way for unknown emails, wrong passwords and
+	// unverified emails
+	unknown := testLogin(t, "unknown"+email, p, http.StatusUnauthorized).Body.String()
+	if wrong := testLogin(t, email, "wrongPassword", http.StatusUnauthorized).Body.String(); wrong != unknown {
+		t.Fatalf("Expected the same error as for an unknown email %q; Got %q", unknown, wrong)
+	}
+	if unverified := testLogin(t, email, p, http.StatusUnauthorized).Body.String(); unverified != unknown {
+		t.Fatalf("Expected the same error as for an unknown email %q; Got %q", unknown, unverified)
+	}
+
+	testVerifyEmail(t, verifyToken, http.StatusNoContent)
+	token := testAuth(t, "/login", email, p, http.StatusOK)
+
+	// Changing the email to a taken one looks like changing it
+	otherEmail := "other" + email
+	testAuth(t, "/signup", otherEmail, p, http.StatusAccepted)
+	taken := testMe(t, "PATCH", token, &User{Email: otherEmail, CurrentPassword: p}, http.StatusAccepted).Body.String()
+	if changed := testMe(t, "PATCH", token, &User{Email: "new" + email, CurrentPassword: p}, http.StatusAccepted).Body.String(); changed != taken {
+		t.Fatalf("Expected the same response as for a taken email %q; Got %q", taken, changed)
+	}
+}
+
+/* --- Test Facebook Callbacks --- */
+
+func TestFacebookDataDeletion(t *testing.T) {
+	fbID := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if _, err := model.CreateIdentityUser("facebook", fbID, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer()
+
+	/* Requesting deletion */
+	form := url.Values{"signed_request": {signFacebookRequest(fmt.Sprintf(`{"algorithm": "HMAC-SHA256", "issued_at": %d, "user_id": "%s"}`, time.Now().Unix(), fbID))}}
+	r, _ := http.NewRequest("POST", "/facebook/deletion", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status (%d); Got (%d): %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	res := new(dataDeletionResponse)
+	if err := json.NewDecoder(w.Body).Decode(res); err != nil {
+		t.Fatal(err)
+	}
+	if res.ConfirmationCode == "" || !strings.HasSuffix(res.URL, "?code="+res.ConfirmationCode) {
+		t.Fatalf("Expected a confirmation code and status URL; Got %+v", res)
+	}
+
+	if _, err := model.GetIdentityUser("facebook", fbID); err != sql.ErrNoRows {
+		t.Fatalf("Expected the Facebook user to be deleted; Got %v", err)
+	}
+
+	/* Checking the status page */
+	r, _ = http.NewRequest("GET", "/facebook/deletion?code="+res.ConfirmationCode, nil)
+	w = httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), deletionStatuses[DeletionCompleted]) {
+		t.Fatalf("Expected a completed deletion status page; Got (%d): %s", w.Code, w.Body.String())
+	}
+}
+
+func TestFacebookDataDeletionForgedRequest(t *testing.T) {
+	s := NewServer()
+
+	form := url.Values{"signed_request": {"forged.request"}}
+	r, _ := http.NewRequest("POST", "/facebook/deletion", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	checkHeaders(w, http.StatusBadRequest, t)
+}
+
+/* --- Test 404 --- */
+
+func Test404(t *testing.T) {
+	s := NewServer()
+	r, _ := http.NewRequest("GET", "/not-found", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	// Assert Headers
+	checkHeaders(w, http.StatusNotFound, t)
+}
+
+/* --- Helper Methods --- */
+
+func testAuth(t *testing.T, path, email, password string, status int) string {
+	/* Seting up test */
+	s := NewServer()
+
+	user := &User{
+		Email:    email,
+		Password: password,
+	}
+	body := testutil.Body{}
+	if err := jsonapi.MarshalOnePayload(body, user); err != nil {
+		t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest("POST", path, body)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert Headers
+	checkHeaders(w, status, t)
+
+	if status == http.StatusOK {
+		/* Reading result */
+		token := new(authentication.Token)
+		if err := jsonapi.UnmarshalPayload(w.Body, token); err != nil {
+			t.Fatalf("Failed to unmarshal response payload: %s\nReceived Body:%s\n", err, w.Body.String())
+		}
+		// assert token expiration date
+		now := time.Now()
+		exp, err := time.Parse(time.RFC3339, token.ExpiresAt)
+		if err != nil {
+			t.Logf(
+				"Token date format unrecognized \nExpected Format: %s\nGot:%s\n",
+				time.RFC3339,
+				token.ExpiresAt,
+			)
+			t.Fail()
+		} else if exp.Before(now) {
+			t.Logf(
+				"Token already expired\nNow: %s\nExpires:%s\n",
+				now.Format(time.RFC3339),
+				token.ExpiresAt,
+			)
+			t.Fail()
+		}
+
+		// assert token
+		parsedToken, err := jwt.Parse(token.Subject, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+			}
+
+			return []byte(secret), nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to decode token: %s\n", err)
+		}
+
+		claims := parsedToken.Claims.(jwt.MapClaims)
+		if err != nil {
+			t.Fatalf("Failed getting claims from parsed token: %s\n", err)
+		}
+
+		if expClaim := claims["exp"].(float64); expClaim != float64(exp.Unix()) {
+			t.Logf(
+				"Expiration time mismatch between token and response attributes:\ntoken[\"exp\"]: %s\nattributes[\"ExpiresAt\"]:%s\n",
+				expClaim, float64(exp.Unix()),
+			)
+			t.Fail()
+		}
+
+		if _, err := strconv.Atoi(claims["sub"].(string)); err != nil {
+			t.Fatalf("User ID must be an integer; got %s\n", claims["sub"])
+		}
+
+		return token.Subject
+	}
+	return ""
+}
+
+func testCurrentGet(t *testing.T, token string, expected, status int) {
+	/* Seting up test */
+	s := NewServer()
+
+	/* Running test */
+	r, _ := http.NewRequest("GET", "/current", nil)
+	r.Header.Add("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+
+	if status == http.StatusOK {
+		/* Reading result */
+		number := new(Number)
+		if err := jsonapi.UnmarshalPayload(w.Body, number); err != nil {
+			t.Fatalf("Failed to unmarshal response payload: %s\nReceived Body:%s\n", err, w.Body.String())
+		}
+
+		if got := number.Value; got != expected {
+			t.Fatalf("Expected number = %d, but got = %d\n", expected, got)
+		}
+	}
+}
+
+func testCurrentUpdate(t *testing.T, token string, newValue interface{}, status int) {
+	/* Seting up test */
+	s := NewServer()
+
+	type TestNumber struct {
+		Value interface{} `jsonapi:"attr,value"`
+	}
+
+	number := &TestNumber{
+		Value: newValue,
+	}
+
+	body := testutil.Body{}
+	if err := jsonapi.MarshalOnePayload(body, number); err != nil {
+		t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest("PUT", "/current", body)
+	r.Header.Add("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+
+	if status == http.StatusOK {
+		/* Reading result */
+		number := new(Number)
+		if err := jsonapi.UnmarshalPayload(w.Body, number); err != nil {
+			t.Fatalf("Failed to unmarshal response payload: %s\nReceived Body:%s\n", err, w.Body.String())
+		}
+
+		if got := number.Value; got != newValue {
+			t.Fatalf("Expected number = %d, but got = %d\n", newValue, got)
+		}
+	}
+}
+
+func testNext(t *testing.T, token string, expected, status int) {
+	/* Seting up test */
+	s := NewServer()
+
+	/* Running test */
+	r, _ := http.NewRequest("GET", "/next", nil)
+	r.Header.Add("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+
+	if status == http.StatusOK {
+		/* Reading result */
+		number := new(Number)
+		if err := jsonapi.UnmarshalPayload(w.Body, number); err != nil {
+			t.Fatalf("Failed to unmarshal response payload: %s\nReceived Body:%s\n", err, w.Body.String())
+		}
+
+		if got := number.Value; got != expected {
+			t.Fatalf("Expected number = %d, but got = %d\n", expected, got)
+		}
+	}
+}
+
+func testSessionSignup(t *testing.T) []*http.Cookie {
+	/* Seting up test */
+	s := NewServer()
+
+	body := testutil.Body{}
+	user := &User{Email: fmt.Sprintf(e, time.Now().UnixNano()), Password: p}
+	if err := jsonapi.MarshalOnePayload(body, user); err != nil {
+		t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest("POST", "/signup?session=cookie", body)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, http.StatusOK, t)
+
+	token := new(authentication.Token)
+	if err := jsonapi.UnmarshalPayload(w.Body, token); err != nil {
+		t.Fatalf("Failed to unmarshal response payload: %s\nReceived Body:%s\n", err, w.Body.String())
+	}
+	if token.Subject != "" {
+		t.Fatalf("Expected the token to be kept out of the response body; Got %s", token.Subject)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 2 || cookies[0].Name != authentication.SessionCookieName || !cookies[0].HttpOnly {
+		t.Fatalf("Expected an HttpOnly session cookie and a CSRF cookie; Got %v", cookies)
+	}
+	return cookies
+}
+
+func testSessionUpdate(t *testing.T, cookies []*http.Cookie, csrfToken string, status int) {
+	/* Seting up test */
+	s := NewServer()
+
+	body := testutil.Body{}
+	if err := jsonapi.MarshalOnePayload(body, &Number{Value: 5}); err != nil {
+		t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest("PUT", "/current", body)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	if csrfToken != "" {
+		r.Header.Set(authentication.CSRFHeaderName, csrfToken)
+	}
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+}
+
+func signFacebookRequest(payload string) string {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, []byte(config.FBAppSecret))
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) + "." + encoded
+}
+
+func testExchange(t *testing.T, code, verifier string, status int) {
+	/* Seting up test */
+	s := NewServer()
+
+	body := testutil.Body{}
+	if err := jsonapi.MarshalOnePayload(body, &LoginCode{Code: code, Verifier: verifier}); err != nil {
+		t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest("POST", "/login/exchange", body)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+}
+
+func hashString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func testLinkIdentity(t *testing.T, token, identityToken string, status int) {
+	/* Seting up test */
+	s := NewServer()
+
+	body := testutil.Body{}
+	if err := jsonapi.MarshalOnePayload(body, &Identity{Token: identityToken}); err != nil {
+		t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest("POST", "/me/identities", body)
+	r.Header.Add("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+}
+
+// Returns the value of param in the link in the last email sent to the address
+func tokenFromEmail(t *testing.T, outbox *mailer.MemoryMailer, to, param string) string {
+	background.Wait()
+	msg, ok := outbox.Last(to)
+	if !ok {
+		t.Fatalf("Expected an email to %s", to)
+	}
+
+	for _, field := range strings.Fields(msg.Body) {
+		if link, err := url.Parse(field); err == nil && link.Query().Get(param) != "" {
+			return link.Query().Get(param)
+		}
+	}
+
+	t.Fatalf("Expected a link with %s in the email; Got %q", param, msg.Body)
+	return ""
+}
+
+func testVerifyEmail(t *testing.T, token string, status int) {
+	/* Seting up test */
+	s := NewServer()
+
+	body := testutil.Body{}
+	if err := jsonapi.MarshalOnePayload(body, &EmailVerification{Token: token}); err != nil {
+		t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest("POST", "/email/verify", body)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+}
+
+func testResendVerification(t *testing.T, token string, status int) {
+	/* Seting up test */
+	s := NewServer()
+
+	/* Running test */
+	r, _ := http.NewRequest("POST", "/email/resend", nil)
+	r.Header.Add("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+}
+
+func testMagicLink(t *testing.T, email string, status int) {
+	/* Seting up test */
+	s := NewServer()
+
+	body := testutil.Body{}
+	if err := jsonapi.MarshalOnePayload(body, &User{Email: email}); err != nil {
+		t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest("POST", "/login/magic", body)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+}
+
+// Returns the token the magic link was exchanged for
+func testMagicLinkCallback(t *testing.T, magicToken string, status int) string {
+	/* Seting up test */
+	s := NewServer()
+
+	/* Running test */
+	r, _ := http.NewRequest("GET", "/login/magic/callback?token="+url.QueryEscape(magicToken), nil)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+
+	if status != http.StatusOK {
+		return ""
+	}
+
+	/* Reading result */
+	token := new(authentication.Token)
+	if err := jsonapi.UnmarshalPayload(w.Body, token); err != nil {
+		t.Fatalf("Failed to unmarshal response payload: %s\nReceived Body:%s\n", err, w.Body.String())
+	}
+	return token.Subject
+}
+
+// Returns the current TOTP code for the base32 secret
+func totp(t *testing.T, secret string) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(time.Now().Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func testTwoFactor(t *testing.T, method, path, token string, twoFactor *TwoFactor, status int) *httptest.ResponseRecorder {
+	/* Seting up test */
+	s := NewServer()
+
+	body := testutil.Body{}
+	if twoFactor != nil {
+		if err := jsonapi.MarshalOnePayload(body, twoFactor); err != nil {
+			t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+		}
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest(method, path, body)
+	if token != "" {
+		r.Header.Add("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+	return w
+}
+
+// Logs in as a user with two-factor authentication and returns the challenge
+func testLoginChallenge(t *testing.T, email, password string) string {
+	/* Seting up test */
+	s := NewServer()
+
+	body := testutil.Body{}
+	if err := jsonapi.MarshalOnePayload(body, &User{Email: email, Password: password}); err != nil {
+		t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest("POST", "/login", body)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, http.StatusOK, t)
+
+	/* Reading result */
+	token := new(authentication.Token)
+	if err := jsonapi.UnmarshalPayload(w.Body, token); err != nil {
+		t.Fatalf("Failed to unmarshal response payload: %s\nReceived Body:%s\n", err, w.Body.String())
+	}
+	if token.Type != authentication.TwoFactorChallengeType {
+		t.Fatalf("Expected a two-factor challenge; Got %+v", token)
+	}
+	return token.Subject
+}
+
+// Logs in and returns the response
+func testLogin(t *testing.T, email, password string, status int) *httptest.ResponseRecorder {
+	/* Seting up test */
+	s := NewServer()
+
+	body := testutil.Body{}
+	if err := jsonapi.MarshalOnePayload(body, &User{Email: email, Password: password}); err != nil {
+		t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest("POST", "/login", body)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+	return w
+}
+
+func testUnlock(t *testing.T, token, query string, status int) {
+	/* Seting up test */
+	s := NewServer()
+
+	/* Running test */
+	r, _ := http.NewRequest("DELETE", "/admin/lockouts?"+query, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+}
+
+func testPasswordReset(t *testing.T, path string, reset *PasswordReset, status int) {
+	/* Seting up test */
+	s := NewServer()
+
+	body := testutil.Body{}
+	if err := jsonapi.MarshalOnePayload(body, reset); err != nil {
+		t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest("POST", path, body)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+}
+
+func testMe(t *testing.T, method, token string, user *User, status int) *httptest.ResponseRecorder {
+	/* Seting up test */
+	s := NewServer()
+
+	body := testutil.Body{}
+	if user != nil {
+		if err := jsonapi.MarshalOnePayload(body, user); err != nil {
+			t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+		}
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest(method, "/me", body)
+	r.Header.Add("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+	return w
+}
+
+func testChangePassword(t *testing.T, token string, change *PasswordChange, status int) *httptest.ResponseRecorder {
+	/* Seting up test */
+	s := NewServer()
+
+	body := testutil.Body{}
+	if err := jsonapi.MarshalOnePayload(body, change); err != nil {
+		t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest("POST", "/me/password", body)
+	r.Header.Add("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+	return w
+}
+
+func testDeleteMe(t *testing.T, token string, deletion *AccountDeletion, status int) {
+	/* Seting up test */
+	s := NewServer()
+
+	body := testutil.Body{}
+	if err := jsonapi.MarshalOnePayload(body, deletion); err != nil {
+		t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest("DELETE", "/me", body)
+	r.Header.Add("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+}
+
+func testRestoreAccount(t *testing.T, token string, status int) {
+	/* Seting up test */
+	s := NewServer()
+
+	/* Running test */
+	r, _ := http.NewRequest("POST", "/me/restore", nil)
+	r.Header.Add("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+}
+
+// Signs up a user, makes them an admin and returns their token
+func testAdmin(t *testing.T) string {
+	email := fmt.Sprintf(e, time.Now().UnixNano())
+	token := testAuth(t, "/signup", email, p, http.StatusOK)
+
+	userID, err := model.GetUserID(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := model.SetRole(userID, adminRole); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func testRequest(t *testing.T, method, path, token string, payload interface{}, status int) *httptest.ResponseRecorder {
+	/* Seting up test */
+	s := NewServer()
+
+	body := testutil.Body{}
+	if payload != nil {
+		if err := jsonapi.MarshalOnePayload(body, payload); err != nil {
+			t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+		}
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest(method, path, body)
+	r.Header.Add("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+	return w
+}
+
+func testSignupWithInvite(t *testing.T, email, inviteCode string, status int) {
+	/* Seting up test */
+	s := NewServer()
+
+	body := testutil.Body{}
+	if err := jsonapi.MarshalOnePayload(body, &User{Email: email, Password: p, InviteCode: inviteCode}); err != nil {
+		t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest("POST", "/signup", body)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+}
+
+func testTrial(t *testing.T, status int) *Trial {
+	/* Seting up test */
+	s := NewServer()
+
+	/* Running test */
+	r, _ := http.NewRequest("POST", "/trial", nil)
+	r.RemoteAddr = fmt.Sprintf("%d:1234", time.Now().UnixNano())
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+
+	trial := new(Trial)
+	if status == http.StatusCreated {
+		if err := jsonapi.UnmarshalPayload(w.Body, trial); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return trial
+}
+
+func testConvertTrial(t *testing.T, key string, user *User, status int) *httptest.ResponseRecorder {
+	/* Seting up test */
+	s := NewServer()
+
+	body := testutil.Body{}
+	if err := jsonapi.MarshalOnePayload(body, user); err != nil {
+		t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest("POST", "/trial/convert", body)
+	r.Header.Add("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+	return w
+}
+
+func testCreateAPIKey(t *testing.T, token string, key *APIKey, status int) *APIKey {
+	w := testRequest(t, "POST", "/me/keys", token, key, status)
+
+	created := new(APIKey)
+	if status == http.StatusCreated {
+		if err := jsonapi.UnmarshalPayload(w.Body, created); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return created
+}
+
+func testNextFrom(t *testing.T, key, remoteAddr, forwardedFor, origin, code string, status int) *httptest.ResponseRecorder {
+	/* Seting up test */
+	s := NewServer()
+
+	/* Running test */
+	r, _ := http.NewRequest("GET", "/next", nil)
+	r.RemoteAddr = remoteAddr
+	r.Header.Add("Authorization", "Bearer "+key)
+	if forwardedFor != "" {
+		r.Header.Add("X-Forwarded-For", forwardedFor)
+	}
+	if origin != "" {
+		r.Header.Add("Origin", origin)
+	}
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+
+	if code != "" && !strings.Contains(w.Body.String(), `"code":"`+code+`"`) {
+		t.Fatalf("Expected error code %s; Got %s", code, w.Body.String())
+	}
+	return w
+}
+
+func testCreateServiceAccount(t *testing.T, token string, account *ServiceAccount, status int) *ServiceAccount {
+	w := testRequest(t, "POST", "/me/service-accounts", token, account, status)
+
+	created := new(ServiceAccount)
+	if status == http.StatusCreated {
+		if err := jsonapi.UnmarshalPayload(w.Body, created); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return created
+}
+
+func testClientCredentials(t *testing.T, clientID, secret string, basic bool, form url.Values, code string, status int) *tokenResponse {
+	/* Seting up test */
+	s := NewServer()
+
+	values := url.Values{}
+	for k, v := range form {
+		values[k] = v
+	}
+	if !basic {
+		values.Set("client_id", clientID)
+		values.Set("client_secret", secret)
+	}
+
+	/* Running test */
+	r, _ := http.NewRequest("POST", "/oauth/token", strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if basic {
+		r.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(secret))
+	}
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// The token endpoint speaks OAuth2 rather than JSON API
+	if w.Code != status || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("Expected status %d and no caching; Got %d %q: %s", status, w.Code, w.Header().Get("Cache-Control"), w.Body.String())
+	}
+
+	var response struct {
+		tokenResponse
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Error != code {
+		t.Fatalf("Expected error %q; Got %q", code, response.Error)
+	}
+	return &response.tokenResponse
+}
+
+func testIntrospect(t *testing.T, gatewayToken, token string, status int) *introspectionResponse {
+	/* Seting up test */
+	s := NewServer()
+
+	/* Running test */
+	body := url.Values{"token": {token}}.Encode()
+	r, _ := http.NewRequest("POST", "/oauth/introspect", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Add("Authorization", "Bearer "+gatewayToken)
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	if w.Code != status {
+		t.Fatalf("Expected status %d; Got %d: %s", status, w.Code, w.Body.String())
+	}
+
+	introspection := new(introspectionResponse)
+	if status == http.StatusOK {
+		if !strings.HasPrefix(w.Header().Get("Cache-Control"), "private, max-age=") {
+			t.Fatalf("Expected caching hints; Got %q", w.Header().Get("Cache-Control"))
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), introspection); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return introspection
+}
+
+func testSignedRequest(t *testing.T, method, path, keyID, secret string, payload interface{}) *http.Request {
+	// Signing reads the whole body, so it has to end
+	body := new(bytes.Buffer)
+	if payload != nil {
+		if err := jsonapi.MarshalOnePayload(body, payload); err != nil {
+			t.Fatalf("Failed to marshal jsonapi request body: %s", err)
+		}
+	}
+
+	r, _ := http.NewRequest(method, path, body)
+	if err := signing.Sign(r, keyID, secret); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func testSigned(t *testing.T, r *http.Request, status int) {
+	/* Seting up test */
+	s := NewServer()
+
+	/* Running test */
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
+}
+
+func testCredential(t *testing.T, method, path string, setCredential func(*http.Request), status int) {
+	/* Seting up test */
+	s := NewServer()
+
+	/* Running test */
+	r, _ := http.NewRequest(method, path, nil)
+	if setCredential != nil {
+		setCredential(r)
+	}
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, r)
+
+	// Assert headers
+	checkHeaders(w, status, t)
 }
 
 func checkHeaders(w *httptest.ResponseRecorder, status int, t *testing.T) {
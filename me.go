@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/lib/pq"
+	"github.com/mujz/ipp/authentication"
+	"github.com/mujz/ipp/config"
+	"github.com/mujz/ipp/mailer"
+	"github.com/mujz/ipp/validator"
+)
+
+var emailChangedTemplate = template.Must(template.New("email-changed").Parse(`Hi,
+
+The email address of your i++ account was changed to {{ .Email }}.
+
+If you didn't change it, someone else may have access to your account. Please
+reply to this email so we can help you get it back.
+`))
+
+var accountDeletionTemplate = template.Must(template.New("deletion").Parse(`Hi,
+
+Your i++ account will be deleted for good on {{ .DeleteAt.Format "January 2, 2006" }}.
+
+If you change your mind before then, log in and restore it from your account
+page. If you didn't ask for this, please reply to this email.
+`))
+
+// Responds with the logged in user, their number and linked accounts,
+// changes their email or deletes them
+func MeHandler(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	ctx := r.Context()
+	userID := ctx.Value(userIDKey).(int)
+
+	switch r.Method {
+	case "GET":
+	case "PATCH":
+		// Parse the body's JSON
+		changes := new(User)
+		if err := jsonapi.UnmarshalPayload(r.Body, changes); err != nil {
+			marshalError(w, http.StatusBadRequest, "Invalid request body.")
+			log.Println(err)
+			return
+		}
+
+		// Validate email address
+		if !validator.ValidateEmail(changes.Email) {
+			marshalError(w, http.StatusBadRequest, "Invalid email address.")
+			return
+		}
+
+		// Confirm it's the user, so a stolen token can't take the account
+		// over by changing where its password resets go
+		if !confirmUser(w, userID, changes.CurrentPassword, changes.IdentityToken, "Failed to change email address.") {
+			return
+		}
+
+		if !changeEmail(w, userID, changes.Email) {
+			return
+		}
+
+		// Taken emails look like they changed too, so respond the same
+		// way whatever happened
+		if config.EnumerationProtection {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+	case "DELETE":
+		deleteAccount(w, r, userID)
+		return
+	default:
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Get the user
+	user, err := model.GetUser(userID)
+	if err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to retrieve user.")
+		log.Println(err)
+		return
+	}
+
+	// Send user to client with their number and identities included
+	jsonapi.MarshalOnePayload(w, user)
+}
+
+// Changes the user's email, asks them to verify the new one and tells the
+// old one. Responds with an error and returns false if it can't.
+func changeEmail(w http.ResponseWriter, userID int, email string) bool {
+	oldEmail, _, err := model.GetEmailVerified(userID)
+	if err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to change email address.")
+		log.Println(err)
+		return false
+	}
+	if oldEmail == email {
+		return true
+	}
+
+	if err := model.ChangeEmail(userID, email); err != nil {
+		if err == sql.ErrNoRows {
+			marshalError(w, http.StatusBadRequest, "You log in with a linked account, so there's no email address to change.")
+		} else if err, ok := err.(*pq.Error); ok && err.Code.Name() == "unique_violation" {
+			if config.EnumerationProtection {
+				// Respond as if the email changed and tell the email's
+				// owner instead
+				if err := sendAlreadyRegisteredEmail(email); err != nil {
+					log.Println(err)
+				}
+				return true
+			}
+			marshalError(w, http.StatusBadRequest, "Email address taken.")
+		} else {
+			marshalError(w, http.StatusInternalServerError, "Failed to change email address.")
+			log.Println(err)
+		}
+		return false
+	}
+
+	// The user can ask for another verification email if this fails or was
+	// throttled
+	if err := sendVerificationEmail(userID, email); err != nil && err != authentication.VerificationThrottledErr {
+		log.Println(err)
+	}
+
+	// Let the old email's owner know, in case it wasn't them
+	var body bytes.Buffer
+	if err := emailChangedTemplate.Execute(&body, struct{ Email string }{email}); err != nil {
+		log.Println(err)
+	} else if err := mail.Send(&mailer.Message{
+		To:      oldEmail,
+		Subject: "Your i++ email address was changed",
+		Body:    body.String(),
+	}); err != nil {
+		log.Println(err)
+	}
+
+	return true
+}
+
+// Sets a new password for the logged in user if they know their current one.
+// Their other sessions are logged out, so a new token is sent back.
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Get user ID from context
+	ctx := r.Context()
+	userID := ctx.Value(userIDKey).(int)
+
+	// Parse the body's JSON
+	change := new(PasswordChange)
+	if err := jsonapi.UnmarshalPayload(r.Body, change); err != nil {
+		marshalError(w, http.StatusBadRequest, "Invalid request body.")
+		log.Println(err)
+		return
+	}
+
+	// Validate password
+	if err := passwordPolicy.Check(change.Password); err != nil {
+		marshalPasswordError(w, err)
+		return
+	}
+
+	// A stolen token shouldn't be a way to guess the password
+	if !allowAttempt(w, passwordLimit(userID)) {
+		return
+	}
+
+	// Change the password
+	token, err := auth.ChangePassword(
+		model, userID,
+		validator.NormalizePassword(change.CurrentPassword),
+		validator.NormalizePassword(change.Password),
+	)
+	if err != nil {
+		switch err {
+		case authentication.IncorrectPasswordErr:
+			marshalError(w, http.StatusUnauthorized, "Current password is incorrect.")
+		case authentication.NoPasswordErr:
+			releaseAttempts(passwordLimit(userID))
+			marshalError(w, http.StatusBadRequest, "You log in with a linked account, so there's no password to change.")
+		default:
+			releaseAttempts(passwordLimit(userID))
+			marshalError(w, http.StatusInternalServerError, "Failed to change password.")
+			log.Println(err)
+		}
+		return
+	}
+	resetAttempts(passwordLimit(userID))
+
+	sendToken(w, r, token)
+}
+
+// Confirms it's the user with their password, or an identity token from
+// logging in with a linked provider again if they don't have one. Responds
+// with an error, or the detail if confirming fails, and returns false if it
+// isn't them.
+func confirmUser(w http.ResponseWriter, userID int, password, identityToken, detail string) bool {
+	hash, err := model.GetPasswordHash(userID)
+	if err != nil {
+		marshalError(w, http.StatusInternalServerError, detail)
+		log.Println(err)
+		return false
+	}
+
+	if hash != "" {
+		// A stolen token shouldn't be a way to guess the password
+		if !allowAttempt(w, passwordLimit(userID)) {
+			return false
+		}
+		if err := auth.Hasher.Verify(hash, validator.NormalizePassword(password)); err == authentication.IncorrectPasswordErr {
+			marshalError(w, http.StatusUnauthorized, "Password is incorrect.")
+			return false
+		} else if err != nil {
+			releaseAttempts(passwordLimit(userID))
+			marshalError(w, http.StatusInternalServerError, detail)
+			log.Println(err)
+			return false
+		}
+		resetAttempts(passwordLimit(userID))
+		return true
+	}
+
+	external, err := auth.ParseIdentityToken(identityToken)
+	if err != nil {
+		marshalError(w, http.StatusUnauthorized, "Please log in with your linked account again to confirm.")
+		return false
+	}
+	if id, err := model.GetIdentityUser(external.Provider, external.Subject); err != nil || id != userID {
+		marshalError(w, http.StatusUnauthorized, "Please log in with an account linked to this one to confirm.")
+		return false
+	}
+	return true
+}
+
+// Schedules the user's deletion after they confirm it's them with their
+// password, or an identity token from logging in with a linked provider
+// again if they don't have one. Their tokens stop working right away; the
+// account can be restored until the grace period is over. Trial users have
+// nothing to confirm with or log in with again, so they're deleted at once.
+func deleteAccount(w http.ResponseWriter, r *http.Request, userID int) {
+	if err := model.DeleteTrialUser(userID); err == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if err != sql.ErrNoRows {
+		marshalError(w, http.StatusInternalServerError, "Failed to delete account.")
+		log.Println(err)
+		return
+	}
+
+	// Parse the body's JSON
+	deletion := new(AccountDeletion)
+	if err := jsonapi.UnmarshalPayload(r.Body, deletion); err != nil {
+		marshalError(w, http.StatusBadRequest, "Invalid request body.")
+		log.Println(err)
+		return
+	}
+
+	// Confirm it's the user
+	if !confirmUser(w, userID, deletion.Password, deletion.IdentityToken, "Failed to delete account.") {
+		return
+	}
+
+	// Schedule the deletion and log the user out everywhere
+	now := time.Now()
+	deleteAt := now.Add(config.AccountDeletionGracePeriod)
+	if err := model.ScheduleDeletion(userID, deleteAt, now); err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to delete account.")
+		log.Println(err)
+		return
+	}
+	authentication.ClearSessionCookies(w, config.SecureCookies)
+
+	// Tell the user how to change their mind
+	if email, _, err := model.GetEmailVerified(userID); err != nil {
+		log.Println(err)
+	} else if email != "" {
+		var body bytes.Buffer
+		if err := accountDeletionTemplate.Execute(&body, struct{ DeleteAt time.Time }{deleteAt}); err != nil {
+			log.Println(err)
+		} else if err := mail.Send(&mailer.Message{
+			To:      email,
+			Subject: "Your i++ account will be deleted",
+			Body:    body.String(),
+		}); err != nil {
+			log.Println(err)
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Cancels the logged in user's deletion during the grace period
+func RestoreAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Get user ID from context
+	ctx := r.Context()
+	userID := ctx.Value(userIDKey).(int)
+
+	if err := model.CancelDeletion(userID); err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to restore account.")
+		log.Println(err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Sends the logged in user everything stored about them as a JSON file
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Get user ID from context
+	ctx := r.Context()
+	userID := ctx.Value(userIDKey).(int)
+
+	export, err := model.ExportUser(userID)
+	if err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to export account data.")
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="ipp-export.json"`)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(export); err != nil {
+		log.Println(err)
+	}
+}
+
+// Deletes the users whose grace period is over every interval
+func purgeDeletedUsers(interval time.Duration) {
+	for {
+		if n, err := model.PurgeDeletedUsers(); err != nil {
+			log.Println(err)
+		} else if n > 0 {
+			log.Printf("Deleted %d users", n)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,12 @@
+ALTER TABLE users ADD COLUMN facebook_id VARCHAR(128) UNIQUE;
+
+UPDATE users SET facebook_id = identities.subject
+  FROM identities
+  WHERE identities.user_id = users.id AND identities.provider = 'facebook';
+
+DELETE FROM users WHERE email IS NULL AND facebook_id IS NULL;
+
+ALTER TABLE users ADD CONSTRAINT email_or_facebook_id
+  CHECK(facebook_id IS NOT NULL OR email IS NOT NULL);
+
+DROP TABLE IF EXISTS identities;
@@ -0,0 +1,17 @@
+CREATE TABLE identities (
+  id         SERIAL PRIMARY KEY,
+  user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  provider   VARCHAR(32) NOT NULL,
+  subject    VARCHAR(128) NOT NULL,
+  email      VARCHAR(254),
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  UNIQUE (provider, subject)
+);
+
+CREATE INDEX identities_user_id_idx ON identities (user_id);
+
+INSERT INTO identities (user_id, provider, subject)
+  SELECT id, 'facebook', facebook_id FROM users WHERE facebook_id IS NOT NULL;
+
+ALTER TABLE users DROP CONSTRAINT email_or_facebook_id;
+ALTER TABLE users DROP COLUMN facebook_id;
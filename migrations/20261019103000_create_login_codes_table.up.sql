@@ -0,0 +1,6 @@
+CREATE TABLE login_codes (
+  code_hash      CHAR(64) PRIMARY KEY,
+  user_id        INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  code_challenge VARCHAR(128) NOT NULL,
+  expires_at     TIMESTAMP WITH TIME ZONE NOT NULL
+);
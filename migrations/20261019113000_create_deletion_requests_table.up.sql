@@ -0,0 +1,6 @@
+CREATE TABLE deletion_requests (
+  confirmation_code VARCHAR(64) PRIMARY KEY,
+  status            VARCHAR(16) NOT NULL,
+  requested_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  updated_at        TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
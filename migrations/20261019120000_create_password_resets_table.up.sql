@@ -0,0 +1,7 @@
+ALTER TABLE users ADD COLUMN tokens_valid_since TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE password_resets (
+  token_hash CHAR(64) PRIMARY KEY,
+  user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
@@ -0,0 +1,5 @@
+CREATE TABLE magic_links (
+  token_hash CHAR(64) PRIMARY KEY,
+  user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
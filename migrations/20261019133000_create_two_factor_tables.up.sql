@@ -0,0 +1,14 @@
+CREATE TABLE two_factor (
+  user_id        INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  secret         TEXT NOT NULL,
+  last_used_step BIGINT NOT NULL DEFAULT 0,
+  created_at     TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  confirmed_at   TIMESTAMP WITH TIME ZONE
+);
+
+CREATE TABLE recovery_codes (
+  user_id   INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  code_hash CHAR(64) NOT NULL,
+  used_at   TIMESTAMP WITH TIME ZONE,
+  PRIMARY KEY (user_id, code_hash)
+);
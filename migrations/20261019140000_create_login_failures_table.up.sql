@@ -0,0 +1,6 @@
+CREATE TABLE login_failures (
+  key             VARCHAR(320) PRIMARY KEY,
+  failures        INTEGER NOT NULL,
+  last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+CREATE INDEX login_failures_last_failure_at_idx ON login_failures (last_failure_at);
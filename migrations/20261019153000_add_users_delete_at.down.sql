@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users_delete_at_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS delete_at;
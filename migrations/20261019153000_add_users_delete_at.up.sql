@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN delete_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX users_delete_at_idx ON users (delete_at) WHERE delete_at IS NOT NULL;
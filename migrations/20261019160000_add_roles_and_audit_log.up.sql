@@ -0,0 +1,15 @@
+-- Promote the first admin with: UPDATE users SET role = 'admin' WHERE email = '...';
+ALTER TABLE users ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'user';
+ALTER TABLE users ADD COLUMN disabled_at TIMESTAMP WITH TIME ZONE;
+
+-- Users may be deleted, but what admins did to them is kept
+CREATE TABLE audit_log (
+  id             SERIAL PRIMARY KEY,
+  admin_id       INTEGER REFERENCES users(id) ON DELETE SET NULL,
+  action         VARCHAR(32) NOT NULL,
+  target_user_id INTEGER,
+  details        TEXT NOT NULL DEFAULT '',
+  created_at     TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX audit_log_target_user_id_idx ON audit_log (target_user_id);
@@ -0,0 +1,9 @@
+CREATE TABLE invite_codes (
+  id         SERIAL PRIMARY KEY,
+  code_hash  CHAR(64) NOT NULL UNIQUE,
+  max_uses   INTEGER, -- Unlimited if NULL
+  uses       INTEGER NOT NULL DEFAULT 0,
+  expires_at TIMESTAMP WITH TIME ZONE,
+  created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
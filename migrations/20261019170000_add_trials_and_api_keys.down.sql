@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS api_keys;
+DROP INDEX IF EXISTS users_trial_expires_at_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS trial_expires_at;
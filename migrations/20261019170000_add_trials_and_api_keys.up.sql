@@ -0,0 +1,14 @@
+-- Trial users have no email, password or identity until they convert
+ALTER TABLE users ADD COLUMN trial_expires_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX users_trial_expires_at_idx ON users (trial_expires_at) WHERE trial_expires_at IS NOT NULL;
+
+CREATE TABLE api_keys (
+  id         SERIAL PRIMARY KEY,
+  user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name       VARCHAR(64) NOT NULL,
+  key_hash   CHAR(64) NOT NULL UNIQUE,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX api_keys_user_id_idx ON api_keys (user_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS sandbox_numbers;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS test;
@@ -0,0 +1,8 @@
+ALTER TABLE api_keys ADD COLUMN test BOOLEAN NOT NULL DEFAULT false;
+
+-- Copies of users' numbers that test-mode API keys count with, made the
+-- first time one is used
+CREATE TABLE sandbox_numbers (
+  user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  num     INTEGER NOT NULL
+);
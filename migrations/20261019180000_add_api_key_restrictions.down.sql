@@ -0,0 +1,5 @@
+ALTER TABLE api_keys DROP COLUMN IF EXISTS calls;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS max_calls;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS expires_at;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS allowed_origins;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS allowed_networks;
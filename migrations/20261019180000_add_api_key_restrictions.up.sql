@@ -0,0 +1,6 @@
+-- Restrictions are off when empty or NULL
+ALTER TABLE api_keys ADD COLUMN allowed_networks CIDR[] NOT NULL DEFAULT '{}';
+ALTER TABLE api_keys ADD COLUMN allowed_origins TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE api_keys ADD COLUMN expires_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE api_keys ADD COLUMN max_calls INTEGER;
+ALTER TABLE api_keys ADD COLUMN calls INTEGER NOT NULL DEFAULT 0;
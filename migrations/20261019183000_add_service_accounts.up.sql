@@ -0,0 +1,12 @@
+-- Non-human clients that act for their owner within their scopes
+CREATE TABLE service_accounts (
+  id          SERIAL PRIMARY KEY,
+  owner_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name        VARCHAR(64) NOT NULL,
+  client_id   VARCHAR(64) NOT NULL UNIQUE,
+  secret_hash CHAR(64) NOT NULL,
+  scopes      TEXT[] NOT NULL DEFAULT '{}',
+  created_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX service_accounts_owner_id_idx ON service_accounts (owner_id);
@@ -0,0 +1,3 @@
+ALTER TABLE service_accounts DROP COLUMN IF EXISTS expires_at;
+ALTER TABLE service_accounts DROP COLUMN IF EXISTS allowed_origins;
+ALTER TABLE service_accounts DROP COLUMN IF EXISTS allowed_networks;
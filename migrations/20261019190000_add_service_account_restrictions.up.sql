@@ -0,0 +1,4 @@
+-- Restrictions are off when empty or NULL, like API keys'
+ALTER TABLE service_accounts ADD COLUMN allowed_networks CIDR[] NOT NULL DEFAULT '{}';
+ALTER TABLE service_accounts ADD COLUMN allowed_origins TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE service_accounts ADD COLUMN expires_at TIMESTAMP WITH TIME ZONE;
@@ -2,4 +2,7 @@
 set -e
 
 echo 'Migrating ...'
-psql --username $POSTGRES_USER -d $POSTGRES_DB < /docker-entrypoint-initdb.d/20170518032523_create_user_table.up.sql
+for migration in /migrations/*.up.sql; do
+  echo "$migration"
+  psql -v ON_ERROR_STOP=1 --username $POSTGRES_USER -d $POSTGRES_DB < "$migration"
+done
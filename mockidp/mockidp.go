@@ -0,0 +1,329 @@
+// Package mockidp is an OAuth 2.0/OpenID Connect provider for development
+// and CI. It lets anyone log in as any user they pick, so it must never be
+// enabled in production.
+package mockidp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	codeTTL  = time.Minute
+	tokenTTL = time.Hour
+)
+
+var (
+	InvalidClientErr      = errors.New("mockidp: unknown client_id or redirect_uri.")
+	InvalidGrantErr       = errors.New("mockidp: code is invalid, expired or was issued to another client.")
+	InvalidAccessTokenErr = errors.New("mockidp: access token is invalid or expired.")
+)
+
+// User is an account at the mock provider
+type User struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// DefaultUsers are offered in the user picker
+var DefaultUsers = []User{
+	{ID: "1000001", Name: "Alice Example", Email: "alice@example.com", EmailVerified: true},
+	{ID: "1000002", Name: "Bob Example", Email: "bob@example.com", EmailVerified: true},
+	{ID: "1000003", Name: "Carol (no email)"},
+}
+
+type grant struct {
+	user          User
+	redirectURI   string
+	codeChallenge string
+	expiresAt     time.Time
+}
+
+type Provider struct {
+	baseURL      string
+	clientID     string
+	clientSecret string
+	redirectURI  string
+	users        []User
+
+	lock   sync.Mutex
+	codes  map[string]grant
+	tokens map[string]grant
+}
+
+// Returns a provider served at baseURL that only lets the given client log
+// in and redirect to redirectURI. DefaultUsers are offered if users is nil.
+func New(baseURL, clientID, clientSecret, redirectURI string, users []User) *Provider {
+	if users == nil {
+		users = DefaultUsers
+	}
+
+	return &Provider{
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURI:  redirectURI,
+		users:        users,
+		codes:        map[string]grant{},
+		tokens:       map[string]grant{},
+	}
+}
+
+// Returns the provider's OAuth endpoint
+func (p *Provider) Endpoint() oauth2.Endpoint {
+	return oauth2.Endpoint{
+		AuthURL:   p.baseURL + "/authorize",
+		TokenURL:  p.baseURL + "/token",
+		AuthStyle: oauth2.AuthStyleInParams,
+	}
+}
+
+// Returns the provider's user info URL
+func (p *Provider) UserInfoURL() string {
+	return p.baseURL + "/userinfo"
+}
+
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/authorize":
+		p.AuthorizeHandler(w, r)
+	case "/token":
+		p.TokenHandler(w, r)
+	case "/userinfo":
+		p.UserInfoHandler(w, r)
+	case "/.well-known/openid-configuration":
+		p.DiscoveryHandler(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+var pickerTemplate = template.Must(template.New("picker").Parse(`<!doctype html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8">
+    <title>Mock identity provider</title>
+  </head>
+  <body>
+    <h1>Log in to the mock identity provider</h1>
+    <p>This provider is for development only. Pick who you want to be.</p>
+    {{ range .Users }}
+    <form method="POST">
+      {{ template "params" $ }}
+      <input type="hidden" name="user_id" value="{{ .ID }}">
+      <input type="hidden" name="name" value="{{ .Name }}">
+      <input type="hidden" name="email" value="{{ .Email }}">
+      {{ if .EmailVerified }}<input type="hidden" name="email_verified" value="true">{{ end }}
+      <button type="submit">{{ .Name }}{{ if .Email }} &lt;{{ .Email }}&gt;{{ end }}</button>
+    </form>
+    {{ end }}
+    <h2>Someone else</h2>
+    <form method="POST">
+      {{ template "params" . }}
+      <input name="user_id" placeholder="ID" required>
+      <input name="name" placeholder="Name">
+      <input name="email" type="email" placeholder="Email">
+      <label><input type="checkbox" name="email_verified" value="true"> Email verified</label>
+      <button type="submit">Log in</button>
+    </form>
+  </body>
+</html>
+{{ define "params" }}
+      <input type="hidden" name="client_id" value="{{ .Params.Get "client_id" }}">
+      <input type="hidden" name="redirect_uri" value="{{ .Params.Get "redirect_uri" }}">
+      <input type="hidden" name="state" value="{{ .Params.Get "state" }}">
+      <input type="hidden" name="code_challenge" value="{{ .Params.Get "code_challenge" }}">
+      <input type="hidden" name="code_challenge_method" value="{{ .Params.Get "code_challenge_method" }}">
+{{ end }}
+`))
+
+// Shows the user picker on GET and redirects back to the client with a code
+// for the picked user on POST
+func (p *Provider) AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Form.Get("client_id") != p.clientID || r.Form.Get("redirect_uri") != p.redirectURI {
+		http.Error(w, InvalidClientErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := pickerTemplate.Execute(w, struct {
+			Users  []User
+			Params url.Values
+		}{p.users, r.Form}); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	user := User{
+		ID:            r.PostForm.Get("user_id"),
+		Name:          r.PostForm.Get("name"),
+		Email:         r.PostForm.Get("email"),
+		EmailVerified: r.PostForm.Get("email_verified") == "true",
+	}
+	if user.ID == "" {
+		http.Error(w, "mockidp: pick a user.", http.StatusBadRequest)
+		return
+	}
+
+	code, err := randomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	challenge := ""
+	if r.Form.Get("code_challenge_method") == "S256" {
+		challenge = r.Form.Get("code_challenge")
+	}
+
+	p.lock.Lock()
+	p.codes[code] = grant{user, p.redirectURI, challenge, time.Now().Add(codeTTL)}
+	p.lock.Unlock()
+
+	Url, _ := url.Parse(p.redirectURI)
+	params := Url.Query()
+	params.Set("code", code)
+	params.Set("state", r.Form.Get("state"))
+	Url.RawQuery = params.Encode()
+	http.Redirect(w, r, Url.String(), http.StatusFound)
+}
+
+// Exchanges a code for an access token
+func (p *Provider) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	if clientID != p.clientID || clientSecret != p.clientSecret {
+		tokenError(w, http.StatusUnauthorized, "invalid_client", InvalidClientErr)
+		return
+	}
+
+	// Codes are single-use
+	code := r.FormValue("code")
+	p.lock.Lock()
+	g, ok := p.codes[code]
+	delete(p.codes, code)
+	p.lock.Unlock()
+
+	if !ok || time.Now().After(g.expiresAt) || r.FormValue("redirect_uri") != g.redirectURI {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", InvalidGrantErr)
+		return
+	}
+
+	// Verify PKCE if the client started with a challenge
+	if g.codeChallenge != "" {
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+		if subtle.ConstantTimeCompare([]byte(challenge), []byte(g.codeChallenge)) != 1 {
+			tokenError(w, http.StatusBadRequest, "invalid_grant", InvalidGrantErr)
+			return
+		}
+	}
+
+	accessToken, err := randomString()
+	if err != nil {
+		tokenError(w, http.StatusInternalServerError, "server_error", err)
+		return
+	}
+
+	g.expiresAt = time.Now().Add(tokenTTL)
+	p.lock.Lock()
+	p.tokens[accessToken] = g
+	p.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(tokenTTL.Seconds()),
+	})
+}
+
+// Returns the user the access token was issued for. The token can be sent
+// as a Bearer token or, like Facebook's Graph API, as access_token.
+func (p *Provider) UserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	accessToken := r.FormValue("access_token")
+	if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		accessToken = strings.TrimPrefix(authHeader, "Bearer ")
+	}
+
+	p.lock.Lock()
+	g, ok := p.tokens[accessToken]
+	p.lock.Unlock()
+
+	if !ok || time.Now().After(g.expiresAt) {
+		tokenError(w, http.StatusUnauthorized, "invalid_token", InvalidAccessTokenErr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sub":            g.user.ID,
+		"id":             g.user.ID,
+		"name":           g.user.Name,
+		"email":          g.user.Email,
+		"email_verified": g.user.EmailVerified,
+	})
+}
+
+// Serves the OpenID Connect discovery document
+func (p *Provider) DiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	issuer := p.baseURL
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                           issuer,
+		"authorization_endpoint":           issuer + "/authorize",
+		"token_endpoint":                   issuer + "/token",
+		"userinfo_endpoint":                issuer + "/userinfo",
+		"response_types_supported":         []string{"code"},
+		"grant_types_supported":            []string{"authorization_code"},
+		"code_challenge_methods_supported": []string{"S256"},
+	})
+}
+
+func tokenError(w http.ResponseWriter, status int, code string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": err.Error(),
+	})
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,205 @@
+package mockidp
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mujz/ipp/authentication"
+)
+
+const (
+	clientID     = "12345"
+	clientSecret = "1as2sd34sd5"
+
+	// PKCE example from RFC 7636
+	codeVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	codeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+var auth = authentication.NewAuthenticator([]byte("my,secret,key"), 5*time.Second)
+
+type loginCode struct {
+	userID    int
+	challenge string
+	expiresAt time.Time
+}
+
+// An in-memory user store
+type store struct {
+	lock       sync.Mutex
+	identities map[string]int
+	codes      map[string]loginCode
+}
+
+func (s *store) GetIdentityUser(provider, subject string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if id, ok := s.identities[provider+subject]; ok {
+		return id, nil
+	}
+	return 0, sql.ErrNoRows
+}
+
+func (s *store) GetUserID(email string) (int, error) {
+	return 0, sql.ErrNoRows
+}
+
+func (s *store) CreateIdentityUser(provider, subject, email string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.identities[provider+subject] = len(s.identities) + 1
+	return len(s.identities), nil
+}
+
+func (s *store) CreateLoginCode(hash string, userID int, challenge string, expiresAt time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.codes[hash] = loginCode{userID, challenge, expiresAt}
+	return nil
+}
+
+func (s *store) HasTwoFactor(userID int) (bool, error) {
+	return false, nil
+}
+
+func (s *store) TakeLoginCode(hash string) (int, string, time.Time, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	code, ok := s.codes[hash]
+	if !ok {
+		return 0, "", time.Time{}, sql.ErrNoRows
+	}
+	delete(s.codes, hash)
+	return code.userID, code.challenge, code.expiresAt, nil
+}
+
+// Serves the mock provider and a Facebook authenticator that uses it
+func newServer() (*httptest.Server, *store) {
+	mux := http.NewServeMux()
+	s := httptest.NewServer(mux)
+	users := &store{identities: map[string]int{}, codes: map[string]loginCode{}}
+
+	provider := New(s.URL+"/mock-idp", clientID, clientSecret, s.URL+"/callback", nil)
+	fb := authentication.NewFacebookAuthenticator(clientID, clientSecret, s.URL+"/callback",
+		"http://web.test/", "http://web.test/error", nil, users, auth)
+	fb.Endpoint = provider.Endpoint()
+	fb.ProfileURL = provider.UserInfoURL()
+
+	mux.Handle("/mock-idp/", http.StripPrefix("/mock-idp", provider))
+	mux.HandleFunc("/login", fb.LoginHandler)
+	mux.HandleFunc("/callback", fb.LoginCallbackHandler)
+
+	return s, users
+}
+
+func TestSocialLogin(t *testing.T) {
+	s, users := newServer()
+	defer s.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: jar,
+		// Stop once we're sent back to the web app
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if r.URL.Host == "web.test" {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+
+	/* Starting the login shows the user picker */
+	resp, err := client.Get(s.URL + "/login?code_challenge=" + codeChallenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/mock-idp/authorize" {
+		t.Fatalf("Expected the user picker; Got (%d) %s", resp.StatusCode, resp.Request.URL)
+	}
+
+	/* Picking a user logs them in */
+	form := url.Values{"user_id": {"1000001"}, "name": {"Alice"}, "email": {"alice@example.com"}}
+	resp, err = client.PostForm(resp.Request.URL.String(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	location, err := resp.Location()
+	if err != nil || location.Host != "web.test" || location.Path == "/error" {
+		t.Fatalf("Expected a successful redirect to the web app; Got %v, %v", location, err)
+	}
+
+	token, err := auth.ExchangeLoginCode(users, location.Query().Get("code"), codeVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := auth.Authenticate(token.Subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, _ := users.GetIdentityUser("facebook", "1000001"); id != expected {
+		t.Fatalf("Expected token for user %d; Got %d", expected, id)
+	}
+}
+
+func TestAuthorizeRejectsUnknownRedirect(t *testing.T) {
+	s, _ := newServer()
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/mock-idp/authorize?client_id=" + clientID + "&redirect_uri=" +
+		url.QueryEscape("https://evil.test/callback"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status (%d); Got (%d)", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestTokenRequiresCodeVerifier(t *testing.T) {
+	provider := New("http://idp.test", clientID, clientSecret, "http://api.test/callback", nil)
+
+	form := url.Values{
+		"client_id":             {clientID},
+		"redirect_uri":          {"http://api.test/callback"},
+		"user_id":               {"1000001"},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+	r, _ := http.NewRequest("POST", "/authorize", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	provider.ServeHTTP(w, r)
+
+	location, _ := url.Parse(w.Header().Get("Location"))
+	form = url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"redirect_uri":  {"http://api.test/callback"},
+		"code":          {location.Query().Get("code")},
+		"code_verifier": {"not-the-verifier"},
+	}
+	r, _ = http.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	provider.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_grant") {
+		t.Fatalf("Expected an invalid_grant error; Got (%d) %s", w.Code, w.Body.String())
+	}
+}
@@ -2,17 +2,174 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"net"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/mujz/ipp/authentication"
 )
 
 type User struct {
-	ID       int     `jsonapi:"primary,User"`
-	Email    string  `jsonapi:"attr,email"`
-	Password string  `jsonapi:"attr,password"`
-	Number   *Number `jsonapi:"relation,number"`
+	ID              int         `jsonapi:"primary,User"`
+	Email           string      `jsonapi:"attr,email,omitempty"`
+	Password        string      `jsonapi:"attr,password,omitempty"`
+	InviteCode      string      `jsonapi:"attr,invite_code,omitempty"`
+	CurrentPassword string      `jsonapi:"attr,current_password,omitempty"` // Confirms an email change
+	IdentityToken   string      `jsonapi:"attr,identity_token,omitempty"`   // Confirms it without a password
+	EmailVerified   bool        `jsonapi:"attr,email_verified"`
+	CreatedAt       time.Time   `jsonapi:"attr,created_at,iso8601"`
+	DeleteAt        *time.Time  `jsonapi:"attr,delete_at,iso8601,omitempty"`
+	TrialExpiresAt  *time.Time  `jsonapi:"attr,trial_expires_at,iso8601,omitempty"`
+	Role            string      `jsonapi:"attr,role,omitempty"`
+	DisabledAt      *time.Time  `jsonapi:"attr,disabled_at,iso8601,omitempty"`
+	Number          *Number     `jsonapi:"relation,number"`
+	Identities      []*Identity `jsonapi:"relation,identities"`
+}
+
+type PasswordChange struct {
+	ID              string `jsonapi:"primary,password-change"`
+	CurrentPassword string `jsonapi:"attr,current_password"`
+	Password        string `jsonapi:"attr,password"`
+}
+
+type AccountDeletion struct {
+	ID            string `jsonapi:"primary,account-deletion"`
+	Password      string `jsonapi:"attr,password,omitempty"`
+	IdentityToken string `jsonapi:"attr,identity_token,omitempty"`
+}
+
+// Everything stored about a user, for them to download
+type UserExport struct {
+	ExportedAt       time.Time              `json:"exported_at"`
+	Account          ExportAccount          `json:"account"`
+	Number           int                    `json:"number"`
+	SandboxNumber    *int                   `json:"sandbox_number"`
+	Identities       []ExportIdentity       `json:"identities"`
+	TwoFactor        *ExportTwoFactor       `json:"two_factor"`
+	Sessions         ExportSessions         `json:"sessions"`
+	PendingLinks     []ExportLink           `json:"pending_links"`
+	RecoveryCodeUses []time.Time            `json:"recovery_code_uses"`
+	APIKeys          []ExportAPIKey         `json:"api_keys"`
+	ServiceAccounts  []ExportServiceAccount `json:"service_accounts"`
+}
+
+type ExportAccount struct {
+	ID              int        `json:"id"`
+	Email           *string    `json:"email"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	HasPassword     bool       `json:"has_password"`
+	CreatedAt       time.Time  `json:"created_at"`
+	DeleteAt        *time.Time `json:"delete_at"`
+	TrialExpiresAt  *time.Time `json:"trial_expires_at"`
+}
+
+type ExportIdentity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     *string   `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportTwoFactor struct {
+	CreatedAt         time.Time  `json:"created_at"`
+	ConfirmedAt       *time.Time `json:"confirmed_at"`
+	RecoveryCodesLeft int        `json:"recovery_codes_left"`
+}
+
+// Tokens are stateless, so all that's stored about sessions is when they
+// were last revoked
+type ExportSessions struct {
+	TokensValidSince *time.Time `json:"tokens_valid_since"`
+}
+
+// A login, password reset or verification link that wasn't used yet
+type ExportLink struct {
+	Kind      string    `json:"kind"`
+	Email     *string   `json:"email,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type ExportAPIKey struct {
+	Name      string    `json:"name"`
+	Mode      string    `json:"mode"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportServiceAccount struct {
+	Name      string    `json:"name"`
+	ClientID  string    `json:"client_id"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	liveMode = "live"
+	testMode = "test" // Counts in a sandbox instead of with the user's number
+)
+
+// A long-lived credential for scripts and services. The key and its signing
+// secret are only shown when it's created. Restrictions are off when they're empty.
+type APIKey struct {
+	ID              int        `jsonapi:"primary,api-key"`
+	Name            string     `jsonapi:"attr,name"`
+	Mode            string     `jsonapi:"attr,mode"`
+	Key             string     `jsonapi:"attr,key,omitempty"`
+	SigningSecret   string     `jsonapi:"attr,signing_secret,omitempty"`   // Signs requests instead of sending the key
+	AllowedNetworks []string   `jsonapi:"attr,allowed_networks,omitempty"` // CIDR ranges or IP addresses
+	AllowedOrigins  []string   `jsonapi:"attr,allowed_origins,omitempty"`  // Like https://example.com
+	ExpiresAt       *time.Time `jsonapi:"attr,expires_at,iso8601,omitempty"`
+	MaxCalls        int        `jsonapi:"attr,max_calls,omitempty"`
+	Calls           int        `jsonapi:"attr,calls,omitempty"` // Only counted for keys with a maximum
+	CreatedAt       time.Time  `jsonapi:"attr,created_at,iso8601"`
+}
+
+// A client that gets tokens for its owner with the client-credentials grant.
+// The secret is only shown when it's created. Restrictions are off when
+// they're empty, like an API key's.
+type ServiceAccount struct {
+	ID              int        `jsonapi:"primary,service-account"`
+	Name            string     `jsonapi:"attr,name"`
+	ClientID        string     `jsonapi:"attr,client_id"`
+	Secret          string     `jsonapi:"attr,client_secret,omitempty"`
+	Scopes          []string   `jsonapi:"attr,scopes"`
+	AllowedNetworks []string   `jsonapi:"attr,allowed_networks,omitempty"` // CIDR ranges or IP addresses
+	AllowedOrigins  []string   `jsonapi:"attr,allowed_origins,omitempty"`  // Like https://example.com
+	ExpiresAt       *time.Time `jsonapi:"attr,expires_at,iso8601,omitempty"`
+	CreatedAt       time.Time  `jsonapi:"attr,created_at,iso8601"`
+}
+
+// An anonymous account to try i++ with before signing up. The key is only
+// shown when the trial starts.
+type Trial struct {
+	ID        int       `jsonapi:"primary,trial"`
+	Key       string    `jsonapi:"attr,key"`
+	ExpiresAt time.Time `jsonapi:"attr,expires_at,iso8601"`
+	Number    *Number   `jsonapi:"relation,number"`
+}
+
+// A code that lets people sign up when signup is by invitation only. The
+// code itself is only shown when it's created.
+type Invite struct {
+	ID        int        `jsonapi:"primary,invite"`
+	Code      string     `jsonapi:"attr,code,omitempty"`
+	MaxUses   int        `jsonapi:"attr,max_uses,omitempty"` // Unlimited if 0
+	Uses      int        `jsonapi:"attr,uses"`
+	ExpiresAt *time.Time `jsonapi:"attr,expires_at,iso8601,omitempty"`
+	CreatedBy int        `jsonapi:"attr,created_by,omitempty"`
+	CreatedAt time.Time  `jsonapi:"attr,created_at,iso8601"`
+}
+
+// Something an admin did, to a user unless TargetUserID is 0
+type AuditEntry struct {
+	ID           int       `jsonapi:"primary,audit-entry"`
+	AdminID      int       `jsonapi:"attr,admin_id"`
+	Action       string    `jsonapi:"attr,action"`
+	TargetUserID int       `jsonapi:"attr,target_user_id,omitempty"`
+	Details      string    `jsonapi:"attr,details,omitempty"`
+	CreatedAt    time.Time `jsonapi:"attr,created_at,iso8601"`
 }
 
 type Number struct {
@@ -20,6 +177,57 @@ type Number struct {
 	Value int `jsonapi:"attr,value"`
 }
 
+type Identity struct {
+	ID        int       `jsonapi:"primary,identity"`
+	Provider  string    `jsonapi:"attr,provider"`
+	Subject   string    `jsonapi:"attr,subject"`
+	Email     string    `jsonapi:"attr,email,omitempty"`
+	CreatedAt time.Time `jsonapi:"attr,created_at,iso8601"`
+	Token     string    `jsonapi:"attr,token,omitempty"`
+}
+
+type LoginCode struct {
+	ID       string `jsonapi:"primary,code"`
+	Code     string `jsonapi:"attr,code"`
+	Verifier string `jsonapi:"attr,code_verifier"`
+}
+
+type PasswordReset struct {
+	ID       string `jsonapi:"primary,password-reset"`
+	Email    string `jsonapi:"attr,email,omitempty"`
+	Token    string `jsonapi:"attr,token,omitempty"`
+	Password string `jsonapi:"attr,password,omitempty"`
+}
+
+type EmailVerification struct {
+	ID    string `jsonapi:"primary,email-verification"`
+	Token string `jsonapi:"attr,token"`
+}
+
+type TwoFactor struct {
+	ID            string   `jsonapi:"primary,two-factor"`
+	Secret        string   `jsonapi:"attr,secret,omitempty"`
+	URI           string   `jsonapi:"attr,provisioning_uri,omitempty"`
+	Code          string   `jsonapi:"attr,code,omitempty"`
+	Challenge     string   `jsonapi:"attr,challenge,omitempty"`
+	RecoveryCodes []string `jsonapi:"attr,recovery_codes,omitempty"`
+}
+
+type DeletionRequest struct {
+	ConfirmationCode string
+	Status           string
+	RequestedAt      time.Time
+	UpdatedAt        time.Time
+}
+
+const (
+	DeletionPending   = "pending"
+	DeletionCompleted = "completed"
+	DeletionFailed    = "failed"
+)
+
+var LastLoginMethodErr = errors.New("model: can't remove the user's last login method")
+
 type Model struct {
 	User     string
 	Password string
@@ -56,6 +264,14 @@ func (m *Model) IncrementNumber(id int) (*Number, error) {
 	return number, err
 }
 
+func (m *Model) IncrementNumberUpTo(id, limit int) (*Number, error) {
+	number := &Number{ID: id}
+	err := m.QueryRow(
+		"UPDATE users SET num = num + 1 WHERE id = $1 AND num + 1 <= $2 RETURNING num", id, limit,
+	).Scan(&number.Value)
+	return number, err
+}
+
 func (m *Model) UpdateNumber(userID, newValue int) (*Number, error) {
 	number := &Number{ID: userID}
 	err := m.QueryRow(
@@ -68,8 +284,10 @@ func (m *Model) UpdateNumber(userID, newValue int) (*Number, error) {
 func (m Model) Get(email string) (authentication.User, error) {
 	user := authentication.User{}
 	err := m.QueryRow(
-		"SELECT id, email, password FROM users WHERE email = $1", email,
-	).Scan(&user.ID, &user.Username, &user.Password)
+		`SELECT id, email, password, EXISTS (
+			SELECT 1 FROM two_factor WHERE user_id = users.id AND confirmed_at IS NOT NULL
+		) FROM users WHERE email = $1`, email,
+	).Scan(&user.ID, &user.Username, &user.Password, &user.TwoFactor)
 	return user, err
 }
 
@@ -84,19 +302,1381 @@ func (m Model) Create(email, password string) (authentication.User, error) {
 	return user, err
 }
 
-func (m Model) CreateFacebookUser(fbID string) (int, error) {
+// Replaces the user's password hash, e.g. with a stronger one, unless their
+// password changed since it was read
+func (m Model) UpdatePasswordHash(userID int, oldHash, newHash string) error {
+	_, err := m.Exec(
+		"UPDATE users SET password = $3 WHERE id = $1 AND password = $2",
+		userID, oldHash, newHash,
+	)
+	return err
+}
+
+// Returns the user with their number and identities
+func (m Model) GetUser(userID int) (*User, error) {
+	user, err := scanUser(m.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", userID))
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Identities, err = m.GetIdentities(userID); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Returns a page of the users whose email contains the query, or whose ID is
+// the query, and how many there are in all
+func (m Model) SearchUsers(query string, limit, offset int) ([]*User, int, error) {
+	pattern := "%" + likeEscaper.Replace(query) + "%"
+	rows, err := m.Query(
+		"SELECT "+userColumns+", count(*) OVER () FROM users "+
+			"WHERE $1 = '' OR email ILIKE $2 OR id::text = $1 ORDER BY id LIMIT $3 OFFSET $4",
+		query, pattern, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users, total := []*User{}, 0
+	for rows.Next() {
+		user, err := scanUser(rows, &total)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, user)
+	}
+	return users, total, rows.Err()
+}
+
+const userColumns = `id, email, email IS NULL OR email_verified_at IS NOT NULL, created_at, delete_at,
+	trial_expires_at, role, disabled_at, num`
+
+// Escapes the wildcards in a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// Scans a row of userColumns, followed by any extra columns
+func scanUser(row interface {
+	Scan(...interface{}) error
+}, extra ...interface{}) (*User, error) {
+	user := &User{Number: new(Number)}
+	var (
+		email                                sql.NullString
+		deleteAt, trialExpiresAt, disabledAt pq.NullTime
+	)
+	dest := append([]interface{}{
+		&user.ID, &email, &user.EmailVerified, &user.CreatedAt, &deleteAt,
+		&trialExpiresAt, &user.Role, &disabledAt, &user.Number.Value,
+	}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	user.Number.ID = user.ID
+	user.Email = email.String
+	user.DeleteAt = nullTime(deleteAt)
+	user.TrialExpiresAt = nullTime(trialExpiresAt)
+	user.DisabledAt = nullTime(disabledAt)
+	return user, nil
+}
+
+func (m Model) GetRole(userID int) (string, error) {
+	var role string
+	err := m.QueryRow("SELECT role FROM users WHERE id = $1", userID).Scan(&role)
+	return role, err
+}
+
+// Returns sql.ErrNoRows if there's no such user
+func (m Model) SetRole(userID int, role string) error {
+	return execOne(m.Exec("UPDATE users SET role = $2 WHERE id = $1", userID, role))
+}
+
+// Disables the user and revokes their tokens. Returns sql.ErrNoRows if
+// there's no such user.
+func (m Model) DisableUser(userID int, validSince time.Time) error {
+	return execOne(m.Exec(
+		"UPDATE users SET disabled_at = COALESCE(disabled_at, now()), tokens_valid_since = $2 WHERE id = $1",
+		userID, validSince,
+	))
+}
+
+// Returns sql.ErrNoRows if there's no such user
+func (m Model) EnableUser(userID int) error {
+	return execOne(m.Exec("UPDATE users SET disabled_at = NULL WHERE id = $1", userID))
+}
+
+func (m Model) IsDisabled(userID int) (bool, error) {
+	var disabled bool
+	err := m.QueryRow("SELECT disabled_at IS NOT NULL FROM users WHERE id = $1", userID).Scan(&disabled)
+	return disabled, err
+}
+
+// Revokes the user's tokens issued before validSince. Returns sql.ErrNoRows
+// if there's no such user.
+func (m Model) RevokeTokens(userID int, validSince time.Time) error {
+	return execOne(m.Exec("UPDATE users SET tokens_valid_since = $2 WHERE id = $1", userID, validSince))
+}
+
+// Records what an admin did. targetUserID is 0 if it wasn't to a user.
+func (m Model) LogAdminAction(adminID int, action string, targetUserID int, details string) error {
+	_, err := m.Exec(
+		"INSERT INTO audit_log (admin_id, action, target_user_id, details) VALUES ($1, $2, NULLIF($3, 0), $4)",
+		adminID, action, targetUserID, details,
+	)
+	return err
+}
+
+// Returns a page of the audit log, newest first, only about the target user
+// unless it's 0, and how many entries there are in all
+func (m Model) GetAuditLog(targetUserID, limit, offset int) ([]*AuditEntry, int, error) {
+	rows, err := m.Query(
+		`SELECT id, COALESCE(admin_id, 0), action, COALESCE(target_user_id, 0), details, created_at, count(*) OVER ()
+		FROM audit_log WHERE $1 = 0 OR target_user_id = $1
+		ORDER BY id DESC LIMIT $2 OFFSET $3`,
+		targetUserID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries, total := []*AuditEntry{}, 0
+	for rows.Next() {
+		entry := new(AuditEntry)
+		if err := rows.Scan(
+			&entry.ID, &entry.AdminID, &entry.Action, &entry.TargetUserID, &entry.Details, &entry.CreatedAt, &total,
+		); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, total, rows.Err()
+}
+
+// Saves an invite with the hash of its code. MaxUses 0 means unlimited.
+func (m Model) CreateInvite(hash string, invite *Invite) error {
+	return m.QueryRow(
+		`INSERT INTO invite_codes (code_hash, max_uses, expires_at, created_by)
+		VALUES ($1, NULLIF($2, 0), $3, NULLIF($4, 0)) RETURNING id, created_at`,
+		hash, invite.MaxUses, invite.ExpiresAt, invite.CreatedBy,
+	).Scan(&invite.ID, &invite.CreatedAt)
+}
+
+// Returns a page of the invites, newest first, and how many there are in all
+func (m Model) GetInvites(limit, offset int) ([]*Invite, int, error) {
+	rows, err := m.Query(
+		`SELECT id, COALESCE(max_uses, 0), uses, expires_at, COALESCE(created_by, 0), created_at, count(*) OVER ()
+		FROM invite_codes ORDER BY id DESC LIMIT $1 OFFSET $2`,
+		limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	invites, total := []*Invite{}, 0
+	for rows.Next() {
+		invite := new(Invite)
+		var expiresAt pq.NullTime
+		if err := rows.Scan(
+			&invite.ID, &invite.MaxUses, &invite.Uses, &expiresAt, &invite.CreatedBy, &invite.CreatedAt, &total,
+		); err != nil {
+			return nil, 0, err
+		}
+		invite.ExpiresAt = nullTime(expiresAt)
+		invites = append(invites, invite)
+	}
+	return invites, total, rows.Err()
+}
+
+// Returns sql.ErrNoRows if there's no such invite
+func (m Model) DeleteInvite(id int) error {
+	return execOne(m.Exec("DELETE FROM invite_codes WHERE id = $1", id))
+}
+
+// Uses up one of the invite's uses and returns its ID. Returns sql.ErrNoRows
+// if there's no such invite, or it expired or was used up.
+func (m Model) UseInvite(hash string) (int, error) {
 	var id int
-	// Insert user if it doesn't exist
-	q := fmt.Sprintf(
-		`INSERT INTO users (facebook_id)
-		SELECT '%s' WHERE NOT EXISTS (
-			SELECT id FROM users WHERE facebook_id = '%s'
-		)`, fbID, fbID)
-
-	if _, err := m.Exec(q); err != nil {
+	err := m.QueryRow(
+		`UPDATE invite_codes SET uses = uses + 1
+		WHERE code_hash = $1 AND (max_uses IS NULL OR uses < max_uses) AND (expires_at IS NULL OR expires_at > now())
+		RETURNING id`,
+		hash,
+	).Scan(&id)
+	return id, err
+}
+
+// Gives back a use taken by UseInvite, e.g. because the signup failed
+func (m Model) ReturnInvite(id int) error {
+	_, err := m.Exec("UPDATE invite_codes SET uses = uses - 1 WHERE id = $1 AND uses > 0", id)
+	return err
+}
+
+// Returns sql.ErrNoRows if the statement didn't change any rows
+func execOne(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Changes the user's email and marks it unverified. Returns sql.ErrNoRows if
+// the user doesn't have an email to change, e.g. they log in with Facebook.
+func (m Model) ChangeEmail(userID int, email string) error {
+	return execOne(m.Exec(
+		"UPDATE users SET email = $2, email_verified_at = NULL WHERE id = $1 AND email IS NOT NULL",
+		userID, email,
+	))
+}
+
+func (m Model) GetPasswordHash(userID int) (string, error) {
+	var hash sql.NullString
+	err := m.QueryRow("SELECT password FROM users WHERE id = $1", userID).Scan(&hash)
+	return hash.String, err
+}
+
+// Replaces the user's password hash unless it changed since it was read and
+// revokes their tokens issued before validSince
+func (m Model) ChangePassword(userID int, oldHash, newHash string, validSince time.Time) error {
+	return execOne(m.Exec(
+		"UPDATE users SET password = $3, tokens_valid_since = $4 WHERE id = $1 AND password = $2",
+		userID, oldHash, newHash, validSince,
+	))
+}
+
+// Schedules the user to be deleted at deleteAt and revokes their tokens
+func (m Model) ScheduleDeletion(userID int, deleteAt, validSince time.Time) error {
+	_, err := m.Exec(
+		"UPDATE users SET delete_at = $2, tokens_valid_since = $3 WHERE id = $1",
+		userID, deleteAt, validSince,
+	)
+	return err
+}
+
+func (m Model) CancelDeletion(userID int) error {
+	_, err := m.Exec("UPDATE users SET delete_at = NULL WHERE id = $1", userID)
+	return err
+}
+
+// Deletes the users whose grace period or trial is over, along with
+// everything that references them, and returns how many there were
+func (m Model) PurgeDeletedUsers() (int64, error) {
+	res, err := m.Exec("DELETE FROM users WHERE delete_at <= now() OR trial_expires_at <= now()")
+	if err != nil {
 		return 0, err
 	}
+	return res.RowsAffected()
+}
+
+// Collects everything stored about the user. Secrets, such as the password
+// hash and token hashes, are left out.
+func (m Model) ExportUser(userID int) (*UserExport, error) {
+	export := &UserExport{
+		ExportedAt:       time.Now(),
+		Identities:       []ExportIdentity{},
+		PendingLinks:     []ExportLink{},
+		RecoveryCodeUses: []time.Time{},
+		APIKeys:          []ExportAPIKey{},
+		ServiceAccounts:  []ExportServiceAccount{},
+	}
+
+	var (
+		email                                                  sql.NullString
+		verifiedAt, deleteAt, trialExpiresAt, tokensValidSince pq.NullTime
+	)
+	err := m.QueryRow(
+		`SELECT id, email, email_verified_at, password IS NOT NULL, created_at, delete_at, trial_expires_at,
+			tokens_valid_since, num
+		FROM users WHERE id = $1`, userID,
+	).Scan(
+		&export.Account.ID, &email, &verifiedAt, &export.Account.HasPassword, &export.Account.CreatedAt,
+		&deleteAt, &trialExpiresAt, &tokensValidSince, &export.Number,
+	)
+	if err != nil {
+		return nil, err
+	}
+	export.Account.Email = nullString(email)
+	export.Account.EmailVerifiedAt = nullTime(verifiedAt)
+	export.Account.DeleteAt = nullTime(deleteAt)
+	export.Account.TrialExpiresAt = nullTime(trialExpiresAt)
+	export.Sessions.TokensValidSince = nullTime(tokensValidSince)
+
+	// Identities
+	rows, err := m.Query(
+		"SELECT provider, subject, email, created_at FROM identities WHERE user_id = $1 ORDER BY id",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			identity ExportIdentity
+			email    sql.NullString
+		)
+		if err := rows.Scan(&identity.Provider, &identity.Subject, &email, &identity.CreatedAt); err != nil {
+			return nil, err
+		}
+		identity.Email = nullString(email)
+		export.Identities = append(export.Identities, identity)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Two-factor authentication
+	twoFactor := new(ExportTwoFactor)
+	var confirmedAt pq.NullTime
+	err = m.QueryRow(
+		`SELECT created_at, confirmed_at, (
+			SELECT count(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL
+		) FROM two_factor WHERE user_id = $1`, userID,
+	).Scan(&twoFactor.CreatedAt, &confirmedAt, &twoFactor.RecoveryCodesLeft)
+	if err == nil {
+		twoFactor.ConfirmedAt = nullTime(confirmedAt)
+		export.TwoFactor = twoFactor
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	rows, err = m.Query(
+		"SELECT used_at FROM recovery_codes WHERE user_id = $1 AND used_at IS NOT NULL ORDER BY used_at",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var usedAt time.Time
+		if err := rows.Scan(&usedAt); err != nil {
+			return nil, err
+		}
+		export.RecoveryCodeUses = append(export.RecoveryCodeUses, usedAt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Links and codes that can still be used
+	rows, err = m.Query(
+		`SELECT 'login_code', NULL, expires_at FROM login_codes WHERE user_id = $1
+		UNION ALL SELECT 'magic_link', NULL, expires_at FROM magic_links WHERE user_id = $1
+		UNION ALL SELECT 'password_reset', NULL, expires_at FROM password_resets WHERE user_id = $1
+		UNION ALL SELECT 'email_verification', email, expires_at FROM email_verifications WHERE user_id = $1
+		ORDER BY 3`, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			link  ExportLink
+			email sql.NullString
+		)
+		if err := rows.Scan(&link.Kind, &email, &link.ExpiresAt); err != nil {
+			return nil, err
+		}
+		link.Email = nullString(email)
+		export.PendingLinks = append(export.PendingLinks, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// API keys, without their hashes
+	rows, err = m.Query(
+		"SELECT name, CASE WHEN test THEN 'test' ELSE 'live' END, created_at FROM api_keys WHERE user_id = $1 ORDER BY id",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key ExportAPIKey
+		if err := rows.Scan(&key.Name, &key.Mode, &key.CreatedAt); err != nil {
+			return nil, err
+		}
+		export.APIKeys = append(export.APIKeys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Service accounts, without their secrets' hashes
+	rows, err = m.Query(
+		"SELECT name, client_id, scopes, created_at FROM service_accounts WHERE owner_id = $1 ORDER BY id",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var account ExportServiceAccount
+		if err := rows.Scan(&account.Name, &account.ClientID, pq.Array(&account.Scopes), &account.CreatedAt); err != nil {
+			return nil, err
+		}
+		export.ServiceAccounts = append(export.ServiceAccounts, account)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The sandbox copy of the number, if a test-mode key made one
+	var sandboxNumber int
+	err = m.QueryRow("SELECT num FROM sandbox_numbers WHERE user_id = $1", userID).Scan(&sandboxNumber)
+	if err == nil {
+		export.SandboxNumber = &sandboxNumber
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+func nullString(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+func nullTime(t pq.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// Creates a user with no way to log in but an API key, who's deleted at
+// expiresAt unless they convert
+func (m Model) CreateTrialUser(expiresAt time.Time) (int, error) {
+	var id int
+	err := m.QueryRow(
+		"INSERT INTO users (trial_expires_at) VALUES ($1) RETURNING id", expiresAt,
+	).Scan(&id)
+	return id, err
+}
+
+// Returns whether the user is on a trial
+func (m Model) IsTrial(userID int) (bool, error) {
+	var trial bool
+	err := m.QueryRow(
+		"SELECT trial_expires_at IS NOT NULL FROM users WHERE id = $1", userID,
+	).Scan(&trial)
+	return trial, err
+}
+
+// Gives a trial user an email and password, keeping their number. Returns
+// sql.ErrNoRows if the user isn't on a trial.
+func (m Model) ConvertTrial(userID int, email, password string) error {
+	return execOne(m.Exec(
+		`UPDATE users SET email = $2, password = $3, trial_expires_at = NULL
+		WHERE id = $1 AND trial_expires_at IS NOT NULL`,
+		userID, email, password,
+	))
+}
+
+// Ends the user's trial, e.g. once they link an identity to log in with
+func (m Model) EndTrial(userID int) error {
+	_, err := m.Exec("UPDATE users SET trial_expires_at = NULL WHERE id = $1", userID)
+	return err
+}
+
+// Deletes a trial user right away. Returns sql.ErrNoRows if the user isn't on
+// a trial.
+func (m Model) DeleteTrialUser(userID int) error {
+	return execOne(m.Exec(
+		"DELETE FROM users WHERE id = $1 AND trial_expires_at IS NOT NULL", userID,
+	))
+}
+
+func (m Model) CreateAPIKey(hash, name string, key *authentication.APIKey) (int, error) {
+	networks := formatNetworks(key.AllowedNetworks)
+	var expiresAt *time.Time
+	if !key.ExpiresAt.IsZero() {
+		expiresAt = &key.ExpiresAt
+	}
+
+	var id int
+	err := m.QueryRow(
+		`INSERT INTO api_keys (key_hash, user_id, name, test, allowed_networks, allowed_origins, expires_at, max_calls)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, 0)) RETURNING id`,
+		hash, key.UserID, name, key.Test, pq.Array(networks), pq.Array(key.AllowedOrigins), expiresAt, key.MaxCalls,
+	).Scan(&id)
+	return id, err
+}
+
+// Returns the key, unless its user was disabled, is being deleted or their
+// trial is over
+func (m Model) GetAPIKey(hash string) (authentication.APIKey, error) {
+	key, _, err := m.getAPIKey("k.key_hash = $1", hash)
+	return key, err
+}
+
+// Returns the key and its hash, like GetAPIKey
+func (m Model) GetAPIKeyByID(keyID int) (authentication.APIKey, string, error) {
+	return m.getAPIKey("k.id = $1", keyID)
+}
+
+func (m Model) getAPIKey(condition string, arg interface{}) (authentication.APIKey, string, error) {
+	key := authentication.APIKey{}
+	var (
+		hash      string
+		networks  []string
+		expiresAt pq.NullTime
+		maxCalls  sql.NullInt64
+	)
+	err := m.QueryRow(
+		`SELECT k.id, k.user_id, k.key_hash, k.test, k.allowed_networks, k.allowed_origins, k.expires_at,
+			k.max_calls, k.calls
+		FROM api_keys k JOIN users u ON u.id = k.user_id
+		WHERE `+condition+` AND u.disabled_at IS NULL AND u.delete_at IS NULL
+		AND (u.trial_expires_at IS NULL OR u.trial_expires_at > now())`, arg,
+	).Scan(
+		&key.ID, &key.UserID, &hash, &key.Test, pq.Array(&networks), pq.Array(&key.AllowedOrigins),
+		&expiresAt, &maxCalls, &key.Calls,
+	)
+	if err != nil {
+		return key, hash, err
+	}
+
+	if key.AllowedNetworks, err = parseNetworks(networks); err != nil {
+		return key, hash, err
+	}
+	key.ExpiresAt = expiresAt.Time
+	key.MaxCalls = int(maxCalls.Int64)
+	return key, hash, nil
+}
+
+// Counts a call with the key. Returns sql.ErrNoRows if it already made its
+// maximum calls.
+func (m Model) CountAPIKeyCall(keyID int) error {
+	return execOne(m.Exec(
+		"UPDATE api_keys SET calls = calls + 1 WHERE id = $1 AND calls < max_calls", keyID,
+	))
+}
+
+func (m Model) GetAPIKeys(userID int) ([]*APIKey, error) {
+	rows, err := m.Query(
+		`SELECT id, name, test, allowed_networks, allowed_origins, expires_at, COALESCE(max_calls, 0), calls,
+			created_at
+		FROM api_keys WHERE user_id = $1 ORDER BY id`, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key := &APIKey{Mode: liveMode}
+		var (
+			test      bool
+			expiresAt pq.NullTime
+		)
+		if err := rows.Scan(
+			&key.ID, &key.Name, &test, pq.Array(&key.AllowedNetworks), pq.Array(&key.AllowedOrigins),
+			&expiresAt, &key.MaxCalls, &key.Calls, &key.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		if test {
+			key.Mode = testMode
+		}
+		key.ExpiresAt = nullTime(expiresAt)
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Returns sql.ErrNoRows if the user doesn't have the key
+func (m Model) DeleteAPIKey(userID, keyID int) error {
+	return execOne(m.Exec("DELETE FROM api_keys WHERE id = $1 AND user_id = $2", keyID, userID))
+}
+
+func (m Model) CreateServiceAccount(hash, name string, account *authentication.ServiceAccount) (int, error) {
+	var expiresAt *time.Time
+	if !account.ExpiresAt.IsZero() {
+		expiresAt = &account.ExpiresAt
+	}
 
-	err := m.QueryRow("SELECT id FROM users WHERE facebook_id = $1", fbID).Scan(&id)
+	var id int
+	err := m.QueryRow(
+		`INSERT INTO service_accounts
+			(client_id, secret_hash, owner_id, name, scopes, allowed_networks, allowed_origins, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		account.ClientID, hash, account.OwnerID, name, pq.Array(account.Scopes),
+		pq.Array(formatNetworks(account.AllowedNetworks)), pq.Array(account.AllowedOrigins), expiresAt,
+	).Scan(&id)
 	return id, err
 }
+
+// Returns the account and its secret's hash, unless its owner was disabled or
+// is being deleted
+func (m Model) GetServiceAccount(clientID string) (authentication.ServiceAccount, string, error) {
+	account := authentication.ServiceAccount{ClientID: clientID}
+	var (
+		hash      string
+		networks  []string
+		expiresAt pq.NullTime
+	)
+	err := m.QueryRow(
+		`SELECT a.id, a.owner_id, a.scopes, a.secret_hash, a.allowed_networks, a.allowed_origins, a.expires_at
+		FROM service_accounts a JOIN users u ON u.id = a.owner_id
+		WHERE a.client_id = $1 AND u.disabled_at IS NULL AND u.delete_at IS NULL`, clientID,
+	).Scan(
+		&account.ID, &account.OwnerID, pq.Array(&account.Scopes), &hash,
+		pq.Array(&networks), pq.Array(&account.AllowedOrigins), &expiresAt,
+	)
+	if err != nil {
+		return account, hash, err
+	}
+
+	if account.AllowedNetworks, err = parseNetworks(networks); err != nil {
+		return account, hash, err
+	}
+	account.ExpiresAt = expiresAt.Time
+	return account, hash, nil
+}
+
+func (m Model) GetServiceAccounts(userID int) ([]*ServiceAccount, error) {
+	rows, err := m.Query(
+		`SELECT id, name, client_id, scopes, allowed_networks, allowed_origins, expires_at, created_at
+		FROM service_accounts WHERE owner_id = $1 ORDER BY id`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*ServiceAccount{}
+	for rows.Next() {
+		account := &ServiceAccount{}
+		var expiresAt pq.NullTime
+		if err := rows.Scan(
+			&account.ID, &account.Name, &account.ClientID, pq.Array(&account.Scopes),
+			pq.Array(&account.AllowedNetworks), pq.Array(&account.AllowedOrigins), &expiresAt, &account.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		account.ExpiresAt = nullTime(expiresAt)
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+// Returns the networks as CIDR strings to store
+func formatNetworks(networks []*net.IPNet) []string {
+	s := make([]string, len(networks))
+	for i, network := range networks {
+		s[i] = network.String()
+	}
+	return s
+}
+
+// Parses stored CIDR strings
+func parseNetworks(s []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, network := range s {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, ipNet)
+	}
+	return networks, nil
+}
+
+// Returns sql.ErrNoRows if the user doesn't own the account
+func (m Model) DeleteServiceAccount(userID, accountID int) error {
+	return execOne(m.Exec("DELETE FROM service_accounts WHERE id = $1 AND owner_id = $2", accountID, userID))
+}
+
+func (m Model) GetUserID(email string) (int, error) {
+	var id int
+	err := m.QueryRow("SELECT id FROM users WHERE email = $1", email).Scan(&id)
+	return id, err
+}
+
+func (m Model) GetIdentityUser(provider, subject string) (int, error) {
+	var id int
+	err := m.QueryRow(
+		"SELECT user_id FROM identities WHERE provider = $1 AND subject = $2",
+		provider, subject,
+	).Scan(&id)
+	return id, err
+}
+
+func (m Model) CreateIdentityUser(provider, subject, email string) (int, error) {
+	var id int
+
+	tx, err := m.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow("INSERT INTO users DEFAULT VALUES RETURNING id").Scan(&id); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO identities (user_id, provider, subject, email) VALUES ($1, $2, $3, NULLIF($4, ''))",
+		id, provider, subject, email,
+	); err != nil {
+		// Someone else created the user for this identity first
+		if err, ok := err.(*pq.Error); ok && err.Code.Name() == "unique_violation" {
+			tx.Rollback()
+			return m.GetIdentityUser(provider, subject)
+		}
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+func (m Model) LinkIdentity(userID int, provider, subject, email string) (*Identity, error) {
+	identity := &Identity{Provider: provider, Subject: subject, Email: email}
+	err := m.QueryRow(
+		`INSERT INTO identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+		RETURNING id, created_at`,
+		userID, provider, subject, email,
+	).Scan(&identity.ID, &identity.CreatedAt)
+	return identity, err
+}
+
+func (m Model) GetIdentities(userID int) ([]*Identity, error) {
+	rows, err := m.Query(
+		`SELECT id, provider, subject, COALESCE(email, ''), created_at
+		FROM identities WHERE user_id = $1 ORDER BY id`, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []*Identity{}
+	for rows.Next() {
+		identity := new(Identity)
+		if err := rows.Scan(
+			&identity.ID, &identity.Provider, &identity.Subject,
+			&identity.Email, &identity.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// Unlinks an identity from the user unless it's the only way they can log in
+func (m Model) UnlinkIdentity(userID, identityID int) error {
+	tx, err := m.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the user so concurrent unlinks can't remove both of their
+	// last two login methods
+	var hasPassword bool
+	if err := tx.QueryRow(
+		"SELECT password IS NOT NULL FROM users WHERE id = $1 FOR UPDATE", userID,
+	).Scan(&hasPassword); err != nil {
+		return err
+	}
+
+	var count int
+	if err := tx.QueryRow(
+		"SELECT count(*) FROM identities WHERE user_id = $1", userID,
+	).Scan(&count); err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("DELETE FROM identities WHERE id = $1 AND user_id = $2", identityID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	if !hasPassword && count <= 1 {
+		return LastLoginMethodErr
+	}
+
+	return tx.Commit()
+}
+
+// Unlinks an identity unless it's the only way its user can log in. If it
+// is, it's kept so the user gets the same account back if they log in again.
+func (m Model) DeauthorizeIdentity(provider, subject string) error {
+	_, err := m.Exec(
+		`DELETE FROM identities i
+		WHERE provider = $1 AND subject = $2 AND (
+			EXISTS (SELECT 1 FROM users u WHERE u.id = i.user_id AND u.password IS NOT NULL) OR
+			EXISTS (SELECT 1 FROM identities o WHERE o.user_id = i.user_id AND o.id <> i.id)
+		)`,
+		provider, subject,
+	)
+	return err
+}
+
+// Deletes an identity along with its user if the user can't log in any
+// other way
+func (m Model) DeleteIdentityData(provider, subject string) error {
+	tx, err := m.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow(
+		"DELETE FROM identities WHERE provider = $1 AND subject = $2 RETURNING user_id",
+		provider, subject,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		// Nothing left to delete
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		`DELETE FROM users WHERE id = $1 AND password IS NULL AND NOT EXISTS (
+			SELECT 1 FROM identities WHERE user_id = $1
+		)`, userID,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m Model) CreateDeletionRequest(code string) error {
+	_, err := m.Exec(
+		"INSERT INTO deletion_requests (confirmation_code, status) VALUES ($1, $2)",
+		code, DeletionPending,
+	)
+	return err
+}
+
+func (m Model) UpdateDeletionRequest(code, status string) error {
+	_, err := m.Exec(
+		"UPDATE deletion_requests SET status = $1, updated_at = now() WHERE confirmation_code = $2",
+		status, code,
+	)
+	return err
+}
+
+func (m Model) GetDeletionRequest(code string) (*DeletionRequest, error) {
+	deletion := &DeletionRequest{ConfirmationCode: code}
+	err := m.QueryRow(
+		"SELECT status, requested_at, updated_at FROM deletion_requests WHERE confirmation_code = $1",
+		code,
+	).Scan(&deletion.Status, &deletion.RequestedAt, &deletion.UpdatedAt)
+	return deletion, err
+}
+
+func (m Model) CreateLoginCode(hash string, userID int, challenge string, expiresAt time.Time) error {
+	// Clean up codes nobody came back for
+	if _, err := m.Exec("DELETE FROM login_codes WHERE expires_at < now()"); err != nil {
+		return err
+	}
+
+	_, err := m.Exec(
+		"INSERT INTO login_codes (code_hash, user_id, code_challenge, expires_at) VALUES ($1, $2, $3, $4)",
+		hash, userID, challenge, expiresAt,
+	)
+	return err
+}
+
+func (m Model) TakeLoginCode(hash string) (int, string, time.Time, error) {
+	var (
+		userID    int
+		challenge string
+		expiresAt time.Time
+	)
+	err := m.QueryRow(
+		"DELETE FROM login_codes WHERE code_hash = $1 RETURNING user_id, code_challenge, expires_at",
+		hash,
+	).Scan(&userID, &challenge, &expiresAt)
+	return userID, challenge, expiresAt, err
+}
+
+func (m Model) CreatePasswordReset(hash string, userID int, expiresAt time.Time) error {
+	// Clean up tokens nobody used
+	if _, err := m.Exec("DELETE FROM password_resets WHERE expires_at < now()"); err != nil {
+		return err
+	}
+
+	_, err := m.Exec(
+		"INSERT INTO password_resets (token_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+		hash, userID, expiresAt,
+	)
+	return err
+}
+
+func (m Model) TakePasswordReset(hash string) (int, time.Time, error) {
+	var (
+		userID    int
+		expiresAt time.Time
+	)
+	err := m.QueryRow(
+		"DELETE FROM password_resets WHERE token_hash = $1 RETURNING user_id, expires_at",
+		hash,
+	).Scan(&userID, &expiresAt)
+	return userID, expiresAt, err
+}
+
+// Sets the user's password and revokes their tokens issued before validSince
+// and their reset tokens
+func (m Model) ResetPassword(userID int, password string, validSince time.Time) error {
+	tx, err := m.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		// Following the emailed link proves they own the email too
+		`UPDATE users SET
+			password = $1,
+			tokens_valid_since = $3,
+			email_verified_at = COALESCE(email_verified_at, now())
+		WHERE id = $2`,
+		password, userID, validSince,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM password_resets WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Returns sql.ErrNoRows for disabled users, so none of their tokens work
+func (m Model) GetTokensValidSince(userID int) (time.Time, error) {
+	var validSince pq.NullTime
+	err := m.QueryRow(
+		"SELECT tokens_valid_since FROM users WHERE id = $1 AND disabled_at IS NULL", userID,
+	).Scan(&validSince)
+	return validSince.Time, err
+}
+
+func (m Model) CreateEmailVerification(hash string, userID int, email string, expiresAt time.Time) error {
+	// Clean up tokens nobody used
+	if _, err := m.Exec("DELETE FROM email_verifications WHERE expires_at < now()"); err != nil {
+		return err
+	}
+
+	_, err := m.Exec(
+		"INSERT INTO email_verifications (token_hash, user_id, email, expires_at) VALUES ($1, $2, $3, $4)",
+		hash, userID, email, expiresAt,
+	)
+	return err
+}
+
+func (m Model) GetEmailVerificationSentAt(userID int, email string) (time.Time, error) {
+	var sentAt pq.NullTime
+	err := m.QueryRow(
+		"SELECT max(created_at) FROM email_verifications WHERE user_id = $1 AND email = $2",
+		userID, email,
+	).Scan(&sentAt)
+	return sentAt.Time, err
+}
+
+func (m Model) TakeEmailVerification(hash string) (int, string, time.Time, error) {
+	var (
+		userID    int
+		email     string
+		expiresAt time.Time
+	)
+	err := m.QueryRow(
+		"DELETE FROM email_verifications WHERE token_hash = $1 RETURNING user_id, email, expires_at",
+		hash,
+	).Scan(&userID, &email, &expiresAt)
+	return userID, email, expiresAt, err
+}
+
+// Marks the user's email verified if it's still the given email
+func (m Model) VerifyEmail(userID int, email string) error {
+	res, err := m.Exec(
+		"UPDATE users SET email_verified_at = COALESCE(email_verified_at, now()) WHERE id = $1 AND email = $2",
+		userID, email,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	// The other tokens sent for the email aren't needed anymore
+	_, err = m.Exec("DELETE FROM email_verifications WHERE user_id = $1", userID)
+	return err
+}
+
+// Returns the user's email and whether it's verified. Users who signed up
+// with another provider have no email and count as verified.
+func (m Model) GetEmailVerified(userID int) (string, bool, error) {
+	var (
+		email    sql.NullString
+		verified bool
+	)
+	err := m.QueryRow(
+		"SELECT email, email IS NULL OR email_verified_at IS NOT NULL FROM users WHERE id = $1",
+		userID,
+	).Scan(&email, &verified)
+	return email.String, verified, err
+}
+
+func (m Model) CreateMagicLink(hash string, userID int, expiresAt time.Time) error {
+	// Clean up links nobody used
+	if _, err := m.Exec("DELETE FROM magic_links WHERE expires_at < now()"); err != nil {
+		return err
+	}
+
+	_, err := m.Exec(
+		"INSERT INTO magic_links (token_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+		hash, userID, expiresAt,
+	)
+	return err
+}
+
+func (m Model) TakeMagicLink(hash string) (int, time.Time, error) {
+	var (
+		userID    int
+		expiresAt time.Time
+	)
+	err := m.QueryRow(
+		"DELETE FROM magic_links WHERE token_hash = $1 RETURNING user_id, expires_at",
+		hash,
+	).Scan(&userID, &expiresAt)
+	return userID, expiresAt, err
+}
+
+func (m Model) HasTwoFactor(userID int) (bool, error) {
+	var enabled bool
+	err := m.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM two_factor WHERE user_id = $1 AND confirmed_at IS NOT NULL)",
+		userID,
+	).Scan(&enabled)
+	return enabled, err
+}
+
+// Saves an unconfirmed secret unless the user already confirmed one
+func (m Model) CreateTwoFactor(userID int, secret string) error {
+	_, err := m.Exec(
+		`INSERT INTO two_factor (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, last_used_step = 0, created_at = now()
+		WHERE two_factor.confirmed_at IS NULL`,
+		userID, secret,
+	)
+	return err
+}
+
+func (m Model) GetTwoFactor(userID int) (string, bool, int64, error) {
+	var (
+		secret    string
+		confirmed bool
+		lastStep  int64
+	)
+	err := m.QueryRow(
+		"SELECT secret, confirmed_at IS NOT NULL, last_used_step FROM two_factor WHERE user_id = $1",
+		userID,
+	).Scan(&secret, &confirmed, &lastStep)
+	return secret, confirmed, lastStep, err
+}
+
+// Records the time step a code was used for unless a code was already used
+// for it or a later one
+func (m Model) UseTwoFactorStep(userID int, step int64) error {
+	res, err := m.Exec(
+		"UPDATE two_factor SET last_used_step = $2 WHERE user_id = $1 AND last_used_step < $2",
+		userID, step,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Confirms the user's secret and replaces their recovery codes
+func (m Model) ConfirmTwoFactor(userID int, hashes []string) error {
+	tx, err := m.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE two_factor SET confirmed_at = now() WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		if _, err := tx.Exec(
+			"INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			userID, hash,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (m Model) UseRecoveryCode(userID int, hash string) error {
+	res, err := m.Exec(
+		"UPDATE recovery_codes SET used_at = now() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+		userID, hash,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (m Model) DeleteTwoFactor(userID int) error {
+	tx, err := m.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM two_factor WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Sandbox keeps the copies of users' numbers that test-mode API keys count
+// with. A user's copy starts at their number the first time it's used.
+type Sandbox struct {
+	*sql.DB
+}
+
+func (m Model) Sandbox() Sandbox {
+	return Sandbox{m.DB}
+}
+
+// Copies the user's number unless they already have a copy
+func (s Sandbox) copyNumber(userID int) error {
+	_, err := s.Exec(
+		`INSERT INTO sandbox_numbers (user_id, num) SELECT id, num FROM users WHERE id = $1
+		ON CONFLICT (user_id) DO NOTHING`, userID,
+	)
+	return err
+}
+
+func (s Sandbox) GetNumber(id int) (*Number, error) {
+	if err := s.copyNumber(id); err != nil {
+		return nil, err
+	}
+
+	number := &Number{ID: id}
+	err := s.QueryRow("SELECT num FROM sandbox_numbers WHERE user_id = $1", id).Scan(&number.Value)
+	return number, err
+}
+
+func (s Sandbox) IncrementNumber(id int) (*Number, error) {
+	if err := s.copyNumber(id); err != nil {
+		return nil, err
+	}
+
+	number := &Number{ID: id}
+	err := s.QueryRow(
+		"UPDATE sandbox_numbers SET num = num + 1 WHERE user_id = $1 RETURNING num", id,
+	).Scan(&number.Value)
+	return number, err
+}
+
+func (s Sandbox) IncrementNumberUpTo(id, limit int) (*Number, error) {
+	if err := s.copyNumber(id); err != nil {
+		return nil, err
+	}
+
+	number := &Number{ID: id}
+	err := s.QueryRow(
+		"UPDATE sandbox_numbers SET num = num + 1 WHERE user_id = $1 AND num + 1 <= $2 RETURNING num", id, limit,
+	).Scan(&number.Value)
+	return number, err
+}
+
+func (s Sandbox) UpdateNumber(userID, newValue int) (*Number, error) {
+	number := &Number{ID: userID}
+	err := s.QueryRow(
+		`INSERT INTO sandbox_numbers (user_id, num) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET num = $2 RETURNING num`,
+		userID, newValue,
+	).Scan(&number.Value)
+	return number, err
+}
+
+// Throws away the user's copy, so it starts over at their number
+func (s Sandbox) Wipe(userID int) error {
+	_, err := s.Exec("DELETE FROM sandbox_numbers WHERE user_id = $1", userID)
+	return err
+}
+
+// LoginFailures is a ratelimit.Store in the database so every replica of the
+// API enforces the same limits
+type LoginFailures struct {
+	*sql.DB
+}
+
+// Failures are kept for at least this long even if a limiter's window is
+// shorter, since limiters with different windows share the table
+const loginFailureRetention = 24 * time.Hour
+
+func (m Model) LoginFailures() LoginFailures {
+	return LoginFailures{m.DB}
+}
+
+func (s LoginFailures) Get(key string) (int, time.Time, error) {
+	var (
+		failures    int
+		lastFailure time.Time
+	)
+	err := s.QueryRow(
+		"SELECT failures, last_failure_at FROM login_failures WHERE key = $1", key,
+	).Scan(&failures, &lastFailure)
+	if err == sql.ErrNoRows {
+		return 0, time.Time{}, nil
+	}
+	return failures, lastFailure, err
+}
+
+// Deletes failures that are older than both the window and the retention
+func (s LoginFailures) purge(window time.Duration) error {
+	retention := window
+	if retention < loginFailureRetention {
+		retention = loginFailureRetention
+	}
+	_, err := s.Exec(
+		"DELETE FROM login_failures WHERE last_failure_at < now() - $1 * interval '1 second'",
+		retention.Seconds(),
+	)
+	return err
+}
+
+func (s LoginFailures) Fail(key string, window time.Duration) (int, error) {
+	if err := s.purge(window); err != nil {
+		return 0, err
+	}
+
+	var failures int
+	err := s.QueryRow(
+		`INSERT INTO login_failures (key, failures) VALUES ($1, 1)
+		ON CONFLICT (key) DO UPDATE
+		SET failures = CASE
+			WHEN login_failures.last_failure_at < now() - $2 * interval '1 second' THEN 1
+			ELSE login_failures.failures + 1
+		END, last_failure_at = now()
+		RETURNING failures`,
+		key, window.Seconds(),
+	).Scan(&failures)
+	return failures, err
+}
+
+func (s LoginFailures) Attempt(key string, window time.Duration, wait func(int, time.Time) time.Duration) (time.Duration, error) {
+	if err := s.purge(window); err != nil {
+		return 0, err
+	}
+
+	tx, err := s.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Lock the key's row, creating it if need be, so concurrent attempts
+	// for the key take turns
+	var (
+		failures    int
+		lastFailure time.Time
+	)
+	if _, err := tx.Exec(
+		"INSERT INTO login_failures (key, failures) VALUES ($1, 0) ON CONFLICT (key) DO NOTHING", key,
+	); err != nil {
+		return 0, err
+	}
+	if err := tx.QueryRow(
+		"SELECT failures, last_failure_at FROM login_failures WHERE key = $1 FOR UPDATE", key,
+	).Scan(&failures, &lastFailure); err != nil {
+		return 0, err
+	}
+
+	if d := wait(failures, lastFailure); d > 0 {
+		return d, nil
+	}
+
+	if _, err := tx.Exec(
+		`UPDATE login_failures SET failures = CASE
+			WHEN last_failure_at < now() - $2 * interval '1 second' THEN 1
+			ELSE failures + 1
+		END, last_failure_at = now()
+		WHERE key = $1`,
+		key, window.Seconds(),
+	); err != nil {
+		return 0, err
+	}
+	return 0, tx.Commit()
+}
+
+func (s LoginFailures) Release(key string) error {
+	_, err := s.Exec(
+		"UPDATE login_failures SET failures = failures - 1 WHERE key = $1 AND failures > 0", key,
+	)
+	return err
+}
+
+func (s LoginFailures) Reset(key string) error {
+	_, err := s.Exec("DELETE FROM login_failures WHERE key = $1", key)
+	return err
+}
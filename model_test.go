@@ -1,12 +1,16 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
+	"net"
 	"strconv"
 	"testing"
 	"time"
 
+	"github.com/mujz/ipp/authentication"
 	"github.com/mujz/ipp/config"
+	"github.com/mujz/ipp/ratelimit"
 )
 
 func TestOpen(t *testing.T) {
@@ -37,12 +41,61 @@ func TestCreate(t *testing.T) {
 	}
 }
 
-func TestCreateFacebookUser(t *testing.T) {
-	fbID := time.Now().UnixNano()
-	_, err := model.CreateFacebookUser(strconv.FormatInt(fbID, 10))
+func TestCreateIdentityUser(t *testing.T) {
+	fbID := strconv.FormatInt(time.Now().UnixNano(), 10)
+	id, err := model.CreateIdentityUser("facebook", fbID, "")
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	got, err := model.GetIdentityUser("facebook", fbID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != id {
+		t.Fatalf("Expected ID = %d, Got = %d", id, got)
+	}
+}
+
+func TestLinkAndUnlinkIdentity(t *testing.T) {
+	user, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := model.LinkIdentity(user.ID, "facebook", strconv.FormatInt(time.Now().UnixNano(), 10), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := model.UnlinkIdentity(user.ID, identity.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := model.UnlinkIdentity(user.ID, identity.ID); err != sql.ErrNoRows {
+		t.Fatalf("Expected %v; Got %v", sql.ErrNoRows, err)
+	}
+}
+
+func TestUnlinkLastLoginMethod(t *testing.T) {
+	id, err := model.CreateIdentityUser("facebook", strconv.FormatInt(time.Now().UnixNano(), 10), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identities, err := model.GetIdentities(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(identities) != 1 {
+		t.Fatalf("Expected 1 identity; Got %d", len(identities))
+	}
+
+	if err := model.UnlinkIdentity(id, identities[0].ID); err != LastLoginMethodErr {
+		t.Fatalf("Expected %v; Got %v", LastLoginMethodErr, err)
+	}
 }
 
 func TestGet(t *testing.T) {
@@ -98,6 +151,23 @@ func TestIncrementNumber(t *testing.T) {
 	}
 }
 
+func TestIncrementNumberUpTo(t *testing.T) {
+	user, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if number, err := model.IncrementNumberUpTo(user.ID, 2); err != nil || number.Value != 2 {
+		t.Fatalf("Expected 2; Got %v, %v", number, err)
+	}
+	if _, err := model.IncrementNumberUpTo(user.ID, 2); err != sql.ErrNoRows {
+		t.Fatalf("Expected %v; Got %v", sql.ErrNoRows, err)
+	}
+	if number, err := model.GetNumber(user.ID); err != nil || number.Value != 2 {
+		t.Fatalf("Expected the number to stay 2; Got %v, %v", number, err)
+	}
+}
+
 func TestUpdateNumber(t *testing.T) {
 	user, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), p)
 	if err != nil {
@@ -114,3 +184,508 @@ func TestUpdateNumber(t *testing.T) {
 		t.Fatalf("Expected Number = %d, Got = %d", newNumber, got)
 	}
 }
+
+func TestTakeLoginCode(t *testing.T) {
+	user, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := model.CreateLoginCode(hash, user.ID, "challenge", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	userID, challenge, _, err := model.TakeLoginCode(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if userID != user.ID || challenge != "challenge" {
+		t.Fatalf("Expected (%d, challenge), Got (%d, %s)", user.ID, userID, challenge)
+	}
+
+	if _, _, _, err := model.TakeLoginCode(hash); err != sql.ErrNoRows {
+		t.Fatalf("Expected %v; Got %v", sql.ErrNoRows, err)
+	}
+}
+
+func TestDeauthorizeLastIdentity(t *testing.T) {
+	fbID := strconv.FormatInt(time.Now().UnixNano(), 10)
+	id, err := model.CreateIdentityUser("facebook", fbID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := model.DeauthorizeIdentity("facebook", fbID); err != nil {
+		t.Fatal(err)
+	}
+
+	// It's the user's only login method, so it's kept
+	if got, err := model.GetIdentityUser("facebook", fbID); err != nil || got != id {
+		t.Fatalf("Expected identity to still belong to user %d; Got %d, %v", id, got, err)
+	}
+}
+
+func TestDeleteIdentityDataKeepsUsersWithPasswords(t *testing.T) {
+	user, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fbID := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if _, err := model.LinkIdentity(user.ID, "facebook", fbID, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := model.DeleteIdentityData("facebook", fbID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := model.GetIdentityUser("facebook", fbID); err != sql.ErrNoRows {
+		t.Fatalf("Expected %v; Got %v", sql.ErrNoRows, err)
+	}
+	if _, err := model.GetNumber(user.ID); err != nil {
+		t.Fatalf("Expected user to be kept; Got %v", err)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	user, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if validSince, err := model.GetTokensValidSince(user.ID); err != nil || !validSince.IsZero() {
+		t.Fatalf("Expected the user's tokens to never have been revoked; Got %v, %v", validSince, err)
+	}
+
+	hash := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := model.CreatePasswordReset(hash, user.ID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if err := model.ResetPassword(user.ID, "new hash", now); err != nil {
+		t.Fatal(err)
+	}
+
+	if validSince, err := model.GetTokensValidSince(user.ID); err != nil || !validSince.Equal(now.Truncate(time.Microsecond)) {
+		t.Fatalf("Expected the user's tokens to be revoked as of %v; Got %v, %v", now, validSince, err)
+	}
+
+	// Resetting the password invalidates other reset tokens
+	if _, _, err := model.TakePasswordReset(hash); err != sql.ErrNoRows {
+		t.Fatalf("Expected %v; Got %v", sql.ErrNoRows, err)
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	user, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, verified, err := model.GetEmailVerified(user.ID); err != nil || verified {
+		t.Fatalf("Expected an unverified email; Got %t, %v", verified, err)
+	}
+
+	// Only the user's current email can be verified
+	if err := model.VerifyEmail(user.ID, "old"+user.Username); err != sql.ErrNoRows {
+		t.Fatalf("Expected %v; Got %v", sql.ErrNoRows, err)
+	}
+
+	if err := model.VerifyEmail(user.ID, user.Username); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, verified, err := model.GetEmailVerified(user.ID); err != nil || !verified {
+		t.Fatalf("Expected a verified email; Got %t, %v", verified, err)
+	}
+}
+
+func TestLoginFailures(t *testing.T) {
+	failures := model.LoginFailures()
+	key := fmt.Sprintf("test:%d", time.Now().UnixNano())
+
+	for i := 1; i <= 3; i++ {
+		if n, err := failures.Fail(key, time.Hour); err != nil || n != i {
+			t.Fatalf("Expected %d failures; Got %d, %v", i, n, err)
+		}
+	}
+
+	if n, lastFailure, err := failures.Get(key); err != nil || n != 3 || time.Since(lastFailure) > time.Minute {
+		t.Fatalf("Expected 3 recent failures; Got %d at %s, %v", n, lastFailure, err)
+	}
+
+	// Failures older than the window are forgotten
+	if n, err := failures.Fail(key, 0); err != nil || n != 1 {
+		t.Fatalf("Expected the failures to start over; Got %d, %v", n, err)
+	}
+
+	if err := failures.Reset(key); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := failures.Get(key); err != nil || n != 0 {
+		t.Fatalf("Expected no failures; Got %d, %v", n, err)
+	}
+}
+
+func TestLoginFailureAttempts(t *testing.T) {
+	failures := model.LoginFailures()
+	key := fmt.Sprintf("test:%d", time.Now().UnixNano())
+	limiter := ratelimit.New(failures, ratelimit.Policy{
+		FreeAttempts: 3,
+		Backoff:      time.Minute,
+		MaxBackoff:   time.Minute,
+		Window:       time.Hour,
+	})
+
+	// Only the free attempts get in, however many are made at once
+	allowed := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func() {
+			wait, err := limiter.Attempt(key)
+			allowed <- err == nil && wait == 0
+		}()
+	}
+	n := 0
+	for i := 0; i < 10; i++ {
+		if <-allowed {
+			n++
+		}
+	}
+	if n != 3 {
+		t.Fatalf("Expected 3 attempts to get in; Got %d", n)
+	}
+
+	// Released attempts don't count
+	if err := limiter.Release(key); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := failures.Get(key); err != nil || n != 2 {
+		t.Fatalf("Expected 2 failures; Got %d, %v", n, err)
+	}
+}
+
+func TestUpdatePasswordHash(t *testing.T) {
+	user, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), "old hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing changes if the hash changed since it was read
+	if err := model.UpdatePasswordHash(user.ID, "stale hash", "new hash"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := model.Get(user.Username); got.Password != "old hash" {
+		t.Fatalf("Expected old hash; Got %s", got.Password)
+	}
+
+	if err := model.UpdatePasswordHash(user.ID, "old hash", "new hash"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := model.Get(user.Username); got.Password != "new hash" {
+		t.Fatalf("Expected new hash; Got %s", got.Password)
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	user, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := model.VerifyEmail(user.ID, user.Username); err != nil {
+		t.Fatal(err)
+	}
+
+	email := "new" + user.Username
+	if err := model.ChangeEmail(user.ID, email); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := model.GetUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Email != email || got.EmailVerified || got.Number.Value != 1 || got.CreatedAt.IsZero() {
+		t.Fatalf("Expected an unverified %s with number 1; Got %+v", email, got)
+	}
+
+	// Users who log in with a provider have no email to change
+	id, err := model.CreateIdentityUser("facebook", strconv.FormatInt(time.Now().UnixNano(), 10), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := model.ChangeEmail(id, "other"+user.Username); err != sql.ErrNoRows {
+		t.Fatalf("Expected %v; Got %v", sql.ErrNoRows, err)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	user, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), "old hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing changes if the hash changed since it was read
+	if err := model.ChangePassword(user.ID, "stale hash", "new hash", time.Now()); err != sql.ErrNoRows {
+		t.Fatalf("Expected %v; Got %v", sql.ErrNoRows, err)
+	}
+
+	validSince := time.Now()
+	if err := model.ChangePassword(user.ID, "old hash", "new hash", validSince); err != nil {
+		t.Fatal(err)
+	}
+	if hash, err := model.GetPasswordHash(user.ID); err != nil || hash != "new hash" {
+		t.Fatalf("Expected new hash; Got %s, %v", hash, err)
+	}
+	if got, err := model.GetTokensValidSince(user.ID); err != nil || !got.Equal(validSince.Truncate(time.Microsecond)) {
+		t.Fatalf("Expected the user's tokens to be revoked at %v; Got %v, %v", validSince, got, err)
+	}
+}
+
+func TestPurgeDeletedUsers(t *testing.T) {
+	user, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := model.ScheduleDeletion(user.ID, time.Now().Add(-time.Second), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := model.ScheduleDeletion(kept.ID, time.Now().Add(time.Hour), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := model.PurgeDeletedUsers(); err != nil || n < 1 {
+		t.Fatalf("Expected the user to be deleted; Got %d, %v", n, err)
+	}
+	if _, err := model.GetUser(user.ID); err != sql.ErrNoRows {
+		t.Fatalf("Expected %v; Got %v", sql.ErrNoRows, err)
+	}
+	if _, err := model.GetUser(kept.ID); err != nil {
+		t.Fatalf("Expected the user in their grace period to be kept; Got %v", err)
+	}
+}
+
+func TestExpiredTrial(t *testing.T) {
+	userID, err := model.CreateTrialUser(time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := fmt.Sprintf("%064d", time.Now().UnixNano())
+	if _, err := model.CreateAPIKey(hash, "Trial", &authentication.APIKey{UserID: userID}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key stops working as soon as the trial is over
+	if _, err := model.GetAPIKey(hash); err != sql.ErrNoRows {
+		t.Fatalf("Expected %v; Got %v", sql.ErrNoRows, err)
+	}
+
+	if _, err := model.PurgeDeletedUsers(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := model.GetUser(userID); err != sql.ErrNoRows {
+		t.Fatalf("Expected the expired trial to be deleted; Got %v", err)
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	prefix := fmt.Sprintf("search%d_", time.Now().UnixNano())
+	for i := 0; i < 3; i++ {
+		if _, err := model.Create(fmt.Sprintf("%s%d@m.ca", prefix, i), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users, total, err := model.SearchUsers(prefix, 2, 0)
+	if err != nil || total != 3 || len(users) != 2 {
+		t.Fatalf("Expected 2 of 3 users; Got %d of %d, %v", len(users), total, err)
+	}
+	if users[0].Email != prefix+"0@m.ca" || users[0].Role != userRole {
+		t.Fatalf("Expected the first user; Got %+v", users[0])
+	}
+
+	// Wildcards are taken literally
+	if _, total, err := model.SearchUsers("search%_", 2, 0); err != nil || total != 0 {
+		t.Fatalf("Expected no users; Got %d, %v", total, err)
+	}
+}
+
+func TestDisableUser(t *testing.T) {
+	user, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := model.DisableUser(user.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if disabled, err := model.IsDisabled(user.ID); err != nil || !disabled {
+		t.Fatalf("Expected the user to be disabled; Got %t, %v", disabled, err)
+	}
+
+	// None of a disabled user's tokens are valid
+	if _, err := model.GetTokensValidSince(user.ID); err != sql.ErrNoRows {
+		t.Fatalf("Expected %v; Got %v", sql.ErrNoRows, err)
+	}
+
+	if err := model.EnableUser(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if validSince, err := model.GetTokensValidSince(user.ID); err != nil || validSince.IsZero() {
+		t.Fatalf("Expected the tokens from before to stay revoked; Got %v, %v", validSince, err)
+	}
+
+	if err := model.DisableUser(0, time.Now()); err != sql.ErrNoRows {
+		t.Fatalf("Expected %v; Got %v", sql.ErrNoRows, err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	admin, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := model.LogAdminAction(admin.ID, "view_user", user.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := model.LogAdminAction(admin.ID, "disable", user.ID, "spam"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, total, err := model.GetAuditLog(user.ID, 10, 0)
+	if err != nil || total != 2 {
+		t.Fatalf("Expected 2 entries; Got %d, %v", total, err)
+	}
+	if entry := entries[0]; entry.AdminID != admin.ID || entry.Action != "disable" || entry.Details != "spam" {
+		t.Fatalf("Expected the latest entry first; Got %+v", entry)
+	}
+}
+
+func TestUseInvite(t *testing.T) {
+	hash := fmt.Sprintf("%064d", time.Now().UnixNano())
+	invite := &Invite{MaxUses: 2}
+	if err := model.CreateInvite(hash, invite); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if id, err := model.UseInvite(hash); err != nil || id != invite.ID {
+			t.Fatalf("Expected invite %d; Got %d, %v", invite.ID, id, err)
+		}
+	}
+	if _, err := model.UseInvite(hash); err != sql.ErrNoRows {
+		t.Fatalf("Expected the invite to be used up; Got %v", err)
+	}
+
+	// A returned use can be used again
+	if err := model.ReturnInvite(invite.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := model.UseInvite(hash); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired invites can't be used
+	expired := fmt.Sprintf("%064d", time.Now().UnixNano())
+	expiresAt := time.Now().Add(-time.Second)
+	if err := model.CreateInvite(expired, &Invite{ExpiresAt: &expiresAt}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := model.UseInvite(expired); err != sql.ErrNoRows {
+		t.Fatalf("Expected the invite to be expired; Got %v", err)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	user, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := model.UpdateNumber(user.ID, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	// The sandbox starts as a copy of the number
+	sandbox := model.Sandbox()
+	if number, err := sandbox.IncrementNumber(user.ID); err != nil || number.Value != 6 {
+		t.Fatalf("Expected 6; Got %v, %v", number, err)
+	}
+	if number, err := model.GetNumber(user.ID); err != nil || number.Value != 5 {
+		t.Fatalf("Expected the number to stay 5; Got %v, %v", number, err)
+	}
+
+	// Wiping it starts it over from the number
+	if err := sandbox.Wipe(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if number, err := sandbox.GetNumber(user.ID); err != nil || number.Value != 5 {
+		t.Fatalf("Expected 5; Got %v, %v", number, err)
+	}
+}
+
+func TestServiceAccount(t *testing.T) {
+	user, err := model.Create(fmt.Sprintf(e, time.Now().UnixNano()), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientID := fmt.Sprintf("sa_%d", time.Now().UnixNano())
+	hash := fmt.Sprintf("%064d", time.Now().UnixNano())
+	_, office, _ := net.ParseCIDR("192.0.2.0/24")
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Microsecond)
+	id, err := model.CreateServiceAccount(hash, "Backend", &authentication.ServiceAccount{
+		OwnerID:         user.ID,
+		ClientID:        clientID,
+		Scopes:          []string{"read", "next"},
+		AllowedNetworks: []*net.IPNet{office},
+		AllowedOrigins:  []string{"https://example.com"},
+		ExpiresAt:       expiresAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, stored, err := model.GetServiceAccount(clientID)
+	if err != nil || account.ID != id || account.OwnerID != user.ID || stored != hash || len(account.Scopes) != 2 {
+		t.Fatalf("Expected the account with its hash and scopes; Got %+v, %s, %v", account, stored, err)
+	}
+	if len(account.AllowedNetworks) != 1 || account.AllowedNetworks[0].String() != "192.0.2.0/24" ||
+		len(account.AllowedOrigins) != 1 || !account.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("Expected the account's restrictions; Got %+v", account)
+	}
+
+	// Accounts of users being deleted can't get tokens
+	if err := model.ScheduleDeletion(user.ID, time.Now().Add(time.Hour), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := model.GetServiceAccount(clientID); err != sql.ErrNoRows {
+		t.Fatalf("Expected %v; Got %v", sql.ErrNoRows, err)
+	}
+	if err := model.CancelDeletion(user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the owner can delete the account
+	if err := model.DeleteServiceAccount(user.ID+1, id); err != sql.ErrNoRows {
+		t.Fatalf("Expected %v; Got %v", sql.ErrNoRows, err)
+	}
+	if err := model.DeleteServiceAccount(user.ID, id); err != nil {
+		t.Fatal(err)
+	}
+	if accounts, err := model.GetServiceAccounts(user.ID); err != nil || len(accounts) != 0 {
+		t.Fatalf("Expected no accounts; Got %v, %v", accounts, err)
+	}
+}
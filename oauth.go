@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/jsonapi"
+	"github.com/mujz/ipp/authentication"
+	"github.com/mujz/ipp/config"
+)
+
+const grantKey = key(4)
+
+// What service accounts can be allowed to do
+const (
+	readScope  = "read"  // Get the number
+	writeScope = "write" // Set the number and wipe the sandbox
+	nextScope  = "next"  // Increment the number
+)
+
+var scopes = []string{readScope, writeScope, nextScope}
+
+const maxServiceAccountNameLength = 64
+
+// Why a request broke a service account's restrictions, with a code clients
+// can check
+var clientRestrictionErrors = map[error]*jsonapi.ErrorObject{
+	authentication.ClientExpiredErr: {
+		Code:   "client_expired",
+		Detail: "This service account expired. Please create a new one.",
+	},
+	authentication.ClientIPNotAllowedErr: {
+		Code:   "ip_not_allowed",
+		Detail: "This service account can't be used from your IP address.",
+	},
+	authentication.ClientOriginNotAllowedErr: {
+		Code:   "origin_not_allowed",
+		Detail: "This service account can't be used from this website.",
+	},
+}
+
+// Responds with 403 and returns false if the request's token wasn't granted
+// the scope. Users' own tokens and API keys can do anything.
+func allowScope(w http.ResponseWriter, r *http.Request, scope string) bool {
+	grant, ok := r.Context().Value(grantKey).(*authentication.Grant)
+	if !ok || grant.Allows(scope) {
+		return true
+	}
+
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+	marshalError(w, http.StatusForbidden, fmt.Sprintf("This token needs the %s scope.", scope))
+	return false
+}
+
+// A successful response from the token endpoint, as in RFC 6749
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+// Issues access tokens to service accounts with the client-credentials grant
+// of RFC 6749. Clients authenticate with HTTP Basic auth or the client_id and
+// client_secret form fields, and may ask for fewer scopes than they have.
+func TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Tokens mustn't be cached anywhere
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	if err := r.ParseForm(); err != nil {
+		marshalOAuthError(w, http.StatusBadRequest, "invalid_request", "Invalid request body.")
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "client_credentials":
+	case "":
+		marshalOAuthError(w, http.StatusBadRequest, "invalid_request", "grant_type is missing.")
+		return
+	default:
+		marshalOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Only the client_credentials grant is supported.")
+		return
+	}
+
+	// Get the client's credentials, which are form-encoded in Basic auth
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	token, err := auth.ClientCredentialsToken(
+		model, clientID, secret, strings.Fields(r.PostForm.Get("scope")),
+		net.ParseIP(clientIP(r)), r.Header.Get("Origin"),
+	)
+	if err != nil {
+		if restriction, ok := clientRestrictionErrors[err]; ok {
+			marshalOAuthError(w, http.StatusUnauthorized, "invalid_client", restriction.Detail)
+			return
+		}
+
+		switch err {
+		case authentication.InvalidClientErr:
+			w.Header().Set("WWW-Authenticate", `Basic realm="ipp"`)
+			marshalOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client ID or secret is invalid.")
+		case authentication.InvalidScopeErr:
+			marshalOAuthError(w, http.StatusBadRequest, "invalid_scope", "The client wasn't granted all of these scopes.")
+		default:
+			marshalOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to issue token.")
+			log.Println(err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokenResponse{
+		AccessToken: token.Subject,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(config.AuthTokenExpirationInterval / time.Second),
+		Scope:       token.Scope,
+	})
+}
+
+// A response from the introspection endpoint, as in RFC 7662
+type introspectionResponse struct {
+	Active    bool   `json:"active"`
+	Subject   string `json:"sub,omitempty"`   // The user's ID
+	Scope     string `json:"scope,omitempty"` // Anything the user can do if it's left out
+	ClientID  string `json:"client_id,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	KeyMode   string `json:"key_mode,omitempty"` // live or test, for API keys
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+// Tells the API gateway whether a token or API key is active and what it
+// grants, as in RFC 7662. The gateway authenticates with the introspection
+// secret as a bearer token. Cache-Control says how long it may trust the
+// answer; calls with keys aren't counted until they reach us.
+func IntrospectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || config.IntrospectionSecret == "" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Authenticate the gateway
+	authHeaderParts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(authHeaderParts) != 2 || strings.ToLower(authHeaderParts[0]) != "bearer" ||
+		subtle.ConstantTimeCompare([]byte(authHeaderParts[1]), []byte(config.IntrospectionSecret)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ipp", error="invalid_token"`)
+		marshalOAuthError(w, http.StatusUnauthorized, "invalid_token", "Introspection needs the gateway's credential.")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("token") == "" {
+		marshalOAuthError(w, http.StatusBadRequest, "invalid_request", "token is missing.")
+		return
+	}
+
+	introspection, err := auth.Introspect(model, r.PostForm.Get("token"))
+	if err != nil {
+		marshalOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to introspect token.")
+		log.Println(err)
+		return
+	}
+
+	// Active credentials can be revoked at any time, so they're only cached
+	// briefly, and never past their expiry
+	maxAge := config.IntrospectionCacheTTL
+	response := introspectionResponse{Active: introspection.Active}
+	if introspection.Active {
+		response.Subject = strconv.Itoa(introspection.UserID)
+		response.Scope = strings.Join(introspection.Scopes, " ")
+		response.ClientID = introspection.ClientID
+		response.TokenType = "Bearer"
+		if introspection.APIKey {
+			response.KeyMode = liveMode
+			if introspection.Test {
+				response.KeyMode = testMode
+			}
+		}
+		if !introspection.IssuedAt.IsZero() {
+			response.IssuedAt = introspection.IssuedAt.Unix()
+		}
+		if !introspection.ExpiresAt.IsZero() {
+			response.ExpiresAt = introspection.ExpiresAt.Unix()
+			if left := time.Until(introspection.ExpiresAt); left < maxAge {
+				maxAge = left
+			}
+		}
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(maxAge/time.Second)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Responds with an error in the format of RFC 6749 rather than JSON API, so
+// OAuth2 client libraries understand it
+func marshalOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}{code, description})
+}
+
+// Lists the logged in user's service accounts or creates one
+func ServiceAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	ctx := r.Context()
+	userID := ctx.Value(userIDKey).(int)
+
+	switch r.Method {
+	case "GET":
+		accounts, err := model.GetServiceAccounts(userID)
+		if err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to retrieve service accounts.")
+			log.Println(err)
+			return
+		}
+
+		// Send accounts to client
+		payload := make([]interface{}, len(accounts))
+		for i, account := range accounts {
+			payload[i] = account
+		}
+		jsonapi.MarshalManyPayload(w, payload)
+
+	case "POST":
+		// Parse the body's JSON
+		newAccount := new(ServiceAccount)
+		if err := jsonapi.UnmarshalPayload(r.Body, newAccount); err != nil {
+			marshalError(w, http.StatusBadRequest, "Invalid request body.")
+			log.Println(err)
+			return
+		}
+
+		// Validate the account
+		newAccount.Name = strings.TrimSpace(newAccount.Name)
+		if newAccount.Name == "" || utf8.RuneCountInString(newAccount.Name) > maxServiceAccountNameLength {
+			marshalError(w, http.StatusBadRequest, fmt.Sprintf("Service accounts need a name of up to %d characters.", maxServiceAccountNameLength))
+			return
+		}
+		if len(newAccount.Scopes) == 0 {
+			marshalError(w, http.StatusBadRequest, fmt.Sprintf("Service accounts need at least one scope of %s.", strings.Join(scopes, ", ")))
+			return
+		}
+		for _, scope := range newAccount.Scopes {
+			if !validScope(scope) {
+				marshalError(w, http.StatusBadRequest, fmt.Sprintf("%q isn't a scope. Scopes are %s.", scope, strings.Join(scopes, ", ")))
+				return
+			}
+		}
+
+		account := &authentication.ServiceAccount{OwnerID: userID, Scopes: newAccount.Scopes}
+		networks, ok := parseRestrictions(w, newAccount.AllowedNetworks, newAccount.AllowedOrigins, newAccount.ExpiresAt)
+		if !ok {
+			return
+		}
+		account.AllowedNetworks, account.AllowedOrigins = networks, newAccount.AllowedOrigins
+		if newAccount.ExpiresAt != nil {
+			account.ExpiresAt = *newAccount.ExpiresAt
+		}
+
+		// Create the account
+		secret, err := auth.CreateServiceAccount(model, account, newAccount.Name)
+		if err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to create service account.")
+			log.Println(err)
+			return
+		}
+
+		// Send the account to the client. It's the only time the secret is
+		// shown.
+		newAccount.ID, newAccount.ClientID, newAccount.Secret = account.ID, account.ClientID, secret
+		newAccount.CreatedAt = time.Now()
+		w.WriteHeader(http.StatusCreated)
+		jsonapi.MarshalOnePayload(w, newAccount)
+
+	default:
+		NotFoundHandler(w, r)
+	}
+}
+
+// Deletes one of the logged in user's service accounts, which revokes its
+// tokens
+func ServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Get user ID from context
+	ctx := r.Context()
+	userID := ctx.Value(userIDKey).(int)
+
+	// Get the account ID from the path
+	accountID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/me/service-accounts/"))
+	if err != nil {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	if err := model.DeleteServiceAccount(userID, accountID); err != nil {
+		if err == sql.ErrNoRows {
+			NotFoundHandler(w, r)
+		} else {
+			marshalError(w, http.StatusInternalServerError, "Failed to delete service account.")
+			log.Println(err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func validScope(scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
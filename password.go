@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"text/template"
+
+	"github.com/google/jsonapi"
+	"github.com/mujz/ipp/authentication"
+	"github.com/mujz/ipp/config"
+	"github.com/mujz/ipp/mailer"
+	"github.com/mujz/ipp/validator"
+)
+
+var passwordResetTemplate = template.Must(template.New("reset").Parse(`Hi,
+
+Someone asked to reset the password of your i++ account. If it was you, open
+this link within an hour to choose a new password:
+
+{{ .URL }}
+
+If it wasn't you, you can ignore this email; your password hasn't changed.
+`))
+
+// Emails a password reset link to the user with the email in the body. The
+// response is the same, and as quick, whether or not there's such a user or
+// the email could be sent.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Parse the body's JSON
+	reset := new(PasswordReset)
+	if err := jsonapi.UnmarshalPayload(r.Body, reset); err != nil {
+		marshalError(w, http.StatusBadRequest, "Invalid request body.")
+		log.Println(err)
+		return
+	}
+
+	// Validate email address
+	if !validator.ValidateEmail(reset.Email) {
+		marshalError(w, http.StatusBadRequest, "Invalid email address.")
+		return
+	}
+
+	inBackground(func() error { return sendPasswordResetEmail(reset.Email) })
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Issues a reset token for the user with the email, if there's one, and
+// emails them a link to the web app's reset form with it
+func sendPasswordResetEmail(email string) error {
+	token, err := auth.ForgotPassword(model, email)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	Url, err := url.Parse(config.WebURL)
+	if err != nil {
+		return err
+	}
+	Url.RawQuery = url.Values{"reset_token": {token}}.Encode()
+
+	var body bytes.Buffer
+	if err := passwordResetTemplate.Execute(&body, struct{ URL string }{Url.String()}); err != nil {
+		return err
+	}
+
+	return mail.Send(&mailer.Message{
+		To:      email,
+		Subject: "Reset your i++ password",
+		Body:    body.String(),
+	})
+}
+
+// Sets a new password with a token from a password reset email and logs the
+// user out everywhere
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Parse the body's JSON
+	reset := new(PasswordReset)
+	if err := jsonapi.UnmarshalPayload(r.Body, reset); err != nil {
+		marshalError(w, http.StatusBadRequest, "Invalid request body.")
+		log.Println(err)
+		return
+	}
+
+	// Validate password
+	if err := passwordPolicy.Check(reset.Password); err != nil {
+		marshalPasswordError(w, err)
+		return
+	}
+
+	// Reset the password
+	if err := auth.ResetPassword(model, reset.Token, validator.NormalizePassword(reset.Password)); err != nil {
+		if err == authentication.InvalidResetTokenErr {
+			marshalError(w, http.StatusBadRequest, "Password reset link is invalid or expired. Please ask for a new one.")
+		} else {
+			marshalError(w, http.StatusInternalServerError, "Failed to reset password.")
+			log.Println(err)
+		}
+		return
+	}
+
+	authentication.ClearSessionCookies(w, config.SecureCookies)
+	w.WriteHeader(http.StatusNoContent)
+}
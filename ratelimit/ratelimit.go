@@ -0,0 +1,225 @@
+// Package ratelimit slows down and locks out clients that keep failing,
+// like someone guessing passwords. Failures are counted per key (e.g. an
+// email or IP address) in a Store, which can be in-process or shared by
+// several API replicas.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+type Store interface {
+	// Takes a key and returns its consecutive failures and when the last
+	// one happened
+	Get(string) (int, time.Time, error)
+	// Takes a key and a window, records a failure now and returns the
+	// consecutive failures. Failures are forgotten once there hasn't been
+	// one for the window.
+	Fail(string, time.Duration) (int, error)
+	// Takes a key and forgets its failures
+	Reset(string) error
+	// Takes a key, a window and a function that returns how long a key has
+	// to wait after its consecutive failures and the last one's time. Unless
+	// the key has to wait, records a failure now, in one atomic step, and
+	// returns 0. Returns the wait otherwise.
+	Attempt(string, time.Duration, func(int, time.Time) time.Duration) (time.Duration, error)
+	// Takes a key and takes back one of its failures
+	Release(string) error
+}
+
+// Policy says how long a key has to wait after failing
+type Policy struct {
+	FreeAttempts int           // Failures allowed before having to wait
+	Backoff      time.Duration // Wait after the first failure past the free ones, doubled after each one after
+	MaxBackoff   time.Duration
+	LockoutAfter int           // Failures before the key is locked out
+	Lockout      time.Duration // How long a lockout lasts
+	Window       time.Duration // How long failures are remembered
+}
+
+type Limiter struct {
+	store  Store
+	policy Policy
+}
+
+func New(store Store, policy Policy) *Limiter {
+	return &Limiter{store, policy}
+}
+
+// Returns how long the key has to wait before trying again, or 0 if it can
+// try now
+func (l *Limiter) Check(key string) (time.Duration, error) {
+	failures, lastFailure, err := l.store.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return l.wait(failures, lastFailure), nil
+}
+
+// Reserves an attempt for the key: unless it has to wait, the attempt counts
+// as a failure right away, so concurrent attempts can't all get in before any
+// of them fails. Returns how long the key has to wait, or 0 if the attempt
+// can go ahead. Reset the key if the attempt succeeds, or Release it if it
+// shouldn't count.
+func (l *Limiter) Attempt(key string) (time.Duration, error) {
+	return l.store.Attempt(key, l.policy.Window, l.wait)
+}
+
+// Takes back an attempt reserved for the key
+func (l *Limiter) Release(key string) error {
+	return l.store.Release(key)
+}
+
+// Returns how long a key has to wait after its consecutive failures and the
+// last one's time
+func (l *Limiter) wait(failures int, lastFailure time.Time) time.Duration {
+	if failures == 0 || time.Since(lastFailure) > l.policy.Window {
+		return 0
+	}
+
+	if wait := l.Delay(failures) - time.Since(lastFailure); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Records a failure and returns how long the key has to wait before trying
+// again
+func (l *Limiter) Fail(key string) (time.Duration, error) {
+	failures, err := l.store.Fail(key, l.policy.Window)
+	if err != nil {
+		return 0, err
+	}
+	return l.Delay(failures), nil
+}
+
+// Forgets the key's failures, e.g. after it succeeds or an admin unlocks it
+func (l *Limiter) Reset(key string) error {
+	return l.store.Reset(key)
+}
+
+// Returns how long a key has to wait after the given number of consecutive
+// failures
+func (l *Limiter) Delay(failures int) time.Duration {
+	p := l.policy
+	if p.LockoutAfter > 0 && failures >= p.LockoutAfter {
+		return p.Lockout
+	}
+	if failures < p.FreeAttempts {
+		return 0
+	}
+
+	delay := p.Backoff
+	for i := p.FreeAttempts; i < failures && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
+
+type entry struct {
+	failures    int
+	lastFailure time.Time
+	window      time.Duration // Of the limiter that failed last
+}
+
+// MemoryStore keeps failures in memory. Each process has its own, so use a
+// shared store when running several replicas.
+type MemoryStore struct {
+	lock    sync.Mutex
+	entries map[string]*entry
+	swept   time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: map[string]*entry{}, swept: time.Now()}
+}
+
+func (s *MemoryStore) Get(key string) (int, time.Time, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		return e.failures, e.lastFailure, nil
+	}
+	return 0, time.Time{}, nil
+}
+
+func (s *MemoryStore) Fail(key string, window time.Duration) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	s.sweep(now, window)
+
+	e, ok := s.entries[key]
+	if !ok || now.Sub(e.lastFailure) > window {
+		e = &entry{}
+		s.entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = now
+	e.window = window
+	return e.failures, nil
+}
+
+func (s *MemoryStore) Attempt(key string, window time.Duration, wait func(int, time.Time) time.Duration) (time.Duration, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	s.sweep(now, window)
+
+	e, ok := s.entries[key]
+	if ok {
+		if d := wait(e.failures, e.lastFailure); d > 0 {
+			return d, nil
+		}
+	}
+	if !ok || now.Sub(e.lastFailure) > window {
+		e = &entry{}
+		s.entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = now
+	e.window = window
+	return 0, nil
+}
+
+func (s *MemoryStore) Release(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		if e.failures--; e.failures <= 0 {
+			delete(s.entries, key)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Reset(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// Drops forgotten failures every window so the map doesn't keep growing.
+// Limiters with different windows can share the store, so each entry is kept
+// for its own window rather than the caller's.
+func (s *MemoryStore) sweep(now time.Time, window time.Duration) {
+	if now.Sub(s.swept) < window {
+		return
+	}
+	for key, e := range s.entries {
+		if now.Sub(e.lastFailure) > e.window {
+			delete(s.entries, key)
+		}
+	}
+	s.swept = now
+}
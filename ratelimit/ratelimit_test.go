@@ -0,0 +1,172 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+var policy = Policy{
+	FreeAttempts: 3,
+	Backoff:      time.Second,
+	MaxBackoff:   time.Minute,
+	LockoutAfter: 10,
+	Lockout:      15 * time.Minute,
+	Window:       time.Hour,
+}
+
+func TestDelay(t *testing.T) {
+	l := New(NewMemoryStore(), policy)
+
+	expected := map[int]time.Duration{
+		0:  0,
+		2:  0,
+		3:  time.Second,
+		4:  2 * time.Second,
+		5:  4 * time.Second,
+		9:  time.Minute,
+		10: 15 * time.Minute,
+		50: 15 * time.Minute,
+	}
+	for failures, delay := range expected {
+		if got := l.Delay(failures); got != delay {
+			t.Errorf("Expected delay %s after %d failures; Got %s", delay, failures, got)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := New(NewMemoryStore(), policy)
+
+	for i := 0; i < policy.FreeAttempts-1; i++ {
+		if wait, err := l.Fail("jd@m.ca"); err != nil || wait != 0 {
+			t.Fatalf("Expected free attempt %d; Got %s, %v", i+1, wait, err)
+		}
+	}
+	if wait, err := l.Check("jd@m.ca"); err != nil || wait != 0 {
+		t.Fatalf("Expected no wait; Got %s, %v", wait, err)
+	}
+
+	if wait, err := l.Fail("jd@m.ca"); err != nil || wait != time.Second {
+		t.Fatalf("Expected to wait a second; Got %s, %v", wait, err)
+	}
+	if wait, err := l.Check("jd@m.ca"); err != nil || wait <= 0 || wait > time.Second {
+		t.Fatalf("Expected to wait up to a second; Got %s, %v", wait, err)
+	}
+
+	// Other keys aren't affected
+	if wait, err := l.Check("other@m.ca"); err != nil || wait != 0 {
+		t.Fatalf("Expected no wait for another key; Got %s, %v", wait, err)
+	}
+
+	if err := l.Reset("jd@m.ca"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err := l.Check("jd@m.ca"); err != nil || wait != 0 {
+		t.Fatalf("Expected no wait after a reset; Got %s, %v", wait, err)
+	}
+}
+
+func TestAttempt(t *testing.T) {
+	l := New(NewMemoryStore(), policy)
+
+	// Attempts count as failures until they're released
+	for i := 0; i < policy.FreeAttempts; i++ {
+		if wait, err := l.Attempt("jd@m.ca"); err != nil || wait != 0 {
+			t.Fatalf("Expected free attempt %d; Got %s, %v", i+1, wait, err)
+		}
+	}
+	if wait, err := l.Attempt("jd@m.ca"); err != nil || wait <= 0 || wait > time.Second {
+		t.Fatalf("Expected to wait up to a second; Got %s, %v", wait, err)
+	}
+
+	// Attempts that have to wait don't count
+	if failures, _, err := l.store.Get("jd@m.ca"); err != nil || failures != policy.FreeAttempts {
+		t.Fatalf("Expected %d failures; Got %d, %v", policy.FreeAttempts, failures, err)
+	}
+
+	if err := l.Release("jd@m.ca"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err := l.Attempt("jd@m.ca"); err != nil || wait != 0 {
+		t.Fatalf("Expected a released attempt to be free again; Got %s, %v", wait, err)
+	}
+}
+
+func TestConcurrentAttempts(t *testing.T) {
+	l := New(NewMemoryStore(), policy)
+
+	// Only the free attempts get in, however many are made at once
+	allowed := make(chan bool)
+	for i := 0; i < 50; i++ {
+		go func() {
+			wait, err := l.Attempt("jd@m.ca")
+			allowed <- err == nil && wait == 0
+		}()
+	}
+	n := 0
+	for i := 0; i < 50; i++ {
+		if <-allowed {
+			n++
+		}
+	}
+	if n != policy.FreeAttempts {
+		t.Fatalf("Expected %d attempts to get in; Got %d", policy.FreeAttempts, n)
+	}
+}
+
+func TestMemoryStoreForgetsOldFailures(t *testing.T) {
+	s := NewMemoryStore()
+	s.entries["jd@m.ca"] = &entry{failures: 5, lastFailure: time.Now().Add(-2 * time.Hour)}
+
+	if failures, err := s.Fail("jd@m.ca", time.Hour); err != nil || failures != 1 {
+		t.Fatalf("Expected old failures to be forgotten; Got %d, %v", failures, err)
+	}
+}
+
+func TestMemoryStoreKeepsEachWindow(t *testing.T) {
+	s := NewMemoryStore()
+	s.entries["email:jd@m.ca"] = &entry{failures: 10, lastFailure: time.Now().Add(-11 * time.Minute), window: time.Hour}
+	s.swept = time.Now().Add(-time.Hour)
+
+	// Failing with a shorter window, like a nonce's, doesn't forget failures
+	// that are still within their own
+	if _, err := s.Fail("nonce:1:abc", 10*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if failures, _, err := s.Get("email:jd@m.ca"); err != nil || failures != 10 {
+		t.Fatalf("Expected 10 failures; Got %d, %v", failures, err)
+	}
+
+	// But they're swept once they're older than it
+	s.entries["email:jd@m.ca"].lastFailure = time.Now().Add(-2 * time.Hour)
+	s.swept = time.Now().Add(-time.Hour)
+	if _, err := s.Fail("nonce:1:def", 10*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.entries["email:jd@m.ca"]; ok {
+		t.Fatal("Expected old failures to be swept")
+	}
+}
+
+func TestSharedStoreKeepsLongerWindows(t *testing.T) {
+	s := NewMemoryStore()
+	logins := New(s, policy)
+	trials := New(s, Policy{FreeAttempts: 2, LockoutAfter: 2, Lockout: 24 * time.Hour, Window: 24 * time.Hour})
+
+	for i := 0; i < 2; i++ {
+		if wait, err := trials.Attempt("trial:127.0.0.1"); err != nil || wait != 0 {
+			t.Fatalf("Expected free trial %d; Got %s, %v", i+1, wait, err)
+		}
+	}
+
+	// Login failures sweeping with their hour long window don't forget trials
+	// made before it
+	s.entries["trial:127.0.0.1"].lastFailure = time.Now().Add(-2 * time.Hour)
+	s.swept = time.Now().Add(-2 * time.Hour)
+	if _, err := logins.Fail("email:jd@m.ca"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err := trials.Attempt("trial:127.0.0.1"); err != nil || wait < 21*time.Hour {
+		t.Fatalf("Expected trials to stay locked out; Got %s, %v", wait, err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+const testModeKey = key(3)
+
+// Where a request's numbers are kept
+type NumberStore interface {
+	GetNumber(int) (*Number, error)
+	IncrementNumber(int) (*Number, error)
+	// Takes a user ID and a limit, and returns sql.ErrNoRows instead of
+	// incrementing past it
+	IncrementNumberUpTo(int, int) (*Number, error)
+	UpdateNumber(int, int) (*Number, error)
+}
+
+// Returns the sandbox for requests made with test-mode API keys, so they
+// never touch the user's number, and the users' numbers otherwise
+func numbers(r *http.Request) NumberStore {
+	if test, _ := r.Context().Value(testModeKey).(bool); test {
+		return model.Sandbox()
+	}
+	return &model
+}
+
+// Wipes the logged in user's sandbox, so test-mode keys start over from their
+// number
+func SandboxHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		NotFoundHandler(w, r)
+		return
+	}
+	if !allowScope(w, r, writeScope) {
+		return
+	}
+
+	// Get user ID from context
+	ctx := r.Context()
+	userID := ctx.Value(userIDKey).(int)
+
+	if err := model.Sandbox().Wipe(userID); err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to wipe sandbox.")
+		log.Println(err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"time"
+
+	"github.com/mujz/ipp/authentication"
+	"github.com/mujz/ipp/ratelimit"
+)
+
+var nonces authentication.NonceStore
+
+// Why a signed request was rejected
+var signatureErrors = map[error]string{
+	authentication.InvalidSignatureErr:  "Request signature is invalid. Sign the request with the key's ID and signing secret.",
+	authentication.StaleSignatureErr:    "Request was signed too long ago. Check your clock and sign it again.",
+	authentication.ReplayedSignatureErr: "This signed request was already made. Sign each request with a new nonce.",
+}
+
+// Remembers the nonces of signed requests in the rate limiters' store, so
+// replicas sharing it reject each other's replays too
+type nonceStore struct {
+	ratelimit.Store
+}
+
+func (s nonceStore) UseNonce(nonce string, window time.Duration) (bool, error) {
+	uses, err := s.Fail("nonce:"+nonce, window)
+	return uses == 1, err
+}
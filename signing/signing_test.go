@@ -0,0 +1,73 @@
+package signing
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSign(t *testing.T) {
+	r, _ := http.NewRequest("PUT", "https://api.example.com/current?b=2&a=1", strings.NewReader(`{"value":5}`))
+	if err := Sign(r, "12", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if !IsSigned(r) {
+		t.Fatalf("Expected a signed request; Got %q", r.Header.Get("Authorization"))
+	}
+
+	// The body can still be read
+	if body, _ := ioutil.ReadAll(r.Body); string(body) != `{"value":5}` {
+		t.Fatalf("Expected the body to be kept; Got %q", body)
+	}
+	r.Body = ioutil.NopCloser(strings.NewReader(`{"value":5}`))
+
+	s, err := Parse(r.Header.Get("Authorization"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.KeyID != "12" || s.Nonce == "" || s.String() != r.Header.Get("Authorization") {
+		t.Fatalf("Expected the header to round-trip; Got %+v", s)
+	}
+	if err := s.Verify(r, "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing anything signed breaks the signature
+	for _, tamper := range []func(*http.Request){
+		func(r *http.Request) { r.Method = "POST" },
+		func(r *http.Request) { r.URL.Path = "/next" },
+		func(r *http.Request) { r.URL.RawQuery = "a=1&b=3" },
+		func(r *http.Request) { r.Body = ioutil.NopCloser(strings.NewReader(`{"value":6}`)) },
+	} {
+		tampered, _ := http.NewRequest("PUT", "https://api.example.com/current?b=2&a=1", strings.NewReader(`{"value":5}`))
+		tamper(tampered)
+		if err := s.Verify(tampered, "secret"); err != MismatchErr {
+			t.Fatalf("Expected %v for %s %s; Got %v", MismatchErr, tampered.Method, tampered.URL, err)
+		}
+	}
+	r.Body = ioutil.NopCloser(strings.NewReader(`{"value":5}`))
+	if err := s.Verify(r, "other"); err != MismatchErr {
+		t.Fatalf("Expected %v; Got %v", MismatchErr, err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, header := range []string{
+		"Bearer ipp_live_abc",
+		Algorithm + " Credential=12, Timestamp=now, Nonce=abc, Signature=00",
+		Algorithm + " Credential=12, Timestamp=1500000000, Nonce=abc, Signature=not-hex",
+		Algorithm + " Credential=12, Timestamp=1500000000, Signature=" + strings.Repeat("00", 32),
+		Algorithm + " Credential=12, Timestamp=1500000000, Nonce=" + strings.Repeat("a", MaxNonceLength+1) + ", Signature=" + strings.Repeat("00", 32),
+		Algorithm + " Credential=12 Timestamp=1500000000",
+	} {
+		if _, err := Parse(header); err != MalformedErr {
+			t.Fatalf("Expected %v for %q; Got %v", MalformedErr, header, err)
+		}
+	}
+
+	r, _ := http.NewRequest("POST", "/next", strings.NewReader(strings.Repeat("x", MaxBodySize+1)))
+	if err := Sign(r, "12", "secret"); err != BodyTooLargeErr {
+		t.Fatalf("Expected %v; Got %v", BodyTooLargeErr, err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+
+	"github.com/google/jsonapi"
+	"github.com/mujz/ipp/config"
+	"github.com/mujz/ipp/validator"
+)
+
+// Who can sign up
+const (
+	openSignup   = "open"   // Anyone
+	inviteSignup = "invite" // Only people with an invite code
+	closedSignup = "closed" // Nobody
+)
+
+var (
+	allowedDomains    validator.DomainList // Any domain if empty
+	disposableDomains validator.DomainList
+)
+
+// signupError is why someone can't sign up, worded for them
+type signupError struct {
+	Status int
+	Code   string
+	Detail string
+}
+
+func (e *signupError) Error() string {
+	return e.Detail
+}
+
+var (
+	signupClosedErr = &signupError{
+		http.StatusForbidden, "signup_closed",
+		"Signing up is closed.",
+	}
+	inviteRequiredErr = &signupError{
+		http.StatusForbidden, "invite_required",
+		"Signing up is by invitation only. Please enter your invite code.",
+	}
+	providerInviteErr = &signupError{
+		http.StatusForbidden, "invite_required",
+		"Signing up is by invitation only. Sign up with your email address and invite code, then link your account.",
+	}
+	invalidInviteErr = &signupError{
+		http.StatusBadRequest, "invalid_invite",
+		"Invite code is invalid, expired or used up.",
+	}
+	domainNotAllowedErr = &signupError{
+		http.StatusBadRequest, "domain_not_allowed",
+		"Signing up isn't open to email addresses at this domain.",
+	}
+	disposableEmailErr = &signupError{
+		http.StatusBadRequest, "disposable_email",
+		"Please sign up with a permanent email address, not a disposable one.",
+	}
+)
+
+// Rejects signups that the signup mode or the email's domain doesn't allow
+func signupDecorator(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get user from context
+		ctx := r.Context()
+		user := ctx.Value(userKey).(*User)
+
+		switch config.SignupMode {
+		case closedSignup:
+			marshalSignupError(w, signupClosedErr)
+			return
+		case inviteSignup:
+			if user.InviteCode == "" {
+				marshalSignupError(w, inviteRequiredErr)
+				return
+			}
+		}
+
+		if err := checkSignupEmail(user.Email); err != nil {
+			marshalSignupError(w, err)
+			return
+		}
+
+		f(w, r)
+	}
+}
+
+// Returns a *signupError if nobody can sign up with a provider account with
+// the email, which is "" if the provider didn't verify one
+func checkProviderSignup(email string) error {
+	switch config.SignupMode {
+	case closedSignup:
+		return signupClosedErr
+	case inviteSignup:
+		return providerInviteErr
+	}
+
+	if err := checkSignupEmail(email); err != nil {
+		return err
+	}
+	return nil
+}
+
+func checkSignupEmail(email string) *signupError {
+	domain := ""
+	if email != "" {
+		domain = validator.EmailDomain(email)
+	}
+
+	if len(allowedDomains) > 0 && !allowedDomains.Contains(domain) {
+		return domainNotAllowedErr
+	}
+	if domain != "" && disposableDomains.Contains(domain) {
+		return disposableEmailErr
+	}
+	return nil
+}
+
+// Uses up one of the invite code's uses if signup is by invitation and
+// returns its ID, or 0 if it isn't. Returns invalidInviteErr if the code
+// can't be used.
+func useInvite(code string) (int, error) {
+	if config.SignupMode != inviteSignup {
+		return 0, nil
+	}
+
+	id, err := model.UseInvite(hashInviteCode(code))
+	if err == sql.ErrNoRows {
+		return 0, invalidInviteErr
+	}
+	return id, err
+}
+
+// Gives back the use useInvite took when the signup fails
+func returnInvite(id int) error {
+	if id == 0 {
+		return nil
+	}
+	return model.ReturnInvite(id)
+}
+
+func newInviteCode() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Only the hashes of invite codes are stored
+func hashInviteCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func marshalSignupError(w http.ResponseWriter, err *signupError) {
+	w.WriteHeader(err.Status)
+	jsonapi.MarshalErrors(w, []*jsonapi.ErrorObject{{
+		Title:  errorTitles[err.Status],
+		Detail: err.Detail,
+		Status: strconv.Itoa(err.Status),
+		Code:   err.Code,
+	}})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/lib/pq"
+	"github.com/mujz/ipp/authentication"
+	"github.com/mujz/ipp/config"
+	"github.com/mujz/ipp/ratelimit"
+)
+
+var (
+	// Every trial a client starts counts as a failure, so it's locked out
+	// once it started its share for the day
+	trialPolicy = ratelimit.Policy{
+		FreeAttempts: config.TrialsPerIP,
+		LockoutAfter: config.TrialsPerIP,
+		Lockout:      24 * time.Hour,
+		Window:       24 * time.Hour,
+	}
+
+	trialLimiter *ratelimit.Limiter
+)
+
+func trialLimit(r *http.Request) limit {
+	return limit{trialLimiter, "trial:" + clientIP(r)}
+}
+
+// Starts a trial: an anonymous account with a number and an API key to count
+// with, for developers who want to try i++ before signing up. The account is
+// deleted when the trial is over unless it's converted.
+func TrialHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Trials are a way to sign up, so they're only open when signing up is
+	if config.SignupMode != openSignup || config.TrialsPerIP <= 0 {
+		marshalError(w, http.StatusForbidden, "Trials aren't available. Please sign up instead.")
+		return
+	}
+
+	// Limit how many trials a client can start. The trial is counted before
+	// it's created, so parallel requests can't all start one.
+	l := trialLimit(r)
+	wait, err := l.Attempt(l.key)
+	if err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to start trial.")
+		log.Println(err)
+		return
+	}
+	if wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		marshalError(w, http.StatusTooManyRequests, fmt.Sprintf(
+			"Too many trials were started from your network. Please try again in %d seconds or sign up.", seconds,
+		))
+		return
+	}
+
+	// Create the trial user and their key
+	expiresAt := time.Now().Add(config.TrialLifetime)
+	userID, err := model.CreateTrialUser(expiresAt)
+	if err != nil {
+		releaseAttempts(l)
+		marshalError(w, http.StatusInternalServerError, "Failed to start trial.")
+		log.Println(err)
+		return
+	}
+
+	key, err := auth.CreateAPIKey(model, &authentication.APIKey{UserID: userID}, "Trial")
+	if err != nil {
+		if err := model.DeleteTrialUser(userID); err != nil {
+			log.Println(err)
+		}
+		releaseAttempts(l)
+		marshalError(w, http.StatusInternalServerError, "Failed to start trial.")
+		log.Println(err)
+		return
+	}
+
+	number, err := model.GetNumber(userID)
+	if err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to start trial.")
+		log.Println(err)
+		return
+	}
+
+	// Send the trial to the client
+	w.WriteHeader(http.StatusCreated)
+	jsonapi.MarshalOnePayload(w, &Trial{
+		ID:        userID,
+		Key:       key,
+		ExpiresAt: expiresAt,
+		Number:    number,
+	})
+}
+
+// Converts the logged in trial user into a normal one with the email and
+// password in the body. They keep their number and API key.
+func ConvertTrialHandler(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and the new credentials from context
+	ctx := r.Context()
+	userID := ctx.Value(userIDKey).(int)
+	user := ctx.Value(userKey).(*User)
+
+	// Use up the invite code if signup is by invitation
+	inviteID, err := useInvite(user.InviteCode)
+	if err == invalidInviteErr {
+		marshalSignupError(w, invalidInviteErr)
+		return
+	} else if err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to convert trial.")
+		log.Println(err)
+		return
+	}
+
+	// Convert the trial
+	token, err := auth.ConvertTrial(model, userID, user.Email, user.Password)
+	if err != nil {
+		if err := returnInvite(inviteID); err != nil {
+			log.Println(err)
+		}
+
+		if err == sql.ErrNoRows {
+			marshalError(w, http.StatusBadRequest, "This account isn't a trial.")
+		} else if err, ok := err.(*pq.Error); ok && err.Code.Name() == "unique_violation" {
+			if config.EnumerationProtection {
+				// Respond as if the trial was converted and tell the
+				// email's owner instead
+				if err := sendAlreadyRegisteredEmail(user.Email); err != nil {
+					log.Println(err)
+				}
+				w.WriteHeader(http.StatusAccepted)
+				return
+			}
+			marshalError(w, http.StatusBadRequest, "Email address taken. Did you mean to log in instead?")
+		} else {
+			marshalError(w, http.StatusInternalServerError, "Failed to convert trial.")
+			log.Println(err)
+		}
+		return
+	}
+
+	// Ask the user to verify their email. They can ask for another one if
+	// this fails.
+	if err := sendVerificationEmail(userID, user.Email); err != nil && err != authentication.VerificationThrottledErr {
+		log.Println(err)
+	}
+
+	// With enumeration protection, the user logs in once they've verified
+	// their email
+	if config.EnumerationProtection {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// Send token to client
+	sendToken(w, r, token)
+}
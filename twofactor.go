@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/google/jsonapi"
+	"github.com/mujz/ipp/authentication"
+)
+
+// Starts enrolling the logged in user in two-factor authentication on POST
+// and turns it off on DELETE
+func TwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	ctx := r.Context()
+	userID := ctx.Value(userIDKey).(int)
+
+	switch r.Method {
+	case "POST":
+		// Only users who log in with a password have a first factor to add to
+		email, _, err := model.GetEmailVerified(userID)
+		if err != nil {
+			marshalError(w, http.StatusInternalServerError, "Failed to set up two-factor authentication.")
+			log.Println(err)
+			return
+		}
+		if email == "" {
+			marshalError(w, http.StatusBadRequest, "Two-factor authentication is only available to users who log in with an email and password.")
+			return
+		}
+
+		// Generate the secret
+		secret, uri, err := auth.EnrollTwoFactor(model, userID, email)
+		if err != nil {
+			if err == authentication.TwoFactorEnabledErr {
+				marshalError(w, http.StatusBadRequest, "Two-factor authentication is already enabled.")
+			} else {
+				marshalError(w, http.StatusInternalServerError, "Failed to set up two-factor authentication.")
+				log.Println(err)
+			}
+			return
+		}
+
+		// Send the secret to the client to show as a QR code
+		jsonapi.MarshalOnePayload(w, &TwoFactor{Secret: secret, URI: uri})
+
+	case "DELETE":
+		// Parse the body's JSON
+		twoFactor := new(TwoFactor)
+		if err := jsonapi.UnmarshalPayload(r.Body, twoFactor); err != nil {
+			marshalError(w, http.StatusBadRequest, "Invalid request body.")
+			log.Println(err)
+			return
+		}
+
+		// Turn it off if the code checks out
+		if err := auth.DisableTwoFactor(model, userID, twoFactor.Code); err != nil {
+			twoFactorError(w, err, "Failed to disable two-factor authentication.")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		NotFoundHandler(w, r)
+	}
+}
+
+// Turns on two-factor authentication with the first code from the user's
+// authenticator and returns their recovery codes
+func ConfirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Get user ID from context
+	ctx := r.Context()
+	userID := ctx.Value(userIDKey).(int)
+
+	// Parse the body's JSON
+	twoFactor := new(TwoFactor)
+	if err := jsonapi.UnmarshalPayload(r.Body, twoFactor); err != nil {
+		marshalError(w, http.StatusBadRequest, "Invalid request body.")
+		log.Println(err)
+		return
+	}
+
+	// Confirm the code
+	codes, err := auth.ConfirmTwoFactor(model, userID, twoFactor.Code)
+	if err != nil {
+		if err == authentication.TwoFactorEnabledErr {
+			marshalError(w, http.StatusBadRequest, "Two-factor authentication is already enabled.")
+		} else {
+			twoFactorError(w, err, "Failed to enable two-factor authentication.")
+		}
+		return
+	}
+
+	// Send the recovery codes to the client. This is the only time they're
+	// shown.
+	jsonapi.MarshalOnePayload(w, &TwoFactor{RecoveryCodes: codes})
+}
+
+// Exchanges the challenge a login with two-factor authentication returns and
+// the user's code for a token
+func LoginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Parse the body's JSON
+	twoFactor := new(TwoFactor)
+	if err := jsonapi.UnmarshalPayload(r.Body, twoFactor); err != nil {
+		marshalError(w, http.StatusBadRequest, "Invalid request body.")
+		log.Println(err)
+		return
+	}
+
+	// Make brute-forcing codes slow
+	limits := []limit{ipLimit(r)}
+	if userID, err := auth.TwoFactorChallengeUser(twoFactor.Challenge); err == nil {
+		limits = append(limits, twoFactorLimit(userID))
+	}
+	if !allowAttempt(w, limits...) {
+		return
+	}
+
+	// Log user in
+	token, err := auth.LoginTwoFactor(model, twoFactor.Challenge, twoFactor.Code)
+	if err != nil {
+		// Wrong codes and challenges stay counted as failures
+		if err != authentication.InvalidTwoFactorCodeErr && err != authentication.InvalidTwoFactorChallengeErr {
+			releaseAttempts(limits...)
+		}
+		if err == authentication.InvalidTwoFactorChallengeErr {
+			marshalError(w, http.StatusUnauthorized, "Your login expired. Please log in again.")
+		} else {
+			twoFactorError(w, err, "Error logging the user in.")
+		}
+		return
+	}
+	releaseAttempts(limits[0])
+	resetAttempts(limits[1:]...)
+
+	// Send token to client
+	sendToken(w, r, token)
+}
+
+func twoFactorError(w http.ResponseWriter, err error, detail string) {
+	switch err {
+	case authentication.InvalidTwoFactorCodeErr:
+		marshalError(w, http.StatusUnauthorized, "The code is incorrect or was already used.")
+	case authentication.TwoFactorNotEnrolledErr:
+		marshalError(w, http.StatusBadRequest, "Two-factor authentication isn't set up.")
+	default:
+		marshalError(w, http.StatusInternalServerError, detail)
+		log.Println(err)
+	}
+}
@@ -0,0 +1,61 @@
+package validator
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// DomainList is a set of email domains. A domain is in it if it or any of its
+// parent domains is listed, so mail.example.com is in a list with example.com.
+type DomainList map[string]bool
+
+// Takes domains like example.com and ignores blank ones
+func NewDomainList(domains []string) DomainList {
+	l := DomainList{}
+	for _, domain := range domains {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			l[domain] = true
+		}
+	}
+	return l
+}
+
+// Reads a file with a domain on each line. Blank lines and lines starting
+// with # are ignored.
+func LoadDomainList(path string) (DomainList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	domains := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); !strings.HasPrefix(line, "#") {
+			domains = append(domains, line)
+		}
+	}
+	return NewDomainList(domains), scanner.Err()
+}
+
+func (l DomainList) Contains(domain string) bool {
+	domain = strings.ToLower(domain)
+	for domain != "" {
+		if l[domain] {
+			return true
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return false
+}
+
+// Returns the lowercase domain of an email address
+func EmailDomain(email string) string {
+	return strings.ToLower(email[strings.LastIndexByte(email, '@')+1:])
+}
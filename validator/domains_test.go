@@ -0,0 +1,30 @@
+package validator
+
+import "testing"
+
+func TestDomainList(t *testing.T) {
+	l, err := LoadDomainList("testdata/disposable.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, domain := range []string{"mailinator.com", "MAILINATOR.com", "eu.mailinator.com", "10minutemail.com"} {
+		if !l.Contains(domain) {
+			t.Errorf("Expected %s to be in the list", domain)
+		}
+	}
+	for _, domain := range []string{"m.ca", "notmailinator.com", "com", "", "# Disposable email domains"} {
+		if l.Contains(domain) {
+			t.Errorf("Expected %s not to be in the list", domain)
+		}
+	}
+}
+
+func TestEmailDomain(t *testing.T) {
+	if d := EmailDomain("jd@Mail.M.ca"); d != "mail.m.ca" {
+		t.Errorf("Expected mail.m.ca; Got %s", d)
+	}
+	if d := EmailDomain(`"a@b"@m.ca`); d != "m.ca" {
+		t.Errorf("Expected m.ca; Got %s", d)
+	}
+}
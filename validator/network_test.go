@@ -0,0 +1,50 @@
+package validator
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseCIDR(t *testing.T) {
+	for s, expected := range map[string]string{
+		"10.0.0.0/8":    "10.0.0.0/8",
+		"10.1.2.3/8":    "10.0.0.0/8",
+		" 192.0.2.1 ":   "192.0.2.1/32",
+		"2001:db8::/32": "2001:db8::/32",
+		"2001:db8::1":   "2001:db8::1/128",
+	} {
+		network, err := ParseCIDR(s)
+		if err != nil || network.String() != expected {
+			t.Fatalf("Expected %s to parse as %s; Got %v, %v", s, expected, network, err)
+		}
+	}
+
+	for _, s := range []string{"", "10.0.0.0/33", "example.com", "10.0.0"} {
+		if network, err := ParseCIDR(s); err == nil {
+			t.Fatalf("Expected %q to be invalid; Got %v", s, network)
+		}
+	}
+
+	network, _ := ParseCIDR("192.0.2.1")
+	if !network.Contains(net.ParseIP("::ffff:192.0.2.1")) {
+		t.Fatal("Expected an IPv4 address to match itself mapped to IPv6")
+	}
+}
+
+func TestNormalizeOrigin(t *testing.T) {
+	for s, expected := range map[string]string{
+		"https://Example.com":     "https://example.com",
+		"http://localhost:8080/":  "http://localhost:8080",
+		"https://app.example.com": "https://app.example.com",
+	} {
+		if origin, ok := NormalizeOrigin(s); !ok || origin != expected {
+			t.Fatalf("Expected %s to normalize to %s; Got %s, %v", s, expected, origin, ok)
+		}
+	}
+
+	for _, s := range []string{"", "example.com", "ftp://example.com", "https://example.com/app", "https://u:p@example.com"} {
+		if origin, ok := NormalizeOrigin(s); ok {
+			t.Fatalf("Expected %q to be invalid; Got %s", s, origin)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package validator
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Reasons a password doesn't meet the policy
+const (
+	PasswordTooShort         = "too_short"
+	PasswordTooLong          = "too_long"
+	PasswordInvalidCharacter = "invalid_character"
+	PasswordTooWeak          = "too_weak"
+	PasswordBreached         = "breached"
+)
+
+// Entropy in bits a password needs for each strength score above 0
+var strengthThresholds = []float64{28, 36, 60, 128}
+
+// PasswordPolicy says which passwords users can choose
+type PasswordPolicy struct {
+	MinLength   int               // In characters
+	MaxLength   int               // In characters. 0 means no limit.
+	MaxBytes    int               // bcrypt ignores anything past 72 bytes. 0 means no limit.
+	MinStrength int               // See PasswordStrength
+	Breached    BreachedPasswords // Optional
+}
+
+// PasswordError lists the reasons a password doesn't meet the policy
+type PasswordError struct {
+	Reasons []string
+}
+
+func (e *PasswordError) Error() string {
+	return "validator: password doesn't meet the policy: " + strings.Join(e.Reasons, ", ") + "."
+}
+
+type BreachedPasswords interface {
+	// Takes the first 5 characters of a password's uppercase hex SHA-1 and
+	// returns the rest of the hash of each breached password that starts
+	// with them, like the Pwned Passwords range API
+	Range(string) ([]string, error)
+}
+
+// Normalizes a password so the same passphrase matches however it was typed
+func NormalizePassword(password string) string {
+	return norm.NFKC.String(password)
+}
+
+// Returns a *PasswordError if the password doesn't meet the policy
+func (p *PasswordPolicy) Check(password string) error {
+	password = NormalizePassword(password)
+	reasons := []string{}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		reasons = append(reasons, PasswordTooShort)
+	}
+	if (p.MaxLength > 0 && length > p.MaxLength) || (p.MaxBytes > 0 && len(password) > p.MaxBytes) {
+		reasons = append(reasons, PasswordTooLong)
+	}
+
+	for _, r := range password {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			reasons = append(reasons, PasswordInvalidCharacter)
+			break
+		}
+	}
+
+	if PasswordStrength(password) < p.MinStrength {
+		reasons = append(reasons, PasswordTooWeak)
+	}
+
+	if p.Breached != nil {
+		breached, err := IsBreached(p.Breached, password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			reasons = append(reasons, PasswordBreached)
+		}
+	}
+
+	if len(reasons) > 0 {
+		return &PasswordError{reasons}
+	}
+	return nil
+}
+
+// Scores a password from 0 (trivial to guess) to 4 (very hard to guess)
+func PasswordStrength(password string) int {
+	entropy := PasswordEntropy(password)
+	for score, threshold := range strengthThresholds {
+		if entropy < threshold {
+			return score
+		}
+	}
+	return len(strengthThresholds)
+}
+
+// Estimates a password's entropy in bits from the kinds of characters in it.
+// Repeated and sequential characters (e.g. "aa" or "123") barely count.
+func PasswordEntropy(password string) float64 {
+	var lower, upper, digit, space, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r == ' ':
+			space = true
+		case r < utf8.RuneSelf:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {space, 1}, {symbol, 33}, {other, 100}} {
+		if class.present {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	bits := math.Log2(float64(pool))
+
+	entropy := 0.0
+	previous := rune(-2)
+	for _, r := range password {
+		if r == previous || r == previous+1 || r == previous-1 {
+			entropy++
+		} else {
+			entropy += bits
+		}
+		previous = r
+	}
+	return entropy
+}
+
+// Returns whether the password appeared in a data breach
+func IsBreached(breached BreachedPasswords, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	suffixes, err := breached.Range(hash[:5])
+	if err != nil {
+		return false, err
+	}
+
+	for _, suffix := range suffixes {
+		if suffix == hash[5:] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// BreachedPasswordDir is a directory with a file for each hash prefix, e.g.
+// 5BAA6.txt, with lines like the Pwned Passwords range API returns:
+// 1E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493
+type BreachedPasswordDir string
+
+func (d BreachedPasswordDir) Range(prefix string) ([]string, error) {
+	f, err := os.Open(filepath.Join(string(d), prefix+".txt"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	suffixes := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		suffix := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(suffix, ':'); i >= 0 {
+			suffix = suffix[:i]
+		}
+		suffixes = append(suffixes, strings.ToUpper(suffix))
+	}
+	return suffixes, scanner.Err()
+}
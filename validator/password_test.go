@@ -0,0 +1,67 @@
+package validator
+
+import (
+	"reflect"
+	"testing"
+)
+
+var policy = &PasswordPolicy{
+	MinLength:   8,
+	MaxLength:   64,
+	MaxBytes:    72,
+	MinStrength: 2,
+	Breached:    BreachedPasswordDir("testdata/breached"),
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	valid := []string{
+		"mpa$$!23",
+		"AllGood13!#$%^&*_+=-}{|/.'`~",
+		"correct horse battery staple",
+		"пароль на русском языке",
+		"パスワードはとても長いです",
+	}
+	for _, p := range valid {
+		if err := policy.Check(p); err != nil {
+			t.Errorf("Expected %q to be valid; Got %v", p, err)
+		}
+	}
+
+	invalid := map[string][]string{
+		"short":          {PasswordTooShort, PasswordTooWeak},
+		"aaaaaaaaaaaa":   {PasswordTooWeak},
+		"12345678":       {PasswordTooWeak},
+		"password":       {PasswordTooWeak, PasswordBreached},
+		"Tr0ub4dor&3":    {PasswordBreached},
+		"tab\tseparated": {PasswordInvalidCharacter},
+		"パスワードはとても長いですパスワードはとても長いです": {PasswordTooLong},
+	}
+	for p, reasons := range invalid {
+		err, ok := policy.Check(p).(*PasswordError)
+		if !ok || !reflect.DeepEqual(err.Reasons, reasons) {
+			t.Errorf("Expected %q to be invalid because %v; Got %v", p, reasons, err)
+		}
+	}
+}
+
+func TestNormalizePassword(t *testing.T) {
+	// Full-width and composed characters match what other keyboards type
+	if p := NormalizePassword("ｐａｓｓ"); p != "pass" {
+		t.Errorf("Expected pass; Got %q", p)
+	}
+	if NormalizePassword("cafe\u0301") != NormalizePassword("caf\u00e9") {
+		t.Error("Expected decomposed and composed characters to match")
+	}
+}
+
+func TestPasswordStrength(t *testing.T) {
+	if s := PasswordStrength(""); s != 0 {
+		t.Errorf("Expected an empty password to score 0; Got %d", s)
+	}
+	if weak, strong := PasswordStrength("abcdefgh"), PasswordStrength("qmzkwvxj"); weak >= strong {
+		t.Errorf("Expected a sequence to score lower than random letters; Got %d >= %d", weak, strong)
+	}
+	if s := PasswordStrength("correct horse battery staple"); s < 3 {
+		t.Errorf("Expected a long passphrase to score at least 3; Got %d", s)
+	}
+}
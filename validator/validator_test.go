@@ -17,21 +17,6 @@ func TestValidateEmail(t *testing.T) {
 	}
 }
 
-func TestValidatePassword(t *testing.T) {
-	if p := "AllGood13!#$%^&*_+=-}{|/.'`~"; !ValidatePassword(p) {
-		t.Fatalf("Expected %s to be invalid", p)
-	}
-	if p := "short"; ValidatePassword(p) {
-		t.Fatalf("Expected %s to be invalid", p)
-	}
-	if p := "inv@lid"; ValidatePassword(p) {
-		t.Fatalf("Expected %s to be invalid", p)
-	}
-	if p := "inv alid"; ValidatePassword(p) {
-		t.Fatalf("Expected %s to be invalid", p)
-	}
-}
-
 func TestValidateNumber(t *testing.T) {
 	if n := 1; !ValidateNumber(n) {
 		t.Fatalf("Expected %d to be valid", n)
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"text/template"
+
+	"github.com/google/jsonapi"
+	"github.com/mujz/ipp/authentication"
+	"github.com/mujz/ipp/config"
+	"github.com/mujz/ipp/mailer"
+)
+
+// What users who haven't verified their email can do
+const (
+	fullAccess     = "full"      // Everything
+	readOnlyAccess = "read-only" // Only read their number
+	limitedAccess  = "limited"   // Count up to config.UnverifiedNumberLimit
+)
+
+var emailVerificationTemplate = template.Must(template.New("verification").Parse(`Hi,
+
+Please open this link within a day to confirm that this is your i++ email
+address:
+
+{{ .URL }}
+
+If you didn't sign up or change your email address, you can ignore this email.
+`))
+
+// Verifies the email the token in the body was sent to
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Parse the body's JSON
+	verification := new(EmailVerification)
+	if err := jsonapi.UnmarshalPayload(r.Body, verification); err != nil {
+		marshalError(w, http.StatusBadRequest, "Invalid request body.")
+		log.Println(err)
+		return
+	}
+
+	// Verify the email
+	if _, err := auth.VerifyEmail(model, verification.Token); err != nil {
+		if err == authentication.InvalidVerificationTokenErr {
+			marshalError(w, http.StatusBadRequest, "Verification link is invalid or expired. Please ask for a new one.")
+		} else {
+			marshalError(w, http.StatusInternalServerError, "Failed to verify email address.")
+			log.Println(err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Sends the logged in user another verification email
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Get user ID from context
+	ctx := r.Context()
+	userID := ctx.Value(userIDKey).(int)
+
+	email, verified, err := model.GetEmailVerified(userID)
+	if err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to send verification email.")
+		log.Println(err)
+		return
+	}
+	if verified {
+		marshalError(w, http.StatusBadRequest, "Your email address is already verified.")
+		return
+	}
+
+	if err := sendVerificationEmail(userID, email); err != nil {
+		if err == authentication.VerificationThrottledErr {
+			marshalError(w, http.StatusTooManyRequests, "We just sent you a verification email. Please wait a minute before asking for another one.")
+		} else {
+			marshalError(w, http.StatusInternalServerError, "Failed to send verification email.")
+			log.Println(err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Emails the user a link to the web app that verifies their email
+func sendVerificationEmail(userID int, email string) error {
+	token, err := auth.EmailVerificationToken(model, userID, email)
+	if err != nil {
+		return err
+	}
+
+	Url, err := url.Parse(config.WebURL)
+	if err != nil {
+		return err
+	}
+	Url.RawQuery = url.Values{"verify_token": {token}}.Encode()
+
+	var body bytes.Buffer
+	if err := emailVerificationTemplate.Execute(&body, struct{ URL string }{Url.String()}); err != nil {
+		return err
+	}
+
+	return mail.Send(&mailer.Message{
+		To:      email,
+		Subject: "Verify your i++ email address",
+		Body:    body.String(),
+	})
+}
+
+// Responds with 403 and returns false if the user hasn't verified their
+// email and isn't allowed to set their number to value until they do
+func allowUnverified(w http.ResponseWriter, userID, value int) bool {
+	switch config.UnverifiedAccess {
+	case readOnlyAccess:
+	case limitedAccess:
+		if value <= config.UnverifiedNumberLimit {
+			return true
+		}
+	default:
+		return true
+	}
+
+	_, verified, err := model.GetEmailVerified(userID)
+	if err != nil {
+		marshalError(w, http.StatusInternalServerError, "Failed to retrieve user.")
+		log.Println(err)
+		return false
+	}
+
+	if !verified {
+		detail := "Please verify your email address before changing your number."
+		if config.UnverifiedAccess == limitedAccess {
+			detail = fmt.Sprintf("Please verify your email address to count past %d.", config.UnverifiedNumberLimit)
+		}
+		marshalError(w, http.StatusForbidden, detail)
+	}
+	return verified
+}